@@ -2,7 +2,10 @@ package patricia
 
 import (
 	"encoding/binary"
+	"fmt"
 	"net"
+	"net/netip"
+	"strings"
 )
 
 const _leftmost32Bit = uint32(1 << 31)
@@ -34,6 +37,26 @@ func NewIPv4AddressFromBytes(address []byte, length uint) IPv4Address {
 	}
 }
 
+// NewIPv4AddressFromAddr creates a /32 address from the input netip.Addr, which must be IPv4
+// - an IPv4-mapped IPv6 address, like ::ffff:10.0.0.1, is IPv6 - Unmap it first to use it as IPv4
+func NewIPv4AddressFromAddr(addr netip.Addr) (IPv4Address, error) {
+	if !addr.Is4() {
+		return IPv4Address{}, fmt.Errorf("%s isn't an IPv4 address", addr)
+	}
+	data := addr.As4()
+	return NewIPv4Address(binary.BigEndian.Uint32(data[:]), 32), nil
+}
+
+// NewIPv4AddressFromPrefix creates an address from the input netip.Prefix, which must be IPv4
+// - bits past the prefix length are kept, as with UnmarshalText - use prefix.Masked() to clear them
+func NewIPv4AddressFromPrefix(prefix netip.Prefix) (IPv4Address, error) {
+	if !prefix.IsValid() || !prefix.Addr().Is4() {
+		return IPv4Address{}, fmt.Errorf("%s isn't an IPv4 prefix", prefix)
+	}
+	data := prefix.Addr().As4()
+	return NewIPv4Address(binary.BigEndian.Uint32(data[:]), uint(prefix.Bits())), nil
+}
+
 // ShiftLeft shifts the address to the left
 func (i *IPv4Address) ShiftLeft(shiftCount uint) {
 	i.Address <<= shiftCount
@@ -57,3 +80,43 @@ func (i IPv4Address) String() string {
 	}
 	return ipNet.String()
 }
+
+// Prefix returns this address as a netip.Prefix
+func (i IPv4Address) Prefix() netip.Prefix {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], i.Address)
+	return netip.PrefixFrom(netip.AddrFrom4(data), int(i.Length))
+}
+
+// MarshalText returns the address in CIDR notation, the same as String, implementing encoding.TextMarshaler
+func (i IPv4Address) MarshalText() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+// UnmarshalText parses an address in CIDR notation, implementing encoding.TextUnmarshaler
+// - an address without a prefix length is a /32
+// - bits past the prefix length are kept, the same as MarshalText writes them
+func (i *IPv4Address) UnmarshalText(text []byte) error {
+	prefix, err := parsePrefix(string(text), 32)
+	if err != nil {
+		return err
+	}
+	if !prefix.Addr().Is4() {
+		return fmt.Errorf("%q isn't an IPv4 address", text)
+	}
+	data := prefix.Addr().As4()
+	*i = NewIPv4Address(binary.BigEndian.Uint32(data[:]), uint(prefix.Bits()))
+	return nil
+}
+
+// parse an address in CIDR notation, taking one without a prefix length to be a single host, with the input length
+func parsePrefix(text string, hostLength int) (netip.Prefix, error) {
+	if strings.Contains(text, "/") {
+		return netip.ParsePrefix(text)
+	}
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, hostLength), nil
+}
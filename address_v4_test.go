@@ -1,8 +1,10 @@
 package patricia
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/netip"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -46,3 +48,63 @@ func TestNewIPv4AddressFromBytes(t *testing.T) {
 	assert.Equal(t, uint32(0), sut.Address)
 	assert.Equal(t, uint(0), sut.Length)
 }
+
+func TestNewIPv4AddressFromNetip(t *testing.T) {
+	sut, err := NewIPv4AddressFromAddr(netip.MustParseAddr("10.1.2.3"))
+	assert.NoError(t, err)
+	assert.Equal(t, NewIPv4Address(0x0a010203, 32), sut)
+	sut, err = NewIPv4AddressFromPrefix(netip.MustParsePrefix("10.1.2.3/8"))
+	assert.NoError(t, err)
+	assert.Equal(t, NewIPv4Address(0x0a010203, 8), sut)
+
+	for _, addr := range []netip.Addr{{}, netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("::ffff:10.0.0.1")} {
+		_, err = NewIPv4AddressFromAddr(addr)
+		assert.Error(t, err, addr.String())
+		_, err = NewIPv4AddressFromPrefix(netip.PrefixFrom(addr, 0))
+		assert.Error(t, err, addr.String())
+	}
+	_, err = NewIPv4AddressFromPrefix(netip.PrefixFrom(netip.MustParseAddr("10.0.0.0"), 33))
+	assert.Error(t, err)
+
+	// the same as the prefix it came from
+	for _, text := range []string{"0.0.0.0/0", "192.168.0.0/16", "10.1.2.3/32"} {
+		sut, err = NewIPv4AddressFromPrefix(netip.MustParsePrefix(text))
+		assert.NoError(t, err)
+		assert.Equal(t, netip.MustParsePrefix(text), sut.Prefix())
+	}
+}
+
+func TestIPv4AddressPrefix(t *testing.T) {
+	assert.Equal(t, "1.35.69.103/7", NewIPv4Address(uint32(0x01234567), 7).Prefix().String())
+	assert.Equal(t, "10.0.0.0/8", NewIPv4Address(uint32(0x0a000000), 8).Prefix().String())
+	assert.Equal(t, "0.0.0.0/0", NewIPv4Address(0, 0).Prefix().String())
+	assert.True(t, NewIPv4Address(uint32(0x0a000001), 32).Prefix().Addr().Is4())
+}
+
+func TestIPv4AddressText(t *testing.T) {
+	for _, text := range []string{"1.35.69.103/7", "10.0.0.0/8", "0.0.0.0/0", "192.168.1.1/32"} {
+		var sut IPv4Address
+		assert.NoError(t, sut.UnmarshalText([]byte(text)))
+		marshaled, err := sut.MarshalText()
+		assert.NoError(t, err)
+		assert.Equal(t, text, string(marshaled))
+	}
+
+	var sut IPv4Address
+	assert.NoError(t, sut.UnmarshalText([]byte("10.1.2.3")))
+	assert.Equal(t, NewIPv4Address(0x0a010203, 32), sut)
+	for _, text := range []string{"", "10.0.0.0/33", "10.0.0/8", "2001:db8::/32", "::ffff:10.0.0.1/128", "example.com"} {
+		assert.Error(t, sut.UnmarshalText([]byte(text)), text)
+	}
+
+	// addresses embed in JSON as strings
+	type config struct {
+		Networks []IPv4Address
+	}
+	data, err := json.Marshal(config{Networks: []IPv4Address{NewIPv4Address(0x0a000000, 8)}})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Networks":["10.0.0.0/8"]}`, string(data))
+	var decoded config
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, []IPv4Address{NewIPv4Address(0x0a000000, 8)}, decoded.Networks)
+}
@@ -2,7 +2,9 @@ package patricia
 
 import (
 	"encoding/binary"
+	"fmt"
 	"net"
+	"net/netip"
 )
 
 const _leftmost64Bit = uint64(1 << 63)
@@ -30,6 +32,26 @@ func NewIPv6Address(address []byte, length uint) IPv6Address {
 	}
 }
 
+// NewIPv6AddressFromAddr creates a /128 address from the input netip.Addr, which must be IPv6 - including IPv4-mapped
+// addresses, like ::ffff:10.0.0.1
+func NewIPv6AddressFromAddr(addr netip.Addr) (IPv6Address, error) {
+	if !addr.Is6() {
+		return IPv6Address{}, fmt.Errorf("%s isn't an IPv6 address", addr)
+	}
+	data := addr.As16()
+	return NewIPv6Address(data[:], 128), nil
+}
+
+// NewIPv6AddressFromPrefix creates an address from the input netip.Prefix, which must be IPv6
+// - bits past the prefix length are kept, as with UnmarshalText - use prefix.Masked() to clear them
+func NewIPv6AddressFromPrefix(prefix netip.Prefix) (IPv6Address, error) {
+	if !prefix.IsValid() || !prefix.Addr().Is6() {
+		return IPv6Address{}, fmt.Errorf("%s isn't an IPv6 prefix", prefix)
+	}
+	data := prefix.Addr().As16()
+	return NewIPv6Address(data[:], uint(prefix.Bits())), nil
+}
+
 // ShiftLeft shifts the bits |bitCount| bits left
 func (ip *IPv6Address) ShiftLeft(bitCount uint) {
 	ip.Left, ip.Right, ip.Length = ShiftLeftIPv6(ip.Left, ip.Right, ip.Length, bitCount)
@@ -49,33 +71,49 @@ func (ip IPv6Address) String() string {
 	return ipNet.String()
 }
 
-// ShiftLeftIPv6 shifts IPv6 (as two uint64's) to the left
-func ShiftLeftIPv6(left uint64, right uint64, length uint, bitCount uint) (uint64, uint64, uint) {
-	length = length - bitCount
-	if bitCount >= 64 {
-		// we don't care about the right bit - move it left, then shift shift-64
-		return right << (bitCount - 64), 0, length
-	}
+// Prefix returns this address as a netip.Prefix
+func (ip IPv6Address) Prefix() netip.Prefix {
+	var data [16]byte
+	binary.BigEndian.PutUint64(data[:], ip.Left)
+	binary.BigEndian.PutUint64(data[8:], ip.Right)
+	return netip.PrefixFrom(netip.AddrFrom16(data), int(ip.Length))
+}
+
+// MarshalText returns the address in CIDR notation, implementing encoding.TextMarshaler
+// - the same as String, except that IPv4-mapped addresses are written as IPv6, like "::ffff:10.0.0.1/128", so that
+// they parse back as IPv6
+func (ip IPv6Address) MarshalText() ([]byte, error) {
+	return []byte(ip.Prefix().String()), nil
+}
 
-	// shifting less than 64 - need to shift right over to left
-	left = (left << bitCount) | (right >> (64 - bitCount))
-	right <<= bitCount
+// UnmarshalText parses an address in CIDR notation, implementing encoding.TextUnmarshaler
+// - an address without a prefix length is a /128
+// - bits past the prefix length are kept, the same as MarshalText writes them
+func (ip *IPv6Address) UnmarshalText(text []byte) error {
+	prefix, err := parsePrefix(string(text), 128)
+	if err != nil {
+		return err
+	}
+	if !prefix.Addr().Is6() {
+		return fmt.Errorf("%q isn't an IPv6 address", text)
+	}
+	data := prefix.Addr().As16()
+	*ip = NewIPv6Address(data[:], uint(prefix.Bits()))
+	return nil
+}
 
-	return left, right, length
+// ShiftLeftIPv6 shifts IPv6 (as two uint64's) to the left
+// - branchless, as lookups shift the address at every node: Go shifts by 64 bits or more give 0, and bit counts below 0
+// wrap around to huge ones, so of the right word's two shifts into the left, only the one for this bitCount counts
+func ShiftLeftIPv6(left uint64, right uint64, length uint, bitCount uint) (uint64, uint64, uint) {
+	return left<<bitCount | right>>(64-bitCount) | right<<(bitCount-64), right << bitCount, length - bitCount
 }
 
 // ShiftRightIPv6 shifts IPv6 (as two uint64's) to the right
 // - assumes left and rights have already been masked clean, so there's no extra bits
+// - branchless, like ShiftLeftIPv6
 func ShiftRightIPv6(left uint64, right uint64, bitCount uint) (uint64, uint64) {
-	if bitCount >= 64 {
-		// shifting by at least 64 - just move left to right, and shift the remaining amount
-		return 0, left >> (bitCount - 64)
-	}
-
-	// shifting less than 64 - need to shift left over to right
-	right = (right >> bitCount) | (left << (64 - bitCount))
-	left >>= bitCount
-	return left, right
+	return left >> bitCount, right>>bitCount | left<<(64-bitCount) | left>>(bitCount-64)
 }
 
 // IsLeftBitSet returns whether the leftmost bit is set
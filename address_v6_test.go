@@ -2,6 +2,9 @@ package patricia
 
 import (
 	"fmt"
+	"math/big"
+	"math/rand"
+	"net/netip"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -85,3 +88,90 @@ func TestShiftRightIPv6(t *testing.T) {
 	assert.Equal(t, uint64(0x0), newLeft)
 	assert.Equal(t, uint64(0x81018202830), newRight)
 }
+
+func TestShiftIPv6AllCounts(t *testing.T) {
+	left, right := uint64(0x0102030405060701), uint64(0x7A33881100338844)
+	value := new(big.Int).Lsh(new(big.Int).SetUint64(left), 64)
+	value.Or(value, new(big.Int).SetUint64(right))
+	words := func(value *big.Int) (uint64, uint64) {
+		lower := new(big.Int).And(value, new(big.Int).SetUint64(^uint64(0)))
+		return new(big.Int).Rsh(value, 64).Uint64(), lower.Uint64()
+	}
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(1))
+
+	for bitCount := uint(0); bitCount <= 128; bitCount++ {
+		expectedLeft, expectedRight := words(new(big.Int).And(new(big.Int).Lsh(value, bitCount), mask))
+		newLeft, newRight, newLength := ShiftLeftIPv6(left, right, 128, bitCount)
+		assert.Equal(t, expectedLeft, newLeft, "left shift by %d", bitCount)
+		assert.Equal(t, expectedRight, newRight, "left shift by %d", bitCount)
+		assert.Equal(t, 128-bitCount, newLength)
+
+		expectedLeft, expectedRight = words(new(big.Int).Rsh(value, bitCount))
+		newLeft, newRight = ShiftRightIPv6(left, right, bitCount)
+		assert.Equal(t, expectedLeft, newLeft, "right shift by %d", bitCount)
+		assert.Equal(t, expectedRight, newRight, "right shift by %d", bitCount)
+	}
+}
+
+func BenchmarkShiftLeftIPv6(b *testing.B) {
+	// counts all over the place, as lookups shift by however many bits each node matches
+	random := rand.New(rand.NewSource(1))
+	counts := make([]uint, 1024)
+	for i := range counts {
+		counts[i] = uint(random.Intn(129))
+	}
+
+	b.ResetTimer()
+	var left, right uint64
+	for n := 0; n < b.N; n++ {
+		shiftedLeft, shiftedRight, _ := ShiftLeftIPv6(0x0102030405060701, 0x7A33881100338844, 128, counts[n%len(counts)])
+		left ^= shiftedLeft
+		right ^= shiftedRight
+	}
+	_, _ = left, right
+}
+
+func TestNewIPv6AddressFromNetip(t *testing.T) {
+	sut, err := NewIPv6AddressFromAddr(netip.MustParseAddr("2001:db8::1"))
+	assert.NoError(t, err)
+	assert.Equal(t, NewIPv6Address([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 128), sut)
+	sut, err = NewIPv6AddressFromAddr(netip.MustParseAddr("::ffff:10.0.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "::ffff:10.0.0.1/128", sut.Prefix().String())
+	sut, err = NewIPv6AddressFromPrefix(netip.MustParsePrefix("2001:db8::1/32"))
+	assert.NoError(t, err)
+	assert.Equal(t, NewIPv6Address([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 32), sut)
+
+	for _, addr := range []netip.Addr{{}, netip.MustParseAddr("10.0.0.1")} {
+		_, err = NewIPv6AddressFromAddr(addr)
+		assert.Error(t, err, addr.String())
+		_, err = NewIPv6AddressFromPrefix(netip.PrefixFrom(addr, 0))
+		assert.Error(t, err, addr.String())
+	}
+	_, err = NewIPv6AddressFromPrefix(netip.PrefixFrom(netip.MustParseAddr("2001:db8::"), 129))
+	assert.Error(t, err)
+}
+
+func TestIPv6AddressPrefix(t *testing.T) {
+	sut := NewIPv6Address([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 32)
+	assert.Equal(t, "2001:db8::/32", sut.Prefix().String())
+	assert.True(t, sut.Prefix().Addr().Is6())
+	assert.Equal(t, "::/0", NewIPv6Address(make([]byte, 16), 0).Prefix().String())
+}
+
+func TestIPv6AddressText(t *testing.T) {
+	for _, text := range []string{"2001:db8::/32", "::/0", "fe80::1/128", "2001:db8::1/64", "::ffff:10.0.0.1/128"} {
+		var sut IPv6Address
+		assert.NoError(t, sut.UnmarshalText([]byte(text)))
+		marshaled, err := sut.MarshalText()
+		assert.NoError(t, err)
+		assert.Equal(t, text, string(marshaled))
+	}
+
+	var sut IPv6Address
+	assert.NoError(t, sut.UnmarshalText([]byte("2001:db8::1")))
+	assert.Equal(t, NewIPv6Address([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 128), sut)
+	for _, text := range []string{"", "2001:db8::/129", "10.0.0.0/8", "10.0.0.1", "example.com"} {
+		assert.Error(t, sut.UnmarshalText([]byte(text)), text)
+	}
+}
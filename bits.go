@@ -41,25 +41,16 @@ func MergePrefixes32(left uint32, leftLength uint, right uint32, rightLength uin
 
 // MergePrefixes64 merges two pairs of uint64s, returning a new prefix, new length
 func MergePrefixes64(leftLeft uint64, leftRight uint64, leftLength uint, rightLeft uint64, rightRight uint64, rightLength uint) (uint64, uint64, uint) {
-	// mask the left 128 bits
-	if leftLength <= 64 {
-		leftLeft &= _leftMasks64[leftLength]
-		leftRight = 0
-	} else {
-		leftRight &= _leftMasks64[leftLength-64]
-	}
-
-	// mask the right 128 bits
-	if rightLength <= 64 {
-		rightLeft &= _leftMasks64[rightLength]
-		rightRight = 0
-	} else {
-		rightRight &= _leftMasks64[rightLength-64]
-	}
-
-	// shift the right 128 bits to the right
-	rightLeft, rightRight = ShiftRightIPv6(rightLeft, rightRight, leftLength)
+	// mask both, then shift the right 128 bits to the right, past the left ones
+	leftMaskLeft, leftMaskRight := leftMasks128(leftLength)
+	rightMaskLeft, rightMaskRight := leftMasks128(rightLength)
+	rightLeft, rightRight = ShiftRightIPv6(rightLeft&rightMaskLeft, rightRight&rightMaskRight, leftLength)
+	return leftLeft&leftMaskLeft | rightLeft, leftRight&leftMaskRight | rightRight, leftLength + rightLength
+}
 
-	// now merge the two
-	return leftLeft | rightLeft, leftRight | rightRight, leftLength + rightLength
+// the masks for the first length bits of 128, as left and right words
+// - branchless: shifting by 64 bits or more gives 0, so the left word's mask is full from 64 bits on, and the right
+// word's shift is kept at 64 or more, and its mask empty, up to 64 bits
+func leftMasks128(length uint) (uint64, uint64) {
+	return ^(^uint64(0) >> length), ^(^uint64(0) >> (max(length, 64) - 64))
 }
@@ -38,3 +38,42 @@ func TestMergePrefixes32(t *testing.T) {
 	assert.Equal(t, uint32(0x80000000), newPrefix)
 	assert.Equal(t, uint(4), newLength)
 }
+
+func TestMergePrefixes64(t *testing.T) {
+	// both within the left word
+	newLeft, newRight, newLength := MergePrefixes64(0x2001_0db8_ffff_ffff, 0xffff, 32, 0x1234_ffff_ffff_ffff, 0xffff, 16)
+	assert.Equal(t, uint64(0x2001_0db8_1234_0000), newLeft)
+	assert.Equal(t, uint64(0), newRight)
+	assert.Equal(t, uint(48), newLength)
+
+	// the right prefix crosses into the right word
+	newLeft, newRight, newLength = MergePrefixes64(0x2001_0db8_ffff_ffff, 0xffff, 48, 0x1234_5678_9abc_ffff, 0xffff, 48)
+	assert.Equal(t, uint64(0x2001_0db8_ffff_1234), newLeft)
+	assert.Equal(t, uint64(0x5678_9abc_0000_0000), newRight)
+	assert.Equal(t, uint(96), newLength)
+
+	// the left prefix fills the left word, and more
+	newLeft, newRight, newLength = MergePrefixes64(0x2001_0db8_0000_0001, 0xabcd_ffff_ffff_ffff, 80, 0x1234_ffff_ffff_ffff, 0, 48)
+	assert.Equal(t, uint64(0x2001_0db8_0000_0001), newLeft)
+	assert.Equal(t, uint64(0xabcd_1234_ffff_ffff), newRight)
+	assert.Equal(t, uint(128), newLength)
+
+	// nothing on either side
+	newLeft, newRight, newLength = MergePrefixes64(0xffff, 0xffff, 0, 0x8000_0000_0000_0000, 0xffff, 1)
+	assert.Equal(t, uint64(0x8000_0000_0000_0000), newLeft)
+	assert.Equal(t, uint64(0), newRight)
+	assert.Equal(t, uint(1), newLength)
+}
+
+func TestLeftMasks128(t *testing.T) {
+	for length := uint(0); length <= 128; length++ {
+		left, right := leftMasks128(length)
+		if length <= 64 {
+			assert.Equal(t, _leftMasks64[length], left)
+			assert.Equal(t, uint64(0), right)
+		} else {
+			assert.Equal(t, ^uint64(0), left)
+			assert.Equal(t, _leftMasks64[length-64], right)
+		}
+	}
+}
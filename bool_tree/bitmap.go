@@ -0,0 +1,43 @@
+package bool_tree
+
+import "math/bits"
+
+// tree bitmap nodes shared by the IPv4/IPv6 bitmap trees
+
+// the bits of the address each tree bitmap node covers
+const _bitmapStride = 4
+
+// a node in a tree bitmap, covering the next _bitmapStride bits of the address, as described by Eatherton et al.
+// - prefixes ending part way through the node are set in internal, and the children below it in external, so the
+// node doesn't need a slot for every value of its bits - only its results, and its children, which are each stored
+// together, at resultBase and childBase, in the order of their bits
+type bitmapNode struct {
+	internal   uint16 // bit 1<<l | the prefix's l bits, for each prefix of length l < _bitmapStride
+	external   uint16 // bit chunk for each child, with chunk the next _bitmapStride bits of the addresses below it
+	childBase  uint32
+	resultBase uint32
+}
+
+// the position of a prefix of the input length, whose bits start chunk, in internal
+func bitmapPosition(chunk int, length uint) uint {
+	return 1<<length | uint(chunk)>>(_bitmapStride-length)
+}
+
+// the offset from resultBase of the result for the longest prefix in the node, no longer than maxLength, that chunk
+// starts with, and whether there is one
+func (n *bitmapNode) longestMatch(chunk int, maxLength uint) (uint32, bool) {
+	for length := int(maxLength); length >= 0; length-- {
+		if position := bitmapPosition(chunk, uint(length)); n.internal&(1<<position) != 0 {
+			return uint32(bits.OnesCount16(n.internal & (1<<position - 1))), true
+		}
+	}
+	return 0, false
+}
+
+// the offset from childBase of the child for chunk, and whether there is one
+func (n *bitmapNode) child(chunk int) (uint32, bool) {
+	if n.external&(1<<chunk) == 0 {
+		return 0, false
+	}
+	return uint32(bits.OnesCount16(n.external & (1<<chunk - 1))), true
+}
@@ -0,0 +1,29 @@
+package bool_tree
+
+import (
+	"encoding/binary"
+)
+
+// native encoding shared by the IPv4/IPv6 trees: the node array as it's laid out in memory, so that it can be used in
+// place, without decoding it
+// - header: magic, version (uint32), byte order mark (uint16), node size (uint16), node count (uint32), reserved
+// (uint32), all in the platform's byte order
+// - the node array's memory, starting 8-byte aligned
+// - the free list, tags, and expirations, encoded the same as in MarshalBinary
+// - a CRC-32C checksum of everything before it (uint32, big-endian)
+const (
+	_nativeVersion        = 2 // 2: IPv4 nodes keep their prefix and its length in one word
+	_nativeHeaderSize     = 24
+	_nativeByteOrderMark  = 0x0102
+	_nativeChecksumLength = 4
+)
+
+// append a native encoding's header
+func appendNativeHeader(buf []byte, magic []byte, nodeSize int, nodeCount int) []byte {
+	buf = append(buf, magic...)
+	buf = binary.NativeEndian.AppendUint32(buf, _nativeVersion)
+	buf = binary.NativeEndian.AppendUint16(buf, _nativeByteOrderMark)
+	buf = binary.NativeEndian.AppendUint16(buf, uint16(nodeSize))
+	buf = binary.NativeEndian.AppendUint32(buf, uint32(nodeCount))
+	return binary.NativeEndian.AppendUint32(buf, 0)
+}
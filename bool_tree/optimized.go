@@ -0,0 +1,79 @@
+package bool_tree
+
+// read-only lookup structures shared by the IPv4/IPv6 optimized trees
+
+// the most bits an optimized tree's node branches on, for 1<<16 slots
+const _optimizedMaxBits = 16
+
+// a slot in an optimized tree's node, for one value of the bits the node branches on
+type optimizedSlot struct {
+	child  uint32 // the node for addresses that go on past the slot, or 0 for none
+	prefix uint32 // the deepest prefix holding every address in the slot, or 0 for none
+}
+
+// a prefix in an optimized tree, with its tags
+type optimizedPrefix struct {
+	tagsStart uint32 // the prefix's tags, in the tree's tags
+	tagsEnd   uint32
+	parent    uint32 // the deepest prefix holding this one, or 0 for none
+}
+
+// the prefixes in a read-only tree, with their tags, each pointing to the prefix holding it
+type prefixTags struct {
+	prefixes []optimizedPrefix // [0] is unused, for no prefix
+	tags     []bool
+}
+
+// add a prefix, with the input tags, and the index of the prefix holding it, returning its index
+// - prefixes must start out with the unused prefix 0 in it
+func (p *prefixTags) add(tags []bool, parent uint32) uint32 {
+	p.prefixes = append(p.prefixes, optimizedPrefix{tagsStart: uint32(len(p.tags)), tagsEnd: uint32(len(p.tags) + len(tags)), parent: parent})
+	p.tags = append(p.tags, tags...)
+	return uint32(len(p.prefixes) - 1)
+}
+
+// append the tags of the prefix at the input index, and every prefix holding it, to ret, shallowest first
+func (p *prefixTags) appendTags(ret []bool, prefixIndex uint32) []bool {
+	if prefixIndex == 0 {
+		return ret
+	}
+	prefix := &p.prefixes[prefixIndex]
+	ret = p.appendTags(ret, prefix.parent)
+	return append(ret, p.tags[prefix.tagsStart:prefix.tagsEnd]...)
+}
+
+// call tagFunc for the tags of the prefix at the input index, and every prefix holding it, shallowest first, returning
+// false if it did
+func (p *prefixTags) visitTags(prefixIndex uint32, tagFunc func(tag bool) bool) bool {
+	if prefixIndex == 0 {
+		return true
+	}
+	prefix := &p.prefixes[prefixIndex]
+	if !p.visitTags(prefix.parent, tagFunc) {
+		return false
+	}
+	for _, tag := range p.tags[prefix.tagsStart:prefix.tagsEnd] {
+		if !tagFunc(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// the first tag of the prefix at the input index, if there is one
+func (p *prefixTags) deepestTag(prefixIndex uint32) (bool, bool) {
+	if prefixIndex == 0 {
+		var zero bool
+		return false, zero
+	}
+	return true, p.tags[p.prefixes[prefixIndex].tagsStart]
+}
+
+// the tags of the prefix at the input index, if there is one, which belong to the tree
+func (p *prefixTags) deepestTags(prefixIndex uint32) (bool, []bool) {
+	if prefixIndex == 0 {
+		return false, make([]bool, 0)
+	}
+	prefix := &p.prefixes[prefixIndex]
+	return true, p.tags[prefix.tagsStart:prefix.tagsEnd:prefix.tagsEnd]
+}
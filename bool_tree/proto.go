@@ -0,0 +1,310 @@
+package bool_tree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// protobuf wire format, for the schema in proto/patricia.proto, shared by the IPv4/IPv6 trees
+
+// protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// field numbers, from proto/patricia.proto
+const (
+	protoTreeEntries = 1
+
+	protoEntryAddress = 1
+	protoEntryLength  = 2
+	protoEntryTags    = 3
+
+	protoTagBool    = 1
+	protoTagString  = 2
+	protoTagInt     = 3
+	protoTagUint    = 4
+	protoTagFloat   = 5
+	protoTagDouble  = 6
+	protoTagComplex = 7
+
+	protoComplexReal = 1
+	protoComplexImag = 2
+)
+
+func (e *encoder) protoKey(field int, wireType int) {
+	e.uvarint(uint64(field<<3 | wireType))
+}
+
+func (e *encoder) protoVarint(field int, value uint64) {
+	e.protoKey(field, protoVarint)
+	e.uvarint(value)
+}
+
+func (e *encoder) protoBytes(field int, data []byte) {
+	e.protoKey(field, protoBytes)
+	e.uvarint(uint64(len(data)))
+	e.bytes(data)
+}
+
+func (e *encoder) protoFixed32(field int, value uint32) {
+	e.protoKey(field, protoFixed32)
+	if e.err == nil {
+		e.buf = binary.LittleEndian.AppendUint32(e.buf, value)
+	}
+}
+
+func (e *encoder) protoFixed64(field int, value uint64) {
+	e.protoKey(field, protoFixed64)
+	if e.err == nil {
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, value)
+	}
+}
+
+// write an Entry message
+func (e *encoder) protoEntry(address []byte, length uint, tags []bool) {
+	e.protoBytes(protoEntryAddress, address)
+	if length > 0 {
+		e.protoVarint(protoEntryLength, uint64(length))
+	}
+	var tag encoder
+	for _, t := range tags {
+		tag.buf = tag.buf[:0]
+		tag.protoTag(t)
+		if tag.err != nil {
+			e.err = tag.err
+			return
+		}
+		e.protoBytes(protoEntryTags, tag.buf)
+	}
+}
+
+// write a Tag message
+func (e *encoder) protoTag(tag bool) {
+	switch v := interface{}(tag).(type) {
+	case bool:
+		if v {
+			e.protoVarint(protoTagBool, 1)
+		} else {
+			e.protoVarint(protoTagBool, 0)
+		}
+	case string:
+		e.protoBytes(protoTagString, []byte(v))
+	case int:
+		e.protoSint64(protoTagInt, int64(v))
+	case int8:
+		e.protoSint64(protoTagInt, int64(v))
+	case int16:
+		e.protoSint64(protoTagInt, int64(v))
+	case int32:
+		e.protoSint64(protoTagInt, int64(v))
+	case int64:
+		e.protoSint64(protoTagInt, v)
+	case uint:
+		e.protoVarint(protoTagUint, uint64(v))
+	case uint8:
+		e.protoVarint(protoTagUint, uint64(v))
+	case uint16:
+		e.protoVarint(protoTagUint, uint64(v))
+	case uint32:
+		e.protoVarint(protoTagUint, uint64(v))
+	case uint64:
+		e.protoVarint(protoTagUint, v)
+	case float32:
+		e.protoFixed32(protoTagFloat, math.Float32bits(v))
+	case float64:
+		e.protoFixed64(protoTagDouble, math.Float64bits(v))
+	case complex64:
+		e.protoComplex(complex128(v))
+	case complex128:
+		e.protoComplex(v)
+	default:
+		e.err = fmt.Errorf("%w: %T", ErrUnsupportedTag, tag)
+	}
+}
+
+func (e *encoder) protoSint64(field int, value int64) {
+	// varint does the same zigzag encoding as protobuf's sint64
+	e.protoKey(field, protoVarint)
+	e.varint(value)
+}
+
+func (e *encoder) protoComplex(value complex128) {
+	var c encoder
+	c.protoFixed64(protoComplexReal, math.Float64bits(real(value)))
+	c.protoFixed64(protoComplexImag, math.Float64bits(imag(value)))
+	e.protoBytes(protoTagComplex, c.buf)
+}
+
+// read a field's key, returning its number and wire type
+func (d *decoder) protoKey() (int, int) {
+	key := d.uvarint()
+	// field numbers go up to 1<<29 - 1, so anything bigger is bad, rather than left to wrap around in an int
+	if d.err == nil && (key>>3 == 0 || key>>3 >= 1<<29) {
+		d.fail("bad protobuf field number")
+	}
+	return int(key >> 3), int(key & 7)
+}
+
+// read a length-delimited field, returning a decoder for its contents
+func (d *decoder) protoBytes() decoder {
+	return decoder{data: d.bytes(d.count(uint64(d.remaining()), "protobuf field length"))}
+}
+
+func (d *decoder) protoFixed32() uint32 {
+	data := d.bytes(4)
+	if data == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(data)
+}
+
+func (d *decoder) protoFixed64() uint64 {
+	data := d.bytes(8)
+	if data == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(data)
+}
+
+// skip over a field we don't know, as protobuf requires
+func (d *decoder) protoSkip(wireType int) {
+	switch wireType {
+	case protoVarint:
+		d.uvarint()
+	case protoFixed64:
+		d.bytes(8)
+	case protoBytes:
+		d.protoBytes()
+	case protoFixed32:
+		d.bytes(4)
+	default:
+		d.fail("unsupported protobuf wire type %d", wireType)
+	}
+}
+
+// make sure a known field has the wire type it should
+func (d *decoder) protoExpect(field int, wireType int, expected int) bool {
+	if wireType != expected {
+		d.fail("protobuf field %d has wire type %d, expected %d", field, wireType, expected)
+		return false
+	}
+	return true
+}
+
+// read an Entry message, returning the address bytes, the prefix length, and the tags
+func (d *decoder) protoEntry() ([]byte, uint, []bool) {
+	var address []byte
+	var length uint
+	var tags []bool
+	for d.remaining() > 0 && d.err == nil {
+		field, wireType := d.protoKey()
+		switch field {
+		case protoEntryAddress:
+			if d.protoExpect(field, wireType, protoBytes) {
+				sub := d.protoBytes()
+				address = sub.data
+			}
+		case protoEntryLength:
+			if d.protoExpect(field, wireType, protoVarint) {
+				length = uint(d.count(math.MaxUint8, "prefix length"))
+			}
+		case protoEntryTags:
+			if d.protoExpect(field, wireType, protoBytes) {
+				sub := d.protoBytes()
+				tag := sub.protoTag()
+				if sub.err != nil && d.err == nil {
+					d.err = sub.err
+				}
+				tags = append(tags, tag)
+			}
+		default:
+			d.protoSkip(wireType)
+		}
+	}
+	return address, length, tags
+}
+
+// read a Tag message
+func (d *decoder) protoTag() bool {
+	var value interface{}
+	for d.remaining() > 0 && d.err == nil {
+		field, wireType := d.protoKey()
+		switch field {
+		case protoTagBool:
+			if d.protoExpect(field, wireType, protoVarint) {
+				value = d.uvarint() != 0
+			}
+		case protoTagString:
+			if d.protoExpect(field, wireType, protoBytes) {
+				sub := d.protoBytes()
+				value = string(sub.data)
+			}
+		case protoTagInt:
+			if d.protoExpect(field, wireType, protoVarint) {
+				value = d.varint()
+			}
+		case protoTagUint:
+			if d.protoExpect(field, wireType, protoVarint) {
+				value = d.uvarint()
+			}
+		case protoTagFloat:
+			if d.protoExpect(field, wireType, protoFixed32) {
+				value = math.Float32frombits(d.protoFixed32())
+			}
+		case protoTagDouble:
+			if d.protoExpect(field, wireType, protoFixed64) {
+				value = math.Float64frombits(d.protoFixed64())
+			}
+		case protoTagComplex:
+			if d.protoExpect(field, wireType, protoBytes) {
+				sub := d.protoBytes()
+				value = sub.protoComplex()
+				if sub.err != nil && d.err == nil {
+					d.err = sub.err
+				}
+			}
+		default:
+			d.protoSkip(wireType)
+		}
+	}
+
+	var ret bool
+	if d.err != nil {
+		return ret
+	}
+	if value == nil {
+		d.fail("tag without a value")
+		return ret
+	}
+	ret, err := convertTag(value)
+	if err != nil {
+		d.err = err
+	}
+	return ret
+}
+
+// read a Complex message
+func (d *decoder) protoComplex() complex128 {
+	var realPart, imagPart float64
+	for d.remaining() > 0 && d.err == nil {
+		field, wireType := d.protoKey()
+		switch field {
+		case protoComplexReal:
+			if d.protoExpect(field, wireType, protoFixed64) {
+				realPart = math.Float64frombits(d.protoFixed64())
+			}
+		case protoComplexImag:
+			if d.protoExpect(field, wireType, protoFixed64) {
+				imagPart = math.Float64frombits(d.protoFixed64())
+			}
+		default:
+			d.protoSkip(wireType)
+		}
+	}
+	return complex(realPart, imagPart)
+}
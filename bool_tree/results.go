@@ -0,0 +1,60 @@
+package bool_tree
+
+import "sync"
+
+// pooled lookup results shared by the IPv4/IPv6 trees
+
+// results bigger than this aren't pooled, so one odd lookup doesn't keep a large buffer around for good
+const _maxPooledResultCap = 1024
+
+var (
+	// *[]bool, each holding an empty slice to reuse for a result
+	resultBuffers sync.Pool
+
+	// *[]bool, each empty, for handing slices back to resultBuffers without allocating
+	resultBoxes sync.Pool
+)
+
+// WithResultPool has FindTags and FindTagsWithFilter build their results in pooled buffers, which can be handed back with
+// ReleaseTags once the caller's done with them, so busy lookup servers don't churn through a new slice per lookup
+// - results that aren't released are just garbage collected, like any other
+func WithResultPool() TreeOption {
+	return func(c *treeConfig) {
+		c.resultPool = true
+	}
+}
+
+// an empty slice to build a result in, from the pool
+func getResultBuffer() []bool {
+	box, _ := resultBuffers.Get().(*[]bool)
+	if box == nil {
+		return make([]bool, 0, 4)
+	}
+	ret := *box
+	*box = nil
+	resultBoxes.Put(box)
+	return ret
+}
+
+// ReleaseTags hands tags returned by FindTags or FindTagsWithFilter back to be reused by later lookups, on trees made
+// WithResultPool
+// - the tags, and anything sharing their backing array, must not be used after this
+// - any slice can be released, wherever it came from, but only a tree made WithResultPool will reuse it
+func ReleaseTags(tags []bool) {
+	if cap(tags) == 0 || cap(tags) > _maxPooledResultCap {
+		return
+	}
+
+	// drop what the tags refer to, so the pool doesn't keep it alive
+	var zero bool
+	for i := range tags {
+		tags[i] = zero
+	}
+
+	box, _ := resultBoxes.Get().(*[]bool)
+	if box == nil {
+		box = new([]bool)
+	}
+	*box = tags[:0]
+	resultBuffers.Put(box)
+}
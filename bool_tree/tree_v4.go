@@ -1,83 +1,467 @@
 package bool_tree
 
 import (
+	"context"
 	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
 
 	"github.com/kentik/patricia"
 )
 
 // TreeV4 is an IP Address patricia tree
+// - reads don't change anything, not even the address they're given, so any number of goroutines can read a tree at
+// the same time, as long as nothing changes it while they do - Snapshot counts as a change, unless nothing has changed
+// since the last one
+// - lookups in a tree made WithPrefixLimit, with a policy that evicts, record the prefixes they hit, but do it
+// atomically, so the same holds
 type TreeV4 struct {
 	nodes            []treeNodeV4 // root is always at [1] - [0] is unused
-	availableIndexes []uint       // a place to store node indexes that we deleted, and are available
-	tags             map[uint64]bool
+	availableIndexes []treeIndex  // a place to store node indexes that we deleted, and are available
+	tags             tagStorage   // each node's tags, and their expiration times, kept as the tree's options say
+	prefixCount      int          // how many nodes have tags - see PrefixCount
+	tagCount         int          // how many tags there are, across all nodes - see TagCount
+	hits             []uint64     // when each node's prefix was last hit, by hitClock, for trees that track them - see WithPrefixLimit
+	hitClock         uint64       // bumped for every tag added, for trees that track hits
+	config           treeConfig
+	shared           bool             // whether the storage above is shared with a snapshot, and has to be copied before changing it
+	changeLog        *changeLog       // where changes are recorded, if anywhere - see SetChangeLog
+	changeSeq        uint64           // bumped on every change - see NewCompaction and ErrConcurrentModification
+	hooks            *changeHooksV4   // called after changes, if any - see OnAdd and OnDelete
+	frozen           *OptimizedTreeV4 // serves lookups while the tree is frozen - see FreezeInPlace
 }
 
 // NewTreeV4 returns a new Tree
-func NewTreeV4() *TreeV4 {
+func NewTreeV4(options ...TreeOption) *TreeV4 {
+	config := newTreeConfig(options)
 	return &TreeV4{
 		nodes:            make([]treeNodeV4, 2, 2), // index 0 is skipped, 1 is root
-		availableIndexes: make([]uint, 0),
-		tags:             make(map[uint64]bool),
+		availableIndexes: make([]treeIndex, 0),
+		tags:             newTagStorage(&config),
+		config:           config,
 	}
 }
 
-// Clone creates an identical copy of the tree
-// - Note: the items in the tree are not deep copied
+// Clear removes everything from the tree, leaving it as if it were new
+// - the allocated node array and free list capacity are kept, so a tree that's periodically rebuilt doesn't need to re-grow them
+// - returns ErrFrozen for a frozen tree, like any other change - Thaw it first
+func (t *TreeV4) Clear() error {
+	if t.frozen != nil {
+		return ErrFrozen
+	}
+	if t.hooks != nil {
+		defer t.hookEntries(t.hookSubtree(patricia.IPv4Address{}, false), ChangeDelete)
+	}
+	if t.shared {
+		// the storage belongs to a snapshot too - start over with new storage instead
+		*t = TreeV4{
+			nodes:            make([]treeNodeV4, 2, 2),
+			availableIndexes: make([]treeIndex, 0),
+			tags:             newTagStorage(&t.config),
+			config:           t.config,
+			changeLog:        t.changeLog,
+			changeSeq:        t.changeSeq,
+			hooks:            t.hooks,
+		}
+		t.changing()
+		t.logClear()
+		return nil
+	}
+	t.changing()
+	defer t.logClear()
+
+	t.nodes = t.nodes[:2]
+	t.nodes[0] = treeNodeV4{}
+	t.nodes[1] = treeNodeV4{}
+	t.availableIndexes = t.availableIndexes[:0]
+	t.tags.reset()
+	t.prefixCount = 0
+	t.tagCount = 0
+	clear(t.hits)
+	t.hits = t.hits[:0]
+	return nil
+}
+
+// Clone creates an identical, independent copy of the tree
+// - the node array, free list, and tags are all copied, preserving the node layout, so either tree can be mutated without affecting the other
+// - Note: the tag values themselves are copied by assignment
 func (t *TreeV4) Clone() *TreeV4 {
 	ret := &TreeV4{
-		nodes:            make([]treeNodeV4, len(t.nodes), cap(t.nodes)),
-		availableIndexes: make([]uint, len(t.availableIndexes), cap(t.availableIndexes)),
-		tags:             make(map[uint64]bool, len(t.tags)),
+		nodes:            t.makeNodes(len(t.nodes), cap(t.nodes)),
+		availableIndexes: make([]treeIndex, len(t.availableIndexes), cap(t.availableIndexes)),
+		tags:             t.tags.clone(t, len(t.nodes)),
+		prefixCount:      t.prefixCount,
+		tagCount:         t.tagCount,
+		hitClock:         t.hitClock,
+		config:           t.config,
 	}
 
 	copy(ret.nodes, t.nodes)
 	copy(ret.availableIndexes, t.availableIndexes)
-	for k, v := range t.tags {
-		ret.tags[k] = v
+	if t.hits != nil {
+		// lookups in a snapshot sharing them can be recording hits right now
+		ret.hits = make([]uint64, len(t.hits))
+		for i := range t.hits {
+			ret.hits[i] = atomic.LoadUint64(&t.hits[i])
+		}
 	}
 	return ret
 }
 
-// CountTags iterates through the tree, counting the number of tags
-// - note: unused nodes will have TagCount==0
+// Snapshot returns a read-only view of the tree as it is now, which stays the same as this tree keeps changing
+// - this is cheap: the snapshot shares the tree's storage, and the first change to either of them after that copies it, like Clone does
+// - so the snapshot can be read from other goroutines while this tree keeps changing, as long as this is called from the goroutine changing it
+// - the snapshot can be changed too, without affecting this tree, though that's not what it's for
+// - taking a snapshot of a snapshot doesn't change anything, so any number of readers can do that at the same time without locking
+func (t *TreeV4) Snapshot() *TreeV4 {
+	if !t.shared {
+		t.shared = true
+	}
+	ret := *t
+	ret.changeLog = nil
+	ret.hooks = nil
+	return &ret
+}
+
+// if the tree's storage is shared with a snapshot, give it its own copy to change
+func (t *TreeV4) unshare() {
+	if t.shared {
+		changeLog, changeSeq, hooks, frozen := t.changeLog, t.changeSeq, t.hooks, t.frozen
+		*t = *t.Clone()
+		t.changeLog, t.changeSeq, t.hooks, t.frozen = changeLog, changeSeq, hooks, frozen
+	}
+}
+
+// get the tree ready to be changed: give it its own storage if it's shared, and let the race guard know
+func (t *TreeV4) startChange() {
+	t.unshare()
+	t.changing()
+}
+
+// record that the tree is changing, so a compaction under way knows to start over, and, with the race guard on, lookups
+// running at the same time can tell
+func (t *TreeV4) changing() {
+	if _raceGuard {
+		atomic.AddUint64(&t.changeSeq, 1)
+	} else {
+		t.changeSeq++
+	}
+}
+
+// with the race guard on, deferred by lookups with the change sequence they started with, to turn the tree changing
+// under them into ErrConcurrentModification - along with any panic that caused, such as from the node array being reallocated
+func (t *TreeV4) guardLookup(changeSeq uint64, err *error) {
+	if r := recover(); r != nil {
+		if atomic.LoadUint64(&t.changeSeq) == changeSeq {
+			panic(r)
+		}
+		*err = ErrConcurrentModification
+	} else if atomic.LoadUint64(&t.changeSeq) != changeSeq {
+		*err = ErrConcurrentModification
+	}
+}
+
+// CountTags returns the number of tags in the tree, the same as TagCount
 func (t *TreeV4) CountTags() int {
-	ret := 0
-	for _, node := range t.nodes {
-		ret += node.TagCount
+	return t.tagCount
+}
+
+// Size returns the number of nodes in use, including the root, which is always there
+// - there's a node for each prefix with tags, and one for each place prefixes branch off each other without one there
+// - doesn't walk the tree: deleted nodes go on the free list, so the count comes from the node array's length
+func (t *TreeV4) Size() int {
+	return len(t.nodes) - 1 - len(t.availableIndexes)
+}
+
+// PrefixCount returns the number of prefixes with tags, including those whose tags have all expired and haven't been swept yet
+// - kept up to date as the tree changes, so doesn't walk it
+func (t *TreeV4) PrefixCount() int {
+	return t.prefixCount
+}
+
+// TagCount returns the number of tags in the tree, including those that have expired and haven't been swept yet
+// - kept up to date as the tree changes, so doesn't walk it
+func (t *TreeV4) TagCount() int {
+	return t.tagCount
+}
+
+// count the prefixes and tags from scratch, for trees whose nodes were filled in directly, such as when loading them
+func (t *TreeV4) recount() {
+	t.prefixCount, t.tagCount = 0, 0
+	for nodeIndex := range t.nodes {
+		if tagCount := t.nodes[nodeIndex].TagCount; tagCount > 0 {
+			t.prefixCount++
+			t.tagCount += tagCount
+		}
 	}
-	return ret
 }
 
 // add a tag to the node at the input index, storing it in the first position if 'replaceFirst' is true
-// - if matchFunc is non-nil, will enforce uniqueness at this node
+// - if matchFunc is non-nil, will enforce uniqueness at this node, refreshing the existing tag's expiration time
+// - enforces the tree's tag limit, if it has one
+// - expiresAt is the tag's expiration time as UnixNano, or 0 if it doesn't expire
 // - returns whether the tag count was increased
-func (t *TreeV4) addTag(tag bool, nodeIndex uint, matchFunc MatchesFunc, replaceFirst bool) bool {
-	ret := true
+func (t *TreeV4) addTag(tag bool, nodeIndex uint, matchFunc MatchesFunc, replaceFirst bool, expiresAt int64) (bool, error) {
+	if t.config.trackHits() {
+		t.hitClock++
+		t.hits = growSlots(t.hits, nodeIndex)
+		t.hits[nodeIndex] = t.hitClock
+	}
 	if replaceFirst {
 		if t.nodes[nodeIndex].TagCount == 0 {
-			t.nodes[nodeIndex].TagCount = 1
-		} else {
+			if err := t.appendTag(nodeIndex, tag, expiresAt); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		t.setTag(nodeIndex, 0, tag, expiresAt)
+		return false, nil
+	}
+
+	ret := true
+	if matchFunc != nil {
+		// need to check if this value already exists
+		for i, existing := range t.nodeTags(nodeIndex) {
+			if matchFunc(existing, tag) {
+				if expiresAt != 0 {
+					t.setExpiration(nodeIndex, i, expiresAt)
+				}
+				return false, nil
+			}
+		}
+	}
+	if t.config.maxTagsPerNode > 0 && t.nodes[nodeIndex].TagCount >= t.config.maxTagsPerNode {
+		evicted, err := t.evictTag(nodeIndex, tag)
+		if err != nil {
+			return false, err
+		}
+		if evicted {
+			// making room for the new tag means the count isn't increased
 			ret = false
 		}
-		t.tags[(uint64(nodeIndex) << 32)] = tag
-	} else {
-		key := (uint64(nodeIndex) << 32)
-		tagCount := t.nodes[nodeIndex].TagCount
-		if matchFunc != nil {
-			// need to check if this value already exists
-			for i := 0; i < tagCount; i++ {
-				if matchFunc(t.tags[key+uint64(i)], tag) {
-					return false
+	}
+	if err := t.appendTag(nodeIndex, tag, expiresAt); err != nil {
+		return false, err
+	}
+	return ret, nil
+}
+
+// make room for the input tag at a node that's reached the tag limit, according to the tree's tag limit policy
+// - expired tags are deleted first, which may make enough room without evicting anything
+// - returns whether a tag was evicted, or ErrTagLimitReached if the new tag is rejected
+func (t *TreeV4) evictTag(nodeIndex uint, tag bool) (bool, error) {
+	if t.tags.expiring > 0 && t.expireTags(nodeIndex, time.Now().UnixNano()) > 0 && t.nodes[nodeIndex].TagCount < t.config.maxTagsPerNode {
+		return false, nil
+	}
+
+	evictIndex := -1
+	switch t.config.tagLimitPolicy {
+	case TagLimitEvictOldest:
+		evictIndex = 0
+	case TagLimitEvictFunc:
+		evictIndex = t.config.evictFunc(t.tagsForNode(nodeIndex), tag)
+	}
+	if evictIndex < 0 || evictIndex >= t.nodes[nodeIndex].TagCount {
+		return false, ErrTagLimitReached
+	}
+
+	t.keepTags(nodeIndex, func(i int, _ *bool) bool { return i != evictIndex })
+	return true, nil
+}
+
+// make room for a prefix at the input address in a tree that's reached its prefix limit, according to the tree's
+// prefix limit policy, by deleting others
+// - returns ErrPrefixLimitReached if the new prefix is rejected
+func (t *TreeV4) evictPrefix(address patricia.IPv4Address) error {
+	matchAll := func(bool, bool) bool { return true }
+	var none bool
+	var candidates []evictionCandidateV4
+	var prefixes []PrefixCandidate
+	for t.prefixCount >= t.config.maxPrefixes {
+		candidates = t.evictionCandidates(candidates[:0])
+		evictIndex := -1
+		switch t.config.prefixLimitPolicy {
+		case PrefixLimitEvictLRU:
+			for i, candidate := range candidates {
+				if !t.hasLiveTags(candidate.nodeIndex) {
+					evictIndex = i
+					break
+				}
+				if evictIndex < 0 || candidate.lastHit < candidates[evictIndex].lastHit {
+					evictIndex = i
 				}
 			}
+		case PrefixLimitEvictFunc:
+			prefixes = prefixes[:0]
+			for _, candidate := range candidates {
+				prefixes = append(prefixes, PrefixCandidate{
+					Prefix:  candidate.prefix.Address().Prefix(),
+					Tags:    t.nodeTags(candidate.nodeIndex),
+					LastHit: candidate.lastHit,
+				})
+			}
+			evictIndex = t.config.prefixEvictFunc(prefixes, address.Prefix())
+		}
+		if evictIndex < 0 || evictIndex >= len(candidates) {
+			return ErrPrefixLimitReached
+		}
+		if _, err := t.Delete(candidates[evictIndex].prefix.Address(), matchAll, none); err != nil {
+			return err
 		}
-		t.tags[key+(uint64(tagCount))] = tag
-		t.nodes[nodeIndex].TagCount++
+	}
+	return nil
+}
+
+// a prefix a tree could evict to make room for a new one
+type evictionCandidateV4 struct {
+	nodeIndex uint
+	prefix    treeNodeV4 // the full prefix
+	lastHit   uint64
+}
 
+// append prefixes with tags to ret, as candidates for eviction, returning it - a run of them, in Walk order, from the
+// end of a random path down from the root, wrapping around past the last
+func (t *TreeV4) evictionCandidates(ret []evictionCandidateV4) []evictionCandidateV4 {
+	var start treeNodeV4
+	var choices uint64
+	choiceBits := 0
+	for nodeIndex := uint(1); nodeIndex != 0; {
+		node := &t.nodes[nodeIndex]
+		prefix := start
+		prefix.MergeFromNodes(&start, node)
+		start = prefix
+
+		// take a random side where there are two
+		switch {
+		case node.Left == 0:
+			nodeIndex = uint(node.Right)
+		case node.Right == 0:
+			nodeIndex = uint(node.Left)
+		default:
+			if choiceBits == 0 {
+				choices, choiceBits = rand.Uint64(), 64
+			}
+			nodeIndex = uint(node.Left)
+			if choices&1 != 0 {
+				nodeIndex = uint(node.Right)
+			}
+			choices, choiceBits = choices>>1, choiceBits-1
+		}
+	}
+
+	visit := func(nodeIndex uint, prefix treeNodeV4) bool {
+		if t.nodes[nodeIndex].TagCount > 0 {
+			candidate := evictionCandidateV4{nodeIndex: nodeIndex, prefix: prefix}
+			if int(nodeIndex) < len(t.hits) {
+				candidate.lastHit = atomic.LoadUint64(&t.hits[nodeIndex])
+			}
+			ret = append(ret, candidate)
+		}
+		return len(ret) < _evictionSampleSize
+	}
+	if t.walkNodesAfter(1, treeNodeV4{}, &start, visit) {
+		t.walkNodes(1, treeNodeV4{}, func(nodeIndex uint, prefix treeNodeV4) bool {
+			return prefix.comparePrefix(&start) <= 0 && visit(nodeIndex, prefix)
+		})
 	}
 	return ret
 }
+
+// record that a lookup hit the prefix at the input node, for trees that track hits
+// - lookups can run at the same time, in this tree and its snapshots, which share the hits until either changes
+func (t *TreeV4) hit(nodeIndex uint) {
+	if nodeIndex < uint(len(t.hits)) {
+		atomic.StoreUint64(&t.hits[nodeIndex], t.hitClock)
+	}
+}
+
+// returns how many tags the node at the input index has, or 0 if there's no such node - see tagCounter
+func (t *TreeV4) nodeTagCount(nodeIndex uint) int {
+	if nodeIndex >= uint(len(t.nodes)) {
+		return 0
+	}
+	return t.nodes[nodeIndex].TagCount
+}
+
+// returns the tags at the input node, expired or not, which belong to the tree
+func (t *TreeV4) nodeTags(nodeIndex uint) []bool {
+	return t.tags.get(nodeIndex, t.nodes[nodeIndex].TagCount)
+}
+
+// returns the expiration times of the tags at the input node, or nil if none of them expire
+func (t *TreeV4) nodeExpirations(nodeIndex uint) []int64 {
+	return t.tags.nodeExpirations(nodeIndex, t.nodes[nodeIndex].TagCount)
+}
+
+// returns the expiration time of the input node's tag at index i, or 0 if it doesn't expire
+func (t *TreeV4) tagExpiration(nodeIndex uint, i int) int64 {
+	if expirations := t.nodeExpirations(nodeIndex); expirations != nil {
+		return expirations[i]
+	}
+	return 0
+}
+
+// add a tag to the end of the input node's tags, along with its expiration time (0 for none)
+// - in trees made WithInlineTag, this replaces the node's tag, if it has one
+// - returns ErrTreeFull, leaving the node as it was, if a tree made WithPackedTags has no room left for it
+func (t *TreeV4) appendTag(nodeIndex uint, tag bool, expiresAt int64) error {
+	tagCount := t.nodes[nodeIndex].TagCount
+	added, err := t.tags.appendTag(t, nodeIndex, tagCount, tag, expiresAt)
+	if err != nil || !added {
+		return err
+	}
+	t.nodes[nodeIndex].TagCount++
+	t.tagCount++
+	if tagCount == 0 {
+		t.prefixCount++
+	}
+	return nil
+}
+
+// replace the input node's tag at index i, along with its expiration time (0 for none)
+func (t *TreeV4) setTag(nodeIndex uint, i int, tag bool, expiresAt int64) {
+	t.tags.setTag(nodeIndex, t.nodes[nodeIndex].TagCount, i, tag, expiresAt)
+}
+
+// set the expiration time of the input node's tag at index i (0 for none)
+func (t *TreeV4) setExpiration(nodeIndex uint, i int, expiresAt int64) {
+	t.tags.setExpiration(nodeIndex, t.nodes[nodeIndex].TagCount, i, expiresAt)
+}
+
+// keep the tags at the input node that keep says to, in order, along with their expiration times, returning how many were removed
+// - keep may replace the tag at index i before returning true
+func (t *TreeV4) keepTags(nodeIndex uint, keep func(i int, tag *bool) bool) int {
+	tagCount := t.nodes[nodeIndex].TagCount
+	keepCount := t.tags.keep(nodeIndex, tagCount, keep)
+	if keepCount == tagCount {
+		return 0
+	}
+	t.nodes[nodeIndex].TagCount = keepCount
+	t.tagCount -= tagCount - keepCount
+	if keepCount == 0 {
+		t.prefixCount--
+	}
+	return tagCount - keepCount
+}
+
+// whether the input node has any tags that haven't expired
+func (t *TreeV4) hasLiveTags(nodeIndex uint) bool {
+	expirations := t.nodeExpirations(nodeIndex)
+	if expirations == nil {
+		return t.nodes[nodeIndex].TagCount > 0
+	}
+
+	now := time.Now().UnixNano()
+	for _, expiresAt := range expirations {
+		if !expired(expiresAt, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the tags for the input node, skipping expired ones
 func (t *TreeV4) tagsForNode(nodeIndex uint) []bool {
 	if ret := t.tagsForNodeAppend(nil, nodeIndex); ret != nil {
 		return ret
@@ -88,317 +472,1072 @@ func (t *TreeV4) tagsForNode(nodeIndex uint) []bool {
 	}
 }
 
+// call tagFunc for each of the input node's tags that haven't expired, returning false if it did
+func (t *TreeV4) visitNodeTags(nodeIndex uint, tagFunc func(tag bool) bool) bool {
+	tags := t.nodeTags(nodeIndex)
+	expirations := t.nodeExpirations(nodeIndex)
+	var now int64
+	if expirations != nil {
+		now = time.Now().UnixNano()
+	}
+	for i, tag := range tags {
+		if (expirations == nil || !expired(expirations[i], now)) && !tagFunc(tag) {
+			return false
+		}
+	}
+	return true
+}
+
 func (t *TreeV4) tagsForNodeAppend(ret []bool, nodeIndex uint) []bool {
 	if nodeIndex == 0 {
 		return ret
 	}
 
-	// TODO: clean up the typing in here, between uint, uint64
+	tags := t.nodeTags(nodeIndex)
+	expirations := t.nodeExpirations(nodeIndex)
+	if expirations == nil {
+		return append(ret, tags...)
+	}
+
+	now := time.Now().UnixNano()
+	for i, tag := range tags {
+		if !expired(expirations[i], now) {
+			ret = append(ret, tag)
+		}
+	}
+	return ret
+}
+
+// move all of the tags at one node to another that has none
+func (t *TreeV4) moveTags(fromIndex uint, toIndex uint) {
+	tagCount := t.nodes[fromIndex].TagCount
+	if tagCount == 0 {
+		return
+	}
+	if int(fromIndex) < len(t.hits) {
+		t.hits = growSlots(t.hits, toIndex)
+		t.hits[toIndex] = max(t.hits[toIndex], t.hits[fromIndex])
+	}
+	t.tags.move(fromIndex, toIndex, tagCount)
+	t.nodes[toIndex].TagCount = tagCount
+	t.nodes[fromIndex].TagCount = 0
+}
+
+// returns the first tag for the input node that hasn't expired, and whether there is one
+func (t *TreeV4) firstTagForNode(nodeIndex uint) (bool, bool) {
+	tags := t.nodeTags(nodeIndex)
+	expirations := t.nodeExpirations(nodeIndex)
+	if expirations == nil {
+		if len(tags) > 0 {
+			return tags[0], true
+		}
+	} else {
+		now := time.Now().UnixNano()
+		for i, tag := range tags {
+			if !expired(expirations[i], now) {
+				return tag, true
+			}
+		}
+	}
+	var ret bool
+	return ret, false
+}
+
+// remove all tags from the input node, along with the room for them
+func (t *TreeV4) clearTags(nodeIndex uint) {
 	tagCount := t.nodes[nodeIndex].TagCount
-	key := uint64(nodeIndex) << 32
-	for i := 0; i < tagCount; i++ {
-		ret = append(ret, t.tags[key+uint64(i)])
+	if tagCount == 0 {
+		return
+	}
+	t.tags.clearNode(nodeIndex, tagCount)
+	t.tagCount -= tagCount
+	t.prefixCount--
+	t.nodes[nodeIndex].TagCount = 0
+}
+
+// delete tags at the input node, returning how many were deleted, and how many are left
+func (t *TreeV4) deleteTag(nodeIndex uint, matchTag bool, matchFunc MatchesFunc) (int, int) {
+	deleteCount := t.keepTags(nodeIndex, func(_ int, tag *bool) bool {
+		return !matchFunc(*tag, matchTag)
+	})
+	return deleteCount, t.nodes[nodeIndex].TagCount
+}
+
+// rewrite the tags at the input node with updateFunc, dropping those it rejects
+// - returns how many tags were kept, and how many were dropped
+func (t *TreeV4) updateTags(nodeIndex uint, updateFunc UpdateFunc) (int, int) {
+	dropCount := t.keepTags(nodeIndex, func(_ int, tag *bool) bool {
+		newTag, keep := updateFunc(*tag)
+		if keep {
+			*tag = newTag
+		}
+		return keep
+	})
+	return t.nodes[nodeIndex].TagCount, dropCount
+}
+
+// delete expired tags from the input node, returning how many were deleted
+func (t *TreeV4) expireTags(nodeIndex uint, now int64) int {
+	expirations := t.nodeExpirations(nodeIndex)
+	if expirations == nil {
+		return 0
+	}
+	return t.keepTags(nodeIndex, func(i int, _ *bool) bool {
+		return !expired(expirations[i], now)
+	})
+}
+
+// Set the single value for a node - overwrites what's there
+// Returns whether the tag count at this address was increased, and how many tags at this address
+func (t *TreeV4) Set(address patricia.IPv4Address, tag bool) (bool, int, error) {
+	return t.add(address, tag, nil, true, 0)
+}
+
+// Upsert sets the single value for a node, like Set, returning the value it replaced, and whether there was one
+func (t *TreeV4) Upsert(address patricia.IPv4Address, tag bool) (bool, bool, error) {
+	var previous bool
+	existed := false
+	nodeIndex, _, err := t.findNode(address)
+	if err != nil {
+		return previous, false, err
+	}
+	if nodeIndex != 0 && t.nodes[nodeIndex].TagCount > 0 {
+		previous, existed = t.firstTagForNode(nodeIndex)
+	}
+
+	_, _, err = t.add(address, tag, nil, true, 0)
+	return previous, existed, err
+}
+
+// Add adds a tag to the tree
+// - in single-tag mode, this replaces the node's tag, like Set
+// - if matchFunc is non-nil, it will be used to ensure uniqueness at this node
+// - returns whether the tag count at this address was increased, and how many tags at this address
+func (t *TreeV4) Add(address patricia.IPv4Address, tag bool, matchFunc MatchesFunc) (bool, int, error) {
+	return t.add(address, tag, matchFunc, false, 0)
+}
+
+// AddWithExpiry adds a tag to the tree that expires at expiresAt
+// - once expired, the tag is skipped by queries, and deleted by Sweep - until then, it's still counted by CountTags
+// - if matchFunc is non-nil, it will be used to ensure uniqueness at this node: an existing matching tag gets the new expiration time
+// - a zero expiresAt means the tag never expires, as if it was added with Add, so an existing matching tag keeps its time
+// - returns whether the tag count at this address was increased, and how many tags at this address
+func (t *TreeV4) AddWithExpiry(address patricia.IPv4Address, tag bool, expiresAt time.Time, matchFunc MatchesFunc) (bool, int, error) {
+	return t.add(address, tag, matchFunc, false, expiryNanos(expiresAt))
+}
+
+// Sweep deletes expired tags from the tree, along with any nodes they leave empty
+// - returns how many tags were deleted
+func (t *TreeV4) Sweep() int {
+	if t.tags.expiring == 0 || t.frozen != nil {
+		return 0
+	}
+	t.startChange()
+
+	now := time.Now().UnixNano()
+	deleteCount := t.sweep(now)
+	if deleteCount > 0 {
+		t.logSweep(now)
+	}
+	return deleteCount
+}
+
+// delete tags that expired by now, along with any nodes they leave empty, returning how many were deleted
+func (t *TreeV4) sweep(now int64) int {
+	if t.hooks != nil {
+		defer t.hookEntries(t.hookExpired(now), ChangeDelete)
+	}
+	deleteCount := 0
+	for nodeIndex := 1; nodeIndex < len(t.nodes); nodeIndex++ {
+		if t.nodes[nodeIndex].TagCount > 0 {
+			deleteCount += t.expireTags(uint(nodeIndex), now)
+		}
+	}
+	if deleteCount > 0 {
+		t.compactSubtree(1, 1)
+	}
+	return deleteCount
+}
+
+// AddIfAbsent adds a tag to the tree, unless an equal tag is already at this address
+// - if matchFunc is nil, tags are compared with ==
+// - returns whether the tag was added
+func (t *TreeV4) AddIfAbsent(address patricia.IPv4Address, tag bool, matchFunc MatchesFunc) (bool, error) {
+	if matchFunc == nil {
+		matchFunc = equalTags
+	}
+	added, _, err := t.add(address, tag, matchFunc, false, 0)
+	return added, err
+}
+
+// add a tag to the tree, optionally as the single value
+// - overwrites the first value in the list if 'replaceFirst' is true
+// - expiresAt is the tag's expiration time as UnixNano, or 0 if it doesn't expire
+// - returns whether the tag count was increased, and the number of tags at this address
+func (t *TreeV4) add(address patricia.IPv4Address, tag bool, matchFunc MatchesFunc, replaceFirst bool, expiresAt int64) (bool, int, error) {
+	if t.frozen != nil {
+		return false, 0, ErrFrozen
+	}
+	if t.config.maxPrefixes > 0 && t.prefixCount >= t.config.maxPrefixes {
+		if nodeIndex, _, _ := t.findNode(address); nodeIndex == 0 || t.nodes[nodeIndex].TagCount == 0 {
+			if err := t.evictPrefix(address); err != nil {
+				return false, 0, err
+			}
+		}
+	}
+	t.startChange()
+	if t.changeLog != nil {
+		defer t.logTags(address)
+	}
+	if t.hooks != nil {
+		defer t.hookChanges(address, t.hookTags(address))
+	}
+
+	if t.config.singleTag {
+		replaceFirst = true
+	}
+
+	// handle root tags
+	if address.Length == 0 {
+		countIncreased, err := t.addTag(tag, 1, matchFunc, replaceFirst, expiresAt)
+		return countIncreased, t.nodes[1].TagCount, err
+	}
+
+	// nodes are only ever referred to by index here, never by pointer, as adding a node can grow the array, moving them all
+
+	// root node doesn't have any prefix, so find the starting point
+	nodeIndex := uint(t.nodes[1].Right)
+	if !address.IsLeftBitSet() {
+		nodeIndex = uint(t.nodes[1].Left)
+	}
+	if nodeIndex == 0 {
+		newNodeIndex, err := t.newNode(address, address.Length)
+		if err != nil {
+			return false, 0, fmt.Errorf("adding %s: %w", address, err)
+		}
+		countIncreased, err := t.addTag(tag, newNodeIndex, matchFunc, replaceFirst, expiresAt)
+		if err != nil {
+			t.releaseNode(newNodeIndex)
+			return false, 0, err
+		}
+		t.setChild(1, address.IsLeftBitSet(), newNodeIndex)
+		return countIncreased, t.nodes[newNodeIndex].TagCount, err
+	}
+
+	parentIndex := uint(1)
+	for {
+		// sanity checks before we change anything - a corrupt tree returns an error, rather than making things worse
+		// - checking the index against a local copy of the slice proves it's in range, so indexing isn't checked again
+		nodes := t.nodes
+		if nodeIndex == 0 || nodeIndex >= uint(len(nodes)) {
+			return false, 0, fmt.Errorf("%w: node %d links to invalid node index %d, looking for %s", ErrCorruptTree, parentIndex, nodeIndex, address)
+		}
+		node := &nodes[nodeIndex]
+		if _debugChecks {
+			if uint(nodes[parentIndex].Left) != nodeIndex && uint(nodes[parentIndex].Right) != nodeIndex {
+				return false, 0, fmt.Errorf("%w: node %d isn't a child of its parent node %d, looking for %s", ErrCorruptTree, nodeIndex, parentIndex, address)
+			}
+			if node.length() == 0 {
+				return false, 0, fmt.Errorf("%w: node %d has no prefix, looking for %s", ErrCorruptTree, nodeIndex, address)
+			}
+		}
+
+		// a node without a prefix matches nothing, so this catches those too
+		matchCount := node.MatchCount(address)
+		if matchCount == 0 {
+			return false, 0, fmt.Errorf("%w: traversed to node %d with no prefix match - node prefix length: %d; address prefix length: %d", ErrCorruptTree, nodeIndex, node.length(), address.Length)
+		}
+
+		if matchCount == address.Length {
+			// all the bits in the address matched
+
+			if matchCount == node.length() {
+				// the whole prefix matched - we're done!
+				countIncreased, err := t.addTag(tag, nodeIndex, matchFunc, replaceFirst, expiresAt)
+				return countIncreased, t.nodes[nodeIndex].TagCount, err
+			}
+
+			// the input address is shorter than the match found - need to create a new, intermediate parent
+			newNodeIndex, err := t.newNode(address, address.Length)
+			if err != nil {
+				return false, 0, fmt.Errorf("adding %s: %w", address, err)
+			}
+			countIncreased, err := t.addTag(tag, newNodeIndex, matchFunc, replaceFirst, expiresAt)
+			if err != nil {
+				t.releaseNode(newNodeIndex)
+				return false, 0, err
+			}
+
+			// the existing node loses those matching bits, and becomes a child of the new node - found again, as adding a
+			// node can have moved it
+			node = &t.nodes[nodeIndex]
+			node.ShiftPrefix(matchCount)
+			t.setChild(newNodeIndex, node.IsLeftBitSet(), nodeIndex)
+
+			// now give this new node a home
+			t.replaceChild(parentIndex, nodeIndex, newNodeIndex)
+			return countIncreased, t.nodes[newNodeIndex].TagCount, err
+		}
+
+		if matchCount == node.length() {
+			// partial match - we have to keep traversing
+
+			// chop off what's matched so far
+			address.ShiftLeft(matchCount)
+
+			childIndex := uint(node.Right)
+			if !address.IsLeftBitSet() {
+				childIndex = uint(node.Left)
+			}
+			if childIndex == 0 {
+				// nowhere else to go - create a new node here
+				newNodeIndex, err := t.newNode(address, address.Length)
+				if err != nil {
+					return false, 0, fmt.Errorf("adding %s: %w", address, err)
+				}
+				countIncreased, err := t.addTag(tag, newNodeIndex, matchFunc, replaceFirst, expiresAt)
+				if err != nil {
+					t.releaseNode(newNodeIndex)
+					return false, 0, err
+				}
+				t.setChild(nodeIndex, address.IsLeftBitSet(), newNodeIndex)
+				return countIncreased, t.nodes[newNodeIndex].TagCount, err
+			}
+
+			// there's a node that way - traverse it
+			parentIndex = nodeIndex
+			nodeIndex = childIndex
+			continue
+		}
+
+		// partial match with this node - need to split this node
+		newCommonParentNodeIndex, err := t.newNode(address, matchCount)
+		if err != nil {
+			return false, 0, fmt.Errorf("adding %s: %w", address, err)
+		}
+
+		// shift
+		address.ShiftLeft(matchCount)
+
+		newNodeIndex, err := t.newNode(address, address.Length)
+		if err != nil {
+			t.releaseNode(newCommonParentNodeIndex)
+			return false, 0, fmt.Errorf("adding %s: %w", address, err)
+		}
+		countIncreased, err := t.addTag(tag, newNodeIndex, matchFunc, replaceFirst, expiresAt)
+		if err != nil {
+			t.releaseNode(newNodeIndex)
+			t.releaseNode(newCommonParentNodeIndex)
+			return false, 0, err
+		}
+
+		// see where the existing node fits - left or right - and the new node goes the other way
+		node = &t.nodes[nodeIndex]
+		node.ShiftPrefix(matchCount)
+		t.setChild(newCommonParentNodeIndex, node.IsLeftBitSet(), nodeIndex)
+		t.setChild(newCommonParentNodeIndex, !node.IsLeftBitSet(), newNodeIndex)
+
+		// now determine where the new node belongs
+		t.replaceChild(parentIndex, nodeIndex, newCommonParentNodeIndex)
+		return countIncreased, t.nodes[newNodeIndex].TagCount, err
+	}
+}
+
+// give a node that newNode made, but that was never linked in, back for it to make again
+func (t *TreeV4) releaseNode(nodeIndex uint) {
+	t.nodes[nodeIndex] = treeNodeV4{}
+	t.availableIndexes = append(t.availableIndexes, treeIndex(nodeIndex))
+}
+
+// set the left child of the node at the input index, or the right one if right is true
+func (t *TreeV4) setChild(nodeIndex uint, right bool, childIndex uint) {
+	if right {
+		t.nodes[nodeIndex].Right = treeIndex(childIndex)
+	} else {
+		t.nodes[nodeIndex].Left = treeIndex(childIndex)
+	}
+}
+
+// replace the node's child at oldIndex with the one at newIndex
+func (t *TreeV4) replaceChild(nodeIndex uint, oldIndex uint, newIndex uint) {
+	t.setChild(nodeIndex, uint(t.nodes[nodeIndex].Left) != oldIndex, newIndex)
+}
+
+// Delete a tag from the tree if it matches matchVal, as determined by matchFunc. Returns how many tags are removed
+func (t *TreeV4) Delete(address patricia.IPv4Address, matchFunc MatchesFunc, matchVal bool) (int, error) {
+	if t.frozen != nil {
+		return 0, ErrFrozen
+	}
+	t.startChange()
+	if t.changeLog != nil {
+		defer t.logTags(address)
+	}
+	if t.hooks != nil {
+		defer t.hookChanges(address, t.hookTags(address))
+	}
+
+	// traverse the tree, finding the node and its parent
+	targetNodeIndex, parentIndex, err := t.findNode(address)
+	if err != nil {
+		return 0, err
+	}
+	if targetNodeIndex == 0 || t.nodes[targetNodeIndex].TagCount == 0 {
+		// no tags found
+		return 0, nil
+	}
+
+	// delete matching tags
+	deleteCount, remainingTagCount := t.deleteTag(targetNodeIndex, matchVal, matchFunc)
+	if remainingTagCount > 0 {
+		// target node still has tags - we're not deleting it
+		return deleteCount, nil
+	}
+
+	return deleteCount, t.removeNode(targetNodeIndex, parentIndex)
+}
+
+// UpdateTags rewrites each tag at the exact node for the input address with updateFunc
+// - tags for which updateFunc returns false are dropped
+// - returns how many tags were kept, and how many were dropped
+func (t *TreeV4) UpdateTags(address patricia.IPv4Address, updateFunc UpdateFunc) (int, int, error) {
+	if t.frozen != nil {
+		return 0, 0, ErrFrozen
+	}
+	t.startChange()
+	if t.changeLog != nil {
+		defer t.logTags(address)
+	}
+	if t.hooks != nil {
+		defer t.hookChanges(address, t.hookTags(address))
+	}
+
+	targetNodeIndex, parentIndex, err := t.findNode(address)
+	if err != nil {
+		return 0, 0, err
+	}
+	if targetNodeIndex == 0 || t.nodes[targetNodeIndex].TagCount == 0 {
+		// no tags found
+		return 0, 0, nil
+	}
+
+	keepCount, dropCount := t.updateTags(targetNodeIndex, updateFunc)
+	if keepCount == 0 {
+		err = t.removeNode(targetNodeIndex, parentIndex)
+	}
+	return keepCount, dropCount, err
+}
+
+// MapTags returns a new tree with every tag rewritten by mapFunc, leaving this tree untouched
+// - tags for which mapFunc returns false are dropped, along with any nodes that leaves empty
+// - the new tree has the same prefixes otherwise, the same tag order and expiration times, and the same options
+func (t *TreeV4) MapTags(mapFunc UpdateFunc) *TreeV4 {
+	ret := t.Clone()
+	dropCount := 0
+	for nodeIndex := 1; nodeIndex < len(ret.nodes); nodeIndex++ {
+		if ret.nodes[nodeIndex].TagCount > 0 {
+			_, dropped := ret.updateTags(uint(nodeIndex), mapFunc)
+			dropCount += dropped
+		}
+	}
+	if dropCount > 0 {
+		ret.compactSubtree(1, 1)
+	}
+	return ret
+}
+
+// Prune deletes everything strictly more specific than the input address, keeping the address's own tags
+// - returns how many tagged prefixes, and how many tags were deleted
+func (t *TreeV4) Prune(address patricia.IPv4Address) (int, int, error) {
+	if t.frozen != nil {
+		return 0, 0, ErrFrozen
+	}
+	t.startChange()
+	if t.changeLog != nil {
+		defer t.logPrune(address)
+	}
+	if t.hooks != nil {
+		defer t.hookEntries(t.hookSubtree(address, true), ChangeDelete)
+	}
+
+	if address.Length == 0 {
+		// everything but the root
+		root := &t.nodes[1]
+		leftPrefixCount, leftTagCount := t.deleteSubtree(uint(root.Left))
+		rightPrefixCount, rightTagCount := t.deleteSubtree(uint(root.Right))
+		root.Left = 0
+		root.Right = 0
+		return leftPrefixCount + rightPrefixCount, leftTagCount + rightTagCount, nil
+	}
+
+	root := &t.nodes[1]
+	parentIndex := uint(1)
+	grandparentIndex := uint(1)
+	var nodeIndex uint
+	if !address.IsLeftBitSet() {
+		nodeIndex = uint(root.Left)
+	} else {
+		nodeIndex = uint(root.Right)
+	}
+
+	// traverse the tree
+	for {
+		if nodeIndex == 0 {
+			return 0, 0, nil
+		}
+
+		node := &t.nodes[nodeIndex]
+		matchCount := node.MatchCount(address)
+		if matchCount == address.Length {
+			if matchCount == node.length() {
+				// exact match - delete its children, and the node itself if it has nothing left
+				leftPrefixCount, leftTagCount := t.deleteSubtree(uint(node.Left))
+				rightPrefixCount, rightTagCount := t.deleteSubtree(uint(node.Right))
+				node.Left = 0
+				node.Right = 0
+				var err error
+				if node.TagCount == 0 {
+					err = t.removeNode(nodeIndex, parentIndex)
+				}
+				return leftPrefixCount + rightPrefixCount, leftTagCount + rightTagCount, err
+			}
+
+			// this node is strictly more specific than the address - delete it entirely
+			prefixCount, tagCount := t.deleteSubtree(nodeIndex)
+			parent := &t.nodes[parentIndex]
+			if uint(parent.Left) == nodeIndex {
+				parent.Left = 0
+			} else {
+				parent.Right = 0
+			}
+			var err error
+			if parent.TagCount == 0 {
+				// parent was only here to split its children - it's left with one
+				err = t.removeNode(parentIndex, grandparentIndex)
+			}
+			return prefixCount, tagCount, err
+		}
+		if matchCount < node.length() {
+			// didn't match the entire node - nothing below the address
+			return 0, 0, nil
+		}
+
+		// there's still more address - keep traversing
+		grandparentIndex = parentIndex
+		parentIndex = nodeIndex
+		address.ShiftLeft(matchCount)
+		if !address.IsLeftBitSet() {
+			nodeIndex = uint(node.Left)
+		} else {
+			nodeIndex = uint(node.Right)
+		}
+	}
+}
+
+// delete the node at the input index and all of its descendants, freeing their indexes
+// - doesn't unlink the node from its parent
+// - returns how many tagged prefixes, and how many tags were deleted
+func (t *TreeV4) deleteSubtree(nodeIndex uint) (int, int) {
+	if nodeIndex == 0 {
+		return 0, 0
+	}
+
+	// the nodes still to delete - each one's children are found before it's cleared
+	var buf [_walkStackSize]uint
+	stack := append(buf[:0], nodeIndex)
+	prefixCount, tagCount := 0, 0
+	for len(stack) > 0 {
+		nodeIndex = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		node := &t.nodes[nodeIndex]
+		if node.TagCount > 0 {
+			prefixCount++
+			tagCount += node.TagCount
+		}
+		if node.Right != 0 {
+			stack = append(stack, uint(node.Right))
+		}
+		if node.Left != 0 {
+			stack = append(stack, uint(node.Left))
+		}
+
+		t.clearTags(nodeIndex)
+		t.nodes[nodeIndex] = treeNodeV4{}
+		t.availableIndexes = append(t.availableIndexes, treeIndex(nodeIndex))
+	}
+	return prefixCount, tagCount
+}
+
+// remove the nodes in the subtree at the input index that are left without tags, and without two children to split between
+// - the root node is never removed
+func (t *TreeV4) compactSubtree(nodeIndex uint, parentIndex uint) {
+	// the nodes still to look at, each after its children, which are pushed the first time it comes off the stack
+	type compactNode struct {
+		nodeIndex   uint
+		parentIndex uint
+		expanded    bool
+	}
+	var buf [2 * _walkStackSize]compactNode
+	stack := append(buf[:0], compactNode{nodeIndex: nodeIndex, parentIndex: parentIndex})
+	for len(stack) > 0 {
+		next := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		nodeIndex, parentIndex = next.nodeIndex, next.parentIndex
+		node := &t.nodes[nodeIndex]
+		if !next.expanded {
+			stack = append(stack, compactNode{nodeIndex: nodeIndex, parentIndex: parentIndex, expanded: true})
+			if node.Right != 0 {
+				stack = append(stack, compactNode{nodeIndex: uint(node.Right), parentIndex: nodeIndex})
+			}
+			if node.Left != 0 {
+				stack = append(stack, compactNode{nodeIndex: uint(node.Left), parentIndex: nodeIndex})
+			}
+			continue
+		}
+		if nodeIndex == 1 || node.TagCount > 0 || (node.Left != 0 && node.Right != 0) {
+			continue
+		}
+
+		// replace this node with its only child, if it has one
+		childIndex := node.Left
+		if childIndex == 0 {
+			childIndex = node.Right
+		}
+		if childIndex != 0 {
+			child := &t.nodes[childIndex]
+			child.MergeFromNodes(node, child)
+		}
+
+		parent := &t.nodes[parentIndex]
+		if uint(parent.Left) == nodeIndex {
+			parent.Left = childIndex
+		} else {
+			parent.Right = childIndex
+		}
+
+		*node = treeNodeV4{}
+		t.availableIndexes = append(t.availableIndexes, treeIndex(nodeIndex))
+	}
+}
+
+// Graft adds all tags from src to the tree, with src's prefixes interpreted relative to the input address
+// - src's prefixes are appended to the address's bits, so grafting at /0 copies them as-is
+// - if matchFunc is non-nil, it will be used to ensure uniqueness at each node
+// - tag expiration times are kept
+// - every prefix is checked before anything's added, so a graft with one that'd be too long leaves the tree as it was
+// - where the tree has no prefixes at or below the address, and there's no matchFunc, change log, hooks, or prefix
+// limit to see to, a copy of src's nodes is linked in as it is, rather than its tags being added one at a time
+// - returns how many tags were added
+func (t *TreeV4) Graft(address patricia.IPv4Address, src *TreeV4, matchFunc MatchesFunc) (int, error) {
+	return t.graft(context.Background(), address, src, matchFunc)
+}
+
+// Graft, stopping once ctx is done - see GraftContext
+func (t *TreeV4) graft(ctx context.Context, address patricia.IPv4Address, src *TreeV4, matchFunc MatchesFunc) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := t.validateAddress(address); err != nil {
+		return 0, err
+	}
+	if t.frozen != nil {
+		return 0, ErrFrozen
+	}
+	if src == t {
+		src = t.Clone()
+	}
+
+	// start with the graft point, masked to its length
+	var graftPoint treeNodeV4
+	addressNode := treeNodeV4FromAddress(address)
+	graftPoint.MergeFromNodes(&graftPoint, &addressNode)
+
+	// make sure all of src's prefixes fit below the graft point before changing anything
+	var err error
+	src.walkNodes(1, graftPoint, func(nodeIndex uint, prefix treeNodeV4) bool {
+		if src.nodes[nodeIndex].TagCount > 0 {
+			err = t.validateAddress(prefix.Address())
+		}
+		return err == nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	t.startChange()
+
+	if matchFunc == nil && !t.config.singleTag && t.config.maxPrefixes == 0 && t.changeLog == nil && t.hooks == nil {
+		spliced, err := t.splice(address, graftPoint, src)
+		if err != nil {
+			return 0, err
+		}
+		if spliced {
+			return src.tagCount, nil
+		}
+	}
+
+	// make room for everything up front, rather than growing along the way
+	t.reserveNodes(len(src.nodes) * 2)
+
+	addCount := 0
+	check := contextCheck{ctx: ctx}
+	src.walkNodes(1, graftPoint, func(nodeIndex uint, prefix treeNodeV4) bool {
+		if err = check.step(); err != nil {
+			return false
+		}
+		nodeAddress := prefix.Address()
+		for i, tag := range src.nodeTags(nodeIndex) {
+			countIncreased, _, addErr := t.add(nodeAddress, tag, matchFunc, false, src.tagExpiration(nodeIndex, i))
+			if addErr != nil {
+				err = addErr
+				return false
+			}
+			if countIncreased {
+				addCount++
+			}
+		}
+		return true
+	})
+	return addCount, err
+}
+
+// link a copy of src's nodes into the tree at the input address, whose full prefix is graftPoint, for Graft
+// - returns false, having changed nothing, if the tree has prefixes at or below the address, or if src's tags can't be
+// copied in as they are
+func (t *TreeV4) splice(address patricia.IPv4Address, graftPoint treeNodeV4, src *TreeV4) (bool, error) {
+	if !t.tags.hasRoom(src.tagCount) || uint64(len(t.nodes)+len(src.nodes)) > _maxTreeIndex {
+		return false, nil
+	}
+	if src.tags.interner != nil && !t.tags.intern {
+		// src's interned tags would be shared by nodes that change them in place
+		return false, nil
+	}
+
+	// the node to link in is a copy of src's root, at the graft point, unless it has no tags and only one child, which
+	// goes in its place
+	root := &src.nodes[1]
+	topIndex := uint(1)
+	if root.TagCount == 0 {
+		if root.Left == 0 && root.Right == 0 {
+			return true, nil
+		}
+		if root.Left == 0 || root.Right == 0 {
+			topIndex = uint(root.Left | root.Right)
+		}
+	}
+
+	if address.Length == 0 {
+		// src's root becomes the tree's, which has to be empty
+		if t.nodes[1].TagCount > 0 || t.nodes[1].Left != 0 || t.nodes[1].Right != 0 {
+			return false, nil
+		}
+		t.reserveNodes(len(src.nodes))
+		var copier tagCopier
+		t.tags.copyNode(&src.tags, 1, 1, root.TagCount, &copier)
+		t.tags.share(1, root.TagCount)
+		t.nodes[1].TagCount = root.TagCount
+		for _, childIndex := range [2]uint{uint(root.Left), uint(root.Right)} {
+			if childIndex != 0 {
+				nodeIndex := t.copySubtree(src, childIndex, &copier)
+				t.setChild(1, t.nodes[nodeIndex].IsLeftBitSet(), nodeIndex)
+			}
+		}
+		t.prefixCount += src.prefixCount
+		t.tagCount += src.tagCount
+		return true, nil
+	}
+
+	// find the deepest node above the address, and the node, if any, on the address's side of it, which mustn't be at
+	// or below the address, but can share some of its bits, and have to be split from it where they part
+	parentIndex, parentLength := uint(1), uint(0)
+	remaining := address
+	var siblingIndex, matchCount uint
+	for {
+		childIndex := uint(t.nodes[parentIndex].Right)
+		if !remaining.IsLeftBitSet() {
+			childIndex = uint(t.nodes[parentIndex].Left)
+		}
+		if childIndex == 0 {
+			break
+		}
+		if childIndex >= uint(len(t.nodes)) {
+			return false, fmt.Errorf("%w: node %d links to invalid node index %d, looking for %s", ErrCorruptTree, parentIndex, childIndex, address)
+		}
+		node := &t.nodes[childIndex]
+		matchCount = node.MatchCount(remaining)
+		if matchCount == remaining.Length {
+			return false, nil
+		}
+		if matchCount < node.length() {
+			siblingIndex = childIndex
+			break
+		}
+		parentIndex = childIndex
+		parentLength += matchCount
+		remaining.ShiftLeft(matchCount)
+	}
+
+	// room for the copy, and a node to split the sibling from it, so they don't move while they're linked in
+	t.reserveNodes(len(src.nodes) + 1)
+	var splitIndex uint
+	if siblingIndex != 0 {
+		var err error
+		if splitIndex, err = t.newNode(remaining, matchCount); err != nil {
+			return false, err
+		}
+	}
+	var copier tagCopier
+	topNodeIndex := t.copySubtree(src, topIndex, &copier)
+	top := &t.nodes[topNodeIndex]
+	top.MergeFromNodes(&graftPoint, top)
+	top.ShiftPrefix(parentLength)
+	if siblingIndex == 0 {
+		t.setChild(parentIndex, top.IsLeftBitSet(), topNodeIndex)
+	} else {
+		t.nodes[topNodeIndex].ShiftPrefix(matchCount)
+		t.nodes[siblingIndex].ShiftPrefix(matchCount)
+		t.setChild(splitIndex, t.nodes[topNodeIndex].IsLeftBitSet(), topNodeIndex)
+		t.setChild(splitIndex, t.nodes[siblingIndex].IsLeftBitSet(), siblingIndex)
+		t.replaceChild(parentIndex, siblingIndex, splitIndex)
+	}
+	t.prefixCount += src.prefixCount
+	t.tagCount += src.tagCount
+	return true, nil
+}
+
+// call visit for the node at the input index and all of its descendants, in pre-order (node, left, right)
+// - since a node's prefix is a prefix of its descendants', and left is a 0 bit, this visits full prefixes in ascending order of address, then length
+// - parent holds the full prefix of the node's parent, and visit is given the node's full prefix
+// - visit gets the prefix by value: a pointer to it would escape to the heap, costing an allocation per node
+// - stops as soon as visit returns false, returning false
+func (t *TreeV4) walkNodes(nodeIndex uint, parent treeNodeV4, visit func(nodeIndex uint, prefix treeNodeV4) bool) bool {
+	// the right children still to visit, with their parents' full prefixes - left children are visited straight away
+	var buf [_walkStackSize]walkNodeV4
+	stack := buf[:0]
+	for {
+		node := &t.nodes[nodeIndex]
+		prefix := parent
+		prefix.MergeFromNodes(&parent, node)
+		if !visit(nodeIndex, prefix) {
+			return false
+		}
+
+		node = &t.nodes[nodeIndex]
+		if node.Left != 0 {
+			if node.Right != 0 {
+				stack = append(stack, walkNodeV4{nodeIndex: uint(node.Right), parent: prefix})
+			}
+			nodeIndex, parent = uint(node.Left), prefix
+		} else if node.Right != 0 {
+			nodeIndex, parent = uint(node.Right), prefix
+		} else if len(stack) > 0 {
+			next := &stack[len(stack)-1]
+			nodeIndex, parent = next.nodeIndex, next.parent
+			stack = stack[:len(stack)-1]
+		} else {
+			return true
+		}
 	}
-	return ret
 }
 
-func (t *TreeV4) moveTags(fromIndex uint, toIndex uint) {
-	tagCount := t.nodes[fromIndex].TagCount
-	fromKey := uint64(fromIndex) << 32
-	toKey := uint64(toIndex) << 32
-	for i := 0; i < tagCount; i++ {
-		t.tags[toKey+uint64(i)] = t.tags[fromKey+uint64(i)]
-		delete(t.tags, fromKey+uint64(i))
-	}
-	t.nodes[toIndex].TagCount += t.nodes[fromIndex].TagCount
-	t.nodes[fromIndex].TagCount = 0
+// a right child waiting to be visited by a walk, along with its parent's full prefix, and its depth below where the
+// walk started - or for walkOverlaps, how many prefixes cover it
+// - there's one waiting at each level at most, so the stack of them holds no more than the tree is deep
+type walkNodeV4 struct {
+	nodeIndex uint
+	parent    treeNodeV4
+	depth     int
 }
 
-func (t *TreeV4) firstTagForNode(nodeIndex uint) bool {
-	return t.tags[(uint64(nodeIndex) << 32)]
-}
+// check that the nodes make a tree: every node below the root is reached once, by a path using up no more than a
+// full address, and the free list holds nodes that aren't in use
+// - returns an error wrapping ErrCorruptTree if not
+func (t *TreeV4) checkStructure() error {
+	if len(t.nodes) < 2 {
+		return fmt.Errorf("%w: no root node", ErrCorruptTree)
+	}
+	if t.nodes[1].length() != 0 {
+		return fmt.Errorf("%w: root node has prefix length %d", ErrCorruptTree, t.nodes[1].length())
+	}
 
-// delete tags at the input node, returning how many were deleted, and how many are left
-func (t *TreeV4) deleteTag(nodeIndex uint, matchTag bool, matchFunc MatchesFunc) (int, int) {
-	// TODO: this could be done much more efficiently
+	type pathNode struct {
+		nodeIndex uint
+		length    uint // the prefix length, down to and including the node
+	}
+	reached := make([]bool, len(t.nodes))
+	reached[1] = true
+	stack := []pathNode{{nodeIndex: 1}}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, childIndex := range [2]uint{uint(t.nodes[current.nodeIndex].Left), uint(t.nodes[current.nodeIndex].Right)} {
+			if childIndex == 0 {
+				continue
+			}
+			if childIndex >= uint(len(t.nodes)) {
+				return fmt.Errorf("%w: node %d links to invalid node index %d", ErrCorruptTree, current.nodeIndex, childIndex)
+			}
+			if reached[childIndex] {
+				return fmt.Errorf("%w: node %d is linked to more than once", ErrCorruptTree, childIndex)
+			}
+			reached[childIndex] = true
+			child := &t.nodes[childIndex]
+			if child.length() == 0 {
+				return fmt.Errorf("%w: node %d has no prefix", ErrCorruptTree, childIndex)
+			}
+			length := current.length + child.length()
+			if length > _maxPrefixLengthV4 {
+				return fmt.Errorf("%w: node %d is at prefix length %d", ErrCorruptTree, childIndex, length)
+			}
+			stack = append(stack, pathNode{nodeIndex: childIndex, length: length})
+		}
+	}
 
-	// get tags
-	tags := t.tagsForNode(nodeIndex)
+	for _, nodeIndex := range t.availableIndexes {
+		if nodeIndex == 0 || uint(nodeIndex) >= uint(len(t.nodes)) || reached[nodeIndex] {
+			return fmt.Errorf("%w: node %d is on the free list, but isn't free", ErrCorruptTree, nodeIndex)
+		}
+		// mark it, to catch it being on the list twice
+		reached[nodeIndex] = true
+	}
+	return nil
+}
 
-	// delete tags
-	for i := 0; i < t.nodes[nodeIndex].TagCount; i++ {
-		delete(t.tags, (uint64(nodeIndex)<<32)+uint64(i))
+// return the indexes of the nodes that can't be reached from the root, other than the unused node 0
+// - stops following links that go out of range, or back to a node already reached, leaving those for checkStructure
+func (t *TreeV4) unreachableNodes() []treeIndex {
+	reached := make([]bool, len(t.nodes))
+	reached[1] = true
+	stack := []uint{1}
+	for len(stack) > 0 {
+		nodeIndex := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, childIndex := range [2]uint{uint(t.nodes[nodeIndex].Left), uint(t.nodes[nodeIndex].Right)} {
+			if childIndex != 0 && childIndex < uint(len(t.nodes)) && !reached[childIndex] {
+				reached[childIndex] = true
+				stack = append(stack, childIndex)
+			}
+		}
 	}
-	t.nodes[nodeIndex].TagCount = 0
 
-	// put them back
-	deleteCount := 0
-	keepCount := 0
-	for _, tag := range tags {
-		if matchFunc(tag, matchTag) {
-			deleteCount++
-		} else {
-			// doesn't match - get to keep it
-			t.addTag(tag, nodeIndex, matchFunc, false)
-			keepCount++
+	ret := make([]treeIndex, 0)
+	for nodeIndex := 2; nodeIndex < len(t.nodes); nodeIndex++ {
+		if !reached[nodeIndex] {
+			ret = append(ret, treeIndex(nodeIndex))
 		}
 	}
-	return deleteCount, keepCount
+	return ret
 }
 
-// Set the single value for a node - overwrites what's there
-// Returns whether the tag count at this address was increased, and how many tags at this address
-func (t *TreeV4) Set(address patricia.IPv4Address, tag bool) (bool, int, error) {
-	return t.add(address, tag, nil, true)
+// Reserve sizes the tree's storage to hold prefixCount prefixes, in all, without growing, so building a tree of known
+// size doesn't copy its node array over and over as it grows
+// - a tree of n prefixes needs up to 2n nodes besides the root, as prefixes that branch off each other need a node for
+// where they do
+// - never shrinks the storage - see ShrinkToFit for that
+func (t *TreeV4) Reserve(prefixCount int) {
+	t.startChange()
+	t.reserveNodes(2*prefixCount + 2 - len(t.nodes))
+	t.tags.reserve(cap(t.nodes))
 }
 
-// Add adds a tag to the tree
-// - if matchFunc is non-nil, it will be used to ensure uniqueness at this node
-// - returns whether the tag count at this address was increased, and how many tags at this address
-func (t *TreeV4) Add(address patricia.IPv4Address, tag bool, matchFunc MatchesFunc) (bool, int, error) {
-	return t.add(address, tag, matchFunc, false)
+// grow the node array, when it's full, as the tree's growth policy says
+func (t *TreeV4) growNodes() {
+	temp := t.makeNodes(len(t.nodes), t.config.grownCapacity(cap(t.nodes), len(t.nodes)+1))
+	copy(temp, t.nodes)
+	t.nodes = temp
 }
 
-// add a tag to the tree, optionally as the single value
-// - overwrites the first value in the list if 'replaceFirst' is true
-// - returns whether the tag count was increased, and the number of tags at this address
-func (t *TreeV4) add(address patricia.IPv4Address, tag bool, matchFunc MatchesFunc, replaceFirst bool) (bool, int, error) {
-	// make sure we have more than enough capacity before we start adding to the tree, which invalidates pointers into the array
-	if (len(t.availableIndexes) + cap(t.nodes)) < (len(t.nodes) + 10) {
-		temp := make([]treeNodeV4, len(t.nodes), (cap(t.nodes)+1)*2)
+// make sure the node array can hold count more nodes without growing
+func (t *TreeV4) reserveNodes(count int) {
+	if len(t.nodes)+count > cap(t.nodes) {
+		temp := t.makeNodes(len(t.nodes), len(t.nodes)+count)
 		copy(temp, t.nodes)
 		t.nodes = temp
 	}
+}
 
-	root := &t.nodes[1]
+// returns a node array with the input length and capacity, from the tree's arena, if it has one
+func (t *TreeV4) makeNodes(length int, capacity int) []treeNodeV4 {
+	if t.config.arena != nil {
+		return t.config.arena.treeNodesV4(length, capacity)
+	}
+	return make([]treeNodeV4, length, capacity)
+}
 
-	// handle root tags
+// find the node exactly matching the input address, returning its index and the index of its parent
+// - returns a node index of 0 if there's no exact match
+// - the root node is its own parent
+func (t *TreeV4) findNode(address patricia.IPv4Address) (uint, uint, error) {
 	if address.Length == 0 {
-		countIncreased := t.addTag(tag, 1, matchFunc, replaceFirst)
-		return countIncreased, t.nodes[1].TagCount, nil
+		// caller just looking for root
+		return 1, 1, nil
 	}
 
-	// root node doesn't have any prefix, so find the starting point
-	nodeIndex := uint(0)
-	parent := root
+	root := &t.nodes[1]
+	parentIndex := uint(1)
+	var nodeIndex uint
 	if !address.IsLeftBitSet() {
-		if root.Left == 0 {
-			newNodeIndex := t.newNode(address, address.Length)
-			countIncreased := t.addTag(tag, newNodeIndex, matchFunc, replaceFirst)
-			root.Left = newNodeIndex
-			return countIncreased, t.nodes[newNodeIndex].TagCount, nil
-		}
-		nodeIndex = root.Left
+		nodeIndex = uint(root.Left)
 	} else {
-		if root.Right == 0 {
-			newNodeIndex := t.newNode(address, address.Length)
-			countIncreased := t.addTag(tag, newNodeIndex, matchFunc, replaceFirst)
-			root.Right = newNodeIndex
-			return countIncreased, t.nodes[newNodeIndex].TagCount, nil
-		}
-		nodeIndex = root.Right
+		nodeIndex = uint(root.Right)
 	}
 
+	// traverse the tree
 	for {
 		if nodeIndex == 0 {
-			panic("Trying to traverse nodeIndex=0")
+			return 0, 0, nil
 		}
-		node := &t.nodes[nodeIndex]
-		if node.prefixLength == 0 {
-			panic("Reached a node with no prefix")
+		if nodeIndex >= uint(len(t.nodes)) {
+			return 0, 0, fmt.Errorf("%w: node %d links to invalid node index %d, looking for %s", ErrCorruptTree, parentIndex, nodeIndex, address)
 		}
 
-		matchCount := uint(node.MatchCount(address))
-		if matchCount == 0 {
-			panic(fmt.Sprintf("Should not have traversed to a node with no prefix match - node prefix length: %d; address prefix length: %d", node.prefixLength, address.Length))
+		node := &t.nodes[nodeIndex]
+		matchCount := node.MatchCount(address)
+		if matchCount < node.length() {
+			// didn't match the entire node - we're done
+			return 0, 0, nil
 		}
 
 		if matchCount == address.Length {
-			// all the bits in the address matched
-
-			if matchCount == node.prefixLength {
-				// the whole prefix matched - we're done!
-				countIncreased := t.addTag(tag, nodeIndex, matchFunc, replaceFirst)
-				return countIncreased, t.nodes[nodeIndex].TagCount, nil
-			}
-
-			// the input address is shorter than the match found - need to create a new, intermediate parent
-			newNodeIndex := t.newNode(address, address.Length)
-			newNode := &t.nodes[newNodeIndex]
-			countIncreased := t.addTag(tag, newNodeIndex, matchFunc, replaceFirst)
-
-			// the existing node loses those matching bits, and becomes a child of the new node
-
-			// shift
-			node.ShiftPrefix(matchCount)
-
-			if !node.IsLeftBitSet() {
-				newNode.Left = nodeIndex
-			} else {
-				newNode.Right = nodeIndex
-			}
-
-			// now give this new node a home
-			if parent.Left == nodeIndex {
-				parent.Left = newNodeIndex
-			} else {
-				if parent.Right != nodeIndex {
-					panic("node isn't left or right parent - should be impossible! (1)")
-				}
-				parent.Right = newNodeIndex
-			}
-			return countIncreased, t.nodes[newNodeIndex].TagCount, nil
-		}
-
-		if matchCount == node.prefixLength {
-			// partial match - we have to keep traversing
-
-			// chop off what's matched so far
-			address.ShiftLeft(matchCount)
-
-			if !address.IsLeftBitSet() {
-				if node.Left == 0 {
-					// nowhere else to go - create a new node here
-					newNodeIndex := t.newNode(address, address.Length)
-					countIncreased := t.addTag(tag, newNodeIndex, matchFunc, replaceFirst)
-					node.Left = newNodeIndex
-					return countIncreased, t.nodes[newNodeIndex].TagCount, nil
-				}
-
-				// there's a node to the left - traverse it
-				parent = node
-				nodeIndex = node.Left
-				continue
-			}
-
-			// node didn't belong on the left, so it belongs on the right
-			if node.Right == 0 {
-				// nowhere else to go - create a new node here
-				newNodeIndex := t.newNode(address, address.Length)
-				countIncreased := t.addTag(tag, newNodeIndex, matchFunc, replaceFirst)
-				node.Right = newNodeIndex
-				return countIncreased, t.nodes[newNodeIndex].TagCount, nil
-			}
-
-			// there's a node to the right - traverse it
-			parent = node
-			nodeIndex = node.Right
-			continue
+			// exact match - we're done
+			return nodeIndex, parentIndex, nil
 		}
 
-		// partial match with this node - need to split this node
-		newCommonParentNodeIndex := t.newNode(address, matchCount)
-		newCommonParentNode := &t.nodes[newCommonParentNodeIndex]
-
-		// shift
+		// there's still more address - keep traversing
+		parentIndex = nodeIndex
 		address.ShiftLeft(matchCount)
-
-		newNodeIndex := t.newNode(address, address.Length)
-		countIncreased := t.addTag(tag, newNodeIndex, matchFunc, replaceFirst)
-
-		// see where the existing node fits - left or right
-		node.ShiftPrefix(matchCount)
-		if !node.IsLeftBitSet() {
-			newCommonParentNode.Left = nodeIndex
-			newCommonParentNode.Right = newNodeIndex
-		} else {
-			newCommonParentNode.Right = nodeIndex
-			newCommonParentNode.Left = newNodeIndex
-		}
-
-		// now determine where the new node belongs
-		if parent.Left == nodeIndex {
-			parent.Left = newCommonParentNodeIndex
+		if !address.IsLeftBitSet() {
+			nodeIndex = uint(node.Left)
 		} else {
-			if parent.Right != nodeIndex {
-				panic("node isn't left or right parent - should be impossible! (2)")
-			}
-			parent.Right = newCommonParentNodeIndex
+			nodeIndex = uint(node.Right)
 		}
-		return countIncreased, t.nodes[newNodeIndex].TagCount, nil
 	}
 }
 
-// Delete a tag from the tree if it matches matchVal, as determined by matchFunc. Returns how many tags are removed
-func (t *TreeV4) Delete(address patricia.IPv4Address, matchFunc MatchesFunc, matchVal bool) (int, error) {
-	// traverse the tree, finding the node and its parent
-	root := &t.nodes[1]
-	var parentIndex uint
-	var parent *treeNodeV4
-	var targetNode *treeNodeV4
-	var targetNodeIndex uint
-
-	if address.Length == 0 {
-		// caller just looking for root tags
-		targetNode = root
-		targetNodeIndex = 1
-	} else {
-		nodeIndex := uint(0)
-
-		parentIndex = 1
-		parent = root
-		if !address.IsLeftBitSet() {
-			nodeIndex = root.Left
-		} else {
-			nodeIndex = root.Right
-		}
-
-		// traverse the tree
-		for {
-			if nodeIndex == 0 {
-				return 0, nil
-			}
-
-			node := &t.nodes[nodeIndex]
-			matchCount := node.MatchCount(address)
-			if matchCount < node.prefixLength {
-				// didn't match the entire node - we're done
-				return 0, nil
-			}
-
-			if matchCount == address.Length {
-				// exact match - we're done
-				targetNode = node
-				targetNodeIndex = nodeIndex
-				break
-			}
-
-			// there's still more address - keep traversing
-			parentIndex = nodeIndex
-			parent = node
-			address.ShiftLeft(matchCount)
-			if !address.IsLeftBitSet() {
-				nodeIndex = node.Left
-			} else {
-				nodeIndex = node.Right
-			}
-		}
+// remove the input node, which has just lost all of its tags, compacting the tree if possible
+// - the root node is never removed
+func (t *TreeV4) removeNode(targetNodeIndex uint, parentIndex uint) error {
+	if targetNodeIndex == 1 {
+		// can't delete the root node
+		return nil
 	}
 
-	if targetNode == nil || targetNode.TagCount == 0 {
-		// no tags found
-		return 0, nil
-	}
+	targetNode := &t.nodes[targetNodeIndex]
+	parent := &t.nodes[parentIndex]
 
-	// delete matching tags
-	deleteCount, remainingTagCount := t.deleteTag(targetNodeIndex, matchVal, matchFunc)
-	if remainingTagCount > 0 {
-		// target node still has tags - we're not deleting it
-		return deleteCount, nil
+	// sanity checks before we change anything
+	if uint(parent.Left) != targetNodeIndex && uint(parent.Right) != targetNodeIndex {
+		return fmt.Errorf("%w: node %d isn't a child of its parent node %d", ErrCorruptTree, targetNodeIndex, parentIndex)
 	}
-
-	if targetNodeIndex == 1 {
-		// can't delete the root node
-		return deleteCount, nil
+	if uint(targetNode.Left) >= uint(len(t.nodes)) || uint(targetNode.Right) >= uint(len(t.nodes)) {
+		return fmt.Errorf("%w: node %d links to invalid node indexes %d/%d", ErrCorruptTree, targetNodeIndex, targetNode.Left, targetNode.Right)
 	}
 
 	// compact the tree, if possible
 	if targetNode.Left != 0 && targetNode.Right != 0 {
 		// target has two children - nothing we can do - not deleting the node
-		return deleteCount, nil
+		return nil
 	} else if targetNode.Left != 0 {
 		// target node only has only left child
-		if parent.Left == targetNodeIndex {
+		if uint(parent.Left) == targetNodeIndex {
 			parent.Left = targetNode.Left
 		} else {
 			parent.Right = targetNode.Left
@@ -409,7 +1548,7 @@ func (t *TreeV4) Delete(address patricia.IPv4Address, matchFunc MatchesFunc, mat
 		tmpNode.MergeFromNodes(targetNode, tmpNode)
 	} else if targetNode.Right != 0 {
 		// target node has only right child
-		if parent.Left == targetNodeIndex {
+		if uint(parent.Left) == targetNodeIndex {
 			parent.Left = targetNode.Right
 		} else {
 			parent.Right = targetNode.Right
@@ -420,11 +1559,11 @@ func (t *TreeV4) Delete(address patricia.IPv4Address, matchFunc MatchesFunc, mat
 		tmpNode.MergeFromNodes(targetNode, tmpNode)
 	} else {
 		// target node has no children - straight-up remove this node
-		if parent.Left == targetNodeIndex {
+		if uint(parent.Left) == targetNodeIndex {
 			parent.Left = 0
 			if parentIndex > 1 && parent.TagCount == 0 && parent.Right != 0 {
 				// parent isn't root, has no tags, and there's a sibling - merge sibling into parent
-				siblingIndexToDelete := parent.Right
+				siblingIndexToDelete := uint(parent.Right)
 				tmpNode := &t.nodes[siblingIndexToDelete]
 				parent.MergeFromNodes(parent, tmpNode)
 
@@ -435,13 +1574,13 @@ func (t *TreeV4) Delete(address patricia.IPv4Address, matchFunc MatchesFunc, mat
 				parent.Left = t.nodes[siblingIndexToDelete].Left
 				parent.Right = t.nodes[siblingIndexToDelete].Right
 
-				t.availableIndexes = append(t.availableIndexes, siblingIndexToDelete)
+				t.availableIndexes = append(t.availableIndexes, treeIndex(siblingIndexToDelete))
 			}
 		} else {
 			parent.Right = 0
 			if parentIndex > 1 && parent.TagCount == 0 && parent.Left != 0 {
 				// parent isn't root, has no tags, and there's a sibling - merge sibling into parent
-				siblingIndexToDelete := parent.Left
+				siblingIndexToDelete := uint(parent.Left)
 				tmpNode := &t.nodes[siblingIndexToDelete]
 				parent.MergeFromNodes(parent, tmpNode)
 
@@ -452,28 +1591,40 @@ func (t *TreeV4) Delete(address patricia.IPv4Address, matchFunc MatchesFunc, mat
 				parent.Right = t.nodes[parent.Left].Right
 				parent.Left = t.nodes[parent.Left].Left
 
-				t.availableIndexes = append(t.availableIndexes, siblingIndexToDelete)
+				t.availableIndexes = append(t.availableIndexes, treeIndex(siblingIndexToDelete))
 			}
 		}
 	}
 
 	targetNode.Left = 0
 	targetNode.Right = 0
-	t.availableIndexes = append(t.availableIndexes, targetNodeIndex)
-	return deleteCount, nil
+	t.availableIndexes = append(t.availableIndexes, treeIndex(targetNodeIndex))
+	return nil
 }
 
 // FindTagsWithFilter finds all matching tags that passes the filter function
-func (t *TreeV4) FindTagsWithFilter(address patricia.IPv4Address, filterFunc FilterFunc) ([]bool, error) {
-	root := &t.nodes[1]
+// - on a tree made WithResultPool, the result can be handed back with ReleaseTags once it's no longer needed
+func (t *TreeV4) FindTagsWithFilter(address patricia.IPv4Address, filterFunc FilterFunc) (ret []bool, err error) {
+	if _raceGuard {
+		defer t.guardLookup(atomic.LoadUint64(&t.changeSeq), &err)
+	}
 	if filterFunc == nil {
 		return t.FindTags(address)
 	}
+	if t.frozen != nil {
+		return t.frozenFindTagsWithFilter(address, filterFunc), nil
+	}
+	root := &t.nodes[1]
 
 	var matchCount uint
-	ret := make([]bool, 0)
+	if t.config.resultPool {
+		ret = getResultBuffer()
+	} else {
+		ret = make([]bool, 0)
+	}
 
 	if root.TagCount > 0 {
+		t.hit(1)
 		for _, tag := range t.tagsForNode(1) {
 			if filterFunc(tag) {
 				ret = append(ret, tag)
@@ -488,28 +1639,29 @@ func (t *TreeV4) FindTagsWithFilter(address patricia.IPv4Address, filterFunc Fil
 
 	var nodeIndex uint
 	if !address.IsLeftBitSet() {
-		nodeIndex = root.Left
+		nodeIndex = uint(root.Left)
 	} else {
-		nodeIndex = root.Right
+		nodeIndex = uint(root.Right)
 	}
 
-	// traverse the tree
-	count := 0
+	// traverse the tree - checking each index against a local copy of the slice proves it's in range, so indexing isn't
+	// checked again, and a link out of range in a corrupt tree ends the lookup
+	nodes := t.nodes
 	for {
-		count++
-		if nodeIndex == 0 {
+		if nodeIndex == 0 || nodeIndex >= uint(len(nodes)) {
 			return ret, nil
 		}
-		node := &t.nodes[nodeIndex]
+		node := &nodes[nodeIndex]
 
 		matchCount = node.MatchCount(address)
-		if matchCount < node.prefixLength {
+		if matchCount < node.length() {
 			// didn't match the entire node - we're done
 			return ret, nil
 		}
 
 		// matched the full node - get its tags, then chop off the bits we've already matched and continue
 		if node.TagCount > 0 {
+			t.hit(nodeIndex)
 			for _, tag := range t.tagsForNode(nodeIndex) {
 				if filterFunc(tag) {
 					ret = append(ret, tag)
@@ -525,15 +1677,22 @@ func (t *TreeV4) FindTagsWithFilter(address patricia.IPv4Address, filterFunc Fil
 		// there's still more address - keep traversing
 		address.ShiftLeft(matchCount)
 		if !address.IsLeftBitSet() {
-			nodeIndex = node.Left
+			nodeIndex = uint(node.Left)
 		} else {
-			nodeIndex = node.Right
+			nodeIndex = uint(node.Right)
 		}
 	}
 }
 
 // FindTags finds all matching tags for given address
-func (t *TreeV4) FindTags(address patricia.IPv4Address) ([]bool, error) {
+// - on a tree made WithResultPool, the result can be handed back with ReleaseTags once it's no longer needed
+func (t *TreeV4) FindTags(address patricia.IPv4Address) (tags []bool, err error) {
+	if _raceGuard {
+		defer t.guardLookup(atomic.LoadUint64(&t.changeSeq), &err)
+	}
+	if t.config.resultPool {
+		return t.FindTagsAppend(getResultBuffer(), address), nil
+	}
 	if ret := t.FindTagsAppend(nil, address); ret != nil {
 		// NB: the nil error is for compatibility with the old FindTags()
 		return ret, nil
@@ -545,10 +1704,14 @@ func (t *TreeV4) FindTags(address patricia.IPv4Address) ([]bool, error) {
 
 // FindTagsAppend finds all matching tags for given address and appends them to ret
 func (t *TreeV4) FindTagsAppend(ret []bool, address patricia.IPv4Address) []bool {
+	if t.frozen != nil {
+		return t.frozen.FindTagsAppend(ret, address)
+	}
 	var matchCount uint
 	root := &t.nodes[1]
 
 	if root.TagCount > 0 {
+		t.hit(1)
 		ret = t.tagsForNodeAppend(ret, 1)
 	}
 
@@ -559,28 +1722,29 @@ func (t *TreeV4) FindTagsAppend(ret []bool, address patricia.IPv4Address) []bool
 
 	var nodeIndex uint
 	if !address.IsLeftBitSet() {
-		nodeIndex = root.Left
+		nodeIndex = uint(root.Left)
 	} else {
-		nodeIndex = root.Right
+		nodeIndex = uint(root.Right)
 	}
 
-	// traverse the tree
-	count := 0
+	// traverse the tree - checking each index against a local copy of the slice proves it's in range, so indexing isn't
+	// checked again, and a link out of range in a corrupt tree ends the lookup
+	nodes := t.nodes
 	for {
-		count++
-		if nodeIndex == 0 {
+		if nodeIndex == 0 || nodeIndex >= uint(len(nodes)) {
 			return ret
 		}
-		node := &t.nodes[nodeIndex]
+		node := &nodes[nodeIndex]
 
 		matchCount = node.MatchCount(address)
-		if matchCount < node.prefixLength {
+		if matchCount < node.length() {
 			// didn't match the entire node - we're done
 			return ret
 		}
 
 		// matched the full node - get its tags, then chop off the bits we've already matched and continue
 		if node.TagCount > 0 {
+			t.hit(nodeIndex)
 			ret = t.tagsForNodeAppend(ret, nodeIndex)
 		}
 
@@ -592,23 +1756,28 @@ func (t *TreeV4) FindTagsAppend(ret []bool, address patricia.IPv4Address) []bool
 		// there's still more address - keep traversing
 		address.ShiftLeft(matchCount)
 		if !address.IsLeftBitSet() {
-			nodeIndex = node.Left
+			nodeIndex = uint(node.Left)
 		} else {
-			nodeIndex = node.Right
+			nodeIndex = uint(node.Right)
 		}
 	}
 }
 
 // FindDeepestTag finds a tag at the deepest level in the tree, representing the closest match.
 // - if that target node has multiple tags, the first in the list is returned
-func (t *TreeV4) FindDeepestTag(address patricia.IPv4Address) (bool, bool, error) {
+func (t *TreeV4) FindDeepestTag(address patricia.IPv4Address) (found bool, ret bool, err error) {
+	if _raceGuard {
+		defer t.guardLookup(atomic.LoadUint64(&t.changeSeq), &err)
+	}
+	if t.frozen != nil {
+		found, ret = t.frozen.FindDeepestTag(address)
+		return found, ret, nil
+	}
 	root := &t.nodes[1]
-	var found bool
-	var ret bool
 
 	if root.TagCount > 0 {
-		ret = t.firstTagForNode(1)
-		found = true
+		t.hit(1)
+		ret, found = t.firstTagForNode(1)
 	}
 
 	if address.Length == 0 {
@@ -618,28 +1787,33 @@ func (t *TreeV4) FindDeepestTag(address patricia.IPv4Address) (bool, bool, error
 
 	var nodeIndex uint
 	if !address.IsLeftBitSet() {
-		nodeIndex = root.Left
+		nodeIndex = uint(root.Left)
 	} else {
-		nodeIndex = root.Right
+		nodeIndex = uint(root.Right)
 	}
 
-	// traverse the tree
+	// traverse the tree - checking each index against a local copy of the slice proves it's in range, so indexing isn't
+	// checked again, and a link out of range in a corrupt tree ends the lookup
+	nodes := t.nodes
 	for {
-		if nodeIndex == 0 {
+		if nodeIndex == 0 || nodeIndex >= uint(len(nodes)) {
 			return found, ret, nil
 		}
-		node := &t.nodes[nodeIndex]
+		node := &nodes[nodeIndex]
 
 		matchCount := node.MatchCount(address)
-		if matchCount < node.prefixLength {
+		if matchCount < node.length() {
 			// didn't match the entire node - we're done
 			return found, ret, nil
 		}
 
 		// matched the full node - get its tags, then chop off the bits we've already matched and continue
 		if node.TagCount > 0 {
-			ret = t.firstTagForNode(nodeIndex)
-			found = true
+			t.hit(nodeIndex)
+			if tag, ok := t.firstTagForNode(nodeIndex); ok {
+				ret = tag
+				found = true
+			}
 		}
 
 		if matchCount == address.Length {
@@ -650,95 +1824,318 @@ func (t *TreeV4) FindDeepestTag(address patricia.IPv4Address) (bool, bool, error
 		// there's still more address - keep traversing
 		address.ShiftLeft(matchCount)
 		if !address.IsLeftBitSet() {
-			nodeIndex = node.Left
+			nodeIndex = uint(node.Left)
 		} else {
-			nodeIndex = node.Right
+			nodeIndex = uint(node.Right)
+		}
+	}
+}
+
+// FindDeepestTagBatch finds a tag at the deepest level in the tree for each of the addresses, like FindDeepestTag,
+// setting found and tags at the same index as each address
+// - found and tags must be at least as long as addresses
+// - several addresses are looked up at once, a node at a time each, in turn, so the reads of their nodes from memory
+// overlap, rather than each waiting on the last - for trees too big to stay in cache, where lookups spend most of their
+// time waiting on memory, this is much quicker than looking them up one at a time
+func (t *TreeV4) FindDeepestTagBatch(addresses []patricia.IPv4Address, found []bool, tags []bool) (err error) {
+	if _raceGuard {
+		defer t.guardLookup(atomic.LoadUint64(&t.changeSeq), &err)
+	}
+	found, tags = found[:len(addresses)], tags[:len(addresses)]
+	if t.frozen != nil {
+		for i, address := range addresses {
+			found[i], tags[i] = t.frozen.FindDeepestTag(address)
+		}
+		return nil
+	}
+
+	var rootIndex uint
+	root := &t.nodes[1]
+	if root.TagCount > 0 && t.hasLiveTags(1) {
+		t.hit(1)
+		rootIndex = 1
+	}
+
+	// the lookups under way, each a node down the tree - checking each index against a local copy of the slice proves
+	// it's in range, so indexing isn't checked again, and a link out of range in a corrupt tree ends the lookup
+	nodes := t.nodes
+	var lanes [_lookupLanes]lookupLaneV4
+	inFlight, next := 0, 0
+	for next < len(addresses) || inFlight > 0 {
+		for inFlight < len(lanes) && next < len(addresses) {
+			lane := lookupLaneV4{address: addresses[next], index: next, deepest: rootIndex}
+			if !lane.address.IsLeftBitSet() {
+				lane.nodeIndex = uint(root.Left)
+			} else {
+				lane.nodeIndex = uint(root.Right)
+			}
+			if lane.address.Length == 0 {
+				// caller just looking for root tags
+				lane.nodeIndex = 0
+			}
+			lanes[inFlight] = lane
+			inFlight++
+			next++
+		}
+
+		// load each lookup's next node first, so the loads are all under way together
+		for l := range lanes[:inFlight] {
+			lane := &lanes[l]
+			if nodeIndex := lane.nodeIndex; nodeIndex != 0 && nodeIndex < uint(len(nodes)) {
+				lane.node = nodes[nodeIndex]
+			} else {
+				lane.nodeIndex = 0
+			}
+		}
+
+		for l := 0; l < inFlight; {
+			lane := &lanes[l]
+			if nodeIndex := lane.nodeIndex; nodeIndex != 0 {
+				node := &lane.node
+				matchCount := node.MatchCount(lane.address)
+				lane.nodeIndex = 0
+				if matchCount >= node.length() {
+					// matched the full node - note it, if it has tags, then chop off the bits we've already matched and continue
+					if node.TagCount > 0 && t.hasLiveTags(nodeIndex) {
+						t.hit(nodeIndex)
+						lane.deepest = nodeIndex
+					}
+					if matchCount < lane.address.Length {
+						lane.address.ShiftLeft(matchCount)
+						if !lane.address.IsLeftBitSet() {
+							lane.nodeIndex = uint(node.Left)
+						} else {
+							lane.nodeIndex = uint(node.Right)
+						}
+						l++
+						continue
+					}
+				}
+			}
+
+			// this lookup's done - its lane goes to the last one under way
+			found[lane.index] = false
+			var zero bool
+			tags[lane.index] = zero
+			if lane.deepest != 0 {
+				tags[lane.index], found[lane.index] = t.firstTagForNode(lane.deepest)
+			}
+			inFlight--
+			lanes[l] = lanes[inFlight]
 		}
 	}
+	return nil
+}
+
+// a lookup under way in FindDeepestTagBatch
+type lookupLaneV4 struct {
+	address   patricia.IPv4Address // what's left of it, below the node
+	nodeIndex uint                 // the next node to check, or 0 if there are none
+	node      treeNodeV4           // a copy of it
+	deepest   uint                 // the deepest node holding the address that has tags, so far
+	index     int                  // into the addresses
 }
 
 // FindDeepestTags finds all tags at the deepest level in the tree, representing the closest match
 // - returns empty array if nothing found
-func (t *TreeV4) FindDeepestTags(address patricia.IPv4Address) (bool, []bool, error) {
+func (t *TreeV4) FindDeepestTags(address patricia.IPv4Address) (found bool, tags []bool, err error) {
+	if _raceGuard {
+		defer t.guardLookup(atomic.LoadUint64(&t.changeSeq), &err)
+	}
+	if t.frozen != nil {
+		// the frozen tree's tags are its own, and the caller's free to change these
+		found, tags = t.frozen.FindDeepestTags(address)
+		return found, append(make([]bool, 0, len(tags)), tags...), nil
+	}
+	nodeIndex := t.findDeepestTagsNode(address)
+	return nodeIndex != 0, t.tagsForNode(nodeIndex), nil
+}
+
+// FindDeepestTagsView finds all tags at the deepest level in the tree, like FindDeepestTags, without copying them
+// - the returned slice belongs to the tree: it must not be changed, and is only good until the tree's next change
+// - appending to it copies it, rather than writing into the tree
+// - tags are only copied if some of the node's tags have expired, to leave those out
+// - returns nil if nothing found
+func (t *TreeV4) FindDeepestTagsView(address patricia.IPv4Address) (found bool, tags []bool, err error) {
+	if _raceGuard {
+		defer t.guardLookup(atomic.LoadUint64(&t.changeSeq), &err)
+	}
+	if t.frozen != nil {
+		found, tags = t.frozen.FindDeepestTags(address)
+		return found, tags, nil
+	}
+	nodeIndex := t.findDeepestTagsNode(address)
+	if nodeIndex == 0 {
+		return false, nil, nil
+	}
+	if t.nodeExpirations(nodeIndex) != nil {
+		return true, t.tagsForNode(nodeIndex), nil
+	}
+	tags = t.nodeTags(nodeIndex)
+	return true, tags[:len(tags):len(tags)], nil
+}
+
+// returns the index of the deepest node holding the address that has tags which haven't expired, or 0 if there isn't one
+func (t *TreeV4) findDeepestTagsNode(address patricia.IPv4Address) uint {
+	root := &t.nodes[1]
+	var ret uint
+
+	if root.TagCount > 0 && t.hasLiveTags(1) {
+		t.hit(1)
+		ret = 1
+	}
+
+	if address.Length == 0 {
+		// caller just looking for root tags
+		return ret
+	}
+
+	var nodeIndex uint
+	if !address.IsLeftBitSet() {
+		nodeIndex = uint(root.Left)
+	} else {
+		nodeIndex = uint(root.Right)
+	}
+
+	// traverse the tree - checking each index against a local copy of the slice proves it's in range, so indexing isn't
+	// checked again, and a link out of range in a corrupt tree ends the lookup
+	nodes := t.nodes
+	for {
+		if nodeIndex == 0 || nodeIndex >= uint(len(nodes)) {
+			return ret
+		}
+		node := &nodes[nodeIndex]
+
+		matchCount := node.MatchCount(address)
+		if matchCount < node.length() {
+			// didn't match the entire node - we're done
+			return ret
+		}
+
+		// matched the full node - note it, if it has tags, then chop off the bits we've already matched and continue
+		if node.TagCount > 0 && t.hasLiveTags(nodeIndex) {
+			t.hit(nodeIndex)
+			ret = nodeIndex
+		}
+
+		if matchCount == address.Length {
+			// exact match - we're done
+			return ret
+		}
+
+		// there's still more address - keep traversing
+		address.ShiftLeft(matchCount)
+		if !address.IsLeftBitSet() {
+			nodeIndex = uint(node.Left)
+		} else {
+			nodeIndex = uint(node.Right)
+		}
+	}
+}
+
+// FindTagsFunc calls tagFunc for every tag matching the address, in the same order as FindTags returns them, without
+// copying them into a slice
+// - stops as soon as tagFunc returns false
+// - tagFunc mustn't change the tree
+func (t *TreeV4) FindTagsFunc(address patricia.IPv4Address, tagFunc func(tag bool) bool) (err error) {
+	if _raceGuard {
+		defer t.guardLookup(atomic.LoadUint64(&t.changeSeq), &err)
+	}
+	if t.frozen != nil {
+		t.frozen.visitTags(t.frozen.find(address), tagFunc)
+		return nil
+	}
 	root := &t.nodes[1]
-	var found bool
-	var retTagIndex uint
 
 	if root.TagCount > 0 {
-		retTagIndex = 1
-		found = true
+		t.hit(1)
+		if !t.visitNodeTags(1, tagFunc) {
+			return nil
+		}
 	}
 
 	if address.Length == 0 {
 		// caller just looking for root tags
-		return found, t.tagsForNode(retTagIndex), nil
+		return nil
 	}
 
 	var nodeIndex uint
 	if !address.IsLeftBitSet() {
-		nodeIndex = root.Left
+		nodeIndex = uint(root.Left)
 	} else {
-		nodeIndex = root.Right
+		nodeIndex = uint(root.Right)
 	}
 
-	// traverse the tree
+	// traverse the tree - checking each index against a local copy of the slice proves it's in range, so indexing isn't
+	// checked again, and a link out of range in a corrupt tree ends the lookup
+	nodes := t.nodes
 	for {
-		if nodeIndex == 0 {
-			return found, t.tagsForNode(retTagIndex), nil
+		if nodeIndex == 0 || nodeIndex >= uint(len(nodes)) {
+			return nil
 		}
-		node := &t.nodes[nodeIndex]
+		node := &nodes[nodeIndex]
 
 		matchCount := node.MatchCount(address)
-		if matchCount < node.prefixLength {
+		if matchCount < node.length() {
 			// didn't match the entire node - we're done
-			return found, t.tagsForNode(retTagIndex), nil
+			return nil
 		}
 
-		// matched the full node - get its tags, then chop off the bits we've already matched and continue
+		// matched the full node - visit its tags, then chop off the bits we've already matched and continue
 		if node.TagCount > 0 {
-			retTagIndex = nodeIndex
-			found = true
+			t.hit(nodeIndex)
+			if !t.visitNodeTags(nodeIndex, tagFunc) {
+				return nil
+			}
 		}
 
 		if matchCount == address.Length {
 			// exact match - we're done
-			return found, t.tagsForNode(retTagIndex), nil
+			return nil
 		}
 
 		// there's still more address - keep traversing
 		address.ShiftLeft(matchCount)
 		if !address.IsLeftBitSet() {
-			nodeIndex = node.Left
+			nodeIndex = uint(node.Left)
 		} else {
-			nodeIndex = node.Right
+			nodeIndex = uint(node.Right)
 		}
 	}
 }
 
 // note: this is only used for unit testing
 func (t *TreeV4) countNodes(nodeIndex uint) int {
-	nodeCount := 1
-
-	node := &t.nodes[nodeIndex]
-	if node.Left != 0 {
-		nodeCount += t.countNodes(node.Left)
-	}
-	if node.Right != 0 {
-		nodeCount += t.countNodes(node.Right)
+	nodeCount := 0
+	stack := []uint{nodeIndex}
+	for len(stack) > 0 {
+		node := &t.nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		nodeCount++
+		if node.Left != 0 {
+			stack = append(stack, uint(node.Left))
+		}
+		if node.Right != 0 {
+			stack = append(stack, uint(node.Right))
+		}
 	}
 	return nodeCount
 }
 
 // note: this is only used for unit testing
 func (t *TreeV4) countTags(nodeIndex uint) int {
-	node := &t.nodes[nodeIndex]
-
-	tagCount := node.TagCount
-	if node.Left != 0 {
-		tagCount += t.countTags(node.Left)
-	}
-	if node.Right != 0 {
-		tagCount += t.countTags(node.Right)
+	tagCount := 0
+	stack := []uint{nodeIndex}
+	for len(stack) > 0 {
+		node := &t.nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		tagCount += node.TagCount
+		if node.Left != 0 {
+			stack = append(stack, uint(node.Left))
+		}
+		if node.Right != 0 {
+			stack = append(stack, uint(node.Right))
+		}
 	}
 	return tagCount
 }
@@ -0,0 +1,77 @@
+package bool_tree
+
+import (
+	"sync/atomic"
+
+	"github.com/kentik/patricia"
+)
+
+// AtomicTreeV4 is a tree with a single writer and any number of readers, where reads never lock
+// - the writer changes the tree returned by Writer, then calls Publish to make those changes visible to readers
+// - readers look up the most recently published tree, which is swapped in with an atomic pointer, so they never wait
+// on the writer or on each other
+// - each publish has a generation number, so readers can tell whether they've seen the latest tree
+// - publishing is cheap, but the writer's first change after it copies the tree's storage, like Snapshot, so
+// it's best to publish after a batch of changes, not after each one
+type AtomicTreeV4 struct {
+	writer    *TreeV4
+	published atomic.Pointer[publishedTreeV4]
+}
+
+// a published tree, along with its generation, so the two are always loaded together
+type publishedTreeV4 struct {
+	tree       *TreeV4
+	generation uint64
+}
+
+// NewAtomicTreeV4 returns a new, empty AtomicTreeV4, with the empty tree published as generation 0
+func NewAtomicTreeV4(options ...TreeOption) *AtomicTreeV4 {
+	ret := &AtomicTreeV4{writer: NewTreeV4(options...)}
+	ret.published.Store(&publishedTreeV4{tree: ret.writer.Snapshot()})
+	return ret
+}
+
+// Writer returns the tree to make changes to, which readers don't see until Publish is called
+// - this and Publish must only be called from the one writing goroutine
+func (a *AtomicTreeV4) Writer() *TreeV4 {
+	return a.writer
+}
+
+// Publish makes the writer's changes visible to readers, returning the new generation
+func (a *AtomicTreeV4) Publish() uint64 {
+	generation := a.published.Load().generation + 1
+	a.published.Store(&publishedTreeV4{tree: a.writer.Snapshot(), generation: generation})
+	return generation
+}
+
+// Load returns the most recently published tree, and its generation
+// - the tree must not be changed, but can be read for as long as it's needed: it stays the same after later publishes
+func (a *AtomicTreeV4) Load() (*TreeV4, uint64) {
+	p := a.published.Load()
+	return p.tree, p.generation
+}
+
+// Generation returns the generation of the most recently published tree
+func (a *AtomicTreeV4) Generation() uint64 {
+	return a.published.Load().generation
+}
+
+// FindTags finds all matching tags for the address in the published tree - see TreeV4.FindTags
+func (a *AtomicTreeV4) FindTags(address patricia.IPv4Address) ([]bool, error) {
+	return a.published.Load().tree.FindTags(address)
+}
+
+// FindTagsAppend finds all matching tags for the address in the published tree and appends them to ret - see TreeV4.FindTagsAppend
+func (a *AtomicTreeV4) FindTagsAppend(ret []bool, address patricia.IPv4Address) []bool {
+	return a.published.Load().tree.FindTagsAppend(ret, address)
+}
+
+// FindDeepestTag finds a tag at the deepest level in the published tree - see TreeV4.FindDeepestTag
+func (a *AtomicTreeV4) FindDeepestTag(address patricia.IPv4Address) (bool, bool, error) {
+	return a.published.Load().tree.FindDeepestTag(address)
+}
+
+// FindDeepestTags finds all tags at the deepest level in the published tree - see TreeV4.FindDeepestTags
+func (a *AtomicTreeV4) FindDeepestTags(address patricia.IPv4Address) (bool, []bool, error) {
+	return a.published.Load().tree.FindDeepestTags(address)
+}
@@ -0,0 +1,135 @@
+package bool_tree
+
+import (
+	"math/bits"
+
+	"github.com/kentik/patricia"
+)
+
+// BitmapTreeV4 is a read-only copy of a tree, stored as a tree bitmap, for very large trees where memory and cache
+// misses count most - see TreeV4.OptimizeBitmap
+// - each node covers 4 bits of the address, in 12 bytes, with bitmaps of the prefixes ending in it and the children
+// below it, rather than a slot for every value of its bits - so it takes less memory than an OptimizedTreeV4, at the
+// cost of a few more nodes visited per lookup
+// - safe for concurrent use
+type BitmapTreeV4 struct {
+	nodes   []bitmapNode // the first node is the root
+	results []uint32     // the index of each node's prefixes, in the order of their positions
+	prefixTags
+}
+
+// OptimizeBitmap returns a read-only copy of the tree, stored as a tree bitmap - see BitmapTreeV4
+// - expired tags are left out, and tags that haven't expired yet are kept without their expiration times
+// - the copy doesn't change along with this tree: call OptimizeBitmap again to pick up changes
+func (t *TreeV4) OptimizeBitmap() *BitmapTreeV4 {
+	ret := &BitmapTreeV4{nodes: make([]bitmapNode, 1)}
+	var entries []optimizedEntryV4
+	ret.prefixTags, entries = t.readOnlyPrefixes()
+	ret.build(0, 0, entries)
+	return ret
+}
+
+// build the node at the input index, for entries that share their first depth bits, and are no shorter than that
+// - the entries must be in order, by address, then length, as Walk visits them
+func (b *BitmapTreeV4) build(nodeIndex uint32, depth uint, entries []optimizedEntryV4) {
+	relative := func(entry optimizedEntryV4) patricia.IPv4Address {
+		address := entry.address
+		address.ShiftLeft(depth)
+		return address
+	}
+
+	// prefixes ending in this node are set in its internal bitmap, and longer ones are handed on to a child for their
+	// next bits, which they're all together in
+	type child struct {
+		chunk   int
+		entries []optimizedEntryV4
+	}
+	var node bitmapNode
+	var children []child
+	for i := 0; i < len(entries); {
+		address := relative(entries[i])
+		if address.Length < _bitmapStride {
+			node.internal |= 1 << bitmapPosition(shardIndexV4(address, _bitmapStride), address.Length)
+			i++
+			continue
+		}
+		chunk := shardIndexV4(address, _bitmapStride)
+		end := i + 1
+		for end < len(entries) {
+			next := relative(entries[end])
+			if next.Length < _bitmapStride || shardIndexV4(next, _bitmapStride) != chunk {
+				break
+			}
+			end++
+		}
+		node.external |= 1 << chunk
+		children = append(children, child{chunk: chunk, entries: entries[i:end]})
+		i = end
+	}
+
+	// now that the internal bitmap's complete, each result goes at its position's rank in it
+	node.resultBase = uint32(len(b.results))
+	results := make([]uint32, bits.OnesCount16(node.internal))
+	for _, entry := range entries {
+		if address := relative(entry); address.Length < _bitmapStride {
+			offset, _ := node.longestMatch(shardIndexV4(address, _bitmapStride), address.Length)
+			results[offset] = entry.index
+		}
+	}
+	b.results = append(b.results, results...)
+
+	node.childBase = uint32(len(b.nodes))
+	b.nodes = append(b.nodes, make([]bitmapNode, len(children))...)
+	b.nodes[nodeIndex] = node
+	for i, child := range children {
+		b.build(node.childBase+uint32(i), depth+_bitmapStride, child.entries)
+	}
+}
+
+// the index of the deepest prefix holding the address, or 0 if there isn't one
+func (b *BitmapTreeV4) find(address patricia.IPv4Address) uint32 {
+	var ret uint32
+	node := &b.nodes[0]
+	for {
+		// the bits past the address's length don't matter, as only prefixes no longer than it are matched
+		chunk := shardIndexV4(address, _bitmapStride)
+		if offset, found := node.longestMatch(chunk, min(address.Length, _bitmapStride-1)); found {
+			ret = b.results[node.resultBase+offset]
+		}
+		if address.Length < _bitmapStride {
+			return ret
+		}
+		offset, found := node.child(chunk)
+		if !found {
+			return ret
+		}
+		node = &b.nodes[node.childBase+offset]
+		address.ShiftLeft(_bitmapStride)
+	}
+}
+
+// CountTags returns the number of tags in the tree
+func (b *BitmapTreeV4) CountTags() int {
+	return len(b.tags)
+}
+
+// FindTags finds all matching tags for the address, like TreeV4.FindTags
+func (b *BitmapTreeV4) FindTags(address patricia.IPv4Address) []bool {
+	return b.appendTags(make([]bool, 0), b.find(address))
+}
+
+// FindTagsAppend finds all matching tags for the address and appends them to ret, like TreeV4.FindTagsAppend
+func (b *BitmapTreeV4) FindTagsAppend(ret []bool, address patricia.IPv4Address) []bool {
+	return b.appendTags(ret, b.find(address))
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree, like TreeV4.FindDeepestTag
+func (b *BitmapTreeV4) FindDeepestTag(address patricia.IPv4Address) (bool, bool) {
+	return b.deepestTag(b.find(address))
+}
+
+// FindDeepestTags finds all tags at the deepest level in the tree, like TreeV4.FindDeepestTags
+// - the returned slice belongs to the tree, and must not be changed
+func (b *BitmapTreeV4) FindDeepestTags(address patricia.IPv4Address) (bool, []bool) {
+	return b.deepestTags(b.find(address))
+}
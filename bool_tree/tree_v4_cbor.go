@@ -0,0 +1,123 @@
+package bool_tree
+
+import (
+	"fmt"
+
+	"github.com/kentik/patricia"
+)
+
+// MarshalCBOR encodes the tree as CBOR (RFC 8949), implementing the Marshaler interface of CBOR packages such as fxamacker/cbor
+// - an array of the prefixes that have tags, in the same order as Walk, each as a 2-item array of the prefix and an array of its tags
+// - prefixes are RFC 9164 IPv4 prefixes: tag 52 on an array of the prefix length and the address bytes, without trailing zero bytes
+// - tags are encoded as the closest CBOR type, except complex numbers, which are arrays of their real and imaginary parts
+func (t *TreeV4) MarshalCBOR() ([]byte, error) {
+	var entries encoder
+	entryCount := 0
+	t.Walk(func(prefix patricia.IPv4Address, tags []bool) bool {
+		entries.cborHead(cborArray, 2)
+
+		addressData := t.addressBytes(prefix)
+		for len(addressData) > 0 && addressData[len(addressData)-1] == 0 {
+			addressData = addressData[:len(addressData)-1]
+		}
+		entries.cborHead(cborTag, _cborPrefixTagV4)
+		entries.cborHead(cborArray, 2)
+		entries.cborHead(cborUint, uint64(prefix.Length))
+		entries.cborHead(cborBytes, uint64(len(addressData)))
+		entries.bytes(addressData)
+
+		entries.cborHead(cborArray, uint64(len(tags)))
+		for _, tag := range tags {
+			entries.cborTag(tag)
+		}
+		entryCount++
+		return entries.err == nil
+	})
+	if entries.err != nil {
+		return nil, entries.err
+	}
+
+	e := encoder{buf: make([]byte, 0, len(entries.buf)+9)}
+	e.cborHead(cborArray, uint64(entryCount))
+	e.bytes(entries.buf)
+	return e.buf, nil
+}
+
+// UnmarshalCBOR replaces the tree's contents with those encoded by MarshalCBOR, implementing the Unmarshaler interface
+// of CBOR packages such as fxamacker/cbor
+// - indefinite-length arrays and half-precision floats are read too, as other encoders may write them
+// - tags are added in order, as with Add, so the tree's options apply
+// - tags are converted to the tree's tag type if they fit, so, for example, a small unsigned integer can be read into an int8 tree
+// - if an error is returned, the tree is left as it was
+func (t *TreeV4) UnmarshalCBOR(data []byte) error {
+	tree := NewTreeV4()
+	tree.config = t.config
+
+	d := decoder{data: data}
+	entryCount := d.cborArray()
+	for entryIndex := 0; d.cborNext(entryCount, entryIndex); entryIndex++ {
+		if d.cborArray() != 2 && d.err == nil {
+			d.fail("entry %d isn't a 2-item array", entryIndex)
+		}
+		address := tree.cborAddress(&d)
+		tagCount := d.cborArray()
+		for tagIndex := 0; d.cborNext(tagCount, tagIndex); tagIndex++ {
+			value := d.cborTagValue()
+			if d.err != nil {
+				break
+			}
+			tag, err := convertTag(value)
+			if err != nil {
+				return fmt.Errorf("entry %d: %w", entryIndex, err)
+			}
+			if _, _, err = tree.Add(address, tag, nil); err != nil {
+				return fmt.Errorf("entry %d (%s): %w", entryIndex, address, err)
+			}
+		}
+		if d.err != nil {
+			return fmt.Errorf("entry %d: %w", entryIndex, d.err)
+		}
+	}
+	if d.err == nil && d.remaining() > 0 {
+		d.fail("%d bytes of trailing data", d.remaining())
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	t.replace(tree)
+	return nil
+}
+
+// read an RFC 9164 prefix - or an address, which is the same as a full-length prefix
+func (t *TreeV4) cborAddress(d *decoder) patricia.IPv4Address {
+	major, number, _ := d.cborHead()
+	if d.err == nil && (major != cborTag || number != _cborPrefixTagV4) {
+		d.fail("expected an IPv4 prefix, as CBOR tag %d", _cborPrefixTagV4)
+	}
+
+	size := len(t.addressBytes(patricia.IPv4Address{}))
+	length := uint64(size * 8)
+	if d.err == nil && d.fill(1) && d.data[0]>>5 == cborArray {
+		if d.cborArray() != 2 && d.err == nil {
+			d.fail("IPv4 prefix isn't a 2-item array")
+		}
+		length = d.cborUint()
+	}
+	data := d.cborBytes()
+	if d.err == nil && (len(data) > size || length > uint64(size*8)) {
+		d.fail("invalid IPv4 prefix: %d address bytes, prefix length %d", len(data), length)
+	}
+	if d.err != nil {
+		return patricia.IPv4Address{}
+	}
+
+	// trailing zero bytes are left out
+	padded := make([]byte, size)
+	copy(padded, data)
+	address, err := t.addressFromBytes(padded, uint(length))
+	if err != nil {
+		d.fail("%s", err)
+	}
+	return address
+}
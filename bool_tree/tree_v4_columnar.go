@@ -0,0 +1,110 @@
+package bool_tree
+
+import (
+	"time"
+
+	"github.com/kentik/patricia"
+)
+
+// ColumnarTreeV4 is a read-only copy of a tree, with its nodes laid out as a structure of arrays - see TreeV4.Columnar
+// - each of the nodes' fields is in an array of its own, so a lookup only pulls the fields it checks into cache, and
+// each cache line holds several times as many nodes' worth of them as it does of the tree's own nodes
+// - the nodes are the tree's, in the order Walk visits them, so a node's left child comes right after it
+// - unlike OptimizedTreeV4, nothing's copied more than once, so it takes less memory than the tree, and is quick to build
+// - safe for concurrent use
+type ColumnarTreeV4 struct {
+	prefixBits    []prefixBitsV4 // each node's prefix, relative to its parent - the first node is the root
+	prefixLengths []uint8
+	children      [][2]uint32 // each node's left and right child, or 0 for none
+	tagIndexes    []uint32    // each node's prefix, with its tags, or 0 if it has none
+	prefixTags
+}
+
+// Columnar returns a read-only copy of the tree, with its nodes laid out as a structure of arrays, for lookups in large
+// trees, which spend most of their time waiting on memory - see ColumnarTreeV4
+// - expired tags are left out, and tags that haven't expired yet are kept without their expiration times
+// - the copy doesn't change along with this tree: call Columnar again to pick up changes
+func (t *TreeV4) Columnar() *ColumnarTreeV4 {
+	ret := &ColumnarTreeV4{prefixTags: prefixTags{prefixes: make([]optimizedPrefix, 1)}}
+	ret.copyNode(t, 1, 0, time.Now().UnixNano())
+	return ret
+}
+
+// copy the node at the input index in the tree, and the nodes below it, returning the copy's index
+// - parentIndex is the index of the deepest prefix holding the node
+func (c *ColumnarTreeV4) copyNode(t *TreeV4, nodeIndex uint, parentIndex uint32, now int64) uint32 {
+	node := &t.nodes[nodeIndex]
+	ret := uint32(len(c.prefixBits))
+	c.prefixBits = append(c.prefixBits, node.prefixBits())
+	c.prefixLengths = append(c.prefixLengths, uint8(node.length()))
+	c.children = append(c.children, [2]uint32{})
+	c.tagIndexes = append(c.tagIndexes, 0)
+	if tags := t.unexpiredTags(nodeIndex, now); len(tags) > 0 {
+		parentIndex = c.add(tags, parentIndex)
+		c.tagIndexes[ret] = parentIndex
+	}
+
+	if node.Left != 0 {
+		left := c.copyNode(t, uint(node.Left), parentIndex, now)
+		c.children[ret][0] = left
+	}
+	if node.Right != 0 {
+		right := c.copyNode(t, uint(node.Right), parentIndex, now)
+		c.children[ret][1] = right
+	}
+	return ret
+}
+
+// the index of the deepest prefix holding the address, or 0 if there isn't one
+func (c *ColumnarTreeV4) find(address patricia.IPv4Address) uint32 {
+	ret := c.tagIndexes[0]
+	nodeIndex := uint32(0)
+	for address.Length > 0 {
+		side := 0
+		if address.IsLeftBitSet() {
+			side = 1
+		}
+		nodeIndex = c.children[nodeIndex][side]
+		if nodeIndex == 0 {
+			return ret
+		}
+
+		prefixLength := uint(c.prefixLengths[nodeIndex])
+		matchCount := matchPrefixBitsV4(c.prefixBits[nodeIndex], prefixLength, address)
+		if matchCount < prefixLength {
+			// didn't match the entire node - we're done
+			return ret
+		}
+		if tagIndex := c.tagIndexes[nodeIndex]; tagIndex != 0 {
+			ret = tagIndex
+		}
+		address.ShiftLeft(matchCount)
+	}
+	return ret
+}
+
+// CountTags returns the number of tags in the tree
+func (c *ColumnarTreeV4) CountTags() int {
+	return len(c.tags)
+}
+
+// FindTags finds all matching tags for the address, like TreeV4.FindTags
+func (c *ColumnarTreeV4) FindTags(address patricia.IPv4Address) []bool {
+	return c.appendTags(make([]bool, 0), c.find(address))
+}
+
+// FindTagsAppend finds all matching tags for the address and appends them to ret, like TreeV4.FindTagsAppend
+func (c *ColumnarTreeV4) FindTagsAppend(ret []bool, address patricia.IPv4Address) []bool {
+	return c.appendTags(ret, c.find(address))
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree, like TreeV4.FindDeepestTag
+func (c *ColumnarTreeV4) FindDeepestTag(address patricia.IPv4Address) (bool, bool) {
+	return c.deepestTag(c.find(address))
+}
+
+// FindDeepestTags finds all tags at the deepest level in the tree, like TreeV4.FindDeepestTags
+// - the returned slice belongs to the tree, and must not be changed
+func (c *ColumnarTreeV4) FindDeepestTags(address patricia.IPv4Address) (bool, []bool) {
+	return c.deepestTags(c.find(address))
+}
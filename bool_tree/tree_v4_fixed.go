@@ -0,0 +1,113 @@
+package bool_tree
+
+import (
+	"fmt"
+	"math/bits"
+
+	"github.com/kentik/patricia"
+)
+
+// FixedLengthTreeV4 is a read-only copy of a tree whose prefixes are all the same length - /24s, say - kept in a hash
+// table, so a lookup is a hash and a probe or two, rather than a walk down the trie - see TreeV4.OptimizeFixedLength
+// - short prefixes are kept in an array indexed by their bits instead, when it takes no more memory than the table
+// would, so a lookup is a single read
+// - addresses shorter than the prefixes don't match any of them
+// - safe for concurrent use
+type FixedLengthTreeV4 struct {
+	length uint          // of every prefix in the tree
+	slots  []fixedSlotV4 // the hash table, a power of 2 long, with empty slots in between - nil when direct is used
+	shift  uint          // how far right to shift a prefix's hash for its first slot
+	direct []uint32      // the prefix with each value of the first length bits, or 0 for none, instead of slots
+	prefixTags
+}
+
+// a slot in a FixedLengthTreeV4's hash table
+type fixedSlotV4 struct {
+	prefix patricia.IPv4Address
+	index  uint32 // in the tree's prefixes, or 0 for an empty slot
+}
+
+// OptimizeFixedLength returns a read-only copy of a tree whose prefixes are all the same length, for trees of /24s, or
+// /64s, say, that need none of what a trie's for - see FixedLengthTreeV4
+// - fails with ErrMixedPrefixLengths if the tree holds prefixes of more than one length
+// - expired tags are left out, and tags that haven't expired yet are kept without their expiration times
+// - the copy doesn't change along with this tree: call OptimizeFixedLength again to pick up changes
+func (t *TreeV4) OptimizeFixedLength() (*FixedLengthTreeV4, error) {
+	ret := &FixedLengthTreeV4{}
+	var entries []optimizedEntryV4
+	ret.prefixTags, entries = t.readOnlyPrefixes()
+	if len(entries) > 0 {
+		ret.length = entries[0].address.Length
+	}
+	for _, entry := range entries {
+		if entry.address.Length != ret.length {
+			return nil, fmt.Errorf("%w: /%d and /%d", ErrMixedPrefixLengths, ret.length, entry.address.Length)
+		}
+	}
+
+	// half the hash table's slots are left empty, so probes stay short, and a slot takes several times the memory of
+	// an entry in the array
+	tableBits := uint(bits.Len(uint(len(entries)))) + 1
+	if ret.length <= tableBits+2 {
+		ret.direct = make([]uint32, 1<<ret.length)
+		for _, entry := range entries {
+			ret.direct[shardIndexV4(entry.address, ret.length)] = entry.index
+		}
+		return ret, nil
+	}
+	ret.slots = make([]fixedSlotV4, 1<<tableBits)
+	ret.shift = 64 - tableBits
+	mask := uint64(len(ret.slots) - 1)
+	for _, entry := range entries {
+		prefix := maskAddressV4(entry.address, ret.length)
+		i := hashAddressV4(prefix) >> ret.shift
+		for ret.slots[i].index != 0 {
+			i = (i + 1) & mask
+		}
+		ret.slots[i] = fixedSlotV4{prefix: prefix, index: entry.index}
+	}
+	return ret, nil
+}
+
+// the index of the prefix holding the address, or 0 if there isn't one
+func (f *FixedLengthTreeV4) find(address patricia.IPv4Address) uint32 {
+	if address.Length < f.length {
+		return 0
+	}
+	if f.direct != nil {
+		return f.direct[shardIndexV4(address, f.length)]
+	}
+	prefix := maskAddressV4(address, f.length)
+	mask := uint64(len(f.slots) - 1)
+	for i := hashAddressV4(prefix) >> f.shift; ; i = (i + 1) & mask {
+		if slot := &f.slots[i]; slot.index == 0 || slot.prefix == prefix {
+			return slot.index
+		}
+	}
+}
+
+// CountTags returns the number of tags in the tree
+func (f *FixedLengthTreeV4) CountTags() int {
+	return len(f.tags)
+}
+
+// FindTags finds all matching tags for the address, like TreeV4.FindTags
+func (f *FixedLengthTreeV4) FindTags(address patricia.IPv4Address) []bool {
+	return f.appendTags(make([]bool, 0), f.find(address))
+}
+
+// FindTagsAppend finds all matching tags for the address and appends them to ret, like TreeV4.FindTagsAppend
+func (f *FixedLengthTreeV4) FindTagsAppend(ret []bool, address patricia.IPv4Address) []bool {
+	return f.appendTags(ret, f.find(address))
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree, like TreeV4.FindDeepestTag
+func (f *FixedLengthTreeV4) FindDeepestTag(address patricia.IPv4Address) (bool, bool) {
+	return f.deepestTag(f.find(address))
+}
+
+// FindDeepestTags finds all tags at the deepest level in the tree, like TreeV4.FindDeepestTags
+// - the returned slice belongs to the tree, and must not be changed
+func (f *FixedLengthTreeV4) FindDeepestTags(address patricia.IPv4Address) (bool, []bool) {
+	return f.deepestTags(f.find(address))
+}
@@ -0,0 +1,63 @@
+package bool_tree
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// TreeHandleV4 double-buffers a tree: readers Load the active tree, while writers change the standby tree, then Swap it in
+// - Load never locks, and always returns a whole tree, from before or after a swap
+// - once swapped in, a tree is never changed again, so readers can keep using whatever Load returned for as long as they need
+// - the new standby tree after a swap is a Snapshot of the new active tree, so it starts out the same, and is only copied
+// when it's first changed
+// - Standby, Swap, and Store must only be called by one goroutine at a time - Update takes care of that for several writers
+type TreeHandleV4 struct {
+	writeMu sync.Mutex // held by Update
+	active  atomic.Pointer[TreeV4]
+	standby *TreeV4
+}
+
+// NewTreeHandleV4 returns a handle on a new, empty tree
+func NewTreeHandleV4(options ...TreeOption) *TreeHandleV4 {
+	ret := &TreeHandleV4{}
+	ret.Store(NewTreeV4(options...))
+	return ret
+}
+
+// Load returns the active tree, which must not be changed
+func (h *TreeHandleV4) Load() *TreeV4 {
+	return h.active.Load()
+}
+
+// Standby returns the standby tree, to be changed and then swapped in with Swap
+func (h *TreeHandleV4) Standby() *TreeV4 {
+	return h.standby
+}
+
+// Swap makes the standby tree active, returning it, with a new standby tree that's the same as it
+func (h *TreeHandleV4) Swap() *TreeV4 {
+	active := h.standby
+	h.Store(active)
+	return active
+}
+
+// Store makes the input tree active, such as one rebuilt from scratch, with a new standby tree that's the same as it
+// - the tree must not be changed after this
+func (h *TreeHandleV4) Store(tree *TreeV4) {
+	h.standby = tree.Snapshot()
+	h.active.Store(tree)
+}
+
+// Update calls updateFunc with the standby tree, then swaps it in if updateFunc returns nil, for any number of writers
+// - if updateFunc returns an error, the standby tree is reset to the active tree, throwing away anything updateFunc did, and
+// the error is returned
+func (h *TreeHandleV4) Update(updateFunc func(standby *TreeV4) error) error {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+	if err := updateFunc(h.standby); err != nil {
+		h.standby = h.active.Load().Snapshot()
+		return err
+	}
+	h.Swap()
+	return nil
+}
@@ -0,0 +1,148 @@
+package bool_tree
+
+import (
+	"github.com/kentik/patricia"
+)
+
+// ChangeHookV4 is called with a tag that's been added to or deleted from a tree, and its prefix - see TreeV4.OnAdd
+type ChangeHookV4 func(prefix patricia.IPv4Address, tag bool, op ChangeOp)
+
+// the hooks registered on a tree
+type changeHooksV4 struct {
+	onAdd    []ChangeHookV4
+	onDelete []ChangeHookV4
+}
+
+// OnAdd registers hook to be called for every tag added to the tree, once the change adding it is done
+// - changes are worked out by comparing the tags at a prefix before and after, so replacing a tag with an equal one
+// doesn't call any hooks, and updating one in place is a delete, then an add
+// - replacing the tree's contents by decoding one deletes every tag it had, then adds every tag it has now
+// - hooks are called from the goroutine making the change, and must not change the tree
+// - hooks aren't copied to clones or snapshots
+func (t *TreeV4) OnAdd(hook ChangeHookV4) {
+	if t.hooks == nil {
+		t.hooks = &changeHooksV4{}
+	}
+	t.hooks.onAdd = append(t.hooks.onAdd, hook)
+}
+
+// OnDelete registers hook to be called for every tag deleted from the tree, once the change deleting it is done - see OnAdd
+func (t *TreeV4) OnDelete(hook ChangeHookV4) {
+	if t.hooks == nil {
+		t.hooks = &changeHooksV4{}
+	}
+	t.hooks.onDelete = append(t.hooks.onDelete, hook)
+}
+
+// ClearHooks removes every hook registered with OnAdd and OnDelete
+func (t *TreeV4) ClearHooks() {
+	t.hooks = nil
+}
+
+// call the hooks for op on each tag
+func (t *TreeV4) callHooks(prefix patricia.IPv4Address, tags []bool, op ChangeOp) {
+	hooks := t.hooks.onAdd
+	if op == ChangeDelete {
+		hooks = t.hooks.onDelete
+	}
+	for _, tag := range tags {
+		for _, hook := range hooks {
+			hook(prefix, tag, op)
+		}
+	}
+}
+
+// the tags at exactly the address, including any that have expired, for comparing with what's there after a change
+func (t *TreeV4) hookTags(address patricia.IPv4Address) []bool {
+	nodeIndex, _, err := t.findNode(address)
+	if err != nil || nodeIndex == 0 {
+		return nil
+	}
+	return t.rawTagsForNode(nodeIndex)
+}
+
+// all the tags for the node, including any that have expired
+func (t *TreeV4) rawTagsForNode(nodeIndex uint) []bool {
+	return append([]bool(nil), t.nodeTags(nodeIndex)...)
+}
+
+// call the hooks for how the tags at the address have changed since they were before
+// - deferred by changes to a single address, with the tags from hookTags
+func (t *TreeV4) hookChanges(address patricia.IPv4Address, before []bool) {
+	after := t.hookTags(address)
+
+	// pair off the tags that are in both, leaving what was deleted and what was added
+	kept := make([]bool, len(after))
+	var deleted []bool
+	for _, tag := range before {
+		found := false
+		for i := range after {
+			if !kept[i] && after[i] == tag {
+				kept[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			deleted = append(deleted, tag)
+		}
+	}
+	var added []bool
+	for i, tag := range after {
+		if !kept[i] {
+			added = append(added, tag)
+		}
+	}
+
+	prefix := hookPrefixV4(address)
+	t.callHooks(prefix, deleted, ChangeDelete)
+	t.callHooks(prefix, added, ChangeAdd)
+}
+
+// the address as hooks are given it, with the bits past its length cleared, as they are in walks
+func hookPrefixV4(address patricia.IPv4Address) patricia.IPv4Address {
+	var prefix treeNodeV4
+	addressNode := treeNodeV4FromAddress(address)
+	prefix.MergeFromNodes(&prefix, &addressNode)
+	return prefix.Address()
+}
+
+// every prefix within the address with tags, and all of its tags, including those that have expired, before a change
+// that deletes them
+// - if strict, the address's own tags are left out
+func (t *TreeV4) hookSubtree(address patricia.IPv4Address, strict bool) []EntryV4 {
+	var ret []EntryV4
+	t.walkSubtreeNodes(address, func(nodeIndex uint, prefix treeNodeV4) bool {
+		if t.nodes[nodeIndex].TagCount > 0 && !(strict && prefix.length() == address.Length) {
+			ret = append(ret, EntryV4{Prefix: prefix.Address(), Tags: t.rawTagsForNode(nodeIndex)})
+		}
+		return true
+	})
+	return ret
+}
+
+// call the hooks for op on every tag in entries
+func (t *TreeV4) hookEntries(entries []EntryV4, op ChangeOp) {
+	for _, entry := range entries {
+		t.callHooks(entry.Prefix, entry.Tags, op)
+	}
+}
+
+// every prefix with expired tags, and those tags, before they're swept
+func (t *TreeV4) hookExpired(now int64) []EntryV4 {
+	var ret []EntryV4
+	t.walkNodes(1, treeNodeV4{}, func(nodeIndex uint, prefix treeNodeV4) bool {
+		expirations := t.nodeExpirations(nodeIndex)
+		var expiredTags []bool
+		for i, tag := range t.nodeTags(nodeIndex) {
+			if expirations != nil && expired(expirations[i], now) {
+				expiredTags = append(expiredTags, tag)
+			}
+		}
+		if len(expiredTags) > 0 {
+			ret = append(ret, EntryV4{Prefix: prefix.Address(), Tags: expiredTags})
+		}
+		return true
+	})
+	return ret
+}
@@ -0,0 +1,277 @@
+package bool_tree
+
+import (
+	"time"
+
+	"github.com/kentik/patricia"
+)
+
+// OptimizedTreeV4 is a read-only copy of a tree, laid out for lookups that touch as little memory as they can - see
+// TreeV4.Optimize
+// - each node branches on several bits of the address at once, rather than one, so a lookup visits a few nodes, not
+// one for every prefix it passes
+// - a prefix shorter than the bits a node branches on is copied into every slot it covers, so each slot holds the
+// deepest prefix matching there, and lookups don't need to look back for it
+// - safe for concurrent use
+type OptimizedTreeV4 struct {
+	nodes []optimizedNodeV4 // the first node is the root
+	slots []optimizedSlot
+	inner []optimizedInnerV4
+	prefixTags
+	root uint32 // the prefix with a length of 0, if it has tags
+}
+
+// a node in an OptimizedTreeV4
+type optimizedNodeV4 struct {
+	// bits every address below the node has, relative to the node's parent, which lookups check and skip past
+	path patricia.IPv4Address
+
+	// the node branches on this many bits after the path, to 1<<bits slots starting at firstSlot
+	bits      uint
+	firstSlot uint32
+
+	// the prefixes shorter than bits, after the path, for lookups of addresses that end part way through them
+	firstInner uint32
+	innerCount uint32
+}
+
+// a prefix that ends part way through the bits a node branches on
+type optimizedInnerV4 struct {
+	prefix patricia.IPv4Address // relative to the node's path
+	index  uint32               // in the tree's prefixes
+}
+
+// a prefix, with its full address, while an OptimizedTreeV4 is being built
+type optimizedEntryV4 struct {
+	address patricia.IPv4Address
+	index   uint32
+}
+
+// Optimize returns a read-only copy of the tree, laid out for lookups that touch much less memory than they do in this
+// tree, for read-mostly workloads - see OptimizedTreeV4
+// - takes longer than copying the tree, and more memory, as prefixes are copied into each slot they cover
+// - expired tags are left out, and tags that haven't expired yet are kept without their expiration times
+// - the copy doesn't change along with this tree: call Optimize again to pick up changes
+func (t *TreeV4) Optimize() *OptimizedTreeV4 {
+	ret, _ := t.optimize()
+	return ret
+}
+
+// build an optimized copy of the tree, returning it along with the prefixes it holds, other than the root's, in order
+func (t *TreeV4) optimize() (*OptimizedTreeV4, []optimizedEntryV4) {
+	ret := &OptimizedTreeV4{}
+	var entries []optimizedEntryV4
+	ret.prefixTags, entries = t.readOnlyPrefixes()
+
+	// the root's tags hold for every address, so every lookup starts with them
+	if len(entries) > 0 && entries[0].address.Length == 0 {
+		ret.root = entries[0].index
+		entries = entries[1:]
+	}
+	ret.nodes = append(ret.nodes, optimizedNodeV4{})
+	ret.build(0, 0, ret.root, entries)
+	return ret, entries
+}
+
+// copy the prefixes with tags, and their tags, for a read-only tree, returning them along with their full prefixes,
+// in order, by address, then length, as Walk visits them
+// - expired tags are left out, along with prefixes left without any
+func (t *TreeV4) readOnlyPrefixes() (prefixTags, []optimizedEntryV4) {
+	ret := prefixTags{prefixes: make([]optimizedPrefix, 1)}
+	var entries []optimizedEntryV4
+	t.readOnlyEntries(1, treeNodeV4{}, 0, time.Now().UnixNano(), &ret, &entries)
+	return ret, entries
+}
+
+// add the prefixes with tags at the node at the input index, and below it, to p and entries, in order
+// - parent is the full prefix of the node's parent, and parentIndex the index of the deepest prefix holding the node
+func (t *TreeV4) readOnlyEntries(nodeIndex uint, parent treeNodeV4, parentIndex uint32, now int64, p *prefixTags, entries *[]optimizedEntryV4) {
+	node := &t.nodes[nodeIndex]
+	prefix := parent
+	prefix.MergeFromNodes(&parent, node)
+	if tags := t.unexpiredTags(nodeIndex, now); len(tags) > 0 {
+		parentIndex = p.add(tags, parentIndex)
+		*entries = append(*entries, optimizedEntryV4{address: prefix.Address(), index: parentIndex})
+	}
+	if node.Left != 0 {
+		t.readOnlyEntries(uint(node.Left), prefix, parentIndex, now, p, entries)
+	}
+	if node.Right != 0 {
+		t.readOnlyEntries(uint(node.Right), prefix, parentIndex, now, p, entries)
+	}
+}
+
+// returns the tags at the input node that haven't expired by now, which belong to the tree unless some have
+func (t *TreeV4) unexpiredTags(nodeIndex uint, now int64) []bool {
+	tags := t.nodeTags(nodeIndex)
+	expirations := t.nodeExpirations(nodeIndex)
+	if expirations == nil {
+		return tags
+	}
+	ret := make([]bool, 0, len(tags))
+	for i, tag := range tags {
+		if !expired(expirations[i], now) {
+			ret = append(ret, tag)
+		}
+	}
+	return ret
+}
+
+// build the node at the input index, for entries that share their first depth bits, and are all longer than that
+// - the entries must be in order, by address, then length, as Walk visits them
+// - inherited is the index of the deepest prefix holding all of the entries
+func (o *OptimizedTreeV4) build(nodeIndex uint32, depth uint, inherited uint32, entries []optimizedEntryV4) {
+	if len(entries) == 0 {
+		// only the root can be empty
+		o.nodes[nodeIndex].firstSlot = uint32(len(o.slots))
+		o.slots = append(o.slots, optimizedSlot{prefix: inherited})
+		return
+	}
+
+	// skip past the bits all the entries share
+	relative := func(entry optimizedEntryV4) patricia.IPv4Address {
+		address := entry.address
+		address.ShiftLeft(depth)
+		return address
+	}
+	path := treeNodeV4FromAddress(relative(entries[0]))
+	longest := uint(0)
+	for _, entry := range entries {
+		path.setLength(path.MatchCount(relative(entry)))
+		longest = max(longest, entry.address.Length)
+	}
+	depth += path.length()
+
+	// branch on as many bits as keep at least half the slots in use, going by where the entries start
+	bits := uint(0)
+	if longest > depth {
+		bits = 1
+		for next := uint(2); next <= _optimizedMaxBits && depth+next <= _maxPrefixLengthV4; next++ {
+			used, last := 0, -1
+			for _, entry := range entries {
+				if slot := o.firstSlot(relative(entry), next); slot != last {
+					used, last = used+1, slot
+				}
+			}
+			if used*2 < 1<<next {
+				break
+			}
+			bits = next
+		}
+	}
+
+	node := optimizedNodeV4{path: path.Address(), bits: bits, firstSlot: uint32(len(o.slots)), firstInner: uint32(len(o.inner))}
+	slots := make([]optimizedSlot, 1<<bits)
+	for i := range slots {
+		slots[i].prefix = inherited
+	}
+
+	// entries no longer than the bits go in each slot they cover - containing prefixes come first, so the deepest
+	// ends up in each - and longer ones are handed on to a node for their slot, which they're all together in
+	type child struct {
+		slot    int
+		entries []optimizedEntryV4
+	}
+	var children []child
+	for i := 0; i < len(entries); {
+		address := relative(entries[i])
+		if address.Length > bits {
+			slot := shardIndexV4(address, bits)
+			end := i + 1
+			for end < len(entries) && o.firstSlot(relative(entries[end]), bits) == slot {
+				end++
+			}
+			children = append(children, child{slot: slot, entries: entries[i:end]})
+			i = end
+			continue
+		}
+
+		first := o.firstSlot(address, bits)
+		for slot := first; slot < first+1<<(bits-address.Length); slot++ {
+			slots[slot].prefix = entries[i].index
+		}
+		if address.Length < bits {
+			o.inner = append(o.inner, optimizedInnerV4{prefix: address, index: entries[i].index})
+		}
+		i++
+	}
+	node.innerCount = uint32(len(o.inner)) - node.firstInner
+	o.slots = append(o.slots, slots...)
+	o.nodes[nodeIndex] = node
+
+	for _, child := range children {
+		childIndex := uint32(len(o.nodes))
+		o.nodes = append(o.nodes, optimizedNodeV4{})
+		slot := &o.slots[node.firstSlot+uint32(child.slot)]
+		slot.child = childIndex
+		o.build(childIndex, depth+bits, slot.prefix, child.entries)
+	}
+}
+
+// the first of a node's slots, branching on bits, that the relative address falls in
+func (o *OptimizedTreeV4) firstSlot(address patricia.IPv4Address, bits uint) int {
+	if address.Length >= bits {
+		return shardIndexV4(address, bits)
+	}
+	return shardIndexV4(address, address.Length) << (bits - address.Length)
+}
+
+// the index of the deepest prefix holding the address, or 0 if there isn't one
+func (o *OptimizedTreeV4) find(address patricia.IPv4Address) uint32 {
+	ret := o.root
+	node := &o.nodes[0]
+	for {
+		if node.path.Length > 0 {
+			path := treeNodeV4FromAddress(node.path)
+			if address.Length < node.path.Length || path.MatchCount(address) < node.path.Length {
+				return ret
+			}
+			address.ShiftLeft(node.path.Length)
+		}
+		if address.Length < node.bits {
+			// the address ends part way through the bits, so only the prefixes no longer than it can hold it - the
+			// deepest come last
+			for _, inner := range o.inner[node.firstInner : node.firstInner+node.innerCount] {
+				prefix := treeNodeV4FromAddress(inner.prefix)
+				if inner.prefix.Length <= address.Length && prefix.MatchCount(address) == inner.prefix.Length {
+					ret = inner.index
+				}
+			}
+			return ret
+		}
+
+		slot := &o.slots[node.firstSlot+uint32(shardIndexV4(address, node.bits))]
+		ret = slot.prefix
+		if slot.child == 0 {
+			return ret
+		}
+		address.ShiftLeft(node.bits)
+		node = &o.nodes[slot.child]
+	}
+}
+
+// CountTags returns the number of tags in the tree
+func (o *OptimizedTreeV4) CountTags() int {
+	return len(o.tags)
+}
+
+// FindTags finds all matching tags for the address, like TreeV4.FindTags
+func (o *OptimizedTreeV4) FindTags(address patricia.IPv4Address) []bool {
+	return o.appendTags(make([]bool, 0), o.find(address))
+}
+
+// FindTagsAppend finds all matching tags for the address and appends them to ret, like TreeV4.FindTagsAppend
+func (o *OptimizedTreeV4) FindTagsAppend(ret []bool, address patricia.IPv4Address) []bool {
+	return o.appendTags(ret, o.find(address))
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree, like TreeV4.FindDeepestTag
+func (o *OptimizedTreeV4) FindDeepestTag(address patricia.IPv4Address) (bool, bool) {
+	return o.deepestTag(o.find(address))
+}
+
+// FindDeepestTags finds all tags at the deepest level in the tree, like TreeV4.FindDeepestTags
+// - the returned slice belongs to the tree, and must not be changed
+func (o *OptimizedTreeV4) FindDeepestTags(address patricia.IPv4Address) (bool, []bool) {
+	return o.deepestTags(o.find(address))
+}
@@ -0,0 +1,37 @@
+package bool_tree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/kentik/patricia"
+)
+
+// WriteRoutes writes the tree to w as a routing table, in the input style, with a line for each tag
+// - lines are in the same order as Walk, so the output of two trees can be compared with diff
+// - formatFunc decides what each tag's route says - if it's nil, each line is just the prefix, with the tag as a comment
+func (t *TreeV4) WriteRoutes(w io.Writer, style RouteStyle, formatFunc RouteFormatFunc) error {
+	if style != RouteStyleIP && style != RouteStyleBIRD {
+		return fmt.Errorf("unknown route style %d", style)
+	}
+	if formatFunc == nil {
+		formatFunc = formatRouteTag
+	}
+
+	bw := bufio.NewWriter(w)
+	var err error
+	t.Walk(func(prefix patricia.IPv4Address, tags []bool) bool {
+		for _, tag := range tags {
+			route, comment := formatFunc(tag)
+			if _, err = bw.WriteString(style.line(prefix.String(), route, comment) + "\n"); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
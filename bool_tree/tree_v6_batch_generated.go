@@ -0,0 +1,145 @@
+package bool_tree
+
+import (
+	"fmt"
+
+	"github.com/kentik/patricia"
+)
+
+// BatchV6 collects mutations to a TreeV6 so they can be applied all-or-nothing with Commit
+// - nothing is applied to the tree until Commit is called
+// - not thread-safe, same as the tree
+type BatchV6 struct {
+	tree *TreeV6
+	ops  []batchOpV6
+}
+
+type batchOpV6 struct {
+	kind      batchOpKind
+	address   patricia.IPv6Address
+	tag       bool
+	matchFunc MatchesFunc
+}
+
+// NewBatch returns an empty batch of mutations for this tree
+func (t *TreeV6) NewBatch() *BatchV6 {
+	return &BatchV6{tree: t}
+}
+
+// Add queues adding a tag to the tree - see TreeV6.Add
+func (b *BatchV6) Add(address patricia.IPv6Address, tag bool, matchFunc MatchesFunc) {
+	b.ops = append(b.ops, batchOpV6{kind: batchOpAdd, address: address, tag: tag, matchFunc: matchFunc})
+}
+
+// Set queues setting the single value for a node - see TreeV6.Set
+func (b *BatchV6) Set(address patricia.IPv6Address, tag bool) {
+	b.ops = append(b.ops, batchOpV6{kind: batchOpSet, address: address, tag: tag})
+}
+
+// Delete queues deleting the tags matching matchVal - see TreeV6.Delete
+func (b *BatchV6) Delete(address patricia.IPv6Address, matchFunc MatchesFunc, matchVal bool) {
+	b.ops = append(b.ops, batchOpV6{kind: batchOpDelete, address: address, tag: matchVal, matchFunc: matchFunc})
+}
+
+// Len returns how many operations are queued
+func (b *BatchV6) Len() int {
+	return len(b.ops)
+}
+
+// Rollback discards all queued operations, leaving the tree untouched
+func (b *BatchV6) Rollback() {
+	b.ops = b.ops[:0]
+}
+
+// Commit validates, then applies all queued operations to the tree
+// - either all operations are applied, or, if an error is returned, the tree is left exactly as it was
+// - the operations are applied to a copy of the tree which replaces it on success, so this needs memory for a second tree
+// - the batch is empty afterwards, whether or not the commit succeeded
+// - change logs and hooks see where the ops left each address they name, along with any prefixes the tree's prefix limit
+// evicted to make room
+func (b *BatchV6) Commit() error {
+	defer b.Rollback()
+
+	if b.tree.frozen != nil {
+		return ErrFrozen
+	}
+	for i, op := range b.ops {
+		if err := b.tree.validateAddress(op.address); err != nil {
+			return fmt.Errorf("batch operation %d: %w", i, err)
+		}
+		if op.kind == batchOpDelete && op.matchFunc == nil {
+			return fmt.Errorf("batch operation %d: delete from %s requires a match function", i, op.address)
+		}
+	}
+
+	// the copy has no hooks either, so note the tags at each address the ops change, to work out what they did
+	var hookAddresses []patricia.IPv6Address
+	var hookTags [][]bool
+	seen := make(map[patricia.IPv6Address]bool, len(b.ops))
+	for _, op := range b.ops {
+		prefix := hookPrefixV6(op.address)
+		if !seen[prefix] {
+			seen[prefix] = true
+			if b.tree.hooks != nil {
+				hookAddresses = append(hookAddresses, prefix)
+				hookTags = append(hookTags, b.tree.hookTags(prefix))
+			}
+		}
+	}
+
+	// a prefix limit can evict prefixes the ops don't name from the copy - note what they had as it goes, to log and hook
+	// their deletion too
+	tree := b.tree.Clone()
+	var evicted []patricia.IPv6Address
+	var evictedTags [][]bool
+	if tree.config.maxPrefixes > 0 && (b.tree.changeLog != nil || b.tree.hooks != nil) {
+		tree.OnDelete(func(prefix patricia.IPv6Address, tag bool, _ ChangeOp) {
+			if seen[prefix] {
+				return
+			}
+			if len(evicted) == 0 || evicted[len(evicted)-1] != prefix {
+				evicted = append(evicted, prefix)
+				evictedTags = append(evictedTags, nil)
+			}
+			evictedTags[len(evictedTags)-1] = append(evictedTags[len(evictedTags)-1], tag)
+		})
+	}
+
+	for i, op := range b.ops {
+		var opErr error
+		switch op.kind {
+		case batchOpAdd:
+			_, _, opErr = tree.Add(op.address, op.tag, op.matchFunc)
+		case batchOpSet:
+			_, _, opErr = tree.Set(op.address, op.tag)
+		case batchOpDelete:
+			_, opErr = tree.Delete(op.address, op.matchFunc, op.tag)
+		}
+		if opErr != nil {
+			return fmt.Errorf("batch operation %d (%s %s): %w", i, op.kind, op.address, opErr)
+		}
+	}
+
+	// the copy wasn't logging, so the ops weren't logged as they were applied - log where they've left things, after the
+	// evictions that made room for them
+	tree.changeLog, tree.changeSeq, tree.hooks = b.tree.changeLog, b.tree.changeSeq, b.tree.hooks
+	*b.tree = *tree
+	b.tree.changing()
+	if b.tree.changeLog != nil {
+		for _, prefix := range evicted {
+			b.tree.logTags(prefix)
+		}
+		for _, op := range b.ops {
+			b.tree.logTags(op.address)
+		}
+	}
+	if b.tree.hooks != nil {
+		for i, prefix := range evicted {
+			b.tree.callHooks(prefix, evictedTags[i], ChangeDelete)
+		}
+	}
+	for i, address := range hookAddresses {
+		b.tree.hookChanges(address, hookTags[i])
+	}
+	return nil
+}
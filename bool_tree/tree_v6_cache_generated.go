@@ -0,0 +1,76 @@
+package bool_tree
+
+import (
+	"math/bits"
+	"sync/atomic"
+
+	"github.com/kentik/patricia"
+)
+
+// LookupCacheV6 answers FindDeepestTag for a tree from a small cache of recent results, checked before the tree, for
+// workloads where a few addresses make up most lookups - see TreeV6.NewLookupCache
+// - direct-mapped: each address has one slot, holding the last address looked up there, so a hit costs a hash and a
+// compare, and a miss a lookup in the tree
+// - any change to the tree empties it, as each slot notes the change it was filled after
+// - while the tree has tags with expiration times, lookups go straight to the tree, as tags expiring changes their
+// results without changing the tree
+// - not safe for concurrent use - each goroutine doing lookups needs its own, which keeps them from evicting each
+// other's addresses too
+type LookupCacheV6 struct {
+	tree   *TreeV6
+	slots  []lookupCacheSlotV6
+	shift  uint // how far to shift an address's hash right to get its slot
+	hits   uint64
+	misses uint64
+}
+
+// an address, and what FindDeepestTag returned for it
+type lookupCacheSlotV6 struct {
+	address   patricia.IPv6Address
+	changeSeq uint64 // the tree's, plus 1, when the slot was filled, so an empty slot never matches
+	nodeIndex uint   // the node the tag came from, or 0
+	found     bool
+	tag       bool
+}
+
+// NewLookupCache returns a cache of the results of FindDeepestTag for the addresses looked up most recently, to check
+// before the tree - see LookupCacheV6
+// - size is how many addresses it holds, rounded up to a power of 2 - a few times as many as there are hot addresses
+// keeps them from pushing each other out
+func (t *TreeV6) NewLookupCache(size int) *LookupCacheV6 {
+	slotBits := uint(bits.Len(uint(max(size, 1) - 1)))
+	return &LookupCacheV6{tree: t, slots: make([]lookupCacheSlotV6, 1<<slotBits), shift: 64 - slotBits}
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree, like TreeV6.FindDeepestTag, from the cache if it's there
+func (c *LookupCacheV6) FindDeepestTag(address patricia.IPv6Address) (found bool, ret bool, err error) {
+	t := c.tree
+	if t.tags.expiring > 0 {
+		return t.FindDeepestTag(address)
+	}
+	changeSeq := t.changeSeq + 1
+	slot := &c.slots[hashAddressV6(address)>>c.shift]
+	if slot.changeSeq == changeSeq && slot.address == address {
+		c.hits++
+		t.hit(slot.nodeIndex)
+		return slot.found, slot.tag, nil
+	}
+
+	c.misses++
+	if _raceGuard {
+		defer t.guardLookup(atomic.LoadUint64(&t.changeSeq), &err)
+	}
+	var nodeIndex uint
+	if t.frozen != nil {
+		found, ret = t.frozen.FindDeepestTag(address)
+	} else if nodeIndex = t.findDeepestTagsNode(address); nodeIndex != 0 {
+		ret, found = t.firstTagForNode(nodeIndex)
+	}
+	*slot = lookupCacheSlotV6{address: address, changeSeq: changeSeq, nodeIndex: nodeIndex, found: found, tag: ret}
+	return found, ret, nil
+}
+
+// Stats returns how many lookups the cache has answered, and how many it's passed on to the tree
+func (c *LookupCacheV6) Stats() (hits uint64, misses uint64) {
+	return c.hits, c.misses
+}
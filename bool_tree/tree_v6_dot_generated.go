@@ -0,0 +1,49 @@
+package bool_tree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteDot writes the tree's nodes to w as a Graphviz DOT graph, for seeing how the tree is laid out
+// - each node is labeled with its index, its full prefix, the bits of the prefix it holds below its parent, and its
+// tag count, with its left and right links as edges labeled 0 and 1
+// - nodes that aren't in use aren't shown
+func (t *TreeV6) WriteDot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph TreeV6 {")
+	fmt.Fprintln(bw, "\tnode [shape=box, fontname=monospace];")
+	t.walkNodes(1, treeNodeV6{}, func(nodeIndex uint, prefix treeNodeV6) bool {
+		node := &t.nodes[nodeIndex]
+		fmt.Fprintf(bw, "\tn%d [label=\"#%d\\n%s\\nbits: %s\\ntags: %d\"];\n", nodeIndex, nodeIndex, prefix.Address().String(), dotBitsV6(node), node.TagCount)
+		if node.Left != 0 {
+			fmt.Fprintf(bw, "\tn%d -> n%d [label=\"0\"];\n", nodeIndex, node.Left)
+		}
+		if node.Right != 0 {
+			fmt.Fprintf(bw, "\tn%d -> n%d [label=\"1\"];\n", nodeIndex, node.Right)
+		}
+		return true
+	})
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// the bits of the prefix a node holds below its parent, as 0s and 1s, or "-" if there aren't any
+func dotBitsV6(node *treeNodeV6) string {
+	address := node.Address()
+	if address.Length == 0 {
+		return "-"
+	}
+	var b strings.Builder
+	for address.Length > 0 {
+		if address.IsLeftBitSet() {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+		address.ShiftLeft(1)
+	}
+	return b.String()
+}
@@ -0,0 +1,50 @@
+package bool_tree
+
+import "github.com/kentik/patricia"
+
+// FreezeInPlace ends the tree's build phase: lookups are served from then on by an OptimizedTreeV6 copy of it, which
+// are faster, and don't allocate, other than for FindTags' result, and changes return ErrFrozen until Thaw is called
+// - FindTags, FindTagsAppend, FindTagsWithFilter, FindDeepestTag, and FindDeepestTags use the copy - everything else,
+// such as Walk, CountTags, and encoding, works from the tree as usual
+// - tags expire as of when the tree's frozen: Sweep does nothing, and lookups keep returning tags that have expired since
+// - loading the tree from an encoding thaws it, as it starts the tree over - Clear doesn't, and returns ErrFrozen
+// - a Snapshot of a frozen tree is frozen too, while a Clone isn't
+// - freezing a frozen tree picks up nothing new, as it can't have changed
+func (t *TreeV6) FreezeInPlace() {
+	if t.frozen == nil {
+		t.frozen = t.Optimize()
+	}
+}
+
+// Thaw undoes FreezeInPlace, so the tree can be changed again, with lookups going back to the tree itself
+func (t *TreeV6) Thaw() {
+	t.frozen = nil
+}
+
+// IsFrozen returns whether the tree is frozen - see FreezeInPlace
+func (t *TreeV6) IsFrozen() bool {
+	return t.frozen != nil
+}
+
+// FindTagsWithFilter, for a frozen tree
+func (t *TreeV6) frozenFindTagsWithFilter(address patricia.IPv6Address, filterFunc FilterFunc) []bool {
+	var ret []bool
+	if t.config.resultPool {
+		ret = getResultBuffer()
+	} else {
+		ret = make([]bool, 0)
+	}
+
+	// filter the tags in place, past those already in ret
+	start := len(ret)
+	ret = t.frozen.FindTagsAppend(ret, address)
+	kept := start
+	for _, tag := range ret[start:] {
+		if filterFunc(tag) {
+			ret[kept] = tag
+			kept++
+		}
+	}
+	clear(ret[kept:])
+	return ret[:kept]
+}
@@ -0,0 +1,579 @@
+package bool_tree
+
+import (
+	"container/heap"
+	"context"
+	"iter"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kentik/patricia"
+)
+
+// EntryV6 is a prefix in the tree, along with its tags
+type EntryV6 struct {
+	Prefix patricia.IPv6Address
+	Tags   []bool
+
+	// where the prefix's node sits in the tree - only set by WalkEntries, Entries, and Stream
+	Depth      int // how many nodes there are above it, the root node being at depth 0
+	ChildCount int // how many nodes are directly below it: 0, 1, or 2
+	TagCount   int // how many tags it has, including any that expired and haven't been swept yet
+}
+
+// Walk calls walkFunc for every prefix in the tree that has tags, along with those tags
+// - prefixes are visited in ascending order of their address, with shorter prefixes before longer ones with the same address
+// - that order only depends on which prefixes are in the tree: not on the order they were added or deleted in, or on how nodes are laid out
+// - each prefix's tags are in the order they were added
+// - stops as soon as walkFunc returns false
+func (t *TreeV6) Walk(walkFunc func(prefix patricia.IPv6Address, tags []bool) bool) {
+	t.walkNodes(1, treeNodeV6{}, func(nodeIndex uint, prefix treeNodeV6) bool {
+		if t.nodes[nodeIndex].TagCount == 0 {
+			return true
+		}
+		tags := t.tagsForNode(nodeIndex)
+		if len(tags) == 0 {
+			// they've all expired
+			return true
+		}
+		return walkFunc(prefix.Address(), tags)
+	})
+}
+
+// Visit calls visitFunc for every prefix in the tree that has tags, along with those tags, in the same order as Walk
+// - visitFunc's verdict decides whether to go on with the prefixes within the one just visited, skip them, or stop altogether
+// - skipped prefixes aren't looked at at all, so skipping a large subtree is cheap
+func (t *TreeV6) Visit(visitFunc func(prefix patricia.IPv6Address, tags []bool) WalkVerdict) {
+	t.visitNodes(1, treeNodeV6{}, func(nodeIndex uint, prefix treeNodeV6) WalkVerdict {
+		if t.nodes[nodeIndex].TagCount == 0 {
+			return WalkContinue
+		}
+		tags := t.tagsForNode(nodeIndex)
+		if len(tags) == 0 {
+			// they've all expired
+			return WalkContinue
+		}
+		return visitFunc(prefix.Address(), tags)
+	})
+}
+
+// like walkNodes, but visit's verdict can also skip the nodes below the one it was given
+func (t *TreeV6) visitNodes(nodeIndex uint, parent treeNodeV6, visit func(nodeIndex uint, prefix treeNodeV6) WalkVerdict) bool {
+	// the right children still to visit, with their parents' full prefixes - left children are visited straight away
+	var buf [_walkStackSize]walkNodeV6
+	stack := buf[:0]
+	for {
+		node := &t.nodes[nodeIndex]
+		prefix := parent
+		prefix.MergeFromNodes(&parent, node)
+		verdict := visit(nodeIndex, prefix)
+		if verdict == WalkStop {
+			return false
+		}
+
+		left, right := t.nodes[nodeIndex].Left, t.nodes[nodeIndex].Right
+		if verdict == WalkSkipSubtree {
+			left, right = 0, 0
+		}
+		if left != 0 {
+			if right != 0 {
+				stack = append(stack, walkNodeV6{nodeIndex: uint(right), parent: prefix})
+			}
+			nodeIndex, parent = uint(left), prefix
+		} else if right != 0 {
+			nodeIndex, parent = uint(right), prefix
+		} else if len(stack) > 0 {
+			next := &stack[len(stack)-1]
+			nodeIndex, parent = next.nodeIndex, next.parent
+			stack = stack[:len(stack)-1]
+		} else {
+			return true
+		}
+	}
+}
+
+// All returns an iterator over every prefix in the tree that has tags, along with those tags
+// - in the same order as Walk
+func (t *TreeV6) All() iter.Seq2[patricia.IPv6Address, []bool] {
+	return func(yield func(patricia.IPv6Address, []bool) bool) {
+		t.Walk(yield)
+	}
+}
+
+// AllNetip returns an iterator over every prefix in the tree that has tags, as a netip.Prefix, along with those tags
+// - in the same order as Walk
+func (t *TreeV6) AllNetip() iter.Seq2[netip.Prefix, []bool] {
+	return func(yield func(netip.Prefix, []bool) bool) {
+		t.Walk(func(prefix patricia.IPv6Address, tags []bool) bool {
+			return yield(prefix.Prefix(), tags)
+		})
+	}
+}
+
+// WalkPrefixes calls walkFunc for every prefix in the tree that has tags, without the tags
+// - in the same order as Walk
+// - tags aren't read or copied, so this is much cheaper than Walk for when only the prefixes are needed
+// - stops as soon as walkFunc returns false
+func (t *TreeV6) WalkPrefixes(walkFunc func(prefix patricia.IPv6Address) bool) {
+	t.walkNodes(1, treeNodeV6{}, func(nodeIndex uint, prefix treeNodeV6) bool {
+		if t.nodes[nodeIndex].TagCount == 0 || !t.hasLiveTags(nodeIndex) {
+			return true
+		}
+		return walkFunc(prefix.Address())
+	})
+}
+
+// Prefixes returns an iterator over every prefix in the tree that has tags
+// - in the same order as Walk, and just as cheap as WalkPrefixes
+func (t *TreeV6) Prefixes() iter.Seq[patricia.IPv6Address] {
+	return func(yield func(patricia.IPv6Address) bool) {
+		t.WalkPrefixes(yield)
+	}
+}
+
+// Tags returns an iterator over every tag in the tree
+// - in the same order as Walk, with each prefix's tags in the order they were added
+func (t *TreeV6) Tags() iter.Seq[bool] {
+	return func(yield func(bool) bool) {
+		t.Walk(func(prefix patricia.IPv6Address, tags []bool) bool {
+			for _, tag := range tags {
+				if !yield(tag) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+}
+
+// WalkEntries calls walkFunc for every prefix in the tree that has tags, with an entry holding its tags and where its node sits in the tree
+// - in the same order as Walk
+// - stops as soon as walkFunc returns false
+func (t *TreeV6) WalkEntries(walkFunc func(entry EntryV6) bool) {
+	t.walkEntries(1, treeNodeV6{}, 0, walkFunc)
+}
+
+// Entries returns an iterator over every prefix in the tree that has tags, as entries holding its tags and where its node sits in the tree
+// - in the same order as Walk
+func (t *TreeV6) Entries() iter.Seq[EntryV6] {
+	return func(yield func(EntryV6) bool) {
+		t.WalkEntries(yield)
+	}
+}
+
+// like walkNodes, but keeping track of depth, and building entries for nodes with tags
+func (t *TreeV6) walkEntries(nodeIndex uint, parent treeNodeV6, depth int, walkFunc func(entry EntryV6) bool) bool {
+	var buf [_walkStackSize]walkNodeV6
+	stack := buf[:0]
+	for {
+		node := &t.nodes[nodeIndex]
+		prefix := parent
+		prefix.MergeFromNodes(&parent, node)
+		if node.TagCount > 0 {
+			if tags := t.tagsForNode(nodeIndex); len(tags) > 0 {
+				entry := EntryV6{
+					Prefix:   prefix.Address(),
+					Tags:     tags,
+					Depth:    depth,
+					TagCount: node.TagCount,
+				}
+				if node.Left != 0 {
+					entry.ChildCount++
+				}
+				if node.Right != 0 {
+					entry.ChildCount++
+				}
+				if !walkFunc(entry) {
+					return false
+				}
+			}
+		}
+
+		node = &t.nodes[nodeIndex]
+		if node.Left != 0 {
+			if node.Right != 0 {
+				stack = append(stack, walkNodeV6{nodeIndex: uint(node.Right), parent: prefix, depth: depth + 1})
+			}
+			nodeIndex, parent, depth = uint(node.Left), prefix, depth+1
+		} else if node.Right != 0 {
+			nodeIndex, parent, depth = uint(node.Right), prefix, depth+1
+		} else if len(stack) > 0 {
+			next := &stack[len(stack)-1]
+			nodeIndex, parent, depth = next.nodeIndex, next.parent, next.depth
+			stack = stack[:len(stack)-1]
+		} else {
+			return true
+		}
+	}
+}
+
+// Stream walks the tree in a new goroutine, sending every prefix that has tags, along with those tags, to the returned channel
+// - in the same order as Walk
+// - the channel is closed once the walk is done, or ctx is cancelled
+// - the tree must not be modified until the channel is closed
+func (t *TreeV6) Stream(ctx context.Context) <-chan EntryV6 {
+	ret := make(chan EntryV6)
+	go func() {
+		defer close(ret)
+		t.WalkEntries(func(entry EntryV6) bool {
+			if ctx.Err() != nil {
+				// don't leave it to select to pick between a ready send and cancellation
+				return false
+			}
+			select {
+			case ret <- entry:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return ret
+}
+
+// ReduceV6 folds every prefix in the tree that has tags, along with those tags, into a single value, starting with init
+// - reduceFunc is called in the same order as Walk, with the value so far, returning the next one
+// - the tags slice is reused between calls, so it must not be kept once reduceFunc returns
+func ReduceV6[A any](t *TreeV6, init A, reduceFunc func(acc A, prefix patricia.IPv6Address, tags []bool) A) A {
+	acc := init
+	var tags []bool
+	t.walkNodes(1, treeNodeV6{}, func(nodeIndex uint, prefix treeNodeV6) bool {
+		if t.nodes[nodeIndex].TagCount == 0 {
+			return true
+		}
+		tags = t.tagsForNodeAppend(tags[:0], nodeIndex)
+		if len(tags) > 0 {
+			acc = reduceFunc(acc, prefix.Address(), tags)
+		}
+		return true
+	})
+	return acc
+}
+
+// WalkLength calls walkFunc for every prefix in the tree that has tags and is exactly length bits long, along with its tags
+// - in the same order as Walk
+// - nothing more specific than length is looked at
+// - stops as soon as walkFunc returns false
+func (t *TreeV6) WalkLength(length uint, walkFunc func(prefix patricia.IPv6Address, tags []bool) bool) {
+	t.visitNodes(1, treeNodeV6{}, func(nodeIndex uint, prefix treeNodeV6) WalkVerdict {
+		if prefix.length() < length {
+			return WalkContinue
+		}
+		if prefix.length() > length || t.nodes[nodeIndex].TagCount == 0 {
+			// everything below is longer
+			return WalkSkipSubtree
+		}
+		tags := t.tagsForNode(nodeIndex)
+		if len(tags) > 0 && !walkFunc(prefix.Address(), tags) {
+			return WalkStop
+		}
+		return WalkSkipSubtree
+	})
+}
+
+// WalkParallel calls walkFunc for every prefix in the tree that has tags, along with those tags, from several goroutines at once
+// - the tree is split into subtrees, which are handed out to workers goroutines, or to GOMAXPROCS of them if workers isn't positive
+// - walkFunc is called concurrently, in no particular order, and must be safe for that
+// - returns once every call to walkFunc has returned
+// - once walkFunc returns false, no new calls are made, though calls already under way in other goroutines finish
+// - the tree must not be modified until this returns
+func (t *TreeV6) WalkParallel(walkFunc func(prefix patricia.IPv6Address, tags []bool) bool, workers int) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	var stopped atomic.Bool
+	visit := func(nodeIndex uint, prefix treeNodeV6) bool {
+		if stopped.Load() {
+			return false
+		}
+		if t.nodes[nodeIndex].TagCount == 0 {
+			return true
+		}
+		tags := t.tagsForNode(nodeIndex)
+		if len(tags) == 0 {
+			// they've all expired
+			return true
+		}
+		if !walkFunc(prefix.Address(), tags) {
+			stopped.Store(true)
+			return false
+		}
+		return true
+	}
+
+	// split the tree into a few times as many subtrees as there are workers, so they can even out uneven subtrees between them,
+	// visiting the nodes above those subtrees here as we go
+	type subtree struct {
+		nodeIndex uint
+		parent    treeNodeV6
+	}
+	subtrees := []subtree{{nodeIndex: 1}}
+	for len(subtrees) < workers*4 {
+		var next []subtree
+		split := false
+		for _, s := range subtrees {
+			node := &t.nodes[s.nodeIndex]
+			if node.Left == 0 && node.Right == 0 {
+				next = append(next, s)
+				continue
+			}
+			split = true
+			prefix := s.parent
+			prefix.MergeFromNodes(&s.parent, node)
+			if !visit(s.nodeIndex, prefix) {
+				return
+			}
+			if node.Left != 0 {
+				next = append(next, subtree{nodeIndex: uint(node.Left), parent: prefix})
+			}
+			if node.Right != 0 {
+				next = append(next, subtree{nodeIndex: uint(node.Right), parent: prefix})
+			}
+		}
+		subtrees = next
+		if !split {
+			// they're all single nodes
+			break
+		}
+	}
+
+	queue := make(chan subtree)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(subtrees); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range queue {
+				t.walkNodes(s.nodeIndex, s.parent, visit)
+			}
+		}()
+	}
+	for _, s := range subtrees {
+		if stopped.Load() {
+			break
+		}
+		queue <- s
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// WalkLeaves calls walkFunc for every prefix in the tree without more specific prefixes below it, along with its tags
+// - in the same order as Walk
+// - stops as soon as walkFunc returns false
+func (t *TreeV6) WalkLeaves(walkFunc func(prefix patricia.IPv6Address, tags []bool) bool) {
+	t.walkNodes(1, treeNodeV6{}, func(nodeIndex uint, prefix treeNodeV6) bool {
+		node := &t.nodes[nodeIndex]
+		if node.Left != 0 || node.Right != 0 || node.TagCount == 0 {
+			return true
+		}
+		tags := t.tagsForNode(nodeIndex)
+		if len(tags) == 0 {
+			// they've all expired
+			return true
+		}
+		return walkFunc(prefix.Address(), tags)
+	})
+}
+
+// Leaves returns an iterator over every prefix in the tree without more specific prefixes below it, along with its tags
+// - in the same order as Walk
+func (t *TreeV6) Leaves() iter.Seq2[patricia.IPv6Address, []bool] {
+	return func(yield func(patricia.IPv6Address, []bool) bool) {
+		t.WalkLeaves(yield)
+	}
+}
+
+// WalkSubtree calls walkFunc for every prefix in the tree that has tags and is contained within the input address, along with its tags
+// - the address's own prefix is included
+// - in the same order as Walk
+// - stops as soon as walkFunc returns false
+func (t *TreeV6) WalkSubtree(address patricia.IPv6Address, walkFunc func(prefix patricia.IPv6Address, tags []bool) bool) {
+	t.walkSubtreeNodes(address, func(nodeIndex uint, prefix treeNodeV6) bool {
+		if t.nodes[nodeIndex].TagCount == 0 {
+			return true
+		}
+		tags := t.tagsForNode(nodeIndex)
+		if len(tags) == 0 {
+			// they've all expired
+			return true
+		}
+		return walkFunc(prefix.Address(), tags)
+	})
+}
+
+// Subtree returns an iterator over every prefix in the tree that has tags and is contained within the input address, along with its tags
+// - in the same order as Walk
+func (t *TreeV6) Subtree(address patricia.IPv6Address) iter.Seq2[patricia.IPv6Address, []bool] {
+	return func(yield func(patricia.IPv6Address, []bool) bool) {
+		t.WalkSubtree(address, yield)
+	}
+}
+
+// WalkOverlaps calls walkFunc for every pair of prefixes in the tree that have tags, where one contains the other
+// - covered prefixes come in the same order as Walk, each with the prefixes covering it from least to most specific
+// - tags aren't read, besides checking whether any have expired
+// - stops as soon as walkFunc returns false
+func (t *TreeV6) WalkOverlaps(walkFunc func(covering patricia.IPv6Address, covered patricia.IPv6Address) bool) {
+	t.walkOverlaps(1, treeNodeV6{}, nil, walkFunc)
+}
+
+// Overlaps returns an iterator over every pair of prefixes in the tree that have tags, where the first contains the second
+// - in the same order as WalkOverlaps
+func (t *TreeV6) Overlaps() iter.Seq2[patricia.IPv6Address, patricia.IPv6Address] {
+	return func(yield func(patricia.IPv6Address, patricia.IPv6Address) bool) {
+		t.WalkOverlaps(yield)
+	}
+}
+
+// like walkNodes, but keeping track of the tagged prefixes above each node
+func (t *TreeV6) walkOverlaps(nodeIndex uint, parent treeNodeV6, covering []patricia.IPv6Address, walkFunc func(covering patricia.IPv6Address, covered patricia.IPv6Address) bool) bool {
+	// the right children still to visit, with their parents' full prefixes, and how many prefixes cover them - left
+	// children are visited straight away
+	var buf [_walkStackSize]walkNodeV6
+	stack := buf[:0]
+	for {
+		node := &t.nodes[nodeIndex]
+		prefix := parent
+		prefix.MergeFromNodes(&parent, node)
+		if node.TagCount > 0 && t.hasLiveTags(nodeIndex) {
+			address := prefix.Address()
+			for _, coveringAddress := range covering {
+				if !walkFunc(coveringAddress, address) {
+					return false
+				}
+			}
+			covering = append(covering, address)
+		}
+
+		node = &t.nodes[nodeIndex]
+		if node.Left != 0 {
+			if node.Right != 0 {
+				stack = append(stack, walkNodeV6{nodeIndex: uint(node.Right), parent: prefix, depth: len(covering)})
+			}
+			nodeIndex, parent = uint(node.Left), prefix
+		} else if node.Right != 0 {
+			nodeIndex, parent = uint(node.Right), prefix
+		} else if len(stack) > 0 {
+			next := &stack[len(stack)-1]
+			nodeIndex, parent, covering = next.nodeIndex, next.parent, covering[:next.depth]
+			stack = stack[:len(stack)-1]
+		} else {
+			return true
+		}
+	}
+}
+
+// WalkBreadthFirst calls walkFunc for every prefix in the tree that has tags, along with those tags, shortest prefixes first
+// - prefixes of the same length are visited in ascending order of their address
+// - so every prefix is visited before any more specific prefix within it
+// - stops as soon as walkFunc returns false
+func (t *TreeV6) WalkBreadthFirst(walkFunc func(prefix patricia.IPv6Address, tags []bool) bool) {
+	// a node's full prefix is always longer than its parent's, so always taking the shortest prefix seen so far
+	// visits every prefix in order across the whole tree, not just level by level
+	queue := &breadthFirstQueueV6{{nodeIndex: 1}}
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(breadthFirstItemV6)
+		node := &t.nodes[item.nodeIndex]
+		if node.TagCount > 0 {
+			if tags := t.tagsForNode(item.nodeIndex); len(tags) > 0 && !walkFunc(item.prefix.Address(), tags) {
+				return
+			}
+		}
+		for _, childIndex := range [2]uint{uint(node.Left), uint(node.Right)} {
+			if childIndex == 0 {
+				continue
+			}
+			child := breadthFirstItemV6{nodeIndex: childIndex}
+			child.prefix.MergeFromNodes(&item.prefix, &t.nodes[childIndex])
+			heap.Push(queue, child)
+		}
+	}
+}
+
+// BreadthFirst returns an iterator over every prefix in the tree that has tags, along with those tags, shortest prefixes first
+// - in the same order as WalkBreadthFirst
+func (t *TreeV6) BreadthFirst() iter.Seq2[patricia.IPv6Address, []bool] {
+	return func(yield func(patricia.IPv6Address, []bool) bool) {
+		t.WalkBreadthFirst(yield)
+	}
+}
+
+type breadthFirstItemV6 struct {
+	nodeIndex uint
+	prefix    treeNodeV6 // full prefix of the node
+}
+
+// min-heap of nodes by prefix length, then address, for container/heap
+type breadthFirstQueueV6 []breadthFirstItemV6
+
+func (q breadthFirstQueueV6) Len() int {
+	return len(q)
+}
+
+func (q breadthFirstQueueV6) Less(i, j int) bool {
+	if q[i].prefix.length() != q[j].prefix.length() {
+		return q[i].prefix.length() < q[j].prefix.length()
+	}
+	return q[i].prefix.comparePrefix(&q[j].prefix) < 0
+}
+
+func (q breadthFirstQueueV6) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *breadthFirstQueueV6) Push(item interface{}) {
+	*q = append(*q, item.(breadthFirstItemV6))
+}
+
+func (q *breadthFirstQueueV6) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// call visit for every node whose full prefix is contained within the input address, in pre-order
+// - visit is given the node's full prefix
+func (t *TreeV6) walkSubtreeNodes(address patricia.IPv6Address, visit func(nodeIndex uint, prefix treeNodeV6) bool) {
+	if address.Length == 0 {
+		t.walkNodes(1, treeNodeV6{}, visit)
+		return
+	}
+
+	// the full prefix of the node we're at, as we traverse down
+	var parentPrefix treeNodeV6
+	root := &t.nodes[1]
+	var nodeIndex uint
+	if !address.IsLeftBitSet() {
+		nodeIndex = uint(root.Left)
+	} else {
+		nodeIndex = uint(root.Right)
+	}
+
+	for nodeIndex != 0 {
+		node := &t.nodes[nodeIndex]
+		matchCount := node.MatchCount(address)
+		if matchCount == address.Length {
+			// this node, and everything below it, is within the address
+			t.walkNodes(nodeIndex, parentPrefix, visit)
+			return
+		}
+		if matchCount < node.length() {
+			// didn't match the entire node - there's nothing within the address
+			return
+		}
+
+		// there's still more address - keep traversing
+		parentPrefix.MergeFromNodes(&parentPrefix, node)
+		address.ShiftLeft(matchCount)
+		if !address.IsLeftBitSet() {
+			nodeIndex = uint(node.Left)
+		} else {
+			nodeIndex = uint(node.Right)
+		}
+	}
+}
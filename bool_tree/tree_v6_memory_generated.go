@@ -0,0 +1,26 @@
+package bool_tree
+
+import "unsafe"
+
+// MemoryStats reports the memory the tree's storage takes - see MemoryStats
+// - walks every node, so it takes time in proportion to the size of the tree - see Size, PrefixCount, and TagCount for
+// counts that don't
+// - a tree sharing its storage with a snapshot reports all of it, even though the snapshot holds on to it too
+func (t *TreeV6) MemoryStats() MemoryStats {
+	ret := MemoryStats{
+		Nodes:         len(t.nodes),
+		NodeCapacity:  cap(t.nodes),
+		NodeBytes:     cap(t.nodes) * int(unsafe.Sizeof(treeNodeV6{})),
+		FreeNodes:     len(t.availableIndexes),
+		FreeListBytes: cap(t.availableIndexes) * int(unsafe.Sizeof(treeIndex(0))),
+	}
+	ret.TagBytes = t.tags.bytes() + cap(t.hits)*int(unsafe.Sizeof(uint64(0)))
+	for nodeIndex := range t.nodes {
+		if tagCount := t.nodes[nodeIndex].TagCount; tagCount > 0 {
+			ret.Tags += tagCount
+			ret.Prefixes++
+		}
+	}
+	ret.TotalBytes = ret.NodeBytes + ret.FreeListBytes + ret.TagBytes
+	return ret
+}
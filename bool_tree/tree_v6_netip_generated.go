@@ -0,0 +1,77 @@
+package bool_tree
+
+import (
+	"net/netip"
+
+	"github.com/kentik/patricia"
+)
+
+// the tree's changes and lookups, taking netip types rather than the tree's own addresses - each converts its input
+// the same as NewIPv6AddressFromPrefix and NewIPv6AddressFromAddr do, without allocating, and fails if it's not of
+// the tree's address family
+// - lookups take addresses, not prefixes, as they're usually of hosts - convert a prefix with
+// patricia.NewIPv6AddressFromPrefix to look it up with FindTags and the rest
+
+// AddNetip adds a tag to the tree for the prefix, like Add
+func (t *TreeV6) AddNetip(prefix netip.Prefix, tag bool, matchFunc MatchesFunc) (bool, int, error) {
+	address, err := patricia.NewIPv6AddressFromPrefix(prefix)
+	if err != nil {
+		return false, 0, err
+	}
+	return t.Add(address, tag, matchFunc)
+}
+
+// SetNetip sets the single tag for the prefix, like Set
+func (t *TreeV6) SetNetip(prefix netip.Prefix, tag bool) (bool, int, error) {
+	address, err := patricia.NewIPv6AddressFromPrefix(prefix)
+	if err != nil {
+		return false, 0, err
+	}
+	return t.Set(address, tag)
+}
+
+// DeleteNetip deletes the prefix's tags that match matchVal, like Delete
+func (t *TreeV6) DeleteNetip(prefix netip.Prefix, matchFunc MatchesFunc, matchVal bool) (int, error) {
+	address, err := patricia.NewIPv6AddressFromPrefix(prefix)
+	if err != nil {
+		return 0, err
+	}
+	return t.Delete(address, matchFunc, matchVal)
+}
+
+// FindTagsNetip finds all matching tags for the address, like FindTags
+func (t *TreeV6) FindTagsNetip(addr netip.Addr) ([]bool, error) {
+	address, err := patricia.NewIPv6AddressFromAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.FindTags(address)
+}
+
+// FindTagsAppendNetip finds all matching tags for the address and appends them to ret, like FindTagsAppend
+func (t *TreeV6) FindTagsAppendNetip(ret []bool, addr netip.Addr) ([]bool, error) {
+	address, err := patricia.NewIPv6AddressFromAddr(addr)
+	if err != nil {
+		return ret, err
+	}
+	return t.FindTagsAppend(ret, address), nil
+}
+
+// FindDeepestTagNetip finds a tag at the deepest level in the tree for the address, like FindDeepestTag
+func (t *TreeV6) FindDeepestTagNetip(addr netip.Addr) (bool, bool, error) {
+	address, err := patricia.NewIPv6AddressFromAddr(addr)
+	if err != nil {
+		var zero bool
+		return false, zero, err
+	}
+	return t.FindDeepestTag(address)
+}
+
+// FindDeepestTagsNetip finds all tags at the deepest level in the tree for the address, like FindDeepestTags
+func (t *TreeV6) FindDeepestTagsNetip(addr netip.Addr) (bool, []bool, error) {
+	address, err := patricia.NewIPv6AddressFromAddr(addr)
+	if err != nil {
+		return false, nil, err
+	}
+	return t.FindDeepestTags(address)
+}
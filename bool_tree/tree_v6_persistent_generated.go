@@ -0,0 +1,335 @@
+package bool_tree
+
+import (
+	"iter"
+
+	"github.com/kentik/patricia"
+)
+
+// PersistentTreeV6 is an immutable tree: Add, Set, and Delete return a new tree, leaving this one as it was
+// - the new tree shares every node with the old one, other than those on the path to the changed prefix, so a change
+// costs a few small allocations, however big the tree is
+// - any number of versions can be kept, read from any number of goroutines without locking, and rolled back to
+// - the zero value isn't usable: start with NewPersistentTreeV6 or TreeV6.Persistent
+// - there are no tag limits, single-tag mode, or tag expiration
+type PersistentTreeV6 struct {
+	root     *persistentNodeV6
+	tagCount int
+}
+
+// a node in a PersistentTreeV6, which never changes once it's in a tree
+type persistentNodeV6 struct {
+	prefix treeNodeV6 // only the prefix and its length, relative to the parent, are used
+	left   *persistentNodeV6
+	right  *persistentNodeV6
+	tags   []bool
+}
+
+// NewPersistentTreeV6 returns a new, empty tree
+func NewPersistentTreeV6() *PersistentTreeV6 {
+	return &PersistentTreeV6{root: &persistentNodeV6{}}
+}
+
+// Persistent returns a PersistentTreeV6 holding the same tags as this tree
+// - expired tags are left out, and tags that haven't expired yet are kept without their expiration times
+func (t *TreeV6) Persistent() *PersistentTreeV6 {
+	ret := &PersistentTreeV6{}
+	ret.root = t.persistentNode(1, &ret.tagCount)
+	return ret
+}
+
+// copy the node at the input index, and its descendants, adding their tags to tagCount
+func (t *TreeV6) persistentNode(nodeIndex uint, tagCount *int) *persistentNodeV6 {
+	node := &t.nodes[nodeIndex]
+	ret := &persistentNodeV6{prefix: *node}
+	ret.prefix.Left, ret.prefix.Right, ret.prefix.TagCount = 0, 0, 0
+	if node.TagCount > 0 {
+		ret.tags = t.tagsForNode(nodeIndex)
+		*tagCount += len(ret.tags)
+	}
+	if node.Left != 0 {
+		ret.left = t.persistentNode(uint(node.Left), tagCount)
+	}
+	if node.Right != 0 {
+		ret.right = t.persistentNode(uint(node.Right), tagCount)
+	}
+	return ret
+}
+
+// Tree returns a new TreeV6 holding the same tags as this tree
+func (p *PersistentTreeV6) Tree(options ...TreeOption) *TreeV6 {
+	ret := NewTreeV6(options...)
+	p.Walk(func(prefix patricia.IPv6Address, tags []bool) bool {
+		for _, tag := range tags {
+			ret.Add(prefix, tag, nil)
+		}
+		return true
+	})
+	return ret
+}
+
+// CountTags returns the number of tags in the tree
+func (p *PersistentTreeV6) CountTags() int {
+	return p.tagCount
+}
+
+// Add returns a tree with the tag added, and whether the tag count at the address was increased
+// - if matchFunc is non-nil, it will be used to ensure uniqueness at this node: if a tag matches, this tree is returned
+func (p *PersistentTreeV6) Add(address patricia.IPv6Address, tag bool, matchFunc MatchesFunc) (*PersistentTreeV6, bool, error) {
+	return p.add(address, tag, matchFunc, false)
+}
+
+// Set returns a tree with the tag as the single value for the address, replacing the first tag it had, like TreeV6.Set
+func (p *PersistentTreeV6) Set(address patricia.IPv6Address, tag bool) (*PersistentTreeV6, error) {
+	ret, _, err := p.add(address, tag, nil, true)
+	return ret, err
+}
+
+func (p *PersistentTreeV6) add(address patricia.IPv6Address, tag bool, matchFunc MatchesFunc, replace bool) (*PersistentTreeV6, bool, error) {
+	var t *TreeV6
+	if err := t.validateAddress(address); err != nil {
+		return nil, false, err
+	}
+
+	tagCount := p.tagCount
+	root := p.root.add(address, func(tags []bool) []bool {
+		if replace && len(tags) > 0 {
+			ret := make([]bool, len(tags))
+			copy(ret, tags)
+			ret[0] = tag
+			return ret
+		} else if matchFunc != nil {
+			for _, existing := range tags {
+				if matchFunc(existing, tag) {
+					return nil
+				}
+			}
+		}
+
+		// never append in place: the old slice belongs to the old tree
+		ret := make([]bool, len(tags), len(tags)+1)
+		copy(ret, tags)
+		tagCount++
+		return append(ret, tag)
+	})
+	if root == nil {
+		// a matching tag is already there
+		return p, false, nil
+	}
+	return &PersistentTreeV6{root: root, tagCount: tagCount}, tagCount > p.tagCount, nil
+}
+
+// return a copy of the node, with updateTags applied to the tags for address, which is relative to the node's prefix
+// - updateTags is called once, with the existing tags, and returns the new ones, or nil to leave everything as it was,
+// in which case nil is returned
+func (n *persistentNodeV6) add(address patricia.IPv6Address, updateTags func(tags []bool) []bool) *persistentNodeV6 {
+	ret := *n
+	if address.Length == 0 {
+		ret.tags = updateTags(n.tags)
+		if ret.tags == nil {
+			return nil
+		}
+		return &ret
+	}
+
+	goLeft := !address.IsLeftBitSet()
+	child := n.right
+	if goLeft {
+		child = n.left
+	}
+
+	var newChild *persistentNodeV6
+	if child == nil {
+		// nothing that way yet - a new leaf for the rest of the address
+		newChild = &persistentNodeV6{prefix: treeNodeV6FromAddress(address), tags: updateTags(nil)}
+	} else {
+		matchCount := child.prefix.MatchCount(address)
+		if matchCount == child.prefix.length() {
+			address.ShiftLeft(matchCount)
+			newChild = child.add(address, updateTags)
+			if newChild == nil {
+				return nil
+			}
+		} else {
+			// the address leaves the child's prefix part way along it, so the child is split there: a new node for the part
+			// they share, with the rest of the child below it, and the rest of the address, if any, beside it
+			split := &persistentNodeV6{prefix: treeNodeV6FromAddress(address)}
+			split.prefix.setLength(matchCount)
+			rest := *child
+			rest.prefix.ShiftPrefix(matchCount)
+			address.ShiftLeft(matchCount)
+
+			var leaf *persistentNodeV6
+			if address.Length == 0 {
+				split.tags = updateTags(nil)
+			} else {
+				leaf = &persistentNodeV6{prefix: treeNodeV6FromAddress(address), tags: updateTags(nil)}
+			}
+			if rest.prefix.IsLeftBitSet() {
+				split.left, split.right = leaf, &rest
+			} else {
+				split.left, split.right = &rest, leaf
+			}
+			newChild = split
+		}
+	}
+
+	if goLeft {
+		ret.left = newChild
+	} else {
+		ret.right = newChild
+	}
+	return &ret
+}
+
+// Delete returns a tree without the tags at the address that match matchVal, as determined by matchFunc, and how many were removed
+// - if none are removed, this tree is returned
+func (p *PersistentTreeV6) Delete(address patricia.IPv6Address, matchFunc MatchesFunc, matchVal bool) (*PersistentTreeV6, int, error) {
+	var t *TreeV6
+	if err := t.validateAddress(address); err != nil {
+		return nil, 0, err
+	}
+
+	root, deleteCount := p.root.delete(address, matchFunc, matchVal, true)
+	if deleteCount == 0 {
+		return p, 0, nil
+	}
+	return &PersistentTreeV6{root: root, tagCount: p.tagCount - deleteCount}, deleteCount, nil
+}
+
+// return a copy of the node without the matching tags for address, which is relative to the node's prefix, and how many were
+// deleted - if none were, the node itself is returned
+// - a node other than the root that's left without tags goes too, if it has no children, or is merged into its only child
+func (n *persistentNodeV6) delete(address patricia.IPv6Address, matchFunc MatchesFunc, matchVal bool, isRoot bool) (*persistentNodeV6, int) {
+	ret := *n
+	deleteCount := 0
+	if address.Length == 0 {
+		ret.tags = make([]bool, 0, len(n.tags))
+		for _, tag := range n.tags {
+			if matchFunc(tag, matchVal) {
+				deleteCount++
+			} else {
+				ret.tags = append(ret.tags, tag)
+			}
+		}
+		if len(ret.tags) == 0 {
+			ret.tags = nil
+		}
+	} else {
+		child := &ret.right
+		if !address.IsLeftBitSet() {
+			child = &ret.left
+		}
+		if *child == nil {
+			return n, 0
+		}
+		matchCount := (*child).prefix.MatchCount(address)
+		if matchCount < (*child).prefix.length() {
+			return n, 0
+		}
+		address.ShiftLeft(matchCount)
+		*child, deleteCount = (*child).delete(address, matchFunc, matchVal, false)
+	}
+	if deleteCount == 0 {
+		return n, 0
+	}
+
+	if isRoot || len(ret.tags) > 0 {
+		return &ret, deleteCount
+	}
+	switch {
+	case ret.left == nil && ret.right == nil:
+		return nil, deleteCount
+	case ret.left == nil || ret.right == nil:
+		only := ret.left
+		if only == nil {
+			only = ret.right
+		}
+		merged := *only
+		merged.prefix.MergeFromNodes(&ret.prefix, &only.prefix)
+		return &merged, deleteCount
+	}
+	return &ret, deleteCount
+}
+
+// FindTags finds all matching tags for the address, like TreeV6.FindTags
+func (p *PersistentTreeV6) FindTags(address patricia.IPv6Address) []bool {
+	ret := make([]bool, 0)
+	p.walkMatches(address, func(n *persistentNodeV6) {
+		ret = append(ret, n.tags...)
+	})
+	return ret
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree, like TreeV6.FindDeepestTag
+func (p *PersistentTreeV6) FindDeepestTag(address patricia.IPv6Address) (bool, bool) {
+	var ret bool
+	found, tags := p.FindDeepestTags(address)
+	if found {
+		ret = tags[0]
+	}
+	return found, ret
+}
+
+// FindDeepestTags finds all tags at the deepest level in the tree, like TreeV6.FindDeepestTags
+// - the returned slice belongs to the tree, and must not be changed
+func (p *PersistentTreeV6) FindDeepestTags(address patricia.IPv6Address) (bool, []bool) {
+	ret := make([]bool, 0)
+	p.walkMatches(address, func(n *persistentNodeV6) {
+		if len(n.tags) > 0 {
+			ret = n.tags
+		}
+	})
+	return len(ret) > 0, ret
+}
+
+// call visit for each node on the way to the input address, for as long as it matches
+func (p *PersistentTreeV6) walkMatches(address patricia.IPv6Address, visit func(n *persistentNodeV6)) {
+	n := p.root
+	visit(n)
+	for address.Length > 0 {
+		if !address.IsLeftBitSet() {
+			n = n.left
+		} else {
+			n = n.right
+		}
+		if n == nil {
+			return
+		}
+		matchCount := n.prefix.MatchCount(address)
+		if matchCount < n.prefix.length() {
+			return
+		}
+		visit(n)
+		address.ShiftLeft(matchCount)
+	}
+}
+
+// Walk calls walkFunc for every prefix in the tree that has tags, in the same order as TreeV6.Walk
+// - the tags belong to the tree, and must not be changed
+// - stops as soon as walkFunc returns false
+func (p *PersistentTreeV6) Walk(walkFunc func(prefix patricia.IPv6Address, tags []bool) bool) {
+	p.root.walk(treeNodeV6{}, walkFunc)
+}
+
+func (n *persistentNodeV6) walk(parent treeNodeV6, walkFunc func(prefix patricia.IPv6Address, tags []bool) bool) bool {
+	prefix := parent
+	prefix.MergeFromNodes(&parent, &n.prefix)
+	if len(n.tags) > 0 && !walkFunc(prefix.Address(), n.tags) {
+		return false
+	}
+	if n.left != nil && !n.left.walk(prefix, walkFunc) {
+		return false
+	}
+	if n.right != nil && !n.right.walk(prefix, walkFunc) {
+		return false
+	}
+	return true
+}
+
+// All returns an iterator over every prefix in the tree that has tags - see Walk
+func (p *PersistentTreeV6) All() iter.Seq2[patricia.IPv6Address, []bool] {
+	return func(yield func(patricia.IPv6Address, []bool) bool) {
+		p.Walk(yield)
+	}
+}
@@ -0,0 +1,282 @@
+package bool_tree
+
+import (
+	"io"
+	"iter"
+	"sync"
+	"time"
+
+	"github.com/kentik/patricia"
+)
+
+// SafeTreeV6 is a TreeV6 that's safe for concurrent use, with the same API, under a sync.RWMutex
+// - lookups, walks, and encoding take the read lock, so they can run at the same time as each other
+// - changes take the write lock
+// - walk functions are called with the read lock held, so they must not change this tree
+// - for anything not wrapped here, use Read and Write
+type SafeTreeV6 struct {
+	mu   sync.RWMutex
+	tree *TreeV6
+}
+
+// NewSafeTreeV6 returns a new, empty SafeTreeV6
+func NewSafeTreeV6(options ...TreeOption) *SafeTreeV6 {
+	return &SafeTreeV6{tree: NewTreeV6(options...)}
+}
+
+// Read calls readFunc with the tree under the read lock
+// - readFunc must not change the tree, or keep it once it returns
+func (s *SafeTreeV6) Read(readFunc func(tree *TreeV6)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	readFunc(s.tree)
+}
+
+// Write calls writeFunc with the tree under the write lock
+// - writeFunc must not keep the tree once it returns
+func (s *SafeTreeV6) Write(writeFunc func(tree *TreeV6)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeFunc(s.tree)
+}
+
+// Clear removes everything from the tree - see TreeV6.Clear
+func (s *SafeTreeV6) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Clear()
+}
+
+// Clone returns an identical, independent copy of the tree - see TreeV6.Clone
+func (s *SafeTreeV6) Clone() *SafeTreeV6 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &SafeTreeV6{tree: s.tree.Clone()}
+}
+
+// Snapshot returns a view of the tree as it is now, which stays the same as this tree keeps changing - see TreeV6.Snapshot
+// - the snapshot is a plain TreeV6, which can be read from any number of goroutines without locking, as long as none of them change it
+func (s *SafeTreeV6) Snapshot() *TreeV6 {
+	// marks the storage as shared, so this is a change
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Snapshot()
+}
+
+// CountTags returns the number of tags in the tree - see TreeV6.CountTags
+func (s *SafeTreeV6) CountTags() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.CountTags()
+}
+
+// Size returns the number of nodes in use - see TreeV6.Size
+func (s *SafeTreeV6) Size() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.Size()
+}
+
+// PrefixCount returns the number of prefixes with tags - see TreeV6.PrefixCount
+func (s *SafeTreeV6) PrefixCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.PrefixCount()
+}
+
+// TagCount returns the number of tags in the tree - see TreeV6.TagCount
+func (s *SafeTreeV6) TagCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.TagCount()
+}
+
+// Set sets the single value for a node - see TreeV6.Set
+func (s *SafeTreeV6) Set(address patricia.IPv6Address, tag bool) (bool, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Set(address, tag)
+}
+
+// Upsert sets the single value for a node, returning the one it replaced - see TreeV6.Upsert
+func (s *SafeTreeV6) Upsert(address patricia.IPv6Address, tag bool) (bool, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Upsert(address, tag)
+}
+
+// Add adds a tag to the tree - see TreeV6.Add
+func (s *SafeTreeV6) Add(address patricia.IPv6Address, tag bool, matchFunc MatchesFunc) (bool, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Add(address, tag, matchFunc)
+}
+
+// AddWithExpiry adds a tag to the tree that expires at expiresAt - see TreeV6.AddWithExpiry
+func (s *SafeTreeV6) AddWithExpiry(address patricia.IPv6Address, tag bool, expiresAt time.Time, matchFunc MatchesFunc) (bool, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.AddWithExpiry(address, tag, expiresAt, matchFunc)
+}
+
+// AddIfAbsent adds a tag to the tree, unless the address already has one - see TreeV6.AddIfAbsent
+func (s *SafeTreeV6) AddIfAbsent(address patricia.IPv6Address, tag bool, matchFunc MatchesFunc) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.AddIfAbsent(address, tag, matchFunc)
+}
+
+// Sweep removes expired tags - see TreeV6.Sweep
+func (s *SafeTreeV6) Sweep() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Sweep()
+}
+
+// Delete removes tags from the tree - see TreeV6.Delete
+func (s *SafeTreeV6) Delete(address patricia.IPv6Address, matchFunc MatchesFunc, matchVal bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Delete(address, matchFunc, matchVal)
+}
+
+// UpdateTags updates the tags for an address in place - see TreeV6.UpdateTags
+func (s *SafeTreeV6) UpdateTags(address patricia.IPv6Address, updateFunc UpdateFunc) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.UpdateTags(address, updateFunc)
+}
+
+// MapTags returns a new tree with mapFunc applied to every tag - see TreeV6.MapTags
+func (s *SafeTreeV6) MapTags(mapFunc UpdateFunc) *SafeTreeV6 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &SafeTreeV6{tree: s.tree.MapTags(mapFunc)}
+}
+
+// Prune removes an address and everything under it - see TreeV6.Prune
+func (s *SafeTreeV6) Prune(address patricia.IPv6Address) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Prune(address)
+}
+
+// Graft adds everything in src to the tree, under address - see TreeV6.Graft
+// - src must not change while this runs
+func (s *SafeTreeV6) Graft(address patricia.IPv6Address, src *TreeV6, matchFunc MatchesFunc) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Graft(address, src, matchFunc)
+}
+
+// FindTags finds all matching tags for the address - see TreeV6.FindTags
+func (s *SafeTreeV6) FindTags(address patricia.IPv6Address) ([]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindTags(address)
+}
+
+// FindTagsAppend finds all matching tags for the address and appends them to ret - see TreeV6.FindTagsAppend
+func (s *SafeTreeV6) FindTagsAppend(ret []bool, address patricia.IPv6Address) []bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindTagsAppend(ret, address)
+}
+
+// FindTagsWithFilter finds all matching tags for the address that pass the filter - see TreeV6.FindTagsWithFilter
+// - filterFunc is called with the read lock held
+func (s *SafeTreeV6) FindTagsWithFilter(address patricia.IPv6Address, filterFunc FilterFunc) ([]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindTagsWithFilter(address, filterFunc)
+}
+
+// FindTagsFunc calls tagFunc for every tag matching the address, without copying them - see TreeV6.FindTagsFunc
+// - tagFunc is called with the read lock held
+// - there's no FindDeepestTagsView, as the tags could change as soon as the lock's released
+func (s *SafeTreeV6) FindTagsFunc(address patricia.IPv6Address, tagFunc func(tag bool) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindTagsFunc(address, tagFunc)
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree - see TreeV6.FindDeepestTag
+func (s *SafeTreeV6) FindDeepestTag(address patricia.IPv6Address) (bool, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindDeepestTag(address)
+}
+
+// FindDeepestTagBatch finds a tag at the deepest level in the tree for each of the addresses, holding the read lock
+// once for them all - see TreeV6.FindDeepestTagBatch
+func (s *SafeTreeV6) FindDeepestTagBatch(addresses []patricia.IPv6Address, found []bool, tags []bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindDeepestTagBatch(addresses, found, tags)
+}
+
+// FindDeepestTags finds all tags at the deepest level in the tree - see TreeV6.FindDeepestTags
+func (s *SafeTreeV6) FindDeepestTags(address patricia.IPv6Address) (bool, []bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindDeepestTags(address)
+}
+
+// Walk calls walkFunc for every prefix in the tree that has tags - see TreeV6.Walk
+func (s *SafeTreeV6) Walk(walkFunc func(prefix patricia.IPv6Address, tags []bool) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.tree.Walk(walkFunc)
+}
+
+// WalkSubtree calls walkFunc for every prefix with tags at or under the address - see TreeV6.WalkSubtree
+func (s *SafeTreeV6) WalkSubtree(address patricia.IPv6Address, walkFunc func(prefix patricia.IPv6Address, tags []bool) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.tree.WalkSubtree(address, walkFunc)
+}
+
+// All returns an iterator over every prefix in the tree that has tags - see TreeV6.All
+// - the read lock is held for as long as the iteration runs, so the loop body must not change this tree
+func (s *SafeTreeV6) All() iter.Seq2[patricia.IPv6Address, []bool] {
+	return func(yield func(patricia.IPv6Address, []bool) bool) {
+		s.Walk(yield)
+	}
+}
+
+// Subtree returns an iterator over every prefix with tags at or under the address - see TreeV6.Subtree
+// - the read lock is held for as long as the iteration runs, so the loop body must not change this tree
+func (s *SafeTreeV6) Subtree(address patricia.IPv6Address) iter.Seq2[patricia.IPv6Address, []bool] {
+	return func(yield func(patricia.IPv6Address, []bool) bool) {
+		s.WalkSubtree(address, yield)
+	}
+}
+
+// MarshalBinary encodes the tree - see TreeV6.MarshalBinary
+func (s *SafeTreeV6) MarshalBinary() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.MarshalBinary()
+}
+
+// UnmarshalBinary replaces the tree's contents with the encoded tree - see TreeV6.UnmarshalBinary
+func (s *SafeTreeV6) UnmarshalBinary(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.UnmarshalBinary(data)
+}
+
+// Save writes the encoded tree to w - see TreeV6.Save
+func (s *SafeTreeV6) Save(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.Save(w)
+}
+
+// Load replaces the tree's contents with the encoded tree read from r - see TreeV6.Load
+// - the write lock is held while r is read, so this blocks everything else on the tree until it's done
+func (s *SafeTreeV6) Load(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Load(r)
+}
@@ -0,0 +1,291 @@
+package bool_tree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/kentik/patricia"
+)
+
+// a view's layout, all little-endian:
+// - header: magic, version (uint32), node count (uint32), tag data length (uint64)
+// - a fixed-size record for each node, including the unused node 0, as written by treeNodeV6.appendViewRecord
+// - tag data: each node's tags, encoded one after the other, starting at the offset in its record
+// everything is relative to the start of the view, so it works wherever it's loaded or mapped
+var _viewMagicV6 = []byte("PTVIEWV6")
+
+const (
+	_viewVersionV6    = 1
+	_viewHeaderSizeV6 = 24
+)
+
+// TreeV6View is a read-only tree that works directly on an encoded tree, as written by TreeV6.WriteView
+// - nothing is decoded up front, besides checking that the encoding is sound, so the data can be memory-mapped
+// and shared between processes, with only the parts being looked up being paged in
+// - tags are decoded as they're found, so lookups allocate, unlike with TreeV6
+// - safe for concurrent use, as long as the data doesn't change
+type TreeV6View struct {
+	nodes     []byte // node records
+	nodeCount int
+	tagData   []byte
+}
+
+// WriteView writes the tree to w in the format read by NewTreeV6View
+// - expired tags are left out
+// - fails for tag types that aren't bool, string, or numeric, or if the tags take up more than 4GB encoded
+func (t *TreeV6) WriteView(w io.Writer) error {
+	// the node records need to know where their tags go, so encode the tags first
+	tags := encoder{}
+	offsets := make([]uint32, len(t.nodes))
+	counts := make([]int, len(t.nodes))
+	for nodeIndex := range t.nodes {
+		if uint64(len(tags.buf)) > math.MaxUint32 {
+			return fmt.Errorf("tag data is too large for a view")
+		}
+		offsets[nodeIndex] = uint32(len(tags.buf))
+		if t.nodes[nodeIndex].TagCount == 0 {
+			continue
+		}
+		nodeTags := t.tagsForNode(uint(nodeIndex))
+		counts[nodeIndex] = len(nodeTags)
+		for _, tag := range nodeTags {
+			tags.tag(tag)
+		}
+		if tags.err != nil {
+			return tags.err
+		}
+	}
+
+	e := encoder{buf: make([]byte, 0, _encodingChunkSize), w: w}
+	e.bytes(_viewMagicV6)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, _viewVersionV6)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, uint32(len(t.nodes)))
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, uint64(len(tags.buf)))
+	for nodeIndex := range t.nodes {
+		node := t.nodes[nodeIndex]
+		node.TagCount = counts[nodeIndex]
+		e.buf = node.appendViewRecord(e.buf, offsets[nodeIndex])
+		e.chunk()
+	}
+	e.flush()
+	if e.err == nil {
+		_, e.err = w.Write(tags.buf)
+	}
+	return e.err
+}
+
+// Freeze returns the tree encoded in the format read by NewTreeV6View and LoadFrozen, the same as WriteView
+// - expired tags are left out, and tags that haven't expired yet are kept without their expiration times
+func (t *TreeV6) Freeze() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(_viewHeaderSizeV6 + len(t.nodes)*_viewNodeSizeV6 + t.CountTags()*4)
+	if err := t.WriteView(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LoadFrozen replaces the tree's contents with the tree encoded by Freeze or WriteView
+// - the nodes are copied straight from their fixed-size records, as they're laid out in the encoded tree, so this is a
+// single pass over the data, with nothing added a prefix at a time
+// - unlike a TreeV6View, the loaded tree doesn't need the data after this, and can be changed
+// - the tree keeps its own options
+// - if an error is returned, the tree is left as it was
+func (t *TreeV6) LoadFrozen(data []byte) error {
+	v, err := NewTreeV6View(data)
+	if err != nil {
+		return err
+	}
+
+	tagCount := 0
+	nodes := make([]treeNodeV6, v.nodeCount)
+	tagOffsets := make([]uint32, v.nodeCount)
+	for nodeIndex := range nodes {
+		tagOffsets[nodeIndex] = v.node(uint(nodeIndex), &nodes[nodeIndex])
+		tagCount += nodes[nodeIndex].TagCount
+	}
+	if tagCount > len(v.tagData) {
+		// every tag takes at least a byte
+		return fmt.Errorf("%w: more tags than there's data for", ErrInvalidData)
+	}
+
+	tree := &TreeV6{
+		nodes:  nodes,
+		tags:   newTagStorage(&t.config),
+		config: t.config,
+	}
+	slices := make([][]bool, len(nodes))
+	arena := sliceArena[bool]{block: make([]bool, 0, tagCount)}
+	var tags []bool
+	for nodeIndex := range nodes {
+		d := decoder{data: v.tagData[tagOffsets[nodeIndex]:]}
+		tags = tags[:0]
+		for i := 0; i < nodes[nodeIndex].TagCount; i++ {
+			tags = append(tags, d.tag())
+		}
+		if d.err != nil {
+			return fmt.Errorf("node %d: %w", nodeIndex, d.err)
+		}
+		slices[nodeIndex] = arena.copy(tags)
+	}
+
+	// nodes that aren't in the tree are free, which the structure check needs to know, so they're found first
+	tree.availableIndexes = tree.unreachableNodes()
+	if err = tree.checkStructure(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidData, err)
+	}
+	if err = tree.tags.load(slices, tree); err != nil {
+		return err
+	}
+	t.replace(tree)
+	return nil
+}
+
+// NewTreeV6View returns a view of the tree encoded in data, as written by TreeV6.WriteView
+// - data is used as it is, not copied, and must not change while the view is in use
+// - every node record is checked, so that lookups on a corrupt view can't go wrong, but tags aren't decoded until they're looked up
+func NewTreeV6View(data []byte) (*TreeV6View, error) {
+	if len(data) < _viewHeaderSizeV6 || string(data[:len(_viewMagicV6)]) != string(_viewMagicV6) {
+		return nil, fmt.Errorf("%w: not an IPv4 tree view", ErrInvalidData)
+	}
+	if version := binary.LittleEndian.Uint32(data[8:]); version != _viewVersionV6 {
+		return nil, fmt.Errorf("%w: unknown view version %d", ErrInvalidData, version)
+	}
+	nodeCount := uint64(binary.LittleEndian.Uint32(data[12:]))
+	tagDataLength := binary.LittleEndian.Uint64(data[16:])
+	if nodeCount < 2 {
+		return nil, fmt.Errorf("%w: no root node", ErrInvalidData)
+	}
+	if uint64(len(data)-_viewHeaderSizeV6) != nodeCount*_viewNodeSizeV6+tagDataLength {
+		return nil, fmt.Errorf("%w: view is %d bytes, expected %d", ErrInvalidData, len(data), _viewHeaderSizeV6+nodeCount*_viewNodeSizeV6+tagDataLength)
+	}
+
+	nodesEnd := _viewHeaderSizeV6 + int(nodeCount)*_viewNodeSizeV6
+	v := &TreeV6View{
+		nodes:     data[_viewHeaderSizeV6:nodesEnd],
+		nodeCount: int(nodeCount),
+		tagData:   data[nodesEnd:],
+	}
+	for nodeIndex := 0; nodeIndex < v.nodeCount; nodeIndex++ {
+		var node treeNodeV6
+		tagOffset := v.node(uint(nodeIndex), &node)
+		if uint(node.Left) >= uint(nodeCount) || uint(node.Right) >= uint(nodeCount) {
+			return nil, fmt.Errorf("%w: node %d has a child out of range", ErrInvalidData, nodeIndex)
+		}
+		if node.length() > _maxPrefixLengthV6 {
+			return nil, fmt.Errorf("%w: node %d has prefix length %d", ErrInvalidData, nodeIndex, node.length())
+		}
+		if uint64(tagOffset)+uint64(node.TagCount) > tagDataLength {
+			// every tag takes at least a byte
+			return nil, fmt.Errorf("%w: node %d has tags out of range", ErrInvalidData, nodeIndex)
+		}
+
+		// every step down the tree has to use up some of the address, so lookups always end
+		for _, childIndex := range [2]uint{uint(node.Left), uint(node.Right)} {
+			if childIndex == 0 {
+				continue
+			}
+			var child treeNodeV6
+			v.node(childIndex, &child)
+			if childIndex == 1 || child.length() == 0 {
+				return nil, fmt.Errorf("%w: node %d has an invalid child %d", ErrInvalidData, nodeIndex, childIndex)
+			}
+		}
+	}
+	return v, nil
+}
+
+// read the node at the input index, returning the offset of its tags
+func (v *TreeV6View) node(nodeIndex uint, node *treeNodeV6) uint32 {
+	return node.readViewRecord(v.nodes[nodeIndex*_viewNodeSizeV6:])
+}
+
+// append the tags for the node to ret
+func (v *TreeV6View) appendTags(ret []bool, node *treeNodeV6, tagOffset uint32) ([]bool, error) {
+	d := decoder{data: v.tagData[tagOffset:]}
+	for i := 0; i < node.TagCount; i++ {
+		tag := d.tag()
+		if d.err != nil {
+			return ret, d.err
+		}
+		ret = append(ret, tag)
+	}
+	return ret, nil
+}
+
+// call visit for each node on the way to the input address, with its tags' offset, for as long as it matches
+func (v *TreeV6View) walkMatches(address patricia.IPv6Address, visit func(node *treeNodeV6, tagOffset uint32)) {
+	var node treeNodeV6
+	visit(&node, v.node(1, &node))
+	for address.Length > 0 {
+		var nodeIndex uint
+		if !address.IsLeftBitSet() {
+			nodeIndex = uint(node.Left)
+		} else {
+			nodeIndex = uint(node.Right)
+		}
+		if nodeIndex == 0 {
+			return
+		}
+		tagOffset := v.node(nodeIndex, &node)
+
+		matchCount := node.MatchCount(address)
+		if matchCount < node.length() {
+			// didn't match the entire node - we're done
+			return
+		}
+		visit(&node, tagOffset)
+		address.ShiftLeft(matchCount)
+	}
+}
+
+// FindTags finds all matching tags for given address, like TreeV6.FindTags
+func (v *TreeV6View) FindTags(address patricia.IPv6Address) ([]bool, error) {
+	ret := make([]bool, 0)
+	var err error
+	v.walkMatches(address, func(node *treeNodeV6, tagOffset uint32) {
+		if node.TagCount > 0 && err == nil {
+			ret, err = v.appendTags(ret, node, tagOffset)
+		}
+	})
+	return ret, err
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree, like TreeV6.FindDeepestTag
+func (v *TreeV6View) FindDeepestTag(address patricia.IPv6Address) (bool, bool, error) {
+	var ret bool
+	found, tags, err := v.FindDeepestTags(address)
+	if !found || err != nil {
+		return false, ret, err
+	}
+	return true, tags[0], nil
+}
+
+// FindDeepestTags finds all tags at the deepest level in the tree, like TreeV6.FindDeepestTags
+// - returns an empty slice if nothing's found
+func (v *TreeV6View) FindDeepestTags(address patricia.IPv6Address) (bool, []bool, error) {
+	var deepest treeNodeV6
+	var deepestTagOffset uint32
+	v.walkMatches(address, func(node *treeNodeV6, tagOffset uint32) {
+		if node.TagCount > 0 {
+			deepest = *node
+			deepestTagOffset = tagOffset
+		}
+	})
+	ret, err := v.appendTags(make([]bool, 0, deepest.TagCount), &deepest, deepestTagOffset)
+	return deepest.TagCount > 0 && err == nil, ret, err
+}
+
+// CountTags returns how many tags are in the view
+func (v *TreeV6View) CountTags() int {
+	ret := 0
+	for nodeIndex := 1; nodeIndex < v.nodeCount; nodeIndex++ {
+		var node treeNodeV6
+		v.node(uint(nodeIndex), &node)
+		ret += node.TagCount
+	}
+	return ret
+}
@@ -0,0 +1,109 @@
+package byte_tree
+
+import "sync"
+
+// arena allocation, shared by the IPv4/IPv6 trees
+
+// the fewest elements in each block an Arena allocates
+const _arenaBlockSize = 1 << 16
+
+// Arena is memory that trees made WithArena take their node arrays and tags from, in large blocks, so jobs that build
+// lots of short-lived trees make a few big allocations, rather than many small ones, and can reuse them with Reset
+// - storage a tree grows out of isn't handed out again until Reset, so Reserve trees whose size is known
+// - safe for concurrent use, by any number of trees
+type Arena struct {
+	mu      sync.Mutex
+	nodesV4 arenaSlab[treeNodeV4]
+	nodesV6 arenaSlab[treeNodeV6]
+	tags    arenaSlab[byte]
+}
+
+// NewArena returns a new, empty arena
+func NewArena() *Arena {
+	return &Arena{}
+}
+
+// WithArena has the tree take its node array and tags from the arena, rather than allocating them itself
+// - the arena's used for the node array as it grows, and a clone's, and for tags as they're added - copies of tags made by
+// Clone or Compact, say, come from the heap as usual
+func WithArena(arena *Arena) TreeOption {
+	return func(c *treeConfig) {
+		c.arena = arena
+	}
+}
+
+// Reset makes all of the arena's memory available again, clearing it, so nothing it held is kept from the GC
+// - every tree made with the arena must be done with first: using one afterwards gives garbage
+func (a *Arena) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nodesV4.reset()
+	a.nodesV6.reset()
+	a.tags.reset()
+}
+
+// returns a node array with the input length and capacity
+func (a *Arena) treeNodesV4(length int, capacity int) []treeNodeV4 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.nodesV4.alloc(length, capacity)
+}
+
+// returns a node array with the input length and capacity
+func (a *Arena) treeNodesV6(length int, capacity int) []treeNodeV6 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.nodesV6.alloc(length, capacity)
+}
+
+// returns tags with the tag appended, like append, taking any new storage from the arena - or from the heap, if a is nil
+func (a *Arena) appendTag(tags []byte, tag byte) []byte {
+	if a == nil || len(tags) < cap(tags) {
+		return append(tags, tag)
+	}
+	a.mu.Lock()
+	ret := a.tags.alloc(len(tags), max(2*len(tags), 1))
+	a.mu.Unlock()
+	copy(ret, tags)
+	return append(ret, tag)
+}
+
+// blocks of elements of one type, handed out in order
+// - blocks before next are full, or as full as they're going to get, and blocks after it are empty
+type arenaSlab[T any] struct {
+	blocks [][]T
+	next   int
+}
+
+// returns a slice with the input length and capacity, the elements zeroed
+func (s *arenaSlab[T]) alloc(length int, capacity int) []T {
+	if s.next < len(s.blocks) && cap(s.blocks[s.next])-len(s.blocks[s.next]) < capacity {
+		// doesn't fit in what's left of this block - move on to an empty one that it does fit in, if there is one
+		s.next++
+		for i := s.next; i < len(s.blocks); i++ {
+			if cap(s.blocks[i]) >= capacity {
+				s.blocks[s.next], s.blocks[i] = s.blocks[i], s.blocks[s.next]
+				break
+			}
+		}
+	}
+	if s.next == len(s.blocks) || cap(s.blocks[s.next])-len(s.blocks[s.next]) < capacity {
+		s.blocks = append(s.blocks, nil)
+		copy(s.blocks[s.next+1:], s.blocks[s.next:])
+		s.blocks[s.next] = make([]T, 0, max(capacity, _arenaBlockSize))
+	}
+
+	block := s.blocks[s.next]
+	start := len(block)
+	s.blocks[s.next] = block[:start+capacity]
+	return block[start : start+length : start+capacity]
+}
+
+// clear every block, and start handing them out again from the first
+func (s *arenaSlab[T]) reset() {
+	for i := range s.blocks {
+		clear(s.blocks[i])
+		s.blocks[i] = s.blocks[i][:0]
+	}
+	s.next = 0
+}
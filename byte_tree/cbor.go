@@ -0,0 +1,297 @@
+package byte_tree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// CBOR (RFC 8949) encoding, shared by the IPv4/IPv6 trees
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborInt    = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// CBOR simple values and the like, which are major type 7
+const (
+	cborFalse   = 20
+	cborTrue    = 21
+	cborFloat16 = 25
+	cborFloat32 = 26
+	cborFloat64 = 27
+	cborBreak   = 0xff // ends an indefinite-length item
+)
+
+// write an item's head: its major type, and a number that's its value, length, or tag, depending on the type
+func (e *encoder) cborHead(major byte, value uint64) {
+	if e.err != nil {
+		return
+	}
+	major <<= 5
+	switch {
+	case value < 24:
+		e.buf = append(e.buf, major|byte(value))
+	case value <= math.MaxUint8:
+		e.buf = append(e.buf, major|24, byte(value))
+	case value <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, major|25), uint16(value))
+	case value <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, major|26), uint32(value))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, major|27), value)
+	}
+}
+
+func (e *encoder) cborInt(value int64) {
+	if value < 0 {
+		e.cborHead(cborInt, uint64(-1-value))
+	} else {
+		e.cborHead(cborUint, uint64(value))
+	}
+}
+
+func (e *encoder) cborFloat32(value float32) {
+	e.byte(cborSimple<<5 | cborFloat32)
+	e.uint32(math.Float32bits(value))
+}
+
+func (e *encoder) cborFloat64(value float64) {
+	e.byte(cborSimple<<5 | cborFloat64)
+	e.uint64(math.Float64bits(value))
+}
+
+// write a tag as the closest CBOR type - complex numbers, which CBOR has no type for, are arrays of their real and imaginary parts
+func (e *encoder) cborTag(tag byte) {
+	switch v := interface{}(tag).(type) {
+	case bool:
+		if v {
+			e.byte(cborSimple<<5 | cborTrue)
+		} else {
+			e.byte(cborSimple<<5 | cborFalse)
+		}
+	case string:
+		e.cborHead(cborText, uint64(len(v)))
+		e.bytes([]byte(v))
+	case int:
+		e.cborInt(int64(v))
+	case int8:
+		e.cborInt(int64(v))
+	case int16:
+		e.cborInt(int64(v))
+	case int32:
+		e.cborInt(int64(v))
+	case int64:
+		e.cborInt(v)
+	case uint:
+		e.cborHead(cborUint, uint64(v))
+	case uint8:
+		e.cborHead(cborUint, uint64(v))
+	case uint16:
+		e.cborHead(cborUint, uint64(v))
+	case uint32:
+		e.cborHead(cborUint, uint64(v))
+	case uint64:
+		e.cborHead(cborUint, v)
+	case float32:
+		e.cborFloat32(v)
+	case float64:
+		e.cborFloat64(v)
+	case complex64:
+		e.cborHead(cborArray, 2)
+		e.cborFloat32(real(v))
+		e.cborFloat32(imag(v))
+	case complex128:
+		e.cborHead(cborArray, 2)
+		e.cborFloat64(real(v))
+		e.cborFloat64(imag(v))
+	default:
+		e.err = fmt.Errorf("%w: %T", ErrUnsupportedTag, tag)
+	}
+}
+
+// read an item's head, returning its major type and the number that goes with it, and whether it's of indefinite length
+func (d *decoder) cborHead() (byte, uint64, bool) {
+	initial := d.byte()
+	major, info := initial>>5, initial&0x1f
+	switch {
+	case d.err != nil:
+		return 0, 0, false
+	case info < 24:
+		return major, uint64(info), false
+	case info == 24:
+		return major, uint64(d.byte()), false
+	case info == 25:
+		data := d.bytes(2)
+		if data == nil {
+			return 0, 0, false
+		}
+		return major, uint64(binary.BigEndian.Uint16(data)), false
+	case info == 26:
+		return major, uint64(d.uint32()), false
+	case info == 27:
+		return major, d.uint64(), false
+	case info == 31 && (major == cborArray || major == cborMap):
+		return major, 0, true
+	default:
+		d.fail("unsupported CBOR item 0x%02x", initial)
+		return 0, 0, false
+	}
+}
+
+// read the head of an array, returning its length, or -1 if it's of indefinite length
+func (d *decoder) cborArray() int {
+	major, length, indefinite := d.cborHead()
+	if d.err != nil {
+		return 0
+	}
+	if major != cborArray {
+		d.fail("CBOR major type %d, expected an array", major)
+		return 0
+	}
+	if indefinite {
+		return -1
+	}
+	// every item takes at least a byte
+	if length > uint64(d.bound()) {
+		d.fail("CBOR array of %d items is too long", length)
+		return 0
+	}
+	return int(length)
+}
+
+// whether there's another item in an array of the input length, with read items already read
+func (d *decoder) cborNext(length int, read int) bool {
+	if d.err != nil {
+		return false
+	}
+	if length >= 0 {
+		return read < length
+	}
+	if !d.fill(1) {
+		d.fail("unexpected end of data")
+		return false
+	}
+	if d.data[0] == cborBreak {
+		d.byte()
+		return false
+	}
+	return true
+}
+
+// read a CBOR unsigned integer
+func (d *decoder) cborUint() uint64 {
+	major, value, _ := d.cborHead()
+	if d.err == nil && major != cborUint {
+		d.fail("CBOR major type %d, expected an unsigned integer", major)
+	}
+	return value
+}
+
+// read a byte string
+func (d *decoder) cborBytes() []byte {
+	major, length, _ := d.cborHead()
+	if d.err == nil && major != cborBytes {
+		d.fail("CBOR major type %d, expected a byte string", major)
+	}
+	if d.err == nil && length > uint64(d.bound()) {
+		d.fail("CBOR byte string of %d bytes is too long", length)
+	}
+	return d.bytes(int(length))
+}
+
+// read a tag as whatever type it was encoded as
+func (d *decoder) cborTagValue() interface{} {
+	if d.err == nil && d.fill(1) && d.data[0]>>5 == cborSimple {
+		// the head's number is the simple value itself, or a float's bits, so which it is depends on how it was written
+		switch initial := d.byte(); initial & 0x1f {
+		case cborFalse:
+			return false
+		case cborTrue:
+			return true
+		case cborFloat16:
+			data := d.bytes(2)
+			if data == nil {
+				return nil
+			}
+			return float16ToFloat32(binary.BigEndian.Uint16(data))
+		case cborFloat32:
+			return math.Float32frombits(d.uint32())
+		case cborFloat64:
+			return math.Float64frombits(d.uint64())
+		default:
+			d.fail("unsupported CBOR item 0x%02x", initial)
+			return nil
+		}
+	}
+
+	major, value, _ := d.cborHead()
+	if d.err != nil {
+		return nil
+	}
+	switch major {
+	case cborUint:
+		return value
+	case cborInt:
+		if value > math.MaxInt64 {
+			d.fail("CBOR integer -1-%d is out of range", value)
+			return nil
+		}
+		return -1 - int64(value)
+	case cborText:
+		if value > uint64(d.bound()) {
+			d.fail("CBOR text of %d bytes is too long", value)
+			return nil
+		}
+		return string(d.bytes(int(value)))
+	case cborArray:
+		// a complex number
+		if value != 2 {
+			d.fail("CBOR array of %d items isn't a complex number", value)
+			return nil
+		}
+		var parts [2]float64
+		for i := range parts {
+			switch part := d.cborTagValue().(type) {
+			case float32:
+				parts[i] = float64(part)
+			case float64:
+				parts[i] = part
+			default:
+				d.fail("complex number with a %T part", part)
+			}
+		}
+		return complex(parts[0], parts[1])
+	default:
+		d.fail("unsupported CBOR major type %d", major)
+		return nil
+	}
+}
+
+// convert an IEEE 754 half-precision float, which CBOR encoders may use for floats that fit one
+func float16ToFloat32(bits uint16) float32 {
+	sign := uint32(bits>>15) << 31
+	exponent := uint32(bits>>10) & 0x1f
+	fraction := uint32(bits) & 0x3ff
+	switch exponent {
+	case 0:
+		// zero or subnormal, which are normal as a float32
+		value := float32(fraction) / (1 << 24)
+		if sign != 0 {
+			value = -value
+		}
+		return value
+	case 0x1f:
+		// infinity or NaN
+		return math.Float32frombits(sign | 0xff<<23 | fraction<<13)
+	default:
+		return math.Float32frombits(sign | (exponent+127-15)<<23 | fraction<<13)
+	}
+}
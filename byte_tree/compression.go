@@ -0,0 +1,112 @@
+package byte_tree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Compressor wraps w so that what's written is compressed on its way to w, like gzip.NewWriter
+// - closing the returned writer must flush everything out to w, but not close w
+type Compressor func(w io.Writer) (io.WriteCloser, error)
+
+// Decompressor wraps r so that what's read is decompressed from r, like gzip.NewReader
+type Decompressor func(r io.Reader) (io.Reader, error)
+
+// compressed data is written in frames, each a uvarint length followed by that many bytes, ending with an empty frame
+// - so a truncated stream is noticed, whether or not the compression format notices it itself
+
+// frameWriter is an io.WriteCloser writing frames to w
+type frameWriter struct {
+	w   io.Writer
+	buf []byte // the frame being built, after room for its length
+	err error
+}
+
+func newFrameWriter(w io.Writer) *frameWriter {
+	return &frameWriter{w: w, buf: make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+_encodingChunkSize)}
+}
+
+func (f *frameWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 && f.err == nil {
+		n := copy(f.buf[len(f.buf):cap(f.buf)], data)
+		f.buf = f.buf[:len(f.buf)+n]
+		data = data[n:]
+		written += n
+		if len(f.buf) == cap(f.buf) {
+			f.writeFrame()
+		}
+	}
+	return written, f.err
+}
+
+// write the buffered data out as a frame, with its length just before it
+func (f *frameWriter) writeFrame() {
+	if f.err != nil {
+		return
+	}
+	length := len(f.buf) - binary.MaxVarintLen64
+	var header [binary.MaxVarintLen64]byte
+	headerBytes := binary.AppendUvarint(header[:0], uint64(length))
+	start := binary.MaxVarintLen64 - len(headerBytes)
+	copy(f.buf[start:], headerBytes)
+	_, f.err = f.w.Write(f.buf[start:])
+	f.buf = f.buf[:binary.MaxVarintLen64]
+}
+
+// Close writes out what's buffered, followed by the empty frame ending the stream
+func (f *frameWriter) Close() error {
+	if len(f.buf) > binary.MaxVarintLen64 {
+		f.writeFrame()
+	}
+	f.writeFrame()
+	return f.err
+}
+
+// frameReader is an io.Reader reading the frames written by frameWriter
+type frameReader struct {
+	r    *bufio.Reader
+	left uint64 // what's left of the current frame
+	done bool   // whether the empty frame has been read
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: bufio.NewReaderSize(r, _encodingChunkSize)}
+}
+
+func (f *frameReader) Read(data []byte) (int, error) {
+	for f.left == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		length, err := binary.ReadUvarint(f.r)
+		if err != nil {
+			return 0, f.readError(err)
+		}
+		if length > _encodingChunkSize {
+			return 0, fmt.Errorf("%w: frame of %d bytes is too long", ErrInvalidData, length)
+		}
+		f.left = length
+		f.done = length == 0
+	}
+
+	if uint64(len(data)) > f.left {
+		data = data[:f.left]
+	}
+	n, err := f.r.Read(data)
+	f.left -= uint64(n)
+	if err != nil {
+		return n, f.readError(err)
+	}
+	return n, nil
+}
+
+// running out of data before the empty frame means the stream was cut short
+func (f *frameReader) readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: compressed data is truncated", ErrInvalidData)
+	}
+	return err
+}
@@ -0,0 +1,176 @@
+package byte_tree
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// CSV loading shared by the IPv4/IPv6 trees
+
+// ParseFunc turns a value read from a file into a tag
+type ParseFunc func(value string) (byte, error)
+
+// CSVOption configures how a CSV file is read
+type CSVOption func(*csvConfig)
+
+// WithCSVComma sets the field separator, instead of ','
+func WithCSVComma(comma rune) CSVOption {
+	return func(c *csvConfig) {
+		c.comma = comma
+	}
+}
+
+// WithCSVHeader skips the first line, as a header
+func WithCSVHeader() CSVOption {
+	return func(c *csvConfig) {
+		c.header = true
+	}
+}
+
+// WithCSVColumns sets which columns, counting from 0, hold the prefix and the value, instead of 0 and 1
+// - other columns are ignored
+func WithCSVColumns(cidrColumn int, valueColumn int) CSVOption {
+	return func(c *csvConfig) {
+		c.cidrColumn = cidrColumn
+		c.valueColumn = valueColumn
+	}
+}
+
+// WithCSVParser sets how values are turned into tags
+// - by default, values are parsed with strconv as the tag type - or kept as strings, if the tag type is an interface
+func WithCSVParser(parseFunc ParseFunc) CSVOption {
+	return func(c *csvConfig) {
+		c.parseFunc = parseFunc
+	}
+}
+
+// configuration for reading a CSV file, set up by CSVOptions
+type csvConfig struct {
+	comma       rune
+	header      bool
+	cidrColumn  int
+	valueColumn int
+	parseFunc   ParseFunc
+}
+
+func newCSVConfig(options []CSVOption) csvConfig {
+	c := csvConfig{comma: ',', valueColumn: 1, parseFunc: parseTag}
+	for _, option := range options {
+		option(&c)
+	}
+	return c
+}
+
+// GeoIPRow is a line of a MaxMind GeoIP2 or GeoLite2 blocks file
+type GeoIPRow struct {
+	columns map[string]int
+	fields  []string
+}
+
+// Field returns the value in the named column, such as "geoname_id", or "" if there's no such column
+func (r GeoIPRow) Field(column string) string {
+	if i, ok := r.columns[column]; ok && i < len(r.fields) {
+		return r.fields[i]
+	}
+	return ""
+}
+
+// GeoIPFunc makes a tag from a line of a GeoIP blocks file, returning false to skip the line
+type GeoIPFunc func(row GeoIPRow) (byte, bool, error)
+
+// the default GeoIPFunc, tagging networks with their geoname_id, or their registered country's
+func geonameTag(row GeoIPRow) (byte, bool, error) {
+	var ret byte
+	geonameID := row.Field("geoname_id")
+	if geonameID == "" {
+		geonameID = row.Field("registered_country_geoname_id")
+	}
+	if geonameID == "" {
+		return ret, false, nil
+	}
+	ret, err := parseTag(geonameID)
+	if err != nil {
+		return ret, false, fmt.Errorf("invalid geoname_id %q: %w", geonameID, err)
+	}
+	return ret, true, nil
+}
+
+// parse a tag from a string, as whatever type byte is
+func parseTag(value string) (byte, error) {
+	var ret byte
+	var err error
+	switch target := interface{}(&ret).(type) {
+	case *bool:
+		*target, err = strconv.ParseBool(value)
+	case *string:
+		*target = value
+	case *int:
+		var v int64
+		v, err = strconv.ParseInt(value, 0, strconv.IntSize)
+		*target = int(v)
+	case *int8:
+		var v int64
+		v, err = strconv.ParseInt(value, 0, 8)
+		*target = int8(v)
+	case *int16:
+		var v int64
+		v, err = strconv.ParseInt(value, 0, 16)
+		*target = int16(v)
+	case *int32:
+		var v int64
+		v, err = strconv.ParseInt(value, 0, 32)
+		*target = int32(v)
+	case *int64:
+		*target, err = strconv.ParseInt(value, 0, 64)
+	case *uint:
+		var v uint64
+		v, err = strconv.ParseUint(value, 0, strconv.IntSize)
+		*target = uint(v)
+	case *uint8:
+		var v uint64
+		v, err = strconv.ParseUint(value, 0, 8)
+		*target = uint8(v)
+	case *uint16:
+		var v uint64
+		v, err = strconv.ParseUint(value, 0, 16)
+		*target = uint16(v)
+	case *uint32:
+		var v uint64
+		v, err = strconv.ParseUint(value, 0, 32)
+		*target = uint32(v)
+	case *uint64:
+		*target, err = strconv.ParseUint(value, 0, 64)
+	case *float32:
+		var v float64
+		v, err = strconv.ParseFloat(value, 32)
+		*target = float32(v)
+	case *float64:
+		*target, err = strconv.ParseFloat(value, 64)
+	case *complex64:
+		var v complex128
+		v, err = strconv.ParseComplex(value, 64)
+		*target = complex64(v)
+	case *complex128:
+		*target, err = strconv.ParseComplex(value, 128)
+	default:
+		// an interface type, which can hold the string as it is
+		v, ok := interface{}(value).(byte)
+		if !ok {
+			return ret, fmt.Errorf("can't parse a %T", ret)
+		}
+		ret = v
+	}
+	return ret, err
+}
+
+// report CSV syntax errors by line, the same as other errors
+func csvError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		// it knows the line better than we do, with quoted fields spanning lines
+		return fmt.Errorf("line %d: %w", parseErr.Line, parseErr.Err)
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package byte_tree
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// streamed loading shared by the IPv4/IPv6 trees
+
+// LoadProgress is how far LoadFrom has got
+type LoadProgress struct {
+	Tags      int   // how many tags have been loaded
+	BytesRead int64 // how many bytes have been read from the reader
+}
+
+// LoadOption configures how LoadFrom reads a tree
+type LoadOption func(*loadConfig)
+
+// WithLoadProgress calls progressFunc with how far the load has got, at most once per interval, and once more when
+// it's done
+// - progressFunc is called on the loading goroutine, so it holds up the load while it runs
+func WithLoadProgress(interval time.Duration, progressFunc func(progress LoadProgress)) LoadOption {
+	return func(c *loadConfig) {
+		c.progressInterval = interval
+		c.progressFunc = progressFunc
+	}
+}
+
+// WithLoadDecompressor reads a tree written by SaveCompressed, decompressed by decompress, instead of one written by Save
+// - decompress may be nil, if SaveCompressed used no compression
+func WithLoadDecompressor(decompress Decompressor) LoadOption {
+	return func(c *loadConfig) {
+		c.compressed = true
+		c.decompress = decompress
+	}
+}
+
+// configuration for LoadFrom, set up by LoadOptions
+type loadConfig struct {
+	progressInterval time.Duration
+	progressFunc     func(progress LoadProgress)
+	compressed       bool
+	decompress       Decompressor
+}
+
+func newLoadConfig(options []LoadOption) loadConfig {
+	var c loadConfig
+	for _, option := range options {
+		option(&c)
+	}
+	return c
+}
+
+// progressReader counts what's read through it for progress reports, and stops reading once its context is done
+type progressReader struct {
+	ctx        context.Context
+	r          io.Reader
+	d          *decoder // what's decoding the tree, for how many tags it's read
+	config     *loadConfig
+	progress   LoadProgress
+	lastReport time.Time
+}
+
+func (r *progressReader) Read(data []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	read, err := r.r.Read(data)
+	r.progress.BytesRead += int64(read)
+	if r.config.progressFunc != nil {
+		if now := time.Now(); now.Sub(r.lastReport) >= r.config.progressInterval {
+			r.lastReport = now
+			r.report()
+		}
+	}
+	return read, err
+}
+
+// call the progress function with how far the load has got
+func (r *progressReader) report() {
+	r.progress.Tags = r.d.tags
+	r.config.progressFunc(r.progress)
+}
@@ -0,0 +1,62 @@
+package byte_tree
+
+import (
+	"strings"
+)
+
+// prefix list loading shared by the IPv4/IPv6 trees
+
+// PrefixListOption configures how a prefix list is read
+type PrefixListOption func(*prefixListConfig)
+
+// WithPrefixListParser sets how values after a prefix are turned into tags
+// - by default, values are parsed the same as LoadCSV parses them
+func WithPrefixListParser(parseFunc ParseFunc) PrefixListOption {
+	return func(c *prefixListConfig) {
+		c.parseFunc = parseFunc
+	}
+}
+
+// WithPrefixListLenient skips lines that can't be loaded, such as ones that aren't prefixes, or are for the other IP
+// version, instead of failing on the first one
+// - skipFunc, if set, is called with the error for each line that's skipped, which says what line it was
+func WithPrefixListLenient(skipFunc func(err error)) PrefixListOption {
+	return func(c *prefixListConfig) {
+		c.lenient = true
+		c.skipFunc = skipFunc
+	}
+}
+
+// configuration for reading a prefix list, set up by PrefixListOptions
+type prefixListConfig struct {
+	parseFunc ParseFunc
+	lenient   bool
+	skipFunc  func(err error)
+}
+
+func newPrefixListConfig(options []PrefixListOption) prefixListConfig {
+	c := prefixListConfig{parseFunc: parseTag}
+	for _, option := range options {
+		option(&c)
+	}
+	return c
+}
+
+// split a line of a prefix list into its prefix and value, returning false for lines with neither
+// - comments start with '#', ';', or "//", and run to the end of the line
+// - the value is everything after the first run of whitespace following the prefix, so it can hold spaces itself
+func splitPrefixListLine(line string) (string, string, bool) {
+	for _, marker := range []string{"#", ";", "//"} {
+		if i := strings.Index(line, marker); i >= 0 {
+			line = line[:i]
+		}
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", "", false
+	}
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		return line[:i], strings.TrimSpace(line[i:]), true
+	}
+	return line, "", true
+}
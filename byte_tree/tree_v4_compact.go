@@ -0,0 +1,113 @@
+package byte_tree
+
+import "sync/atomic"
+
+// CompactionV4 compacts a tree a step at a time, so a service can reclaim the memory left behind by deletions without
+// stopping to rebuild the tree - see TreeV4.NewCompaction
+type CompactionV4 struct {
+	tree      *TreeV4
+	changeSeq uint64 // the tree's, when the compaction started
+	nodes     []treeNodeV4
+	tags      tagStorage
+	hits      []uint64
+	copier    tagCopier
+	pending   []compactNodeV4 // nodes still to be copied
+	done      bool
+}
+
+// a node still to be copied by a compaction, with the index it's copied to
+type compactNodeV4 struct {
+	from uint
+	to   uint
+}
+
+// NewCompaction starts compacting the tree: copying its nodes into a node array with no free nodes, and its tags into
+// storage with no room left by deleted ones, a few at a time, with Step
+// - the tree is only touched once it's all copied, when the copy replaces its storage in one go, so it can be used as
+// usual between steps - but a change to it starts the compaction over
+// - with a snapshot taken, by AtomicTreeV4 or TreeHandleV4 say, readers of the snapshot never notice, as it keeps the old storage
+func (t *TreeV4) NewCompaction() *CompactionV4 {
+	c := &CompactionV4{tree: t}
+	c.start()
+	return c
+}
+
+// Compact compacts the tree in one go - see NewCompaction
+func (t *TreeV4) Compact() {
+	t.NewCompaction().Step(len(t.nodes))
+}
+
+// ShrinkToFit compacts the tree in one go, like Compact, returning roughly how many bytes of storage that released
+// - counts the node array, free list, and tag slices' capacity, before and after
+// - a snapshot keeps the old storage, so it's only released to the GC once no snapshot of the tree is in use
+func (t *TreeV4) ShrinkToFit() int {
+	before := t.MemoryStats().TotalBytes
+	t.Compact()
+	return max(0, before-t.MemoryStats().TotalBytes)
+}
+
+// start copying the tree from the top
+func (c *CompactionV4) start() {
+	t := c.tree
+	c.changeSeq = t.changeSeq
+	c.nodes = make([]treeNodeV4, 2, len(t.nodes)-len(t.availableIndexes))
+	c.tags = t.tags.emptyCopy()
+	c.tags.reserve(cap(c.nodes))
+	c.hits = nil
+	c.copier = tagCopier{}
+	c.pending = append(c.pending[:0], compactNodeV4{from: 1, to: 1})
+}
+
+// Step copies up to maxNodes more nodes, and their tags, returning whether the compaction is done
+// - once every node is copied, the tree's storage is replaced with the copy
+// - if the tree's been changed since the last step, the compaction starts over
+// - must be called from the goroutine changing the tree, like any change to it
+func (c *CompactionV4) Step(maxNodes int) bool {
+	if c.done {
+		return true
+	}
+	t := c.tree
+	if t.changeSeq != c.changeSeq {
+		c.start()
+	}
+
+	for copied := 0; copied < maxNodes && len(c.pending) > 0; copied++ {
+		next := c.pending[len(c.pending)-1]
+		c.pending = c.pending[:len(c.pending)-1]
+
+		// children are given their indexes as they're found, and copied later
+		node := t.nodes[next.from]
+		if node.Right != 0 {
+			c.nodes = append(c.nodes, treeNodeV4{})
+			c.pending = append(c.pending, compactNodeV4{from: uint(node.Right), to: uint(len(c.nodes) - 1)})
+			node.Right = treeIndex(len(c.nodes) - 1)
+		}
+		if node.Left != 0 {
+			c.nodes = append(c.nodes, treeNodeV4{})
+			c.pending = append(c.pending, compactNodeV4{from: uint(node.Left), to: uint(len(c.nodes) - 1)})
+			node.Left = treeIndex(len(c.nodes) - 1)
+		}
+		c.nodes[next.to] = node
+
+		c.tags.copyNode(&t.tags, next.from, next.to, node.TagCount, &c.copier)
+		if node.TagCount > 0 && int(next.from) < len(t.hits) {
+			c.hits = growSlots(c.hits, next.to)
+			c.hits[next.to] = atomic.LoadUint64(&t.hits[next.from])
+		}
+	}
+	if len(c.pending) > 0 {
+		return false
+	}
+
+	// the node indexes change, so lookups running now, if there are any, are in trouble - let the race guard know
+	t.changing()
+	t.nodes = c.nodes
+	t.availableIndexes = make([]treeIndex, 0)
+	t.tags = c.tags
+	t.hits = c.hits
+	t.shared = false
+	c.done = true
+	c.nodes, c.tags, c.hits = nil, tagStorage{}, nil
+	c.copier = tagCopier{}
+	return true
+}
@@ -0,0 +1,106 @@
+package byte_tree
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// LoadCSV adds a tag to the tree for each line of CSV read from r, like "10.0.0.0/8,value"
+// - the prefix and value columns, the separator, and how values are parsed can be set with CSVOptions
+// - lines are added as they're read, so a file of any size can be loaded without holding it in memory
+// - returns how many lines were added, along with the first error, which says what line it was on; lines before the
+// error stay added
+func (t *TreeV4) LoadCSV(r io.Reader, options ...CSVOption) (int, error) {
+	config := newCSVConfig(options)
+	reader := csv.NewReader(r)
+	reader.Comma = config.comma
+	if config.header {
+		if _, err := reader.Read(); err != nil && err != io.EOF {
+			return 0, csvError(err)
+		}
+	}
+
+	return t.loadCSVRecords(reader, func(record []string) (string, byte, bool, error) {
+		var tag byte
+		if config.cidrColumn >= len(record) || config.valueColumn >= len(record) {
+			return "", tag, false, fmt.Errorf("%d columns, expected at least %d", len(record), max(config.cidrColumn, config.valueColumn)+1)
+		}
+		tag, err := config.parseFunc(record[config.valueColumn])
+		if err != nil {
+			return "", tag, false, fmt.Errorf("invalid value %q: %w", record[config.valueColumn], err)
+		}
+		return record[config.cidrColumn], tag, true, nil
+	})
+}
+
+// LoadGeoIPBlocks adds a tag to the tree for each network in a MaxMind GeoIP2 or GeoLite2 blocks file, such as
+// GeoLite2-City-Blocks-IPv4.csv, read from r
+// - by default, the tag is the network's geoname_id - or its registered_country_geoname_id, for networks without one - parsed
+// as the tag type, and networks with neither are skipped
+// - tagFunc, if set, makes the tag from the line instead, so any column can be used, such as autonomous_system_number
+// in an ASN blocks file
+// - returns how many networks were added, along with the first error, which says what line it was on
+func (t *TreeV4) LoadGeoIPBlocks(r io.Reader, tagFunc GeoIPFunc) (int, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return 0, fmt.Errorf("line 1: no header")
+		}
+		return 0, csvError(err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	if _, ok := columns["network"]; !ok {
+		return 0, fmt.Errorf("line 1: no network column")
+	}
+	if tagFunc == nil {
+		tagFunc = geonameTag
+	}
+
+	// the header's copied into columns, so the record can be reused from here on
+	reader.ReuseRecord = true
+	return t.loadCSVRecords(reader, func(record []string) (string, byte, bool, error) {
+		row := GeoIPRow{columns: columns, fields: record}
+		tag, ok, err := tagFunc(row)
+		return row.Field("network"), tag, ok, err
+	})
+}
+
+// add a tag for each record read, as returned by recordFunc - unless it says to skip the record
+func (t *TreeV4) loadCSVRecords(reader *csv.Reader, recordFunc func(record []string) (string, byte, bool, error)) (int, error) {
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	added := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return added, nil
+		}
+		if err != nil {
+			return added, csvError(err)
+		}
+		lineNumber, _ := reader.FieldPos(0)
+
+		cidr, tag, ok, err := recordFunc(record)
+		if err != nil {
+			return added, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if !ok {
+			continue
+		}
+		address, err := t.parseAddress(strings.TrimSpace(cidr))
+		if err != nil {
+			return added, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if _, _, err = t.Add(address, tag, nil); err != nil {
+			return added, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		added++
+	}
+}
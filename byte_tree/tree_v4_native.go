@@ -0,0 +1,97 @@
+package byte_tree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// identifies natively encoded IPv4 trees
+var _nativeMagicV4 = []byte("PTNATIV4")
+
+// MarshalNative encodes the tree with its nodes laid out as they are in memory, for UnmarshalBinaryNoCopy to use in place
+// - the encoding only works on platforms with the same word size and byte order, unlike MarshalBinary's - so it's for
+// snapshots that are loaded where they're written, not for shipping trees around
+// - fails for tag types that aren't bool, string, or numeric
+func (t *TreeV4) MarshalNative() ([]byte, error) {
+	nodeSize := int(unsafe.Sizeof(treeNodeV4{}))
+	e := encoder{buf: make([]byte, 0, _nativeHeaderSize+len(t.nodes)*nodeSize+t.CountTags()*4)}
+	e.buf = appendNativeHeader(e.buf, _nativeMagicV4, nodeSize, len(t.nodes))
+	if len(t.nodes) > 0 {
+		e.buf = append(e.buf, unsafe.Slice((*byte)(unsafe.Pointer(&t.nodes[0])), len(t.nodes)*nodeSize)...)
+	}
+	t.encodeFreeList(&e, nil)
+	t.encodeTags(&e, nil)
+	t.encodeExpirations(&e, nil)
+	if e.err != nil {
+		return nil, e.err
+	}
+	return binary.BigEndian.AppendUint32(e.buf, crc32Checksum(e.buf)), nil
+}
+
+// UnmarshalBinaryNoCopy replaces the tree's contents with the tree encoded in data by MarshalNative, using the nodes
+// in data as they are, rather than copying them
+// - data must not change while the tree is in use, and the tree doesn't change it: the first change to the tree copies
+// the nodes out of it, the same as after Snapshot
+// - the nodes can only be used in place if they're aligned in memory, as they are in data returned by MarshalNative or
+// read into a buffer from make - otherwise, they're copied
+// - the tags are decoded, and the checksum and the tree's structure are checked, the same as by UnmarshalBinary
+// - the tree keeps its own options
+// - if an error is returned, the tree is left as it was
+func (t *TreeV4) UnmarshalBinaryNoCopy(data []byte) error {
+	nodeSize := int(unsafe.Sizeof(treeNodeV4{}))
+	if len(data) < _nativeHeaderSize+_nativeChecksumLength || string(data[:len(_nativeMagicV4)]) != string(_nativeMagicV4) {
+		return fmt.Errorf("%w: not a natively encoded IPv4 tree", ErrInvalidData)
+	}
+	if version := binary.NativeEndian.Uint32(data[8:]); version != _nativeVersion {
+		return fmt.Errorf("%w: unknown native encoding version %d", ErrInvalidData, version)
+	}
+	if binary.NativeEndian.Uint16(data[12:]) != _nativeByteOrderMark || int(binary.NativeEndian.Uint16(data[14:])) != nodeSize {
+		return fmt.Errorf("%w: natively encoded on a different platform", ErrInvalidData)
+	}
+	checksumStart := len(data) - _nativeChecksumLength
+	if sum := crc32Checksum(data[:checksumStart]); sum != binary.BigEndian.Uint32(data[checksumStart:]) {
+		return fmt.Errorf("%w: checksum mismatch: %08x, expected %08x", ErrInvalidData, sum, binary.BigEndian.Uint32(data[checksumStart:]))
+	}
+	// checked against the room there is before it's multiplied, which could overflow an int on 32-bit platforms
+	encodedCount := uint64(binary.NativeEndian.Uint32(data[16:]))
+	if encodedCount < 2 || encodedCount > uint64((checksumStart-_nativeHeaderSize)/nodeSize) {
+		return fmt.Errorf("%w: %d nodes don't fit in %d bytes", ErrInvalidData, encodedCount, len(data))
+	}
+	nodeCount := int(encodedCount)
+	nodesEnd := _nativeHeaderSize + nodeCount*nodeSize
+
+	tree := &TreeV4{tags: newTagStorage(&t.config), config: t.config, shared: true}
+	nodeData := data[_nativeHeaderSize:nodesEnd]
+	if uintptr(unsafe.Pointer(&nodeData[0]))%unsafe.Alignof(treeNodeV4{}) == 0 {
+		// the capacity's limited, so appending a node can't write past them
+		tree.nodes = unsafe.Slice((*treeNodeV4)(unsafe.Pointer(&nodeData[0])), nodeCount)[:nodeCount:nodeCount]
+	} else {
+		tree.nodes = make([]treeNodeV4, nodeCount)
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&tree.nodes[0])), len(nodeData)), nodeData)
+	}
+	for nodeIndex := range tree.nodes {
+		node := &tree.nodes[nodeIndex]
+		if node.length() > _maxPrefixLengthV4 || node.TagCount < 0 || uint64(node.TagCount) > math.MaxUint32 {
+			return fmt.Errorf("%w: node %d is invalid", ErrInvalidData, nodeIndex)
+		}
+	}
+	tree.recount()
+
+	d := decoder{data: data[nodesEnd:checksumStart]}
+	tree.decodeFreeList(&d)
+	tree.decodeTags(&d)
+	tree.decodeExpirations(&d)
+	if d.err == nil && d.remaining() > 0 {
+		d.fail("%d bytes of trailing data", d.remaining())
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if err := tree.checkStructure(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidData, err)
+	}
+	t.replace(tree)
+	return nil
+}
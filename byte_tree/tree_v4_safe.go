@@ -0,0 +1,282 @@
+package byte_tree
+
+import (
+	"io"
+	"iter"
+	"sync"
+	"time"
+
+	"github.com/kentik/patricia"
+)
+
+// SafeTreeV4 is a TreeV4 that's safe for concurrent use, with the same API, under a sync.RWMutex
+// - lookups, walks, and encoding take the read lock, so they can run at the same time as each other
+// - changes take the write lock
+// - walk functions are called with the read lock held, so they must not change this tree
+// - for anything not wrapped here, use Read and Write
+type SafeTreeV4 struct {
+	mu   sync.RWMutex
+	tree *TreeV4
+}
+
+// NewSafeTreeV4 returns a new, empty SafeTreeV4
+func NewSafeTreeV4(options ...TreeOption) *SafeTreeV4 {
+	return &SafeTreeV4{tree: NewTreeV4(options...)}
+}
+
+// Read calls readFunc with the tree under the read lock
+// - readFunc must not change the tree, or keep it once it returns
+func (s *SafeTreeV4) Read(readFunc func(tree *TreeV4)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	readFunc(s.tree)
+}
+
+// Write calls writeFunc with the tree under the write lock
+// - writeFunc must not keep the tree once it returns
+func (s *SafeTreeV4) Write(writeFunc func(tree *TreeV4)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeFunc(s.tree)
+}
+
+// Clear removes everything from the tree - see TreeV4.Clear
+func (s *SafeTreeV4) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Clear()
+}
+
+// Clone returns an identical, independent copy of the tree - see TreeV4.Clone
+func (s *SafeTreeV4) Clone() *SafeTreeV4 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &SafeTreeV4{tree: s.tree.Clone()}
+}
+
+// Snapshot returns a view of the tree as it is now, which stays the same as this tree keeps changing - see TreeV4.Snapshot
+// - the snapshot is a plain TreeV4, which can be read from any number of goroutines without locking, as long as none of them change it
+func (s *SafeTreeV4) Snapshot() *TreeV4 {
+	// marks the storage as shared, so this is a change
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Snapshot()
+}
+
+// CountTags returns the number of tags in the tree - see TreeV4.CountTags
+func (s *SafeTreeV4) CountTags() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.CountTags()
+}
+
+// Size returns the number of nodes in use - see TreeV4.Size
+func (s *SafeTreeV4) Size() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.Size()
+}
+
+// PrefixCount returns the number of prefixes with tags - see TreeV4.PrefixCount
+func (s *SafeTreeV4) PrefixCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.PrefixCount()
+}
+
+// TagCount returns the number of tags in the tree - see TreeV4.TagCount
+func (s *SafeTreeV4) TagCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.TagCount()
+}
+
+// Set sets the single value for a node - see TreeV4.Set
+func (s *SafeTreeV4) Set(address patricia.IPv4Address, tag byte) (bool, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Set(address, tag)
+}
+
+// Upsert sets the single value for a node, returning the one it replaced - see TreeV4.Upsert
+func (s *SafeTreeV4) Upsert(address patricia.IPv4Address, tag byte) (byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Upsert(address, tag)
+}
+
+// Add adds a tag to the tree - see TreeV4.Add
+func (s *SafeTreeV4) Add(address patricia.IPv4Address, tag byte, matchFunc MatchesFunc) (bool, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Add(address, tag, matchFunc)
+}
+
+// AddWithExpiry adds a tag to the tree that expires at expiresAt - see TreeV4.AddWithExpiry
+func (s *SafeTreeV4) AddWithExpiry(address patricia.IPv4Address, tag byte, expiresAt time.Time, matchFunc MatchesFunc) (bool, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.AddWithExpiry(address, tag, expiresAt, matchFunc)
+}
+
+// AddIfAbsent adds a tag to the tree, unless the address already has one - see TreeV4.AddIfAbsent
+func (s *SafeTreeV4) AddIfAbsent(address patricia.IPv4Address, tag byte, matchFunc MatchesFunc) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.AddIfAbsent(address, tag, matchFunc)
+}
+
+// Sweep removes expired tags - see TreeV4.Sweep
+func (s *SafeTreeV4) Sweep() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Sweep()
+}
+
+// Delete removes tags from the tree - see TreeV4.Delete
+func (s *SafeTreeV4) Delete(address patricia.IPv4Address, matchFunc MatchesFunc, matchVal byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Delete(address, matchFunc, matchVal)
+}
+
+// UpdateTags updates the tags for an address in place - see TreeV4.UpdateTags
+func (s *SafeTreeV4) UpdateTags(address patricia.IPv4Address, updateFunc UpdateFunc) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.UpdateTags(address, updateFunc)
+}
+
+// MapTags returns a new tree with mapFunc applied to every tag - see TreeV4.MapTags
+func (s *SafeTreeV4) MapTags(mapFunc UpdateFunc) *SafeTreeV4 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &SafeTreeV4{tree: s.tree.MapTags(mapFunc)}
+}
+
+// Prune removes an address and everything under it - see TreeV4.Prune
+func (s *SafeTreeV4) Prune(address patricia.IPv4Address) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Prune(address)
+}
+
+// Graft adds everything in src to the tree, under address - see TreeV4.Graft
+// - src must not change while this runs
+func (s *SafeTreeV4) Graft(address patricia.IPv4Address, src *TreeV4, matchFunc MatchesFunc) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Graft(address, src, matchFunc)
+}
+
+// FindTags finds all matching tags for the address - see TreeV4.FindTags
+func (s *SafeTreeV4) FindTags(address patricia.IPv4Address) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindTags(address)
+}
+
+// FindTagsAppend finds all matching tags for the address and appends them to ret - see TreeV4.FindTagsAppend
+func (s *SafeTreeV4) FindTagsAppend(ret []byte, address patricia.IPv4Address) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindTagsAppend(ret, address)
+}
+
+// FindTagsWithFilter finds all matching tags for the address that pass the filter - see TreeV4.FindTagsWithFilter
+// - filterFunc is called with the read lock held
+func (s *SafeTreeV4) FindTagsWithFilter(address patricia.IPv4Address, filterFunc FilterFunc) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindTagsWithFilter(address, filterFunc)
+}
+
+// FindTagsFunc calls tagFunc for every tag matching the address, without copying them - see TreeV4.FindTagsFunc
+// - tagFunc is called with the read lock held
+// - there's no FindDeepestTagsView, as the tags could change as soon as the lock's released
+func (s *SafeTreeV4) FindTagsFunc(address patricia.IPv4Address, tagFunc func(tag byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindTagsFunc(address, tagFunc)
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree - see TreeV4.FindDeepestTag
+func (s *SafeTreeV4) FindDeepestTag(address patricia.IPv4Address) (bool, byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindDeepestTag(address)
+}
+
+// FindDeepestTagBatch finds a tag at the deepest level in the tree for each of the addresses, holding the read lock
+// once for them all - see TreeV4.FindDeepestTagBatch
+func (s *SafeTreeV4) FindDeepestTagBatch(addresses []patricia.IPv4Address, found []bool, tags []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindDeepestTagBatch(addresses, found, tags)
+}
+
+// FindDeepestTags finds all tags at the deepest level in the tree - see TreeV4.FindDeepestTags
+func (s *SafeTreeV4) FindDeepestTags(address patricia.IPv4Address) (bool, []byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.FindDeepestTags(address)
+}
+
+// Walk calls walkFunc for every prefix in the tree that has tags - see TreeV4.Walk
+func (s *SafeTreeV4) Walk(walkFunc func(prefix patricia.IPv4Address, tags []byte) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.tree.Walk(walkFunc)
+}
+
+// WalkSubtree calls walkFunc for every prefix with tags at or under the address - see TreeV4.WalkSubtree
+func (s *SafeTreeV4) WalkSubtree(address patricia.IPv4Address, walkFunc func(prefix patricia.IPv4Address, tags []byte) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.tree.WalkSubtree(address, walkFunc)
+}
+
+// All returns an iterator over every prefix in the tree that has tags - see TreeV4.All
+// - the read lock is held for as long as the iteration runs, so the loop body must not change this tree
+func (s *SafeTreeV4) All() iter.Seq2[patricia.IPv4Address, []byte] {
+	return func(yield func(patricia.IPv4Address, []byte) bool) {
+		s.Walk(yield)
+	}
+}
+
+// Subtree returns an iterator over every prefix with tags at or under the address - see TreeV4.Subtree
+// - the read lock is held for as long as the iteration runs, so the loop body must not change this tree
+func (s *SafeTreeV4) Subtree(address patricia.IPv4Address) iter.Seq2[patricia.IPv4Address, []byte] {
+	return func(yield func(patricia.IPv4Address, []byte) bool) {
+		s.WalkSubtree(address, yield)
+	}
+}
+
+// MarshalBinary encodes the tree - see TreeV4.MarshalBinary
+func (s *SafeTreeV4) MarshalBinary() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.MarshalBinary()
+}
+
+// UnmarshalBinary replaces the tree's contents with the encoded tree - see TreeV4.UnmarshalBinary
+func (s *SafeTreeV4) UnmarshalBinary(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.UnmarshalBinary(data)
+}
+
+// Save writes the encoded tree to w - see TreeV4.Save
+func (s *SafeTreeV4) Save(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.Save(w)
+}
+
+// Load replaces the tree's contents with the encoded tree read from r - see TreeV4.Load
+// - the write lock is held while r is read, so this blocks everything else on the tree until it's done
+func (s *SafeTreeV4) Load(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Load(r)
+}
@@ -0,0 +1,87 @@
+package byte_tree
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/kentik/patricia"
+)
+
+// WalkContext calls walkFunc for every prefix in the tree that has tags, like Walk, but stops once ctx is done, returning its error
+// - ctx is checked every so often along the way, not before every prefix, so walkFunc can be called a few more times after it's done
+// - returns nil if the walk finishes, or walkFunc stops it
+func (t *TreeV6) WalkContext(ctx context.Context, walkFunc func(prefix patricia.IPv6Address, tags []byte) bool) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	check := contextCheck{ctx: ctx}
+	t.walkNodes(1, treeNodeV6{}, func(nodeIndex uint, prefix treeNodeV6) bool {
+		if err = check.step(); err != nil {
+			return false
+		}
+		if t.nodes[nodeIndex].TagCount == 0 {
+			return true
+		}
+		tags := t.tagsForNode(nodeIndex)
+		if len(tags) == 0 {
+			// they've all expired
+			return true
+		}
+		return walkFunc(prefix.Address(), tags)
+	})
+	return err
+}
+
+// SaveContext writes the tree to w like Save, but stops once ctx is done, returning its error
+// - ctx is checked before each chunk is written, so what's been written by then is cut short, and can't be loaded
+func (t *TreeV6) SaveContext(ctx context.Context, w io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	e := encoder{buf: make([]byte, 0, _encodingChunkSize), w: w, ctx: ctx}
+	t.encode(&e)
+	e.flush()
+	return e.err
+}
+
+// GraftContext adds all tags from src to the tree like Graft, but stops once ctx is done, returning how many tags were
+// added along with its error
+// - the tags added before then are kept, so the tree holds some of src's tags, but not all of them - unless src's nodes
+// were linked in as they are, which is done all at once - see Graft
+func (t *TreeV6) GraftContext(ctx context.Context, address patricia.IPv6Address, src *TreeV6, matchFunc MatchesFunc) (int, error) {
+	return t.graft(ctx, address, src, matchFunc)
+}
+
+// AddEntriesContext adds every entry's tags to the tree, in order, stopping once ctx is done, and returns how many
+// tags were added along with ctx's error
+// - if matchFunc is non-nil, it will be used to ensure uniqueness at each node, like Add
+// - each entry's prefix is checked before its tags are added, so an invalid one stops things there, with an error
+// saying which entry it was
+// - the tags added before things stopped are kept
+func (t *TreeV6) AddEntriesContext(ctx context.Context, entries []EntryV6, matchFunc MatchesFunc) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	addCount := 0
+	check := contextCheck{ctx: ctx}
+	for i, entry := range entries {
+		if err := t.validateAddress(entry.Prefix); err != nil {
+			return addCount, fmt.Errorf("entry %d: %w", i, err)
+		}
+		for _, tag := range entry.Tags {
+			if err := check.step(); err != nil {
+				return addCount, err
+			}
+			countIncreased, _, err := t.Add(entry.Prefix, tag, matchFunc)
+			if err != nil {
+				return addCount, err
+			}
+			if countIncreased {
+				addCount++
+			}
+		}
+	}
+	return addCount, nil
+}
@@ -0,0 +1,86 @@
+package byte_tree
+
+import "github.com/kentik/patricia"
+
+// PresenceFilterV6 answers FindDeepestTag for a tree without looking in it, for addresses that can't match any of its
+// prefixes, for workloads where most lookups miss - see TreeV6.NewPresenceFilter
+// - a bitmap with a bit for each value of the first few bits of an address, set if any prefix in the tree holds, or is
+// held by, addresses starting with them - lookups of addresses whose bit isn't set find nothing, and the rest go to the
+// tree, so it never changes what's found
+// - any change to the tree leaves it out of date, and lookups go straight to the tree until it's rebuilt, which it is
+// once it's passed on as many lookups as the tree has prefixes, so the rebuilding takes no more than one prefix's worth
+// of time per lookup - it suits trees that change far less often than they're looked up in
+// - not safe for concurrent use - each goroutine doing lookups needs its own
+type PresenceFilterV6 struct {
+	tree      *TreeV6
+	bits      uint     // the first bits of an address the filter goes by
+	bitmap    []uint64 // a bit for each value of them
+	changeSeq uint64   // the tree's, plus 1, when the bitmap was built, so a new filter is out of date
+	stale     int      // lookups passed on to the tree since the tree changed
+	skipped   uint64
+	passed    uint64
+}
+
+// NewPresenceFilter returns a filter for lookups in the tree, going by the first bits of each address, to check before
+// the tree - see PresenceFilterV6
+// - bits is capped at 24, for a 2MB bitmap - 16, for 8KB, suits most trees, and the more prefixes the tree has, the more
+// bits it takes for the filter to tell their addresses from others
+func (t *TreeV6) NewPresenceFilter(bits uint) *PresenceFilterV6 {
+	bits = min(bits, _maxPresenceFilterBits)
+	return &PresenceFilterV6{tree: t, bits: bits, bitmap: make([]uint64, max(1<<bits/64, 1))}
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree, like TreeV6.FindDeepestTag, without looking in the tree
+// if the filter rules the address out
+func (f *PresenceFilterV6) FindDeepestTag(address patricia.IPv6Address) (bool, byte, error) {
+	if f.changeSeq != f.tree.changeSeq+1 {
+		if f.stale < f.tree.prefixCount {
+			f.stale++
+			f.passed++
+			return f.tree.FindDeepestTag(address)
+		}
+		f.build()
+	}
+	// addresses shorter than the bits the filter goes by can match prefixes in any number of them, so they're left to
+	// the tree
+	if address.Length >= f.bits {
+		index := uint(shardIndexV6(address, f.bits))
+		if f.bitmap[index/64]&(1<<(index%64)) == 0 {
+			f.skipped++
+			var zero byte
+			return false, zero, nil
+		}
+	}
+	f.passed++
+	return f.tree.FindDeepestTag(address)
+}
+
+// set the bits of every prefix in the tree
+func (f *PresenceFilterV6) build() {
+	clear(f.bitmap)
+	f.tree.Walk(func(prefix patricia.IPv6Address, _ []byte) bool {
+		if prefix.Length >= f.bits {
+			f.setBits(uint(shardIndexV6(prefix, f.bits)), 1)
+		} else {
+			shift := f.bits - prefix.Length
+			f.setBits(uint(shardIndexV6(prefix, prefix.Length))<<shift, 1<<shift)
+		}
+		return true
+	})
+	f.changeSeq = f.tree.changeSeq + 1
+	f.stale = 0
+}
+
+// set count bits, starting from the one at index
+func (f *PresenceFilterV6) setBits(index uint, count uint) {
+	for count > 0 {
+		n := min(count, 64-index%64)
+		f.bitmap[index/64] |= (^uint64(0) >> (64 - n)) << (index % 64)
+		index, count = index+n, count-n
+	}
+}
+
+// Stats returns how many lookups the filter has ruled out, and how many it's passed on to the tree
+func (f *PresenceFilterV6) Stats() (skipped uint64, passed uint64) {
+	return f.skipped, f.passed
+}
@@ -0,0 +1,148 @@
+package byte_tree
+
+import (
+	"github.com/kentik/patricia"
+)
+
+// ChangeHookV6 is called with a tag that's been added to or deleted from a tree, and its prefix - see TreeV6.OnAdd
+type ChangeHookV6 func(prefix patricia.IPv6Address, tag byte, op ChangeOp)
+
+// the hooks registered on a tree
+type changeHooksV6 struct {
+	onAdd    []ChangeHookV6
+	onDelete []ChangeHookV6
+}
+
+// OnAdd registers hook to be called for every tag added to the tree, once the change adding it is done
+// - changes are worked out by comparing the tags at a prefix before and after, so replacing a tag with an equal one
+// doesn't call any hooks, and updating one in place is a delete, then an add
+// - replacing the tree's contents by decoding one deletes every tag it had, then adds every tag it has now
+// - hooks are called from the goroutine making the change, and must not change the tree
+// - hooks aren't copied to clones or snapshots
+func (t *TreeV6) OnAdd(hook ChangeHookV6) {
+	if t.hooks == nil {
+		t.hooks = &changeHooksV6{}
+	}
+	t.hooks.onAdd = append(t.hooks.onAdd, hook)
+}
+
+// OnDelete registers hook to be called for every tag deleted from the tree, once the change deleting it is done - see OnAdd
+func (t *TreeV6) OnDelete(hook ChangeHookV6) {
+	if t.hooks == nil {
+		t.hooks = &changeHooksV6{}
+	}
+	t.hooks.onDelete = append(t.hooks.onDelete, hook)
+}
+
+// ClearHooks removes every hook registered with OnAdd and OnDelete
+func (t *TreeV6) ClearHooks() {
+	t.hooks = nil
+}
+
+// call the hooks for op on each tag
+func (t *TreeV6) callHooks(prefix patricia.IPv6Address, tags []byte, op ChangeOp) {
+	hooks := t.hooks.onAdd
+	if op == ChangeDelete {
+		hooks = t.hooks.onDelete
+	}
+	for _, tag := range tags {
+		for _, hook := range hooks {
+			hook(prefix, tag, op)
+		}
+	}
+}
+
+// the tags at exactly the address, including any that have expired, for comparing with what's there after a change
+func (t *TreeV6) hookTags(address patricia.IPv6Address) []byte {
+	nodeIndex, _, err := t.findNode(address)
+	if err != nil || nodeIndex == 0 {
+		return nil
+	}
+	return t.rawTagsForNode(nodeIndex)
+}
+
+// all the tags for the node, including any that have expired
+func (t *TreeV6) rawTagsForNode(nodeIndex uint) []byte {
+	return append([]byte(nil), t.nodeTags(nodeIndex)...)
+}
+
+// call the hooks for how the tags at the address have changed since they were before
+// - deferred by changes to a single address, with the tags from hookTags
+func (t *TreeV6) hookChanges(address patricia.IPv6Address, before []byte) {
+	after := t.hookTags(address)
+
+	// pair off the tags that are in both, leaving what was deleted and what was added
+	kept := make([]bool, len(after))
+	var deleted []byte
+	for _, tag := range before {
+		found := false
+		for i := range after {
+			if !kept[i] && after[i] == tag {
+				kept[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			deleted = append(deleted, tag)
+		}
+	}
+	var added []byte
+	for i, tag := range after {
+		if !kept[i] {
+			added = append(added, tag)
+		}
+	}
+
+	prefix := hookPrefixV6(address)
+	t.callHooks(prefix, deleted, ChangeDelete)
+	t.callHooks(prefix, added, ChangeAdd)
+}
+
+// the address as hooks are given it, with the bits past its length cleared, as they are in walks
+func hookPrefixV6(address patricia.IPv6Address) patricia.IPv6Address {
+	var prefix treeNodeV6
+	addressNode := treeNodeV6FromAddress(address)
+	prefix.MergeFromNodes(&prefix, &addressNode)
+	return prefix.Address()
+}
+
+// every prefix within the address with tags, and all of its tags, including those that have expired, before a change
+// that deletes them
+// - if strict, the address's own tags are left out
+func (t *TreeV6) hookSubtree(address patricia.IPv6Address, strict bool) []EntryV6 {
+	var ret []EntryV6
+	t.walkSubtreeNodes(address, func(nodeIndex uint, prefix treeNodeV6) bool {
+		if t.nodes[nodeIndex].TagCount > 0 && !(strict && prefix.length() == address.Length) {
+			ret = append(ret, EntryV6{Prefix: prefix.Address(), Tags: t.rawTagsForNode(nodeIndex)})
+		}
+		return true
+	})
+	return ret
+}
+
+// call the hooks for op on every tag in entries
+func (t *TreeV6) hookEntries(entries []EntryV6, op ChangeOp) {
+	for _, entry := range entries {
+		t.callHooks(entry.Prefix, entry.Tags, op)
+	}
+}
+
+// every prefix with expired tags, and those tags, before they're swept
+func (t *TreeV6) hookExpired(now int64) []EntryV6 {
+	var ret []EntryV6
+	t.walkNodes(1, treeNodeV6{}, func(nodeIndex uint, prefix treeNodeV6) bool {
+		expirations := t.nodeExpirations(nodeIndex)
+		var expiredTags []byte
+		for i, tag := range t.nodeTags(nodeIndex) {
+			if expirations != nil && expired(expirations[i], now) {
+				expiredTags = append(expiredTags, tag)
+			}
+		}
+		if len(expiredTags) > 0 {
+			ret = append(ret, EntryV6{Prefix: prefix.Address(), Tags: expiredTags})
+		}
+		return true
+	})
+	return ret
+}
@@ -0,0 +1,196 @@
+package byte_tree
+
+import (
+	"iter"
+
+	"github.com/kentik/patricia"
+)
+
+// the most shards a ShardedTreeV6 can have, as bits of the address
+const _maxShardBitsV6 = 8
+
+// ShardedTreeV6 is a tree that's safe for concurrent use, split into shards by the top bits of the address, each with
+// its own lock, so writers to different parts of the address space don't wait on each other
+// - prefixes shorter than the shard bits cover more than one shard, so they're kept together in one more tree, with
+// its own lock - these are usually few, and rarely change
+// - lookups go to the shard for the address, and the tree of short prefixes, and give the same results as a TreeV6 would
+// - walk functions are called with a shard's read lock held, so they must not change this tree
+type ShardedTreeV6 struct {
+	bits   uint
+	short  *SafeTreeV6 // prefixes shorter than bits
+	shards []*SafeTreeV6
+}
+
+// NewShardedTreeV6 returns a new, empty tree, split into 1<<shardBits shards
+// - shardBits is capped at 8, for 256 shards
+// - the options apply to each shard
+func NewShardedTreeV6(shardBits uint, options ...TreeOption) *ShardedTreeV6 {
+	if shardBits > _maxShardBitsV6 {
+		shardBits = _maxShardBitsV6
+	}
+	ret := &ShardedTreeV6{
+		bits:   shardBits,
+		short:  NewSafeTreeV6(options...),
+		shards: make([]*SafeTreeV6, 1<<shardBits),
+	}
+	for i := range ret.shards {
+		ret.shards[i] = NewSafeTreeV6(options...)
+	}
+	return ret
+}
+
+// the tree that holds the prefix
+func (s *ShardedTreeV6) shard(address patricia.IPv6Address) *SafeTreeV6 {
+	if address.Length < s.bits {
+		return s.short
+	}
+	return s.shards[shardIndexV6(address, s.bits)]
+}
+
+// ShardCount returns how many shards the tree is split into
+func (s *ShardedTreeV6) ShardCount() int {
+	return len(s.shards)
+}
+
+// Clear removes everything from the tree - see TreeV6.Clear
+// - each shard is cleared in turn, so concurrent readers can see some shards cleared and others not
+func (s *ShardedTreeV6) Clear() error {
+	if err := s.short.Clear(); err != nil {
+		return err
+	}
+	for _, shard := range s.shards {
+		if err := shard.Clear(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountTags returns the number of tags in the tree - see TreeV6.CountTags
+func (s *ShardedTreeV6) CountTags() int {
+	return s.TagCount()
+}
+
+// Size returns the number of nodes in use, across all the shards, each of which has a root - see TreeV6.Size
+func (s *ShardedTreeV6) Size() int {
+	ret := s.short.Size()
+	for _, shard := range s.shards {
+		ret += shard.Size()
+	}
+	return ret
+}
+
+// PrefixCount returns the number of prefixes with tags - see TreeV6.PrefixCount
+func (s *ShardedTreeV6) PrefixCount() int {
+	ret := s.short.PrefixCount()
+	for _, shard := range s.shards {
+		ret += shard.PrefixCount()
+	}
+	return ret
+}
+
+// TagCount returns the number of tags in the tree - see TreeV6.TagCount
+func (s *ShardedTreeV6) TagCount() int {
+	ret := s.short.TagCount()
+	for _, shard := range s.shards {
+		ret += shard.TagCount()
+	}
+	return ret
+}
+
+// Set sets the single value for a node - see TreeV6.Set
+func (s *ShardedTreeV6) Set(address patricia.IPv6Address, tag byte) (bool, int, error) {
+	return s.shard(address).Set(address, tag)
+}
+
+// Add adds a tag to the tree - see TreeV6.Add
+func (s *ShardedTreeV6) Add(address patricia.IPv6Address, tag byte, matchFunc MatchesFunc) (bool, int, error) {
+	return s.shard(address).Add(address, tag, matchFunc)
+}
+
+// Delete removes tags from the tree - see TreeV6.Delete
+func (s *ShardedTreeV6) Delete(address patricia.IPv6Address, matchFunc MatchesFunc, matchVal byte) (int, error) {
+	return s.shard(address).Delete(address, matchFunc, matchVal)
+}
+
+// Sweep removes expired tags - see TreeV6.Sweep
+func (s *ShardedTreeV6) Sweep() int {
+	ret := s.short.Sweep()
+	for _, shard := range s.shards {
+		ret += shard.Sweep()
+	}
+	return ret
+}
+
+// FindTags finds all matching tags for the address - see TreeV6.FindTags
+func (s *ShardedTreeV6) FindTags(address patricia.IPv6Address) ([]byte, error) {
+	ret := s.FindTagsAppend(make([]byte, 0), address)
+	return ret, nil
+}
+
+// FindTagsAppend finds all matching tags for the address and appends them to ret - see TreeV6.FindTagsAppend
+func (s *ShardedTreeV6) FindTagsAppend(ret []byte, address patricia.IPv6Address) []byte {
+	// the short prefixes are the shallower matches, so their tags come first
+	ret = s.short.FindTagsAppend(ret, address)
+	if address.Length >= s.bits {
+		ret = s.shards[shardIndexV6(address, s.bits)].FindTagsAppend(ret, address)
+	}
+	return ret
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree - see TreeV6.FindDeepestTag
+func (s *ShardedTreeV6) FindDeepestTag(address patricia.IPv6Address) (bool, byte, error) {
+	if address.Length >= s.bits {
+		found, tag, err := s.shards[shardIndexV6(address, s.bits)].FindDeepestTag(address)
+		if found || err != nil {
+			return found, tag, err
+		}
+	}
+	return s.short.FindDeepestTag(address)
+}
+
+// FindDeepestTags finds all tags at the deepest level in the tree - see TreeV6.FindDeepestTags
+func (s *ShardedTreeV6) FindDeepestTags(address patricia.IPv6Address) (bool, []byte, error) {
+	if address.Length >= s.bits {
+		found, tags, err := s.shards[shardIndexV6(address, s.bits)].FindDeepestTags(address)
+		if found || err != nil {
+			return found, tags, err
+		}
+	}
+	return s.short.FindDeepestTags(address)
+}
+
+// Walk calls walkFunc for every prefix in the tree that has tags, in the same order as TreeV6.Walk
+// - each shard is walked in turn, so this isn't a consistent view of the whole tree if it's changing
+func (s *ShardedTreeV6) Walk(walkFunc func(prefix patricia.IPv6Address, tags []byte) bool) {
+	// each short prefix comes right before the shard it starts in, so gather them up first
+	var short []EntryV6
+	s.short.Walk(func(prefix patricia.IPv6Address, tags []byte) bool {
+		short = append(short, EntryV6{Prefix: prefix, Tags: tags})
+		return true
+	})
+
+	for shardIndex, shard := range s.shards {
+		for len(short) > 0 && shardIndexV6(short[0].Prefix, s.bits) == shardIndex {
+			if !walkFunc(short[0].Prefix, short[0].Tags) {
+				return
+			}
+			short = short[1:]
+		}
+		keepWalking := true
+		shard.Walk(func(prefix patricia.IPv6Address, tags []byte) bool {
+			keepWalking = walkFunc(prefix, tags)
+			return keepWalking
+		})
+		if !keepWalking {
+			return
+		}
+	}
+}
+
+// All returns an iterator over every prefix in the tree that has tags - see Walk
+func (s *ShardedTreeV6) All() iter.Seq2[patricia.IPv6Address, []byte] {
+	return func(yield func(patricia.IPv6Address, []byte) bool) {
+		s.Walk(yield)
+	}
+}
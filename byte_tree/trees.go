@@ -1,5 +1,10 @@
 package byte_tree
 
+import (
+	"errors"
+	"net/netip"
+)
+
 // code common to the IPv4/IPv6 trees
 
 // MatchesFunc is called to check if tag data matches the input value
@@ -7,3 +12,275 @@ type MatchesFunc func(payload byte, val byte) bool
 
 // FilterFunc is called on each result to see if it belongs in the resulting set
 type FilterFunc func(payload byte) bool
+
+// the default MatchesFunc, for when the caller doesn't supply one
+func equalTags(payload byte, val byte) bool {
+	return payload == val
+}
+
+// UpdateFunc is called on each tag being updated, returning the new tag value, and whether to keep it
+type UpdateFunc func(payload byte) (byte, bool)
+
+// WalkVerdict is returned by a visitor to say how a walk should go on
+type WalkVerdict int
+
+const (
+	// WalkContinue carries on with the walk, including everything below the prefix just visited
+	WalkContinue WalkVerdict = iota
+
+	// WalkSkipSubtree carries on with the walk, but skips every prefix within the one just visited
+	WalkSkipSubtree
+
+	// WalkStop ends the walk
+	WalkStop
+)
+
+// batchOpKind identifies a mutation queued in a batch
+type batchOpKind int
+
+const (
+	batchOpAdd batchOpKind = iota
+	batchOpSet
+	batchOpDelete
+)
+
+func (k batchOpKind) String() string {
+	switch k {
+	case batchOpAdd:
+		return "add"
+	case batchOpSet:
+		return "set"
+	case batchOpDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// ErrCorruptTree is wrapped by the errors returned when a tree's internal structure is found to be inconsistent
+var ErrCorruptTree = errors.New("corrupt tree")
+
+// ErrConcurrentModification is returned by lookups that find the tree was changed while they ran, in builds with the
+// patricia_raceguard tag - trees aren't thread-safe, and without the tag, such a lookup can return garbage, or panic
+var ErrConcurrentModification = errors.New("tree changed during lookup")
+
+// ErrFrozen is returned by changes to a tree that's frozen - see TreeV4.FreezeInPlace
+var ErrFrozen = errors.New("tree is frozen")
+
+// ErrTreeFull is returned when adding to a tree that already holds as many nodes as a treeIndex can address
+var ErrTreeFull = errors.New("tree is full")
+
+// ErrMixedPrefixLengths is returned when making a fixed-length copy of a tree that holds prefixes of more than one
+// length - see TreeV4.OptimizeFixedLength
+var ErrMixedPrefixLengths = errors.New("prefixes of more than one length")
+
+// ErrTagLimitReached is returned when adding a tag to a node that already holds the maximum number of tags,
+// and the tree's TagLimitPolicy doesn't make room for it
+var ErrTagLimitReached = errors.New("tag limit reached for this address")
+
+// TagLimitPolicy decides what happens when a tag is added to a node that's reached the tree's tag limit
+type TagLimitPolicy int
+
+const (
+	// TagLimitReject rejects the new tag, returning ErrTagLimitReached
+	TagLimitReject TagLimitPolicy = iota
+
+	// TagLimitEvictOldest removes the node's first (oldest) tag to make room for the new one
+	TagLimitEvictOldest
+
+	// TagLimitEvictFunc asks an EvictFunc which tag to remove to make room for the new one
+	TagLimitEvictFunc
+)
+
+// EvictFunc is called when a tag is added to a node that's reached the tree's tag limit
+// - returns the index into tags of the tag to evict, or a negative number to reject the new tag
+type EvictFunc func(tags []byte, newTag byte) int
+
+// ErrPrefixLimitReached is returned when adding a prefix to a tree that already holds the maximum number of prefixes,
+// and the tree's PrefixLimitPolicy doesn't make room for it
+var ErrPrefixLimitReached = errors.New("prefix limit reached")
+
+// PrefixLimitPolicy decides what happens when a prefix is added to a tree that's reached its prefix limit
+type PrefixLimitPolicy int
+
+const (
+	// PrefixLimitReject rejects the new prefix, returning ErrPrefixLimitReached
+	PrefixLimitReject PrefixLimitPolicy = iota
+
+	// PrefixLimitEvictLRU deletes the prefix hit least recently, of a sample of the tree's prefixes, to make room for
+	// the new one - prefixes whose tags have all expired go first
+	PrefixLimitEvictLRU
+
+	// PrefixLimitEvictFunc asks a PrefixEvictFunc which of a sample of the tree's prefixes to delete to make room for
+	// the new one
+	PrefixLimitEvictFunc
+)
+
+// PrefixCandidate is a prefix a tree could evict to make room for a new one, passed to a PrefixEvictFunc
+type PrefixCandidate struct {
+	Prefix netip.Prefix
+	Tags   []byte // belongs to the tree, and must not be changed - includes tags that have expired
+	// when a lookup last matched the prefix, or a tag was added to it, as a count of the tags added to the tree -
+	// the lower it is, the longer ago
+	LastHit uint64
+}
+
+// PrefixEvictFunc is called when a prefix is added to a tree that's reached its prefix limit, with a sample of the
+// prefixes it could evict
+// - returns the index into candidates of the prefix to evict, or a negative number to reject the new prefix
+type PrefixEvictFunc func(candidates []PrefixCandidate, newPrefix netip.Prefix) int
+
+// TreeOption configures a tree when it's created
+type TreeOption func(*treeConfig)
+
+// WithTagLimit limits how many tags each node can hold, applying policy when the limit is reached
+// - a limit of 0 means no limit
+func WithTagLimit(maxTagsPerNode int, policy TagLimitPolicy) TreeOption {
+	return func(c *treeConfig) {
+		c.maxTagsPerNode = maxTagsPerNode
+		c.tagLimitPolicy = policy
+	}
+}
+
+// WithTagEvictFunc limits how many tags each node can hold, asking evictFunc which tag to evict when the limit is reached
+func WithTagEvictFunc(maxTagsPerNode int, evictFunc EvictFunc) TreeOption {
+	return func(c *treeConfig) {
+		c.maxTagsPerNode = maxTagsPerNode
+		c.tagLimitPolicy = TagLimitEvictFunc
+		c.evictFunc = evictFunc
+	}
+}
+
+// WithPrefixLimit limits how many prefixes the tree can hold tags for, applying policy when the limit is reached, so
+// it can serve as a cache of a bounded size, of prefixes learned from traffic say
+// - a limit of 0 means no limit
+// - the victim's picked from a run of a few prefixes, in Walk order, from a random point in the tree, rather than all
+// of them, so adding a prefix stays quick - with PrefixLimitEvictLRU, the prefix evicted is one of the least recently
+// hit, not the least
+// - each prefix's last hit is recorded by lookups that match it, with an atomic store, so lookups take a little longer
+// - evicted prefixes are deleted with Delete, so change logs and OnDelete hooks see them go
+// - the limit holds for Add, Set, and the like - trees that are built or loaded in one go aren't held to it until
+// they're next added to, and then only evict enough to make room for each new prefix
+func WithPrefixLimit(maxPrefixes int, policy PrefixLimitPolicy) TreeOption {
+	return func(c *treeConfig) {
+		c.maxPrefixes = maxPrefixes
+		c.prefixLimitPolicy = policy
+	}
+}
+
+// WithPrefixEvictFunc limits how many prefixes the tree can hold tags for, like WithPrefixLimit, asking evictFunc
+// which prefix to evict when the limit is reached
+func WithPrefixEvictFunc(maxPrefixes int, evictFunc PrefixEvictFunc) TreeOption {
+	return func(c *treeConfig) {
+		c.maxPrefixes = maxPrefixes
+		c.prefixLimitPolicy = PrefixLimitEvictFunc
+		c.prefixEvictFunc = evictFunc
+	}
+}
+
+// WithSingleTag puts the tree in single-tag mode, where each node holds at most one tag
+// - Add replaces the node's tag, like Set
+func WithSingleTag() TreeOption {
+	return func(c *treeConfig) {
+		c.singleTag = true
+	}
+}
+
+// WithInlineTag puts the tree in single-tag mode, like WithSingleTag, keeping each node's tag in an array alongside the
+// nodes, rather than in a slice of its own - for the usual routing table, this takes less memory, and adding a prefix
+// doesn't allocate its tag's slice
+// - encodings with more than one tag for a prefix can't be loaded into the tree
+func WithInlineTag() TreeOption {
+	return func(c *treeConfig) {
+		c.singleTag = true
+		c.inlineTag = true
+		c.packedTags = false
+	}
+}
+
+// WithPackedTags keeps every node's tags together in one array, rather than each node's in a slice of its own, so that
+// for scalar tag types - bool, numbers - none of the tree's storage holds pointers, and the GC can skip over it however
+// big the tree gets, rather than scanning a slice header for each node - see the README for what each type holds
+// - adding a tag to a prefix whose room is used up moves its tags to the end of the array, with twice the room, leaving
+// a gap behind, so trees that change a lot take more memory than they'd otherwise need until they're compacted
+// - the array holds up to as many tags as a treeIndex can address, gaps and all - the gaps are taken back when it's full,
+// and adding a tag past that returns ErrTreeFull
+// - tag expiration times are still kept in slices of their own, per node, so trees with expiring tags aren't pointer-free
+// - has no effect on trees made WithInlineTag, which keep their tags alongside the nodes already, and isn't worth
+// combining with WithInternedTags, which has no slices to share in these trees
+func WithPackedTags() TreeOption {
+	return func(c *treeConfig) {
+		c.packedTags = !c.inlineTag
+	}
+}
+
+// WithInternedTags has nodes with the same tags share one copy of them, rather than each keeping its own - for trees
+// where many prefixes carry the same tags, such as the origin AS of prefixes from a BGP table, this takes much less
+// memory for the tags, and far fewer allocations for the GC to track
+// - tags are compared with ==, so must be comparable
+// - changing a node's tags copies them, so changes take a little longer
+// - has no effect on trees made WithInlineTag or WithPackedTags, which have no tag slices to share
+func WithInternedTags() TreeOption {
+	return func(c *treeConfig) {
+		c.internTags = true
+	}
+}
+
+// configuration shared by IPv4 and IPv6 trees, set up by TreeOptions
+type treeConfig struct {
+	maxTagsPerNode    int
+	tagLimitPolicy    TagLimitPolicy
+	evictFunc         EvictFunc
+	maxPrefixes       int // see WithPrefixLimit
+	prefixLimitPolicy PrefixLimitPolicy
+	prefixEvictFunc   PrefixEvictFunc
+	singleTag         bool
+	inlineTag         bool // see WithInlineTag
+	packedTags        bool // see WithPackedTags
+	internTags        bool // see WithInternedTags
+	resultPool        bool // see WithResultPool
+	growthFactor      float64
+	maxGrowthStep     int
+	arena             *Arena // see WithArena
+}
+
+func newTreeConfig(options []TreeOption) treeConfig {
+	var c treeConfig
+	for _, option := range options {
+		option(&c)
+	}
+	if c.tagLimitPolicy == TagLimitEvictFunc && c.evictFunc == nil {
+		c.tagLimitPolicy = TagLimitReject
+	}
+	if c.prefixLimitPolicy == PrefixLimitEvictFunc && c.prefixEvictFunc == nil {
+		c.prefixLimitPolicy = PrefixLimitReject
+	}
+	return c
+}
+
+// whether the tree records when each prefix was last hit, for its prefix limit policy to go by
+func (c *treeConfig) trackHits() bool {
+	return c.maxPrefixes > 0 && c.prefixLimitPolicy != PrefixLimitReject
+}
+
+// the type of the node indexes trees link their nodes with, and keep their free lists of - uint32 halves the memory
+// child links take on 64-bit platforms, and allows trees of up to 4 billion nodes, which is 2 billion prefixes
+// - generated trees can use uint instead, for bigger ones, with make codegen NODE_INDEX_TYPE=uint
+type treeIndex = uint32
+
+// the highest node index a treeIndex holds - a var only so tests can fill a tree without billions of nodes
+var _maxTreeIndex = uint64(^treeIndex(0))
+
+// how many nodes walks keep room for on their stack of nodes to visit before it spills to the heap - a walk's stack
+// holds no more nodes than the tree is deep, which is at most 34 for IPv4 trees, and for IPv6 trees is rarely more
+const _walkStackSize = 34
+
+// how many lookups FindDeepestTagBatch has under way at once - a core can only wait on so many reads from memory at a
+// time, 10 or so on recent ones, so more lookups than that only wait their turn
+const _lookupLanes = 8
+
+// the most bits of an address a presence filter goes by, for a bitmap of 2MB - see TreeV4.NewPresenceFilter
+const _maxPresenceFilterBits = 24
+
+// how many prefixes a tree that's reached its prefix limit picks one to evict from - the more there are, the closer the
+// victim is to the least recently hit, and the longer adding a prefix takes
+const _evictionSampleSize = 16
@@ -0,0 +1,24 @@
+package complex128_tree
+
+import "context"
+
+// cancellation checks shared by the IPv4/IPv6 trees
+
+// how many steps a long operation takes between checks on whether its context is done
+// - checking is cheap, but not free, so this keeps it from showing up next to the work itself
+const _contextCheckInterval = 1024
+
+// contextCheck counts the steps of a long operation, checking whether its context is done every so often
+type contextCheck struct {
+	ctx   context.Context
+	steps int
+}
+
+// count a step, returning the context's error if it's done, checked every _contextCheckInterval steps
+func (c *contextCheck) step() error {
+	c.steps++
+	if c.steps%_contextCheckInterval != 0 {
+		return nil
+	}
+	return c.ctx.Err()
+}
@@ -0,0 +1,819 @@
+package complex128_tree
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"strconv"
+)
+
+// binary encoding shared by the IPv4/IPv6 trees
+
+// ErrInvalidData is returned when decoding data that isn't a valid encoded tree
+var ErrInvalidData = errors.New("invalid encoded tree")
+
+// ErrUnsupportedTag is returned when encoding a tag whose type has no binary encoding
+var ErrUnsupportedTag = errors.New("unsupported tag type")
+
+// how each prefix is represented in JSON
+type jsonEntry struct {
+	CIDR string `json:"cidr"`
+
+	// a separate block from CIDR, so generated code stays gofmt-clean whatever the tag type's name
+	Tags jsonTags `json:"tags"`
+}
+
+// a prefix's tags, as represented in JSON: as encoding/json would, except that complex numbers, which it has no
+// encoding for, are [real, imaginary] pairs, and floats that aren't finite, which JSON has no numbers for, are the
+// strings "NaN", "+Inf" and "-Inf"
+type jsonTags []complex128
+
+// MarshalJSON implements json.Marshaler
+func (j jsonTags) MarshalJSON() ([]byte, error) {
+	buf := []byte{'['}
+	for i, tag := range j {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		data, err := marshalJSONTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, data...)
+	}
+	return append(buf, ']'), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (j *jsonTags) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*j = make(jsonTags, len(raw))
+	for i := range raw {
+		if err := unmarshalJSONTag(raw[i], &(*j)[i]); err != nil {
+			return fmt.Errorf("tag %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// encode a tag as jsonTags does
+func marshalJSONTag(tag complex128) ([]byte, error) {
+	switch v := any(tag).(type) {
+	case float32:
+		return marshalJSONFloat(float64(v), 32)
+	case float64:
+		return marshalJSONFloat(v, 64)
+	case complex64:
+		return marshalJSONComplex(complex128(v), 32)
+	case complex128:
+		return marshalJSONComplex(v, 64)
+	}
+	return json.Marshal(tag)
+}
+
+// decode a tag encoded by marshalJSONTag
+func unmarshalJSONTag(data []byte, tag *complex128) error {
+	switch v := any(tag).(type) {
+	case *float32:
+		f, err := unmarshalJSONFloat(data, 32)
+		*v = float32(f)
+		return err
+	case *float64:
+		f, err := unmarshalJSONFloat(data, 64)
+		*v = f
+		return err
+	case *complex64:
+		c, err := unmarshalJSONComplex(data, 32)
+		*v = complex64(c)
+		return err
+	case *complex128:
+		c, err := unmarshalJSONComplex(data, 64)
+		*v = c
+		return err
+	}
+	return json.Unmarshal(data, tag)
+}
+
+// encode a float, bitSize bits wide, as a number, or as a string if it's not finite
+func marshalJSONFloat(f float64, bitSize int) ([]byte, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return json.Marshal(strconv.FormatFloat(f, 'g', -1, bitSize))
+	}
+	if bitSize == 32 {
+		return json.Marshal(float32(f))
+	}
+	return json.Marshal(f)
+}
+
+// decode a float, bitSize bits wide, encoded by marshalJSONFloat
+func unmarshalJSONFloat(data []byte, bitSize int) (float64, error) {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return 0, err
+		}
+		return strconv.ParseFloat(s, bitSize)
+	}
+	if bitSize == 32 {
+		var f float32
+		err := json.Unmarshal(data, &f)
+		return float64(f), err
+	}
+	var f float64
+	err := json.Unmarshal(data, &f)
+	return f, err
+}
+
+// encode a complex number, whose parts are partSize bits wide, as a [real, imaginary] pair
+func marshalJSONComplex(c complex128, partSize int) ([]byte, error) {
+	re, err := marshalJSONFloat(real(c), partSize)
+	if err != nil {
+		return nil, err
+	}
+	im, err := marshalJSONFloat(imag(c), partSize)
+	if err != nil {
+		return nil, err
+	}
+	buf := append([]byte{'['}, re...)
+	buf = append(append(buf, ','), im...)
+	return append(buf, ']'), nil
+}
+
+// decode a complex number, whose parts are partSize bits wide, encoded by marshalJSONComplex
+func unmarshalJSONComplex(data []byte, partSize int) (complex128, error) {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return 0, err
+	}
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("a complex number is a [real, imaginary] pair, not %d numbers", len(parts))
+	}
+	re, err := unmarshalJSONFloat(parts[0], partSize)
+	if err != nil {
+		return 0, err
+	}
+	im, err := unmarshalJSONFloat(parts[1], partSize)
+	return complex(re, im), err
+}
+
+// tags are encoded with a leading byte identifying their type, so they can be decoded without knowing it up front
+const (
+	tagKindBool byte = iota + 1
+	tagKindString
+	tagKindInt
+	tagKindInt8
+	tagKindInt16
+	tagKindInt32
+	tagKindInt64
+	tagKindUint
+	tagKindUint8
+	tagKindUint16
+	tagKindUint32
+	tagKindUint64
+	tagKindFloat32
+	tagKindFloat64
+	tagKindComplex64
+	tagKindComplex128
+)
+
+// from version 2 on, an encoded tree is a series of sections, each written as its id, its length, then its contents,
+// ending with encodingSectionEnd
+// - sections must be in order of id, and readers skip ones they don't know, so later versions can add sections without
+// breaking earlier readers
+const (
+	encodingSectionEnd = iota
+	encodingSectionNodes
+	encodingSectionFreeList
+	encodingSectionTags
+	encodingSectionExpirations
+
+	// the CRC-32C of everything before it, from version 3 on - it's always the last section, so it covers all the others
+	encodingSectionChecksum = 0x7f
+)
+
+// for CRC-32C checksums, which most CPUs have instructions for
+var _crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func crc32Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, _crcTable)
+}
+
+// the order nodes are encoded in, when they're renumbered to leave out the ones that aren't in use
+// - a nil numbering encodes the nodes as they are
+type nodeNumbering struct {
+	order []uint // the nodes' indexes in the tree, in their new order
+	index []uint // each node's new index, by its index in the tree - 0 for nodes that are left out
+}
+
+// how many nodes are encoded, out of the tree's nodeCount
+func (n *nodeNumbering) count(nodeCount int) int {
+	if n == nil {
+		return nodeCount
+	}
+	return len(n.order)
+}
+
+// the tree's index for the node encoded at the input index
+func (n *nodeNumbering) node(encodedIndex int) uint {
+	if n == nil {
+		return uint(encodedIndex)
+	}
+	return n.order[encodedIndex]
+}
+
+// the index the node at the input index in the tree is encoded at
+func (n *nodeNumbering) renumber(nodeIndex uint) uint {
+	if n == nil {
+		return nodeIndex
+	}
+	return n.index[nodeIndex]
+}
+
+// how much encoded data is buffered before it's written out, when encoding to an io.Writer
+const _encodingChunkSize = 64 * 1024
+
+// encoder appends encoded values to a buffer, optionally writing it out to an io.Writer in chunks
+type encoder struct {
+	buf    []byte
+	w      io.Writer       // where the buffer is written out to, if anywhere
+	hash   hash.Hash32     // what's written is hashed for a checksum section, if set
+	hashed int             // how much of the buffer has been hashed
+	err    error           // first error encountered - once set, nothing more is written
+	ctx    context.Context // if set, nothing more is written once it's done
+}
+
+// write the buffer out, if it's grown to a chunk's worth
+func (e *encoder) chunk() {
+	if e.w != nil && len(e.buf) >= _encodingChunkSize {
+		e.flush()
+	}
+}
+
+// write out whatever's buffered
+func (e *encoder) flush() {
+	if e.w == nil || e.err != nil || len(e.buf) == 0 {
+		return
+	}
+	if e.ctx != nil {
+		if err := e.ctx.Err(); err != nil {
+			e.err = err
+			return
+		}
+	}
+	if e.hash != nil {
+		e.hash.Write(e.buf[e.hashed:])
+	}
+	if _, err := e.w.Write(e.buf); err != nil {
+		e.err = err
+	}
+	e.buf = e.buf[:0]
+	e.hashed = 0
+}
+
+// write a section, as its id and length followed by whatever write encodes
+// - a section's length isn't known until it's encoded, so when writing to an io.Writer, write runs twice: first just to
+// count the bytes, then to write them out - that way, a large section never has to be held in memory whole
+func (e *encoder) section(id uint64, write func(e *encoder)) {
+	if e.err != nil {
+		return
+	}
+
+	if e.w == nil {
+		// encode it in place, then move it up to make room for the header
+		start := len(e.buf)
+		write(e)
+		if e.err != nil {
+			return
+		}
+		length := len(e.buf) - start
+		var header [2 * binary.MaxVarintLen64]byte
+		headerBytes := binary.AppendUvarint(binary.AppendUvarint(header[:0], id), uint64(length))
+		e.buf = append(e.buf, headerBytes...)
+		copy(e.buf[start+len(headerBytes):], e.buf[start:start+length])
+		copy(e.buf[start:], headerBytes)
+		return
+	}
+
+	var length byteCounter
+	counter := encoder{buf: make([]byte, 0, _encodingChunkSize), w: &length, ctx: e.ctx}
+	write(&counter)
+	counter.flush()
+	if counter.err != nil {
+		e.err = counter.err
+		return
+	}
+	e.uvarint(id)
+	e.uvarint(uint64(length))
+	write(e)
+}
+
+// write a checksum section, holding the CRC-32C of everything written before it
+// - the hash has to have been set before anything was written
+func (e *encoder) checksumSection() {
+	if e.err != nil {
+		return
+	}
+	e.hash.Write(e.buf[e.hashed:])
+	e.hashed = len(e.buf)
+	e.uvarint(encodingSectionChecksum)
+	e.uvarint(4)
+	e.uint32(e.hash.Sum32())
+}
+
+// byteCounter is an io.Writer that counts what's written to it
+type byteCounter uint64
+
+func (c *byteCounter) Write(data []byte) (int, error) {
+	*c += byteCounter(len(data))
+	return len(data), nil
+}
+
+func (e *encoder) bytes(data []byte) {
+	if e.err == nil {
+		e.buf = append(e.buf, data...)
+	}
+}
+
+func (e *encoder) byte(value byte) {
+	if e.err == nil {
+		e.buf = append(e.buf, value)
+	}
+}
+
+func (e *encoder) uvarint(value uint64) {
+	if e.err == nil {
+		e.buf = binary.AppendUvarint(e.buf, value)
+	}
+}
+
+func (e *encoder) varint(value int64) {
+	if e.err == nil {
+		e.buf = binary.AppendVarint(e.buf, value)
+	}
+}
+
+func (e *encoder) uint32(value uint32) {
+	if e.err == nil {
+		e.buf = binary.BigEndian.AppendUint32(e.buf, value)
+	}
+}
+
+func (e *encoder) uint64(value uint64) {
+	if e.err == nil {
+		e.buf = binary.BigEndian.AppendUint64(e.buf, value)
+	}
+}
+
+func (e *encoder) tag(tag complex128) {
+	if e.err != nil {
+		return
+	}
+	switch v := interface{}(tag).(type) {
+	case bool:
+		e.byte(tagKindBool)
+		if v {
+			e.byte(1)
+		} else {
+			e.byte(0)
+		}
+	case string:
+		e.byte(tagKindString)
+		e.uvarint(uint64(len(v)))
+		e.bytes([]byte(v))
+	case int:
+		e.byte(tagKindInt)
+		e.varint(int64(v))
+	case int8:
+		e.byte(tagKindInt8)
+		e.varint(int64(v))
+	case int16:
+		e.byte(tagKindInt16)
+		e.varint(int64(v))
+	case int32:
+		e.byte(tagKindInt32)
+		e.varint(int64(v))
+	case int64:
+		e.byte(tagKindInt64)
+		e.varint(v)
+	case uint:
+		e.byte(tagKindUint)
+		e.uvarint(uint64(v))
+	case uint8:
+		e.byte(tagKindUint8)
+		e.uvarint(uint64(v))
+	case uint16:
+		e.byte(tagKindUint16)
+		e.uvarint(uint64(v))
+	case uint32:
+		e.byte(tagKindUint32)
+		e.uvarint(uint64(v))
+	case uint64:
+		e.byte(tagKindUint64)
+		e.uvarint(v)
+	case float32:
+		e.byte(tagKindFloat32)
+		e.uint32(math.Float32bits(v))
+	case float64:
+		e.byte(tagKindFloat64)
+		e.uint64(math.Float64bits(v))
+	case complex64:
+		e.byte(tagKindComplex64)
+		e.uint32(math.Float32bits(real(v)))
+		e.uint32(math.Float32bits(imag(v)))
+	case complex128:
+		e.byte(tagKindComplex128)
+		e.uint64(math.Float64bits(real(v)))
+		e.uint64(math.Float64bits(imag(v)))
+	default:
+		e.err = fmt.Errorf("%w: %T", ErrUnsupportedTag, tag)
+	}
+}
+
+// decoder reads encoded values from a buffer, optionally reading it in from an io.Reader in chunks
+type decoder struct {
+	data []byte      // what's left to decode
+	r    io.Reader   // where more data comes from, if anywhere
+	buf  []byte      // what data is read into from r
+	read int         // how many bytes have been decoded so far
+	hash hash.Hash32 // what's decoded is hashed, to check a checksum section against, if set
+	err  error       // first error encountered - once set, everything read is zero
+
+	convert ConvertFunc // how tags are converted to complex128, if they don't have to be of that type already
+	tags    int         // how many tags have been decoded
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrInvalidData, fmt.Sprintf(format, args...))
+	}
+}
+
+// how many bytes are left to read, when decoding from a buffer
+func (d *decoder) remaining() int {
+	return len(d.data)
+}
+
+// the most bytes there can be left to read - when decoding from a reader, this isn't known, so this is just a sanity limit
+func (d *decoder) bound() int {
+	if d.r != nil {
+		return math.MaxInt32
+	}
+	return len(d.data)
+}
+
+// how much to allocate up front for count items: when decoding from a reader, we can't tell if a large count is real until we've read the items
+func (d *decoder) capacity(count int) int {
+	if d.r != nil && count > _encodingChunkSize {
+		return _encodingChunkSize
+	}
+	return count
+}
+
+// make sure there are at least count bytes in data, reading more from r if there's a reader
+// - returns whether there are
+func (d *decoder) fill(count int) bool {
+	if len(d.data) >= count {
+		return true
+	}
+	if d.r == nil || d.err != nil {
+		return false
+	}
+
+	// move what's left to the front of the buffer, and read in at least enough after it
+	size := count
+	if size < _encodingChunkSize {
+		size = _encodingChunkSize
+	}
+	if cap(d.buf) < size {
+		d.buf = make([]byte, size)
+	}
+	d.buf = d.buf[:cap(d.buf)]
+	left := copy(d.buf, d.data)
+	read, err := io.ReadAtLeast(d.r, d.buf[left:], count-left)
+	d.data = d.buf[:left+read]
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		d.err = err
+	}
+	return len(d.data) >= count
+}
+
+// read count bytes
+// - when decoding from a reader, they're only valid until the next read
+func (d *decoder) bytes(count int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if count < 0 || !d.fill(count) {
+		d.fail("unexpected end of data")
+		return nil
+	}
+	ret := d.data[:count]
+	d.consume(count)
+	return ret
+}
+
+// move past count bytes that have been decoded
+func (d *decoder) consume(count int) {
+	if d.hash != nil {
+		d.hash.Write(d.data[:count])
+	}
+	d.data = d.data[count:]
+	d.read += count
+}
+
+// skip over count bytes
+func (d *decoder) skip(count int) {
+	for count > 0 && d.err == nil {
+		size := count
+		if size > _encodingChunkSize {
+			size = _encodingChunkSize
+		}
+		d.bytes(size)
+		count -= size
+	}
+}
+
+func (d *decoder) byte() byte {
+	data := d.bytes(1)
+	if data == nil {
+		return 0
+	}
+	return data[0]
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	d.fill(binary.MaxVarintLen64)
+	value, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("bad varint")
+		return 0
+	}
+	d.consume(n)
+	return value
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	d.fill(binary.MaxVarintLen64)
+	value, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail("bad varint")
+		return 0
+	}
+	d.consume(n)
+	return value
+}
+
+// read a uvarint that's used as a count or an index, making sure it's no more than max
+// - nor more than an int holds, which is less than max can be on 32-bit platforms
+func (d *decoder) count(max uint64, what string) int {
+	value := d.uvarint()
+	if value > max || value > math.MaxInt {
+		d.fail("%s %d is out of range", what, value)
+		return 0
+	}
+	return int(value)
+}
+
+func (d *decoder) uint32() uint32 {
+	data := d.bytes(4)
+	if data == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data)
+}
+
+func (d *decoder) uint64() uint64 {
+	data := d.bytes(8)
+	if data == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+// read a tag as whatever type it was encoded from
+func (d *decoder) tagValue() interface{} {
+	switch kind := d.byte(); kind {
+	case tagKindBool:
+		return d.byte() != 0
+	case tagKindString:
+		return string(d.bytes(d.count(uint64(d.bound()), "string length")))
+	case tagKindInt:
+		// encoded on a 64-bit platform, it might not fit on a 32-bit one
+		value := d.varint()
+		if int64(int(value)) != value {
+			d.fail("int tag %d is out of range", value)
+		}
+		return int(value)
+	case tagKindInt8:
+		return int8(d.varint())
+	case tagKindInt16:
+		return int16(d.varint())
+	case tagKindInt32:
+		return int32(d.varint())
+	case tagKindInt64:
+		return d.varint()
+	case tagKindUint:
+		value := d.uvarint()
+		if uint64(uint(value)) != value {
+			d.fail("uint tag %d is out of range", value)
+		}
+		return uint(value)
+	case tagKindUint8:
+		return uint8(d.uvarint())
+	case tagKindUint16:
+		return uint16(d.uvarint())
+	case tagKindUint32:
+		return uint32(d.uvarint())
+	case tagKindUint64:
+		return d.uvarint()
+	case tagKindFloat32:
+		return math.Float32frombits(d.uint32())
+	case tagKindFloat64:
+		return math.Float64frombits(d.uint64())
+	case tagKindComplex64:
+		return complex(math.Float32frombits(d.uint32()), math.Float32frombits(d.uint32()))
+	case tagKindComplex128:
+		return complex(math.Float64frombits(d.uint64()), math.Float64frombits(d.uint64()))
+	default:
+		d.fail("unknown tag type %d", kind)
+		return nil
+	}
+}
+
+// read a tag, which must have been encoded from a complex128
+func (d *decoder) tag() complex128 {
+	var ret complex128
+	value := d.tagValue()
+	if d.err != nil {
+		return ret
+	}
+	d.tags++
+	if d.convert != nil {
+		ret, err := d.convert(value)
+		if err != nil && d.err == nil {
+			d.err = fmt.Errorf("converting tag %v: %w", value, err)
+		}
+		return ret
+	}
+	ret, ok := value.(complex128)
+	if !ok {
+		d.fail("tag of type %T, expected %T", value, ret)
+	}
+	return ret
+}
+
+// ConvertFunc converts a tag from a tree of another tag type, as it was encoded, to this tree's tag type
+// - value is bool, string, or one of the numeric types
+type ConvertFunc func(value interface{}) (complex128, error)
+
+// convert a decoded tag value to complex128, for encodings that don't keep the exact type
+// - numbers convert between types as long as they fit, so a value encoded from an int8 can be read as an int64, and vice versa
+func convertTag(value interface{}) (complex128, error) {
+	var ret complex128
+	fail := func() (complex128, error) {
+		var zero complex128
+		return zero, fmt.Errorf("%w: can't convert %T %v to %T", ErrInvalidData, value, value, ret)
+	}
+
+	switch target := interface{}(&ret).(type) {
+	case *bool:
+		v, ok := value.(bool)
+		if !ok {
+			return fail()
+		}
+		*target = v
+	case *string:
+		v, ok := value.(string)
+		if !ok {
+			return fail()
+		}
+		*target = v
+	case *int, *int8, *int16, *int32, *int64:
+		var v int64
+		switch value := value.(type) {
+		case int64:
+			v = value
+		case uint64:
+			if value > math.MaxInt64 {
+				return fail()
+			}
+			v = int64(value)
+		default:
+			return fail()
+		}
+		switch target := target.(type) {
+		case *int:
+			if int64(int(v)) != v {
+				return fail()
+			}
+			*target = int(v)
+		case *int8:
+			if v < math.MinInt8 || v > math.MaxInt8 {
+				return fail()
+			}
+			*target = int8(v)
+		case *int16:
+			if v < math.MinInt16 || v > math.MaxInt16 {
+				return fail()
+			}
+			*target = int16(v)
+		case *int32:
+			if v < math.MinInt32 || v > math.MaxInt32 {
+				return fail()
+			}
+			*target = int32(v)
+		case *int64:
+			*target = v
+		}
+	case *uint, *uint8, *uint16, *uint32, *uint64:
+		var v uint64
+		switch value := value.(type) {
+		case uint64:
+			v = value
+		case int64:
+			if value < 0 {
+				return fail()
+			}
+			v = uint64(value)
+		default:
+			return fail()
+		}
+		switch target := target.(type) {
+		case *uint:
+			if uint64(uint(v)) != v {
+				return fail()
+			}
+			*target = uint(v)
+		case *uint8:
+			if v > math.MaxUint8 {
+				return fail()
+			}
+			*target = uint8(v)
+		case *uint16:
+			if v > math.MaxUint16 {
+				return fail()
+			}
+			*target = uint16(v)
+		case *uint32:
+			if v > math.MaxUint32 {
+				return fail()
+			}
+			*target = uint32(v)
+		case *uint64:
+			*target = v
+		}
+	case *float32:
+		switch value := value.(type) {
+		case float32:
+			*target = value
+		case float64:
+			*target = float32(value)
+		default:
+			return fail()
+		}
+	case *float64:
+		switch value := value.(type) {
+		case float32:
+			*target = float64(value)
+		case float64:
+			*target = value
+		default:
+			return fail()
+		}
+	case *complex64:
+		v, ok := value.(complex128)
+		if !ok {
+			return fail()
+		}
+		*target = complex64(v)
+	case *complex128:
+		v, ok := value.(complex128)
+		if !ok {
+			return fail()
+		}
+		*target = v
+	default:
+		// an interface type, so it can hold the value as it is
+		v, ok := value.(complex128)
+		if !ok {
+			return fail()
+		}
+		ret = v
+	}
+	return ret, nil
+}
@@ -0,0 +1,41 @@
+package complex128_tree
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONComplex(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(patricia.NewIPv4Address(0, 0), complex(0.1, -2), nil)
+	tree.Add(patricia.NewIPv4Address(10<<24, 8), complex128(complex(math.NaN(), math.Inf(1))), nil)
+	tree.Add(patricia.NewIPv4Address(10<<24|1<<16, 16), complex128(complex(math.Inf(-1), 0)), nil)
+
+	// complex numbers are [real, imaginary] pairs, with parts JSON has no numbers for as strings
+	data, err := json.Marshal(tree)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"cidr":"0.0.0.0/0","tags":[[0.1,-2]]},{"cidr":"10.0.0.0/8","tags":[["NaN","+Inf"]]},`+
+		`{"cidr":"10.1.0.0/16","tags":[["-Inf",0]]}]`, string(data))
+
+	decoded := NewTreeV4()
+	assert.NoError(t, json.Unmarshal(data, decoded))
+	tags, err := decoded.FindTags(patricia.NewIPv4Address(10<<24|1<<16|1, 32))
+	assert.NoError(t, err)
+	if assert.Equal(t, 3, len(tags)) {
+		assert.Equal(t, complex128(complex(0.1, -2)), tags[0])
+		assert.True(t, math.IsNaN(float64(real(tags[1]))))
+		assert.True(t, math.IsInf(float64(imag(tags[1])), 1))
+		assert.Equal(t, complex128(complex(float64(math.Inf(-1)), 0)), tags[2])
+	}
+
+	// anything but a pair of numbers isn't a complex number
+	assert.Error(t, json.Unmarshal([]byte(`[{"cidr":"10.0.0.0/8","tags":[[1]]}]`), decoded))
+	assert.Error(t, json.Unmarshal([]byte(`[{"cidr":"10.0.0.0/8","tags":[[1,2,3]]}]`), decoded))
+	assert.Error(t, json.Unmarshal([]byte(`[{"cidr":"10.0.0.0/8","tags":[1]}]`), decoded))
+	assert.Error(t, json.Unmarshal([]byte(`[{"cidr":"10.0.0.0/8","tags":[["nope",1]]}]`), decoded))
+	assert.Equal(t, 3, decoded.CountTags())
+}
@@ -0,0 +1,55 @@
+package complex128_tree
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// op logs for replicating trees, shared by the IPv4/IPv6 trees
+// - an op is a change log record, numbered, so followers can tell which ones they've already applied
+
+// ErrMissingOps is returned when applying ops that don't follow on from the last one applied, because some were lost in
+// between - the follower has to start again from a copy of the tree
+var ErrMissingOps = errors.New("ops missing before this one")
+
+// Op is one change to a tree, as recorded in its change log, numbered by an OpStream
+type Op struct {
+	Seq  uint64 // the op's sequence number: one more than the op before it
+	Data []byte // the change log record, framed as SetChangeLog writes it, so ops' Data written out in order is a change log
+}
+
+// OpStream turns a tree's change log into a stream of numbered ops, to be applied to other trees with ApplyOps, so any
+// number of followers can keep up with one tree that's changed
+// - pass it to SetChangeLog, and it calls send with an op for every change to the tree, as it's made
+// - to start a follower, save a copy of the tree along with Seq, with nothing changing the tree in between, load the
+// copy on the follower, then apply ops after that sequence number
+// - send is called on the goroutine changing the tree, and the op's Data is its own, to keep or pass on
+// - if send returns an error, the change log stops, and nothing more is sent - see ChangeLogErr
+type OpStream struct {
+	seq  atomic.Uint64
+	send func(op Op) error
+}
+
+// NewOpStream returns a stream whose first op is numbered one after lastSeq, calling send with each one
+// - lastSeq is 0 for a new tree, or the last op's number when carrying on from an earlier stream
+func NewOpStream(lastSeq uint64, send func(op Op) error) *OpStream {
+	ret := &OpStream{send: send}
+	ret.seq.Store(lastSeq)
+	return ret
+}
+
+// Seq returns the number of the last op sent, or the lastSeq the stream was made with, if there hasn't been one
+// - safe to call from any goroutine, but only matches the tree's contents if nothing's changing it
+func (s *OpStream) Seq() uint64 {
+	return s.seq.Load()
+}
+
+// Write sends one change log record as an op, implementing io.Writer for SetChangeLog
+func (s *OpStream) Write(record []byte) (int, error) {
+	op := Op{Seq: s.seq.Load() + 1, Data: append([]byte(nil), record...)}
+	if err := s.send(op); err != nil {
+		return 0, err
+	}
+	s.seq.Store(op.Seq)
+	return len(record), nil
+}
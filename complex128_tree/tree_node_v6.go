@@ -1,6 +1,8 @@
 package complex128_tree
 
 import (
+	"encoding/binary"
+	"math"
 	"math/bits"
 
 	"github.com/kentik/patricia"
@@ -8,29 +10,56 @@ import (
 
 const _leftmost64Bit = uint64(1 << 63)
 
+// the longest prefix a node can have
+const _maxPrefixLengthV6 = 128
+
 type treeNodeV6 struct {
-	Left         uint // left node index: 0 for not set
-	Right        uint // right node index: 0 for not set
+	Left         treeIndex // left node index: 0 for not set
+	Right        treeIndex // right node index: 0 for not set
 	prefixLeft   uint64
 	prefixRight  uint64
 	prefixLength uint
 	TagCount     int
 }
 
+// See how many bits match the input address
+// - branchless, as this is the innermost step of every lookup
 func (n *treeNodeV6) MatchCount(address patricia.IPv6Address) uint {
-	length := address.Length
-	if length > n.prefixLength {
-		length = n.prefixLength
-	}
+	return min(commonBits128(n.prefixLeft, n.prefixRight, address.Left, address.Right), n.prefixLength, address.Length)
+}
 
-	matches := uint(bits.LeadingZeros64(n.prefixLeft ^ address.Left))
-	if matches == 64 && length > 64 {
-		matches += uint(bits.LeadingZeros64(n.prefixRight ^ address.Right))
-	}
-	if matches > length {
-		return length
-	}
-	return matches
+// how many leading bits two 128-bit values, as left and right words, have in common
+// - one XOR and count of leading zeros a word, without branching: the right words' matches only count when the whole
+// left words match, which is when their count, shifted down by 6, is 1 rather than 0
+func commonBits128(aLeft uint64, aRight uint64, bLeft uint64, bRight uint64) uint {
+	leftMatches := uint(bits.LeadingZeros64(aLeft ^ bLeft))
+	return leftMatches + (leftMatches>>6)*uint(bits.LeadingZeros64(aRight^bRight))
+}
+
+// a node's prefix bits, without its length, for layouts that keep the two apart
+type prefixBitsV6 struct {
+	left  uint64
+	right uint64
+}
+
+// returns the node's prefix bits
+func (n *treeNodeV6) prefixBits() prefixBitsV6 {
+	return prefixBitsV6{left: n.prefixLeft, right: n.prefixRight}
+}
+
+// returns the length of the node's prefix
+func (n *treeNodeV6) length() uint {
+	return n.prefixLength
+}
+
+// set the length of the node's prefix, keeping its bits
+func (n *treeNodeV6) setLength(length uint) {
+	n.prefixLength = length
+}
+
+// see how many bits of the input prefix, prefixLength long, match the input address, like MatchCount
+func matchPrefixBitsV6(prefix prefixBitsV6, prefixLength uint, address patricia.IPv6Address) uint {
+	return min(commonBits128(prefix.left, prefix.right, address.Left, address.Right), prefixLength, address.Length)
 }
 
 // ShiftPrefix shifts the prefix by the input shiftCount
@@ -47,3 +76,89 @@ func (n *treeNodeV6) IsLeftBitSet() bool {
 func (n *treeNodeV6) MergeFromNodes(left *treeNodeV6, right *treeNodeV6) {
 	n.prefixLeft, n.prefixRight, n.prefixLength = patricia.MergePrefixes64(left.prefixLeft, left.prefixRight, left.prefixLength, right.prefixLeft, right.prefixRight, right.prefixLength)
 }
+
+// treeNodeV6FromAddress returns an unlinked node holding the input address as its prefix
+func treeNodeV6FromAddress(address patricia.IPv6Address) treeNodeV6 {
+	return treeNodeV6{prefixLeft: address.Left, prefixRight: address.Right, prefixLength: address.Length}
+}
+
+// Address returns the node's prefix as an address
+// - only the full prefix for nodes built up with MergeFromNodes from the root - otherwise, it's what's left below the parent
+func (n *treeNodeV6) Address() patricia.IPv6Address {
+	return patricia.IPv6Address{Left: n.prefixLeft, Right: n.prefixRight, Length: n.prefixLength}
+}
+
+// whether this node's prefix contains the other's - for nodes holding full prefixes
+func (n *treeNodeV6) containsPrefix(other *treeNodeV6) bool {
+	return n.prefixLength <= other.prefixLength && commonBits128(n.prefixLeft, n.prefixRight, other.prefixLeft, other.prefixRight) >= n.prefixLength
+}
+
+// compare this node's prefix to the other's, by address, then length - for nodes holding full prefixes
+// - returns -1, 0, or 1 when this node's prefix is less than, equal to, or greater than the other's
+func (n *treeNodeV6) comparePrefix(other *treeNodeV6) int {
+	switch {
+	case n.prefixLeft < other.prefixLeft:
+		return -1
+	case n.prefixLeft > other.prefixLeft:
+		return 1
+	case n.prefixRight < other.prefixRight:
+		return -1
+	case n.prefixRight > other.prefixRight:
+		return 1
+	case n.prefixLength < other.prefixLength:
+		return -1
+	case n.prefixLength > other.prefixLength:
+		return 1
+	}
+	return 0
+}
+
+// write the node to the encoder
+func (n *treeNodeV6) encode(e *encoder) {
+	e.uvarint(uint64(n.Left))
+	e.uvarint(uint64(n.Right))
+	e.uint64(n.prefixLeft)
+	e.uint64(n.prefixRight)
+	e.byte(byte(n.prefixLength))
+	e.uvarint(uint64(n.TagCount))
+}
+
+// read the node from the decoder, making sure its child indexes are less than nodeCount
+func (n *treeNodeV6) decode(d *decoder, nodeCount int) {
+	n.Left = treeIndex(d.count(uint64(nodeCount-1), "node index"))
+	n.Right = treeIndex(d.count(uint64(nodeCount-1), "node index"))
+	n.prefixLeft = d.uint64()
+	n.prefixRight = d.uint64()
+	n.prefixLength = uint(d.byte())
+	if n.prefixLength > _maxPrefixLengthV6 {
+		d.fail("prefix length %d is out of range", n.prefixLength)
+	}
+	n.TagCount = d.count(math.MaxUint32, "tag count")
+}
+
+// size of a node's record in a TreeV6View
+const _viewNodeSizeV6 = 40
+
+// append the node's record in a TreeV6View, with the offset of its tags in the view's tag data
+func (n *treeNodeV6) appendViewRecord(buf []byte, tagOffset uint32) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(n.Left))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(n.Right))
+	buf = binary.LittleEndian.AppendUint64(buf, n.prefixLeft)
+	buf = binary.LittleEndian.AppendUint64(buf, n.prefixRight)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(n.prefixLength))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(n.TagCount))
+	buf = binary.LittleEndian.AppendUint32(buf, tagOffset)
+	return binary.LittleEndian.AppendUint32(buf, 0) // padding, keeping records 8-byte aligned
+}
+
+// read the node from its record in a TreeV6View, returning the offset of its tags in the view's tag data
+func (n *treeNodeV6) readViewRecord(data []byte) uint32 {
+	_ = data[_viewNodeSizeV6-1]
+	n.Left = treeIndex(binary.LittleEndian.Uint32(data))
+	n.Right = treeIndex(binary.LittleEndian.Uint32(data[4:]))
+	n.prefixLeft = binary.LittleEndian.Uint64(data[8:])
+	n.prefixRight = binary.LittleEndian.Uint64(data[16:])
+	n.prefixLength = uint(binary.LittleEndian.Uint32(data[24:]))
+	n.TagCount = int(binary.LittleEndian.Uint32(data[28:]))
+	return binary.LittleEndian.Uint32(data[32:])
+}
@@ -0,0 +1,290 @@
+package complex128_tree
+
+import (
+	"fmt"
+	"math/bits"
+	"runtime"
+	"sync"
+)
+
+// BuildConcurrentV4 builds a tree holding entries, using workers goroutines, or GOMAXPROCS of them if workers isn't positive
+// - the entries are split up by the top bits of their prefixes, each part is built into a tree of its own by a worker,
+// and those trees' nodes are then linked together under one root, so the work of adding prefixes is spread evenly
+// - the result is the same as adding each entry's tags to a new tree in order, with the same options, though the
+// node layout can differ
+// - entries don't need to be sorted, and are all checked before anything's built
+// - a tree made WithPrefixLimit isn't held to it while it's built - see WithPrefixLimit
+func BuildConcurrentV4(entries []EntryV4, workers int, options ...TreeOption) (*TreeV4, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// a few times as many parts as workers, so uneven parts even out between them
+	partBits := uint(bits.Len(uint(workers*4 - 1)))
+	if partBits > _maxShardBitsV4 {
+		partBits = _maxShardBitsV4
+	}
+
+	// prefixes shorter than the part bits don't belong in any one part, so they're added once the parts are together
+	// the parts are built without the prefix limit, which only holds for the tree as a whole
+	ret := NewTreeV4(options...)
+	maxPrefixes := ret.config.maxPrefixes
+	ret.config.maxPrefixes = 0
+	var short []EntryV4
+	parts := make([][]EntryV4, 1<<partBits)
+	for i, entry := range entries {
+		if err := ret.validateAddress(entry.Prefix); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		if entry.Prefix.Length < partBits {
+			short = append(short, entry)
+			continue
+		}
+		part := shardIndexV4(entry.Prefix, partBits)
+		parts[part] = append(parts[part], entry)
+	}
+
+	trees := make([]*TreeV4, len(parts))
+	errs := make([]error, len(parts))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range work {
+				trees[part] = NewTreeV4(options...)
+				trees[part].config.maxPrefixes = 0
+				errs[part] = trees[part].addEntries(parts[part])
+			}
+		}()
+	}
+	for part := range parts {
+		work <- part
+	}
+	close(work)
+	wg.Wait()
+
+	var tops []stitchNodeV4
+	nodeCount := 0
+	for part, tree := range trees {
+		if errs[part] != nil {
+			return nil, errs[part]
+		}
+		nodeCount += len(tree.nodes)
+		ret.prefixCount += tree.prefixCount
+		ret.tagCount += tree.tagCount
+
+		// every prefix in a part shares its top bits, so the part's root has at most one child, holding them all
+		root := &tree.nodes[1]
+		for _, childIndex := range [2]uint{uint(root.Left), uint(root.Right)} {
+			if childIndex != 0 {
+				tops = append(tops, stitchNodeV4{tree: tree, nodeIndex: childIndex, prefix: tree.nodes[childIndex]})
+			}
+		}
+	}
+	if uint64(nodeCount+len(tops)) > _maxTreeIndex {
+		return nil, fmt.Errorf("%w: it can't hold the %d nodes of its parts - see treeIndex", ErrTreeFull, nodeCount+len(tops))
+	}
+	if !ret.tags.hasRoom(ret.tagCount) {
+		return nil, fmt.Errorf("%w: %d tags are too many for a tree made WithPackedTags", ErrTreeFull, ret.tagCount)
+	}
+	ret.reserveNodes(nodeCount + len(tops))
+	ret.stitchChildren(1, treeNodeV4{}, tops)
+
+	if err := ret.addEntries(short); err != nil {
+		return nil, err
+	}
+	ret.config.maxPrefixes = maxPrefixes
+	return ret, nil
+}
+
+// BuildFromSortedV4 builds a tree holding entries, which must be sorted as Walk visits prefixes, with no prefix repeated
+// - the tree's built from the top down in one pass, linking each prefix in below the last one that holds it, rather than
+// adding them one at a time from the root, so it takes time in proportion to the number of entries - for loading dumps
+// of a tree, or of a routing table, that are already in order
+// - the result is the same as adding each entry's tags to a new tree in order, with the same options
+// - entries without tags are skipped
+// - a tree made WithPrefixLimit isn't held to it while it's built - see WithPrefixLimit
+func BuildFromSortedV4(entries []EntryV4, options ...TreeOption) (*TreeV4, error) {
+	ret := NewTreeV4(options...)
+	ret.Reserve(len(entries))
+
+	// the nodes from the root down to the last prefix linked in - each prefix after it goes below one of them
+	path := []pathNodeV4{{nodeIndex: 1}}
+	var previous treeNodeV4
+	for i, entry := range entries {
+		if err := ret.validateAddress(entry.Prefix); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		var prefix treeNodeV4
+		address := treeNodeV4FromAddress(entry.Prefix)
+		prefix.MergeFromNodes(&prefix, &address)
+		if i > 0 && previous.comparePrefix(&prefix) >= 0 {
+			return nil, fmt.Errorf("entry %d: %s doesn't come after %s - entries must be sorted, with no prefix repeated", i, entry.Prefix, previous.Address())
+		}
+		previous = prefix
+		if len(entry.Tags) == 0 {
+			continue
+		}
+
+		// back up to the deepest node holding the prefix - the last one backed out of, if any, is its child on the
+		// prefix's side, and has to be split where the two part, if that's below the parent
+		// the root's prefix, being the least, can only be first
+		nodeIndex := uint(1)
+		if prefix.length() > 0 {
+			var err error
+
+			// back up to the deepest node holding the prefix - the last one backed out of, if any, is its child on the
+			// prefix's side, and has to be split where the two part, if that's below the parent
+			var sibling pathNodeV4
+			for !path[len(path)-1].prefix.containsPrefix(&prefix) {
+				sibling = path[len(path)-1]
+				path = path[:len(path)-1]
+			}
+			parent := path[len(path)-1]
+			if sibling.nodeIndex != 0 {
+				if common := sibling.prefix.MatchCount(prefix.Address()); common > parent.prefix.length() {
+					split := pathNodeV4{prefix: sibling.prefix}
+					split.prefix.setLength(common)
+					split.prefix.MergeFromNodes(&treeNodeV4{}, &split.prefix)
+					if split.nodeIndex, err = ret.linkSorted(parent, split); err != nil {
+						return nil, fmt.Errorf("entry %d: %w", i, err)
+					}
+					if _, err = ret.linkSorted(split, sibling); err != nil {
+						return nil, fmt.Errorf("entry %d: %w", i, err)
+					}
+					parent = split
+					path = append(path, split)
+				}
+			}
+			if nodeIndex, err = ret.linkSorted(parent, pathNodeV4{prefix: prefix}); err != nil {
+				return nil, fmt.Errorf("entry %d: %w", i, err)
+			}
+			path = append(path, pathNodeV4{nodeIndex: nodeIndex, prefix: prefix})
+		}
+
+		for _, tag := range entry.Tags {
+			if _, err := ret.addTag(tag, nodeIndex, nil, ret.config.singleTag, 0); err != nil {
+				return nil, fmt.Errorf("entry %d: %w", i, err)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// a node, along with its full prefix
+type pathNodeV4 struct {
+	nodeIndex uint
+	prefix    treeNodeV4
+}
+
+// link a node in as the child of parent on its side, returning its index
+// - the node is new, if its index is 0, and otherwise keeps its children and tags
+func (t *TreeV4) linkSorted(parent pathNodeV4, node pathNodeV4) (uint, error) {
+	relative := node.prefix
+	relative.ShiftPrefix(parent.prefix.length())
+	nodeIndex := node.nodeIndex
+	if nodeIndex == 0 {
+		var err error
+		if nodeIndex, err = t.newNode(relative.Address(), relative.length()); err != nil {
+			return 0, err
+		}
+	} else {
+		existing := &t.nodes[nodeIndex]
+		relative.Left, relative.Right, relative.TagCount = existing.Left, existing.Right, existing.TagCount
+		*existing = relative
+	}
+	t.setChild(parent.nodeIndex, relative.IsLeftBitSet(), nodeIndex)
+	return nodeIndex, nil
+}
+
+// add each entry's tags to the tree, in order
+func (t *TreeV4) addEntries(entries []EntryV4) error {
+	for _, entry := range entries {
+		for _, tag := range entry.Tags {
+			if _, _, err := t.Add(entry.Prefix, tag, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// a node in another tree to link into this one, along with its full prefix
+type stitchNodeV4 struct {
+	tree      *TreeV4
+	nodeIndex uint
+	prefix    treeNodeV4
+}
+
+// link nodes from other trees in below the node at the input index, whose full prefix is prefix
+// - the nodes' prefixes must be in ascending order, not contain each other, and all be longer than prefix, which contains them
+func (t *TreeV4) stitchChildren(nodeIndex uint, prefix treeNodeV4, nodes []stitchNodeV4) {
+	// the nodes going left come first, with a 0 bit after the prefix
+	split := len(nodes)
+	for i := range nodes {
+		next := nodes[i].prefix
+		next.ShiftPrefix(prefix.length())
+		if next.IsLeftBitSet() {
+			split = i
+			break
+		}
+	}
+	if split > 0 {
+		left := t.stitch(prefix, nodes[:split])
+		t.nodes[nodeIndex].Left = treeIndex(left)
+	}
+	if split < len(nodes) {
+		right := t.stitch(prefix, nodes[split:])
+		t.nodes[nodeIndex].Right = treeIndex(right)
+	}
+}
+
+// link nodes from other trees in below a parent with the input full prefix, all taking the same side, returning the index of
+// the node holding them
+func (t *TreeV4) stitch(parent treeNodeV4, nodes []stitchNodeV4) uint {
+	if len(nodes) == 1 {
+		nodeIndex := t.copySubtree(nodes[0].tree, nodes[0].nodeIndex, nil)
+		t.nodes[nodeIndex].ShiftPrefix(parent.length())
+		return nodeIndex
+	}
+
+	// a node without tags, for the prefix the nodes all share, split between its children - being in ascending order,
+	// the first and last nodes share the least
+	first := &nodes[0].prefix
+	last := nodes[len(nodes)-1].prefix
+	var prefix treeNodeV4
+	common := *first
+	common.setLength(first.MatchCount(last.Address()))
+	prefix.MergeFromNodes(&prefix, &common)
+
+	nodeIndex := uint(len(t.nodes))
+	node := prefix
+	node.ShiftPrefix(parent.length())
+	t.nodes = append(t.nodes, node)
+	t.stitchChildren(nodeIndex, prefix, nodes)
+	return nodeIndex
+}
+
+// copy the node at the input index in src, along with its descendants and all of their tags, into this tree, returning its new index
+// - the node's prefix is copied as it is, relative to its parent in src
+// - the tags are copied with copier, or with a nil copier, their storage is taken over, so src must not be changed
+// afterwards - see tagStorage.copyNode
+func (t *TreeV4) copySubtree(src *TreeV4, srcIndex uint, copier *tagCopier) uint {
+	nodeIndex := uint(len(t.nodes))
+	node := src.nodes[srcIndex]
+	t.nodes = append(t.nodes, node)
+
+	t.tags.copyNode(&src.tags, srcIndex, nodeIndex, node.TagCount, copier)
+	t.tags.share(nodeIndex, node.TagCount)
+	if node.Left != 0 {
+		left := t.copySubtree(src, uint(node.Left), copier)
+		t.nodes[nodeIndex].Left = treeIndex(left)
+	}
+	if node.Right != 0 {
+		right := t.copySubtree(src, uint(node.Right), copier)
+		t.nodes[nodeIndex].Right = treeIndex(right)
+	}
+	return nodeIndex
+}
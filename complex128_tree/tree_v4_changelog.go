@@ -0,0 +1,233 @@
+package complex128_tree
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/kentik/patricia"
+)
+
+// SetChangeLog starts appending a record of every change to the tree to w, for Replay to redo them
+// - together with a saved copy of the tree, a change log is a cheap way to persist a tree that changes often: save a copy
+// now and then, starting a new log each time, and on restart, load the last copy, and replay the log since
+// - each change is written to w as it's made, with a single Write - buffer w if that's too slow, and flush it when the
+// changes need to be durable
+// - records hold what a prefix's tags are after the change, so replaying a change doesn't call the MatchesFunc or
+// UpdateFunc it was made with
+// - replacing the tree's contents by decoding one is logged as clearing it, then setting each prefix's tags
+// - once writing a record fails, nothing more is written - ChangeLogErr returns why
+// - pass nil to stop logging, returning the error that stopped the last log, if any
+func (t *TreeV4) SetChangeLog(w io.Writer) error {
+	var err error
+	if t.changeLog != nil {
+		err = t.changeLog.err
+	}
+	t.changeLog = nil
+	if w != nil {
+		t.changeLog = &changeLog{w: w}
+	}
+	return err
+}
+
+// ChangeLogErr returns the error that stopped the change log, if it's been stopped by one
+func (t *TreeV4) ChangeLogErr() error {
+	if t.changeLog == nil {
+		return nil
+	}
+	return t.changeLog.err
+}
+
+// Replay redoes the changes recorded in a change log, read from r, as written after SetChangeLog
+// - the tree should be as it was when the log was started, such as freshly loaded from a copy saved then
+// - a record that's incomplete or corrupt, as the last one can be after a crash, stops the replay, returning an error
+// wrapping ErrInvalidData, after the changes before it have been made
+// - the changes are logged again if the tree has a change log, so start logging after replaying
+// - returns how many records were replayed
+func (t *TreeV4) Replay(r io.Reader) (int, error) {
+	d := decoder{r: r}
+	var record []byte
+	var scratch changeLogScratchV4
+	replayed := 0
+	for {
+		var ok bool
+		if record, ok = d.changeLogRecord(record); !ok {
+			return replayed, d.err
+		}
+		if err := t.applyChangeLogRecord(record, &scratch); err != nil {
+			return replayed, fmt.Errorf("change log record %d: %w", replayed, err)
+		}
+		replayed++
+	}
+}
+
+// buffers reused between change log records
+type changeLogScratchV4 struct {
+	tags        []complex128
+	expirations []int64
+}
+
+// redo the change in a change log record, without its framing
+func (t *TreeV4) applyChangeLogRecord(record []byte, scratch *changeLogScratchV4) error {
+	rd := decoder{data: record}
+	switch kind := rd.byte(); kind {
+	case changeLogTags:
+		address := t.decodeChangeLogAddress(&rd)
+		tagCount := rd.count(uint64(rd.remaining()), "tag count")
+		scratch.tags, scratch.expirations = scratch.tags[:0], scratch.expirations[:0]
+		for i := 0; i < tagCount && rd.err == nil; i++ {
+			scratch.tags = append(scratch.tags, rd.tag())
+			scratch.expirations = append(scratch.expirations, rd.varint())
+		}
+		if rd.err == nil {
+			if err := t.replaceTags(address, scratch.tags, scratch.expirations); err != nil {
+				return err
+			}
+		}
+	case changeLogPrune:
+		address := t.decodeChangeLogAddress(&rd)
+		if rd.err == nil {
+			if _, _, err := t.Prune(address); err != nil {
+				return err
+			}
+		}
+	case changeLogClear:
+		if err := t.Clear(); err != nil {
+			return err
+		}
+	case changeLogSweep:
+		now := rd.varint()
+		if rd.err == nil {
+			if t.frozen != nil {
+				return ErrFrozen
+			}
+			t.startChange()
+			if t.sweep(now) > 0 {
+				t.logSweep(now)
+			}
+		}
+	default:
+		rd.fail("unknown change log record type %d", kind)
+	}
+	if rd.err == nil && rd.remaining() > 0 {
+		rd.fail("%d bytes of trailing data", rd.remaining())
+	}
+	return rd.err
+}
+
+// replace the tags at the address with the input tags, which expire at the input times, or never, for 0
+func (t *TreeV4) replaceTags(address patricia.IPv4Address, tags []complex128, expirations []int64) error {
+	if t.hooks != nil {
+		// the hooks hear about the change as a whole, not the delete and adds it's made with
+		hooks := t.hooks
+		t.hooks = nil
+		defer func(before []complex128) {
+			t.hooks = hooks
+			t.hookChanges(address, before)
+		}(t.hookTags(address))
+	}
+	matchAll := func(complex128, complex128) bool { return true }
+	var tag complex128
+	if _, err := t.Delete(address, matchAll, tag); err != nil {
+		return err
+	}
+	for i, tag := range tags {
+		if _, _, err := t.add(address, tag, nil, false, expirations[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record what the tags at the address are now
+func (t *TreeV4) logTags(address patricia.IPv4Address) {
+	if t.changeLog == nil || t.changeLog.err != nil {
+		return
+	}
+	e := t.changeLog.begin(changeLogTags)
+	t.encodeChangeLogAddress(e, address)
+
+	nodeIndex, _, err := t.findNode(address)
+	if err != nil {
+		e.err = err
+	} else if nodeIndex == 0 {
+		e.uvarint(0)
+	} else {
+		tags := t.nodeTags(nodeIndex)
+		e.uvarint(uint64(len(tags)))
+		for i, tag := range tags {
+			e.tag(tag)
+			e.varint(t.tagExpiration(nodeIndex, i))
+		}
+	}
+	t.changeLog.end()
+}
+
+// record that everything more specific than the address was deleted
+func (t *TreeV4) logPrune(address patricia.IPv4Address) {
+	if t.changeLog == nil {
+		return
+	}
+	t.encodeChangeLogAddress(t.changeLog.begin(changeLogPrune), address)
+	t.changeLog.end()
+}
+
+// record that everything was deleted
+func (t *TreeV4) logClear() {
+	if t.changeLog == nil {
+		return
+	}
+	t.changeLog.begin(changeLogClear)
+	t.changeLog.end()
+}
+
+// record that the tags that expired by now were deleted
+func (t *TreeV4) logSweep(now int64) {
+	if t.changeLog == nil {
+		return
+	}
+	t.changeLog.begin(changeLogSweep).varint(now)
+	t.changeLog.end()
+}
+
+// replace the tree's contents with tree's, keeping the change log, and logging the tree's new contents
+func (t *TreeV4) replace(tree *TreeV4) {
+	if t.hooks != nil {
+		t.hookEntries(t.hookSubtree(patricia.IPv4Address{}, false), ChangeDelete)
+		defer func() {
+			t.hookEntries(t.hookSubtree(patricia.IPv4Address{}, false), ChangeAdd)
+		}()
+	}
+	tree.changeLog, tree.changeSeq, tree.hooks = t.changeLog, t.changeSeq, t.hooks
+	*t = *tree
+	t.recount()
+	t.tags.internAll(t)
+	t.changing()
+	if t.changeLog == nil {
+		return
+	}
+	t.logClear()
+	t.walkNodes(1, treeNodeV4{}, func(nodeIndex uint, prefix treeNodeV4) bool {
+		if t.nodes[nodeIndex].TagCount > 0 {
+			t.logTags(prefix.Address())
+		}
+		return t.changeLog.err == nil
+	})
+}
+
+func (t *TreeV4) encodeChangeLogAddress(e *encoder, address patricia.IPv4Address) {
+	e.byte(byte(address.Length))
+	e.bytes(t.addressBytes(address))
+}
+
+func (t *TreeV4) decodeChangeLogAddress(d *decoder) patricia.IPv4Address {
+	length := d.byte()
+	data := d.bytes(len(t.addressBytes(patricia.IPv4Address{})))
+	if d.err != nil {
+		return patricia.IPv4Address{}
+	}
+	address, err := t.addressFromBytes(data, uint(length))
+	if err != nil {
+		d.fail("%s", err)
+	}
+	return address
+}
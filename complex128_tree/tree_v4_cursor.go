@@ -0,0 +1,117 @@
+package complex128_tree
+
+import (
+	"fmt"
+)
+
+// CursorV4 pages through the prefixes in a tree that have tags, in the same order as Walk
+// - the cursor's position is the last prefix it returned, so it stays valid as the tree changes: it picks up with the next prefix after that
+// - that position can be saved with Token, and restored later, even in another process, with CursorFrom
+type CursorV4 struct {
+	tree    *TreeV4
+	after   treeNodeV4 // full prefix of the last entry returned
+	started bool       // whether after is set
+}
+
+// Cursor returns a cursor positioned before the first prefix in the tree
+func (t *TreeV4) Cursor() *CursorV4 {
+	return &CursorV4{tree: t}
+}
+
+// CursorFrom returns a cursor positioned after the prefix that the input token, from CursorV4.Token, was taken at
+// - an empty token positions the cursor before the first prefix in the tree
+func (t *TreeV4) CursorFrom(token string) (*CursorV4, error) {
+	if token == "" {
+		return t.Cursor(), nil
+	}
+	address, err := t.parseAddress(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor token: %w", err)
+	}
+	if err = t.validateAddress(address); err != nil {
+		return nil, err
+	}
+
+	ret := &CursorV4{tree: t, started: true}
+	addressNode := treeNodeV4FromAddress(address)
+	ret.after.MergeFromNodes(&ret.after, &addressNode)
+	return ret, nil
+}
+
+// Next returns up to n more entries, and a token for resuming after them
+// - returns fewer than n entries once the end of the tree is reached
+func (c *CursorV4) Next(n int) ([]EntryV4, string) {
+	ret := make([]EntryV4, 0, n)
+	if n <= 0 {
+		return ret, c.Token()
+	}
+
+	visit := func(nodeIndex uint, prefix treeNodeV4) bool {
+		if c.tree.nodes[nodeIndex].TagCount == 0 {
+			return true
+		}
+		tags := c.tree.tagsForNode(nodeIndex)
+		if len(tags) == 0 {
+			// they've all expired
+			return true
+		}
+		ret = append(ret, EntryV4{Prefix: prefix.Address(), Tags: tags})
+		c.after = prefix
+		c.started = true
+		return len(ret) < n
+	}
+
+	if c.started {
+		after := c.after
+		c.tree.walkNodesAfter(1, treeNodeV4{}, &after, visit)
+	} else {
+		c.tree.walkNodes(1, treeNodeV4{}, visit)
+	}
+	return ret, c.Token()
+}
+
+// Token returns an opaque token for resuming after the last entry returned by the cursor, with CursorFrom
+// - the token is empty if the cursor hasn't returned anything yet
+func (c *CursorV4) Token() string {
+	if !c.started {
+		return ""
+	}
+	return c.after.Address().String()
+}
+
+// like walkNodes, but only visits nodes with full prefixes that come after the input prefix, in Walk order
+func (t *TreeV4) walkNodesAfter(nodeIndex uint, parent treeNodeV4, after *treeNodeV4, visit func(nodeIndex uint, prefix treeNodeV4) bool) bool {
+	// the right children still to look at, with their parents' full prefixes - left children are looked at straight away
+	var buf [_walkStackSize]walkNodeV4
+	stack := buf[:0]
+	for {
+		node := &t.nodes[nodeIndex]
+		prefix := parent
+		prefix.MergeFromNodes(&parent, node)
+		if prefix.containsPrefix(after) {
+			// this node comes before (or is) the one we're looking for, but some of its descendants might not
+			if node.Left != 0 {
+				if node.Right != 0 {
+					stack = append(stack, walkNodeV4{nodeIndex: uint(node.Right), parent: prefix})
+				}
+				nodeIndex, parent = uint(node.Left), prefix
+				continue
+			}
+			if node.Right != 0 {
+				nodeIndex, parent = uint(node.Right), prefix
+				continue
+			}
+		} else if prefix.comparePrefix(after) > 0 && !t.walkNodes(nodeIndex, parent, visit) {
+			// this whole subtree comes after
+			return false
+		}
+
+		// otherwise this whole subtree comes before
+		if len(stack) == 0 {
+			return true
+		}
+		next := &stack[len(stack)-1]
+		nodeIndex, parent = next.nodeIndex, next.parent
+		stack = stack[:len(stack)-1]
+	}
+}
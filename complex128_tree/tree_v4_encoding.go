@@ -0,0 +1,613 @@
+package complex128_tree
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/kentik/patricia"
+)
+
+// identifies encoded IPv4 trees
+var _encodingMagicV4 = []byte("PTV4")
+
+const (
+	// the version written, laid out in sections, ending with a checksum
+	_encodingVersionV4 = 3
+
+	// earlier versions, still read, but no longer written: the first, without sections, and then one without a checksum
+	_encodingVersion1V4 = 1
+	_encodingVersion2V4 = 2
+)
+
+// MarshalBinary encodes the tree, implementing encoding.BinaryMarshaler
+// - the encoding holds the tree's nodes, tags, and tag expiration times, so decoding it doesn't rebuild anything - but
+// with the nodes renumbered to leave out free ones, so the decoded tree is as compact as a new one
+// - tags are encoded along with their type - this only fails for tag types that aren't bool, string, or numeric
+// - the tree's options aren't encoded
+// - the encoding is versioned, and later versions of this package read what earlier versions wrote
+// - the encoding ends with a checksum, and decoding it checks that as well as the tree's structure, so corrupt data
+// can't turn into a broken tree
+func (t *TreeV4) MarshalBinary() ([]byte, error) {
+	e := encoder{buf: make([]byte, 0, len(t.nodes)*16+t.CountTags()*4)}
+	t.encode(&e)
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.buf, nil
+}
+
+// Save writes the tree to w, encoded the same as MarshalBinary
+// - the encoding is written out in chunks as it's built, rather than all at once, so this doesn't need much memory beyond the tree's
+func (t *TreeV4) Save(w io.Writer) error {
+	e := encoder{buf: make([]byte, 0, _encodingChunkSize), w: w}
+	t.encode(&e)
+	e.flush()
+	return e.err
+}
+
+// SaveCompressed writes the tree to w like Save, compressed by compress
+// - the compressed data is split into length-prefixed frames, ending with an empty one, so LoadCompressed notices if
+// it's been cut short
+// - compress may be nil, to only frame the encoding
+func (t *TreeV4) SaveCompressed(w io.Writer, compress Compressor) error {
+	frames := newFrameWriter(w)
+	var compressed io.WriteCloser = frames
+	if compress != nil {
+		var err error
+		if compressed, err = compress(frames); err != nil {
+			return err
+		}
+	}
+
+	err := t.Save(compressed)
+	if compress != nil {
+		if closeErr := compressed.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := frames.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// MarshalCanonical encodes the tree like MarshalBinary, but the same for any two trees holding the same tags, however
+// they were built, so that the encodings can be compared, or hashed, to tell whether trees are the same
+// - the tree is rebuilt in order of prefix, with each node's tags sorted by their encoding, so the nodes are numbered
+// the same, and there's nothing on the free list
+// - expired tags are left out, and tags that haven't expired yet keep their expiration times
+// - the result is read by UnmarshalBinary, like any other encoding, but the tags at each node may come back in a
+// different order than they were added
+func (t *TreeV4) MarshalCanonical() ([]byte, error) {
+	canonical, err := t.canonical()
+	if err != nil {
+		return nil, err
+	}
+	return canonical.MarshalBinary()
+}
+
+// SaveCanonical writes the tree to w, encoded the same as MarshalCanonical
+func (t *TreeV4) SaveCanonical(w io.Writer) error {
+	canonical, err := t.canonical()
+	if err != nil {
+		return err
+	}
+	return canonical.Save(w)
+}
+
+// return a copy of the tree laid out the same as any other tree with the same tags: built up in order of prefix, with
+// each node's tags in order of their encoding
+func (t *TreeV4) canonical() (*TreeV4, error) {
+	type canonicalTag struct {
+		encoded   string
+		tag       complex128
+		expiresAt int64
+	}
+
+	ret := NewTreeV4()
+	now := time.Now().UnixNano()
+	var nodeTags []canonicalTag
+	var e encoder
+	var err error
+	t.walkNodes(1, treeNodeV4{}, func(nodeIndex uint, prefix treeNodeV4) bool {
+		nodeTags = nodeTags[:0]
+		for i, tag := range t.nodeTags(nodeIndex) {
+			expiresAt := t.tagExpiration(nodeIndex, i)
+			if expired(expiresAt, now) {
+				continue
+			}
+			e.buf = e.buf[:0]
+			e.tag(tag)
+			nodeTags = append(nodeTags, canonicalTag{string(e.buf), tag, expiresAt})
+		}
+		if e.err != nil {
+			err = e.err
+			return false
+		}
+		sort.SliceStable(nodeTags, func(i, j int) bool {
+			return nodeTags[i].encoded < nodeTags[j].encoded
+		})
+
+		for _, tag := range nodeTags {
+			if _, _, err = ret.add(prefix.Address(), tag.tag, nil, false, tag.expiresAt); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	return ret, err
+}
+
+// UnmarshalBinary replaces the tree's contents with the encoded tree in data, implementing encoding.BinaryUnmarshaler
+// - data must come from TreeV4.MarshalBinary or TreeV4.Save, in a package for the same tag type
+// - the tree keeps its own options
+// - if an error is returned, the tree is left as it was
+func (t *TreeV4) UnmarshalBinary(data []byte) error {
+	d := decoder{data: data}
+	tree := t.decode(&d)
+	if d.err == nil && d.remaining() > 0 {
+		d.fail("%d bytes of trailing data", d.remaining())
+	}
+	if d.err != nil {
+		return d.err
+	}
+	t.replace(tree)
+	return nil
+}
+
+// Load replaces the tree's contents with an encoded tree read from r, the same as UnmarshalBinary
+// - r is read in chunks as the tree is decoded, so this doesn't need much memory beyond the tree's
+// - r may be read past the end of the encoded tree
+// - if an error is returned, the tree is left as it was
+func (t *TreeV4) Load(r io.Reader) error {
+	d := decoder{r: r}
+	tree := t.decode(&d)
+	if d.err != nil {
+		return d.err
+	}
+	t.replace(tree)
+	return nil
+}
+
+// SaveSubtree writes the prefixes within the input address, and their tags, to w, encoded the same as Save
+// - the prefixes are written relative to the address, with its bits taken off the front, as a tree that LoadSubtree can
+// graft in anywhere - or Load can read on its own
+// - tag expiration times are kept
+func (t *TreeV4) SaveSubtree(address patricia.IPv4Address, w io.Writer) error {
+	if err := t.validateAddress(address); err != nil {
+		return err
+	}
+
+	subtree := NewTreeV4()
+	var err error
+	t.walkSubtreeNodes(address, func(nodeIndex uint, prefix treeNodeV4) bool {
+		if t.nodes[nodeIndex].TagCount == 0 {
+			return true
+		}
+		relative := prefix.Address()
+		relative.ShiftLeft(address.Length)
+
+		for i, tag := range t.nodeTags(nodeIndex) {
+			if _, _, err = subtree.add(relative, tag, nil, false, t.tagExpiration(nodeIndex, i)); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return subtree.Save(w)
+}
+
+// LoadSubtree reads a subtree written by SaveSubtree from r, and grafts it into the tree at the input address, like
+// Graft, returning how many tags were added
+// - the subtree is read in full before anything is added, so if it can't be read, or its prefixes don't fit below the
+// address, the tree is left as it was
+func (t *TreeV4) LoadSubtree(address patricia.IPv4Address, r io.Reader, matchFunc MatchesFunc) (int, error) {
+	subtree := NewTreeV4()
+	if err := subtree.Load(r); err != nil {
+		return 0, err
+	}
+	return t.Graft(address, subtree, matchFunc)
+}
+
+// LoadConverted replaces the tree's contents with a tree read from r, written by Save or MarshalBinary in a package
+// for another tag type, converting each of its tags with convert
+// - this migrates a snapshot from one tag type to another, such as from uint32 to uint16, or to a struct, without
+// rebuilding it from its source
+// - if convert is nil, numbers are converted between types as long as they fit, and other tags have to be of the same type
+// - the tree keeps its own options
+// - if an error is returned, including one from convert, the tree is left as it was
+func (t *TreeV4) LoadConverted(r io.Reader, convert ConvertFunc) error {
+	if convert == nil {
+		convert = convertTag
+	}
+	d := decoder{r: r, convert: convert}
+	tree := t.decode(&d)
+	if d.err != nil {
+		return d.err
+	}
+	t.replace(tree)
+	return nil
+}
+
+// LoadCompressed replaces the tree's contents with one written by SaveCompressed, decompressed by decompress
+// - decompress must undo the compression SaveCompressed used, and may be nil if it used none
+// - everything up to the end of the compressed data is read, so truncated or corrupt data is noticed even after the tree
+// - if an error is returned, the tree is left as it was
+func (t *TreeV4) LoadCompressed(r io.Reader, decompress Decompressor) error {
+	var d decoder
+	tree, err := t.decodeCompressed(&d, r, decompress)
+	if err != nil {
+		return err
+	}
+	t.replace(tree)
+	return nil
+}
+
+// LoadFrom replaces the tree's contents with one read from r, written by Save, the same as Load - but reporting
+// progress as it goes, and stopping if ctx is done, for loading large trees from slow sources, such as object storage
+// - progress reports, and reading a tree written by SaveCompressed, are set up with LoadOptions
+// - if ctx is done before the load is, its error is returned
+// - if an error is returned, the tree is left as it was
+func (t *TreeV4) LoadFrom(ctx context.Context, r io.Reader, options ...LoadOption) error {
+	config := newLoadConfig(options)
+	var d decoder
+	progress := &progressReader{ctx: ctx, r: r, d: &d, config: &config, lastReport: time.Now()}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var tree *TreeV4
+	var err error
+	if config.compressed {
+		tree, err = t.decodeCompressed(&d, progress, config.decompress)
+	} else {
+		d.r = progress
+		tree = t.decode(&d)
+		err = d.err
+	}
+	if err != nil {
+		return err
+	}
+	if config.progressFunc != nil {
+		progress.report()
+	}
+	t.replace(tree)
+	return nil
+}
+
+// read a tree written by SaveCompressed from r, decompressed by decompress, into a new tree with this one's options
+func (t *TreeV4) decodeCompressed(d *decoder, r io.Reader, decompress Decompressor) (*TreeV4, error) {
+	var decompressed io.Reader = newFrameReader(r)
+	if decompress != nil {
+		var err error
+		if decompressed, err = decompress(decompressed); err != nil {
+			return nil, err
+		}
+		if closer, ok := decompressed.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+
+	d.r = decompressed
+	tree := t.decode(d)
+	if d.err == nil {
+		// the decoder may not have read all the way to the end
+		trailing, err := io.Copy(io.Discard, decompressed)
+		if err != nil {
+			d.err = err
+		} else if trailing += int64(d.remaining()); trailing > 0 {
+			d.fail("%d bytes of trailing data", trailing)
+		}
+	}
+	return tree, d.err
+}
+
+// write the tree to the encoder
+// - the nodes are renumbered in the order they're in the tree, leaving out the ones on the free list, so a tree that's
+// had a lot of changes loads as compact as a new one
+func (t *TreeV4) encode(e *encoder) {
+	numbering := t.compactNumbering()
+	e.hash = crc32.New(_crcTable)
+	e.bytes(_encodingMagicV4)
+	e.byte(_encodingVersionV4)
+	e.section(encodingSectionNodes, func(e *encoder) { t.encodeNodes(e, numbering) })
+	e.section(encodingSectionFreeList, func(e *encoder) { t.encodeFreeList(e, numbering) })
+	e.section(encodingSectionTags, func(e *encoder) { t.encodeTags(e, numbering) })
+	e.section(encodingSectionExpirations, func(e *encoder) { t.encodeExpirations(e, numbering) })
+	e.checksumSection()
+	e.uvarint(encodingSectionEnd)
+}
+
+// number the nodes in pre-order, after the unused node 0, leaving out any that can't be reached from the root
+// - returns nil for a tree that fails the structure check, to encode it as it is, so that decoding it fails the same
+// check rather than the damage being hidden
+func (t *TreeV4) compactNumbering() *nodeNumbering {
+	if t.checkStructure() != nil {
+		return nil
+	}
+
+	n := &nodeNumbering{
+		order: make([]uint, 1, len(t.nodes)-len(t.availableIndexes)),
+		index: make([]uint, len(t.nodes)),
+	}
+	stack := []uint{1}
+	for len(stack) > 0 {
+		nodeIndex := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n.index[nodeIndex] = uint(len(n.order))
+		n.order = append(n.order, nodeIndex)
+
+		// right first, so that left comes off the stack first
+		if right := uint(t.nodes[nodeIndex].Right); right != 0 {
+			stack = append(stack, right)
+		}
+		if left := uint(t.nodes[nodeIndex].Left); left != 0 {
+			stack = append(stack, left)
+		}
+	}
+	return n
+}
+
+func (t *TreeV4) encodeNodes(e *encoder, numbering *nodeNumbering) {
+	nodeCount := numbering.count(len(t.nodes))
+	e.uvarint(uint64(nodeCount))
+	for i := 0; i < nodeCount; i++ {
+		node := t.nodes[numbering.node(i)]
+		node.Left = treeIndex(numbering.renumber(uint(node.Left)))
+		node.Right = treeIndex(numbering.renumber(uint(node.Right)))
+		node.encode(e)
+		e.chunk()
+	}
+}
+
+// renumbered nodes leave out the free ones, so there's nothing on the free list
+func (t *TreeV4) encodeFreeList(e *encoder, numbering *nodeNumbering) {
+	if numbering != nil {
+		e.uvarint(0)
+		return
+	}
+	e.uvarint(uint64(len(t.availableIndexes)))
+	for _, nodeIndex := range t.availableIndexes {
+		e.uvarint(uint64(nodeIndex))
+		e.chunk()
+	}
+}
+
+func (t *TreeV4) encodeTags(e *encoder, numbering *nodeNumbering) {
+	for i := 0; i < numbering.count(len(t.nodes)); i++ {
+		for _, tag := range t.nodeTags(numbering.node(i)) {
+			e.tag(tag)
+		}
+		e.chunk()
+	}
+}
+
+// expirations are written in order of node and tag, so the same tree always encodes the same
+func (t *TreeV4) encodeExpirations(e *encoder, numbering *nodeNumbering) {
+	nodeCount := numbering.count(len(t.nodes))
+	e.uvarint(uint64(t.tags.expiring))
+	for i := 0; i < nodeCount && t.tags.expiring > 0; i++ {
+		for j, expiresAt := range t.nodeExpirations(numbering.node(i)) {
+			if expiresAt != 0 {
+				e.uvarint(uint64(i))
+				e.uvarint(uint64(j))
+				e.varint(expiresAt)
+			}
+		}
+		e.chunk()
+	}
+}
+
+// read a tree from the decoder, returning a new tree with this one's options - or nil, if the decoder has an error
+func (t *TreeV4) decode(d *decoder) *TreeV4 {
+	d.hash = crc32.New(_crcTable)
+	if magic := d.bytes(len(_encodingMagicV4)); d.err == nil && string(magic) != string(_encodingMagicV4) {
+		d.fail("not an IPv4 tree")
+	}
+
+	tree := &TreeV4{tags: newTagStorage(&t.config), config: t.config}
+	switch version := d.byte(); {
+	case d.err != nil:
+	case version == _encodingVersion1V4:
+		tree.decodeNodes(d)
+		tree.decodeFreeList(d)
+		tree.decodeTags(d)
+		tree.decodeExpirations(d)
+	case version == _encodingVersion2V4:
+		tree.decodeSections(d, false)
+	case version == _encodingVersionV4:
+		tree.decodeSections(d, true)
+	default:
+		d.fail("unknown version %d - it may be from a later version of this package", version)
+	}
+	if d.err == nil {
+		if err := tree.checkStructure(); err != nil {
+			d.err = fmt.Errorf("%w: %w", ErrInvalidData, err)
+		}
+	}
+
+	if d.err != nil {
+		return nil
+	}
+	return tree
+}
+
+// read the sections of an encoded tree into t, which must be empty
+// - a checksum section is checked if there is one, and there has to be if requireChecksum is set
+func (t *TreeV4) decodeSections(d *decoder, requireChecksum bool) {
+	lastID := uint64(encodingSectionEnd)
+	hasTags, hasChecksum := false, false
+	for d.err == nil {
+		// the checksum covers everything up to its section
+		sum := d.hash.Sum32()
+		id := d.uvarint()
+		if id == encodingSectionEnd || d.err != nil {
+			break
+		}
+		length := d.count(uint64(d.bound()), "section length")
+		if d.err == nil && hasChecksum {
+			d.fail("section %d comes after the checksum", id)
+		}
+		if d.err == nil && id <= lastID {
+			d.fail("section %d is out of order", id)
+		}
+		if d.err == nil && id > encodingSectionNodes && t.nodes == nil {
+			d.fail("section %d comes before the nodes", id)
+		}
+		lastID = id
+
+		start := d.read
+		switch id {
+		case encodingSectionNodes:
+			t.decodeNodes(d)
+		case encodingSectionFreeList:
+			t.decodeFreeList(d)
+		case encodingSectionTags:
+			t.decodeTags(d)
+			hasTags = true
+		case encodingSectionExpirations:
+			t.decodeExpirations(d)
+		case encodingSectionChecksum:
+			if expected := d.uint32(); d.err == nil && expected != sum {
+				d.fail("checksum mismatch: %08x, expected %08x", sum, expected)
+			}
+			hasChecksum = true
+		default:
+			d.skip(length)
+		}
+		if read := d.read - start; d.err == nil && read != length {
+			d.fail("section %d is %d bytes, but %d were read", id, length, read)
+		}
+	}
+
+	if d.err == nil && !hasTags {
+		d.fail("no tags section")
+	}
+	if d.err == nil && requireChecksum && !hasChecksum {
+		d.fail("no checksum")
+	}
+}
+
+func (t *TreeV4) decodeNodes(d *decoder) {
+	// every node takes up more than a byte, so this stops a bad count from allocating much - and their indexes have to
+	// fit in a treeIndex
+	nodeCount := d.count(min(uint64(d.bound()), _maxTreeIndex), "node count")
+	if d.err == nil && nodeCount < 2 {
+		d.fail("no root node")
+	}
+	t.nodes = make([]treeNodeV4, 0, d.capacity(nodeCount))
+	tagCount := 0
+	for i := 0; i < nodeCount && d.err == nil; i++ {
+		var node treeNodeV4
+		node.decode(d, nodeCount)
+		t.nodes = append(t.nodes, node)
+		tagCount += node.TagCount
+		if tagCount > d.bound() {
+			d.fail("more tags than there's data for")
+		}
+	}
+	t.recount()
+}
+
+func (t *TreeV4) decodeFreeList(d *decoder) {
+	availableCount := d.count(uint64(d.bound()), "free list length")
+	t.availableIndexes = make([]treeIndex, 0, d.capacity(availableCount))
+	for i := 0; i < availableCount && d.err == nil; i++ {
+		t.availableIndexes = append(t.availableIndexes, treeIndex(d.count(uint64(len(t.nodes)-1), "free node index")))
+	}
+}
+
+func (t *TreeV4) decodeTags(d *decoder) {
+	tagCount := t.CountTags()
+	slices := make([][]complex128, len(t.nodes))
+	arena := sliceArena[complex128]{block: make([]complex128, 0, d.capacity(tagCount))}
+	var tags []complex128
+	for nodeIndex := 0; nodeIndex < len(t.nodes) && d.err == nil; nodeIndex++ {
+		tags = tags[:0]
+		for i := 0; i < t.nodes[nodeIndex].TagCount && d.err == nil; i++ {
+			tags = append(tags, d.tag())
+		}
+		slices[nodeIndex] = arena.copy(tags)
+	}
+	if d.err == nil {
+		d.err = t.tags.load(slices, t)
+	}
+}
+
+func (t *TreeV4) decodeExpirations(d *decoder) {
+	expirationCount := d.count(uint64(t.CountTags()), "expiration count")
+	if expirationCount == 0 {
+		return
+	}
+	for i := 0; i < expirationCount && d.err == nil; i++ {
+		nodeIndex := d.count(uint64(len(t.nodes)-1), "expiring tag's node index")
+		tagIndex := d.count(math.MaxUint32, "expiring tag's index")
+		if d.err == nil && tagIndex >= t.nodes[nodeIndex].TagCount {
+			d.fail("expiring tag %d is out of range at node %d", tagIndex, nodeIndex)
+		}
+		expiresAt := d.varint()
+		if d.err == nil {
+			t.setExpiration(uint(nodeIndex), tagIndex, expiresAt)
+		}
+	}
+}
+
+// GobEncode encodes the tree for encoding/gob, the same as MarshalBinary
+func (t *TreeV4) GobEncode() ([]byte, error) {
+	return t.MarshalBinary()
+}
+
+// GobDecode decodes a tree encoded with GobEncode, the same as UnmarshalBinary
+func (t *TreeV4) GobDecode(data []byte) error {
+	return t.UnmarshalBinary(data)
+}
+
+// MarshalJSON encodes the tree as a list of prefixes that have tags, along with those tags, implementing json.Marshaler
+// - like [{"cidr":"10.0.0.0/8","tags":["a","b"]}], in the same order as Walk
+// - only prefixes and tags are encoded, not how the tree is laid out, nor when tags expire
+// - tags are encoded as encoding/json encodes them, except that complex numbers are [real, imaginary] pairs, and floats
+// that aren't finite are the strings "NaN", "+Inf" and "-Inf", as JSON has no numbers for them
+func (t *TreeV4) MarshalJSON() ([]byte, error) {
+	entries := make([]jsonEntry, 0)
+	t.Walk(func(prefix patricia.IPv4Address, tags []complex128) bool {
+		entries = append(entries, jsonEntry{CIDR: prefix.String(), Tags: tags})
+		return true
+	})
+	return json.Marshal(entries)
+}
+
+// UnmarshalJSON replaces the tree's contents with the prefixes and tags encoded by MarshalJSON, implementing json.Unmarshaler
+// - tags are added in order, as with Add, so the tree's options apply
+// - if an error is returned, the tree is left as it was
+func (t *TreeV4) UnmarshalJSON(data []byte) error {
+	var entries []jsonEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	tree := NewTreeV4()
+	tree.config = t.config
+	for i, entry := range entries {
+		address, err := tree.parseAddress(entry.CIDR)
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		for _, tag := range entry.Tags {
+			if _, _, err = tree.Add(address, tag, nil); err != nil {
+				return fmt.Errorf("entry %d (%s): %w", i, entry.CIDR, err)
+			}
+		}
+	}
+
+	t.replace(tree)
+	return nil
+}
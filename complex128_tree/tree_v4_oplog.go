@@ -0,0 +1,43 @@
+package complex128_tree
+
+import "fmt"
+
+// ApplyOps makes the changes in ops, sent by an OpStream, to this tree, which follows the tree they were made to,
+// returning the number of the last op applied
+// - lastSeq is the number of the last op already applied, as returned by the last call, or the sequence number of the
+// copy of the tree this one was loaded from
+// - ops at or before lastSeq are skipped, so applying the same ops again, or ops that overlap ones already applied,
+// does nothing more
+// - ops must be in order: one that's more than one after the last op applied returns an error wrapping ErrMissingOps
+// - an op that's corrupt returns an error wrapping ErrInvalidData
+// - when an error is returned, the ops before it have been applied, and the returned sequence number says which
+func (t *TreeV4) ApplyOps(lastSeq uint64, ops []Op) (uint64, error) {
+	var record []byte
+	var scratch changeLogScratchV4
+	for _, op := range ops {
+		if op.Seq <= lastSeq {
+			continue
+		}
+		if op.Seq != lastSeq+1 {
+			return lastSeq, fmt.Errorf("op %d, after op %d: %w", op.Seq, lastSeq, ErrMissingOps)
+		}
+
+		d := decoder{data: op.Data}
+		var ok bool
+		if record, ok = d.changeLogRecord(record); !ok {
+			if d.err == nil {
+				d.fail("empty op")
+			}
+		} else if d.remaining() > 0 {
+			d.fail("%d bytes of trailing data", d.remaining())
+		}
+		if d.err != nil {
+			return lastSeq, fmt.Errorf("op %d: %w", op.Seq, d.err)
+		}
+		if err := t.applyChangeLogRecord(record, &scratch); err != nil {
+			return lastSeq, fmt.Errorf("op %d: %w", op.Seq, err)
+		}
+		lastSeq = op.Seq
+	}
+	return lastSeq, nil
+}
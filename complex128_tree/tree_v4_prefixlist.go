@@ -0,0 +1,62 @@
+package complex128_tree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// LoadPrefixList adds a tag to the tree for each prefix in a plain text prefix list read from r, with one prefix per
+// line, such as a firewall block list or a bogon list
+// - a line can have a value after the prefix, separated by whitespace, which is parsed into its tag - lines without
+// one are tagged with defaultTag
+// - blank lines, and comments starting with '#', ';', or "//", are ignored, and addresses without a prefix length
+// are taken as single hosts
+// - by default, the first line that can't be loaded fails the load, with an error that says what line it was on, and
+// lines before it stay added - WithPrefixListLenient skips such lines instead
+// - returns how many prefixes were added
+func (t *TreeV4) LoadPrefixList(r io.Reader, defaultTag complex128, options ...PrefixListOption) (int, error) {
+	config := newPrefixListConfig(options)
+	scanner := bufio.NewScanner(r)
+
+	added := 0
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		cidr, value, ok := splitPrefixListLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		if err := t.addPrefixListLine(cidr, value, defaultTag, config); err != nil {
+			err = fmt.Errorf("line %d: %w", lineNumber, err)
+			if !config.lenient {
+				return added, err
+			}
+			if config.skipFunc != nil {
+				config.skipFunc(err)
+			}
+			continue
+		}
+		added++
+	}
+	if err := scanner.Err(); err != nil {
+		return added, fmt.Errorf("line %d: %w", lineNumber+1, err)
+	}
+	return added, nil
+}
+
+// add the tag for a line of a prefix list
+func (t *TreeV4) addPrefixListLine(cidr string, value string, defaultTag complex128, config prefixListConfig) error {
+	address, err := t.parseAddress(cidr)
+	if err != nil {
+		return err
+	}
+	tag := defaultTag
+	if value != "" {
+		if tag, err = config.parseFunc(value); err != nil {
+			return fmt.Errorf("invalid value %q: %w", value, err)
+		}
+	}
+	_, _, err = t.Add(address, tag, nil)
+	return err
+}
@@ -0,0 +1,72 @@
+package complex128_tree
+
+import (
+	"fmt"
+
+	"github.com/kentik/patricia"
+)
+
+// ToProto encodes the tree as a Tree message, as defined in proto/patricia.proto
+// - holds the prefixes that have tags, along with those tags, in the same order as Walk
+// - tags are encoded as the closest type the schema has, so, for example, any signed integer is an int_value
+func (t *TreeV4) ToProto() ([]byte, error) {
+	var e encoder
+	var entry encoder
+	t.Walk(func(prefix patricia.IPv4Address, tags []complex128) bool {
+		entry.buf = entry.buf[:0]
+		entry.protoEntry(t.addressBytes(prefix), prefix.Length, tags)
+		if entry.err != nil {
+			e.err = entry.err
+			return false
+		}
+		e.protoBytes(protoTreeEntries, entry.buf)
+		return true
+	})
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.buf, nil
+}
+
+// FromProto replaces the tree's contents with those of a Tree message, as defined in proto/patricia.proto
+// - tags are added in order, as with Add, so the tree's options apply
+// - tags are converted to the tree's tag type if they fit, so, for example, an int_value can be read into an int8 tree if it's small enough
+// - if an error is returned, the tree is left as it was
+func (t *TreeV4) FromProto(data []byte) error {
+	tree := NewTreeV4()
+	tree.config = t.config
+
+	d := decoder{data: data}
+	for entryIndex := 0; d.remaining() > 0 && d.err == nil; {
+		field, wireType := d.protoKey()
+		if field != protoTreeEntries {
+			d.protoSkip(wireType)
+			continue
+		}
+		if !d.protoExpect(field, wireType, protoBytes) {
+			break
+		}
+
+		entry := d.protoBytes()
+		addressData, length, tags := entry.protoEntry()
+		if entry.err != nil {
+			return fmt.Errorf("entry %d: %w", entryIndex, entry.err)
+		}
+		address, err := tree.addressFromBytes(addressData, length)
+		if err != nil {
+			return fmt.Errorf("%w: entry %d: %s", ErrInvalidData, entryIndex, err)
+		}
+		for _, tag := range tags {
+			if _, _, err = tree.Add(address, tag, nil); err != nil {
+				return fmt.Errorf("entry %d (%s): %w", entryIndex, address, err)
+			}
+		}
+		entryIndex++
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	t.replace(tree)
+	return nil
+}
@@ -0,0 +1,77 @@
+package complex128_tree
+
+import (
+	"sync/atomic"
+
+	"github.com/kentik/patricia"
+)
+
+// AtomicTreeV6 is a tree with a single writer and any number of readers, where reads never lock
+// - the writer changes the tree returned by Writer, then calls Publish to make those changes visible to readers
+// - readers look up the most recently published tree, which is swapped in with an atomic pointer, so they never wait
+// on the writer or on each other
+// - each publish has a generation number, so readers can tell whether they've seen the latest tree
+// - publishing is cheap, but the writer's first change after it copies the tree's storage, like Snapshot, so
+// it's best to publish after a batch of changes, not after each one
+type AtomicTreeV6 struct {
+	writer    *TreeV6
+	published atomic.Pointer[publishedTreeV6]
+}
+
+// a published tree, along with its generation, so the two are always loaded together
+type publishedTreeV6 struct {
+	tree       *TreeV6
+	generation uint64
+}
+
+// NewAtomicTreeV6 returns a new, empty AtomicTreeV6, with the empty tree published as generation 0
+func NewAtomicTreeV6(options ...TreeOption) *AtomicTreeV6 {
+	ret := &AtomicTreeV6{writer: NewTreeV6(options...)}
+	ret.published.Store(&publishedTreeV6{tree: ret.writer.Snapshot()})
+	return ret
+}
+
+// Writer returns the tree to make changes to, which readers don't see until Publish is called
+// - this and Publish must only be called from the one writing goroutine
+func (a *AtomicTreeV6) Writer() *TreeV6 {
+	return a.writer
+}
+
+// Publish makes the writer's changes visible to readers, returning the new generation
+func (a *AtomicTreeV6) Publish() uint64 {
+	generation := a.published.Load().generation + 1
+	a.published.Store(&publishedTreeV6{tree: a.writer.Snapshot(), generation: generation})
+	return generation
+}
+
+// Load returns the most recently published tree, and its generation
+// - the tree must not be changed, but can be read for as long as it's needed: it stays the same after later publishes
+func (a *AtomicTreeV6) Load() (*TreeV6, uint64) {
+	p := a.published.Load()
+	return p.tree, p.generation
+}
+
+// Generation returns the generation of the most recently published tree
+func (a *AtomicTreeV6) Generation() uint64 {
+	return a.published.Load().generation
+}
+
+// FindTags finds all matching tags for the address in the published tree - see TreeV6.FindTags
+func (a *AtomicTreeV6) FindTags(address patricia.IPv6Address) ([]complex128, error) {
+	return a.published.Load().tree.FindTags(address)
+}
+
+// FindTagsAppend finds all matching tags for the address in the published tree and appends them to ret - see TreeV6.FindTagsAppend
+func (a *AtomicTreeV6) FindTagsAppend(ret []complex128, address patricia.IPv6Address) []complex128 {
+	return a.published.Load().tree.FindTagsAppend(ret, address)
+}
+
+// FindDeepestTag finds a tag at the deepest level in the published tree - see TreeV6.FindDeepestTag
+func (a *AtomicTreeV6) FindDeepestTag(address patricia.IPv6Address) (bool, complex128, error) {
+	return a.published.Load().tree.FindDeepestTag(address)
+}
+
+// FindDeepestTags finds all tags at the deepest level in the published tree - see TreeV6.FindDeepestTags
+func (a *AtomicTreeV6) FindDeepestTags(address patricia.IPv6Address) (bool, []complex128, error) {
+	return a.published.Load().tree.FindDeepestTags(address)
+}
@@ -0,0 +1,72 @@
+package complex64_tree
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// change logs, shared by the IPv4/IPv6 trees
+// - each record is framed as a uvarint length, the record, then the record's CRC-32C, so a record cut short by a crash is noticed
+// - records say what a prefix's tags are after a change, rather than what the change was, so replaying them doesn't need
+// the match functions the changes were made with
+
+// kinds of change log record
+const (
+	// the prefix's tags, and when they expire
+	changeLogTags byte = iota + 1
+
+	// everything more specific than the prefix was deleted
+	changeLogPrune
+
+	// everything was deleted
+	changeLogClear
+
+	// expired tags were deleted, as of a time
+	changeLogSweep
+)
+
+// changeLog appends records of changes to an io.Writer
+type changeLog struct {
+	w     io.Writer
+	e     encoder // the record being built
+	frame []byte  // the framed record, as it's written out
+	err   error   // first error writing a record - once set, nothing more is written
+}
+
+// start building a record of the input kind, returning an encoder for the rest of it
+func (l *changeLog) begin(kind byte) *encoder {
+	l.e.buf = l.e.buf[:0]
+	l.e.byte(kind)
+	return &l.e
+}
+
+// write out the record that was built
+func (l *changeLog) end() {
+	if l.err != nil {
+		return
+	}
+	if l.e.err != nil {
+		l.err = l.e.err
+		return
+	}
+	l.frame = binary.AppendUvarint(l.frame[:0], uint64(len(l.e.buf)))
+	l.frame = append(l.frame, l.e.buf...)
+	l.frame = binary.BigEndian.AppendUint32(l.frame, crc32Checksum(l.e.buf))
+	_, l.err = l.w.Write(l.frame)
+}
+
+// read the next record's contents, returning false at the end of the log
+// - a record that's cut short or doesn't match its checksum is an error
+func (d *decoder) changeLogRecord(buf []byte) ([]byte, bool) {
+	if !d.fill(1) {
+		return nil, false
+	}
+	length := d.count(uint64(d.bound()), "change log record length")
+	// copied, since reading the checksum may read more from the reader
+	buf = append(buf[:0], d.bytes(length)...)
+	sum := d.uint32()
+	if d.err == nil && sum != crc32Checksum(buf) {
+		d.fail("change log record checksum mismatch")
+	}
+	return buf, d.err == nil
+}
@@ -0,0 +1,7 @@
+//go:build !patricia_debug
+
+package complex64_tree
+
+// changes only check what they have to, to not make a corrupt tree worse - build with the patricia_debug tag for the
+// rest of the tree's invariants
+const _debugChecks = false
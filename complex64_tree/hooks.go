@@ -0,0 +1,24 @@
+package complex64_tree
+
+// change hooks, shared by the IPv4/IPv6 trees
+
+// ChangeOp says how a tag changed, for change hooks
+type ChangeOp int
+
+const (
+	// ChangeAdd is a tag being added
+	ChangeAdd ChangeOp = iota + 1
+
+	// ChangeDelete is a tag being deleted, whether directly, by being replaced or evicted, or by expiring and being swept
+	ChangeDelete
+)
+
+func (o ChangeOp) String() string {
+	switch o {
+	case ChangeAdd:
+		return "add"
+	case ChangeDelete:
+		return "delete"
+	}
+	return "unknown"
+}
@@ -0,0 +1,576 @@
+package complex64_tree
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// tag storage shared by the IPv4/IPv6 trees
+
+// the fewest elements in each block a sliceArena allocates, when it isn't given one to start with
+const _sliceArenaBlockSize = 1024
+
+// sliceArena hands out copies of slices carved from larger blocks, so copying many small slices takes few allocations
+// - each copy's capacity is its length, so appending to one moves it somewhere new, rather than overwriting the next
+type sliceArena[T any] struct {
+	block []T
+}
+
+// returns a copy of src, or nil if it's empty
+func (a *sliceArena[T]) copy(src []T) []T {
+	if len(src) == 0 {
+		return nil
+	}
+	if len(src) > cap(a.block)-len(a.block) {
+		a.block = make([]T, 0, max(len(src), _sliceArenaBlockSize))
+	}
+	start := len(a.block)
+	a.block = append(a.block, src...)
+	return a.block[start:len(a.block):len(a.block)]
+}
+
+// where a node's tags are in a tree's packed tags, for trees made WithPackedTags - the node's TagCount of them, from
+// start, with room for cap of them there
+type tagSpan struct {
+	start treeIndex
+	cap   treeIndex
+}
+
+// whether a tag that expires at expiresAt (UnixNano, 0 for never) has expired as of now (UnixNano)
+func expired(expiresAt int64, now int64) bool {
+	return expiresAt != 0 && expiresAt <= now
+}
+
+// returns expiresAt as it's stored, UnixNano, or 0 if it's the zero time, for tags that don't expire
+func expiryNanos(expiresAt time.Time) int64 {
+	if expiresAt.IsZero() {
+		return 0
+	}
+	if nanos := expiresAt.UnixNano(); nanos != 0 {
+		return nanos
+	}
+	return -1 // the Unix epoch itself, which is long gone, rather than never
+}
+
+// returns slots, grown if need be to have a slot at index, with any new slots empty
+func growSlots[T any](slots []T, index uint) []T {
+	if int(index) < len(slots) {
+		return slots
+	}
+	return append(slots, make([]T, int(index)+1-len(slots))...)
+}
+
+// returns slots with room for capacity of them, without growing, copying them if need be
+func reserveSlots[T any](slots []T, capacity int) []T {
+	if cap(slots) >= capacity {
+		return slots
+	}
+	ret := make([]T, len(slots), capacity)
+	copy(ret, slots)
+	return ret
+}
+
+// what tagStorage needs to know of a tree's nodes, which keep how many tags each has, as TagCount
+type tagCounter interface {
+	// how many tags the node at the input index has - 0 if there's no such node
+	nodeTagCount(nodeIndex uint) int
+}
+
+// how a tree keeps its nodes' tags, chosen from its options by newTagStorage
+type tagLayout uint8
+
+const (
+	tagSlices tagLayout = iota // each node's tags in a slice of its own
+	tagInline                  // each node's one tag in an array alongside the nodes - see WithInlineTag
+	tagPacked                  // every node's tags together in one array - see WithPackedTags
+)
+
+// tagStorage keeps a tree's tags, and their expiration times, by node index, however the tree's options say to - the
+// tree doesn't need to know how
+// - the tree keeps each node's tag count in the node, and passes it in, as tagCount
+// - the slices may be shorter than the tree's nodes, past the last node with tags, and hold nothing for nodes without
+// - copying a tagStorage shares its storage, as a snapshot does, so a copy that's to be changed has to be made with clone
+type tagStorage struct {
+	layout tagLayout
+	intern bool   // whether nodes with the same tags share them, for tagSlices - see WithInternedTags
+	arena  *Arena // where tag slices grow into, if not the heap - see WithArena
+
+	slices [][]complex64 // each node's tags, TagCount long, for tagSlices
+	inline []complex64   // each node's tag, for tagInline
+	packed []complex64   // every node's tags, for tagPacked - see spans
+
+	spans       []tagSpan    // where each node's tags are in packed
+	interner    *tagInterner // the tag sets nodes share, when intern is set - nil until there are any
+	expirations [][]int64    // each node's tags' expiration times (UnixNano, or 0 for none) - nil for nodes with none
+	expiring    int          // how many tags have an expiration time
+}
+
+// returns empty storage, laid out as the tree's options say
+func newTagStorage(config *treeConfig) tagStorage {
+	ret := tagStorage{arena: config.arena}
+	switch {
+	case config.inlineTag:
+		ret.layout = tagInline
+	case config.packedTags:
+		ret.layout = tagPacked
+	default:
+		ret.intern = config.internTags
+	}
+	return ret
+}
+
+// returns the tags at the input node, expired or not, which belong to the storage
+func (s *tagStorage) get(nodeIndex uint, tagCount int) []complex64 {
+	if tagCount == 0 {
+		return nil
+	}
+	switch s.layout {
+	case tagInline:
+		return s.inline[nodeIndex : nodeIndex+1 : nodeIndex+1]
+	case tagPacked:
+		start, end := uint(s.spans[nodeIndex].start), uint(s.spans[nodeIndex].start)+uint(tagCount)
+		return s.packed[start:end:end]
+	}
+	return s.slices[nodeIndex]
+}
+
+// returns the expiration times of the tags at the input node, or nil if none of them expire
+func (s *tagStorage) nodeExpirations(nodeIndex uint, tagCount int) []int64 {
+	if tagCount == 0 || int(nodeIndex) >= len(s.expirations) {
+		return nil
+	}
+	return s.expirations[nodeIndex]
+}
+
+// add a tag to the end of the input node's tags, along with its expiration time (0 for none), returning whether the
+// node has one more tag - for tagInline, a node that has one already has it replaced instead
+// - returns ErrTreeFull, leaving the node as it was, if tagPacked storage has no room left for it
+func (s *tagStorage) appendTag(counts tagCounter, nodeIndex uint, tagCount int, tag complex64, expiresAt int64) (bool, error) {
+	switch s.layout {
+	case tagInline:
+		if tagCount > 0 {
+			// there's only room for the one
+			s.setTag(nodeIndex, tagCount, 0, tag, expiresAt)
+			return false, nil
+		}
+		s.inline = growSlots(s.inline, nodeIndex)
+		s.inline[nodeIndex] = tag
+	case tagPacked:
+		if err := s.appendPackedTag(counts, nodeIndex, tagCount, tag); err != nil {
+			return false, err
+		}
+	default:
+		s.own(nodeIndex, tagCount)
+		s.slices = growSlots(s.slices, nodeIndex)
+		s.slices[nodeIndex] = s.arena.appendTag(s.slices[nodeIndex][:tagCount], tag)
+		s.share(nodeIndex, tagCount+1)
+	}
+
+	expirations := s.nodeExpirations(nodeIndex, tagCount)
+	if tagCount == 0 && int(nodeIndex) < len(s.expirations) {
+		s.expirations[nodeIndex] = nil
+	}
+	if expirations != nil || expiresAt != 0 {
+		if expirations == nil {
+			expirations = make([]int64, tagCount, tagCount+1)
+			s.expirations = growSlots(s.expirations, nodeIndex)
+		}
+		s.expirations[nodeIndex] = append(expirations, expiresAt)
+		if expiresAt != 0 {
+			s.expiring++
+		}
+	}
+	return true, nil
+}
+
+// replace the input node's tag at index i, along with its expiration time (0 for none)
+func (s *tagStorage) setTag(nodeIndex uint, tagCount int, i int, tag complex64, expiresAt int64) {
+	s.own(nodeIndex, tagCount)
+	s.get(nodeIndex, tagCount)[i] = tag
+	s.share(nodeIndex, tagCount)
+	s.setExpiration(nodeIndex, tagCount, i, expiresAt)
+}
+
+// set the expiration time of the input node's tag at index i (0 for none)
+func (s *tagStorage) setExpiration(nodeIndex uint, tagCount int, i int, expiresAt int64) {
+	expirations := s.nodeExpirations(nodeIndex, tagCount)
+	if expirations == nil {
+		if expiresAt == 0 {
+			return
+		}
+		expirations = make([]int64, tagCount)
+		s.expirations = growSlots(s.expirations, nodeIndex)
+		s.expirations[nodeIndex] = expirations
+	}
+	if expirations[i] != 0 {
+		s.expiring--
+	}
+	if expiresAt != 0 {
+		s.expiring++
+	}
+	expirations[i] = expiresAt
+}
+
+// keep the tags at the input node that keep says to, in order, along with their expiration times, returning how many
+// were kept
+// - keep may replace the tag at index i before returning true
+func (s *tagStorage) keep(nodeIndex uint, tagCount int, keep func(i int, tag *complex64) bool) int {
+	s.own(nodeIndex, tagCount)
+	tags := s.get(nodeIndex, tagCount)
+	expirations := s.nodeExpirations(nodeIndex, tagCount)
+	keepCount := 0
+	for i := range tags {
+		if !keep(i, &tags[i]) {
+			if expirations != nil && expirations[i] != 0 {
+				s.expiring--
+			}
+			continue
+		}
+		tags[keepCount] = tags[i]
+		if expirations != nil {
+			expirations[keepCount] = expirations[i]
+		}
+		keepCount++
+	}
+
+	if keepCount < len(tags) {
+		// drop what the removed tags refer to, and keep the room for later ones
+		clear(tags[keepCount:])
+		s.cut(nodeIndex, tags[:keepCount])
+		if expirations != nil {
+			s.expirations[nodeIndex] = expirations[:keepCount]
+			if keepCount == 0 {
+				s.expirations[nodeIndex] = nil
+			}
+		}
+	}
+	s.share(nodeIndex, keepCount)
+	return keepCount
+}
+
+// cut the input node's tags down to tags, the first of them, where they are - or with none left, drop them, keeping
+// the room for later ones where there's a slice of them
+func (s *tagStorage) cut(nodeIndex uint, tags []complex64) {
+	switch s.layout {
+	case tagInline:
+		if len(tags) == 0 && int(nodeIndex) < len(s.inline) {
+			var zero complex64
+			s.inline[nodeIndex] = zero
+		}
+	case tagPacked:
+		if int(nodeIndex) >= len(s.spans) {
+			return
+		}
+		span := &s.spans[nodeIndex]
+		if len(tags) > 0 {
+			clear(s.packed[int(span.start)+len(tags) : span.start+span.cap])
+			return
+		}
+		clear(s.packed[span.start : span.start+span.cap])
+		*span = tagSpan{}
+	default:
+		if int(nodeIndex) < len(s.slices) {
+			s.slices[nodeIndex] = tags
+		}
+	}
+}
+
+// remove all tags from the input node, along with the room for them
+func (s *tagStorage) clearNode(nodeIndex uint, tagCount int) {
+	if tagCount == 0 {
+		return
+	}
+	for _, expiresAt := range s.nodeExpirations(nodeIndex, tagCount) {
+		if expiresAt != 0 {
+			s.expiring--
+		}
+	}
+	if int(nodeIndex) < len(s.expirations) {
+		s.expirations[nodeIndex] = nil
+	}
+	if s.layout == tagSlices {
+		if s.interner != nil {
+			s.interner.release(s.slices[nodeIndex])
+		}
+		s.slices[nodeIndex] = nil
+		return
+	}
+	s.cut(nodeIndex, nil)
+}
+
+// move all of the tags at one node, and their expiration times, to another that has none
+func (s *tagStorage) move(fromIndex uint, toIndex uint, tagCount int) {
+	if tagCount == 0 {
+		return
+	}
+	switch s.layout {
+	case tagInline:
+		var zero complex64
+		s.inline = growSlots(s.inline, toIndex)
+		s.inline[toIndex], s.inline[fromIndex] = s.inline[fromIndex], zero
+	case tagPacked:
+		s.spans = growSlots(s.spans, toIndex)
+		s.spans[toIndex], s.spans[fromIndex] = s.spans[fromIndex], tagSpan{}
+	default:
+		s.slices = growSlots(s.slices, toIndex)
+		s.slices[toIndex], s.slices[fromIndex] = s.slices[fromIndex], nil
+	}
+	if expirations := s.nodeExpirations(fromIndex, tagCount); expirations != nil {
+		s.expirations = growSlots(s.expirations, toIndex)
+		s.expirations[toIndex], s.expirations[fromIndex] = expirations, nil
+	} else if int(toIndex) < len(s.expirations) {
+		s.expirations[toIndex] = nil
+	}
+}
+
+// give the input node's tags a copy of their own, if they're shared with other nodes, so they can be changed in place
+func (s *tagStorage) own(nodeIndex uint, tagCount int) {
+	if s.interner == nil || tagCount == 0 {
+		return
+	}
+	if tags := s.slices[nodeIndex]; s.interner.release(tags) {
+		s.slices[nodeIndex] = append(make([]complex64, 0, len(tags)+1), tags...)
+	}
+}
+
+// share the input node's tags with other nodes that have the same ones, when the storage interns them, once they've
+// been changed
+func (s *tagStorage) share(nodeIndex uint, tagCount int) {
+	if !s.intern || tagCount == 0 {
+		return
+	}
+	if s.interner == nil {
+		s.interner = newTagInterner()
+	}
+	s.slices[nodeIndex] = s.interner.intern(s.slices[nodeIndex])
+}
+
+// share the tags of nodes that have the same ones, when the storage interns them, once they've been loaded or copied
+// in without
+func (s *tagStorage) internAll(counts tagCounter) {
+	s.interner = nil
+	for nodeIndex := range s.slices {
+		s.share(uint(nodeIndex), counts.nodeTagCount(uint(nodeIndex)))
+	}
+}
+
+// take the tags at every node, loaded into slices of their own, into the storage, which has none yet
+// - fails if the storage holds one tag per node, and a node has more than one, or if it's tagPacked, and they don't fit
+func (s *tagStorage) load(slices [][]complex64, counts tagCounter) error {
+	switch s.layout {
+	case tagInline:
+		s.inline = make([]complex64, len(slices))
+		for nodeIndex, tags := range slices {
+			if counts.nodeTagCount(uint(nodeIndex)) == 0 {
+				continue
+			}
+			if len(tags) > 1 {
+				return fmt.Errorf("%d tags at node %d, but the tree holds one tag per prefix", len(tags), nodeIndex)
+			}
+			s.inline[nodeIndex] = tags[0]
+		}
+	case tagPacked:
+		tagCount := 0
+		for nodeIndex, tags := range slices {
+			if counts.nodeTagCount(uint(nodeIndex)) > 0 {
+				tagCount += len(tags)
+			}
+		}
+		if !s.hasRoom(tagCount) {
+			return fmt.Errorf("%w: %d tags are too many for a tree made WithPackedTags", ErrTreeFull, tagCount)
+		}
+		s.packed = make([]complex64, 0, tagCount)
+		s.spans = make([]tagSpan, len(slices))
+		for nodeIndex, tags := range slices {
+			if counts.nodeTagCount(uint(nodeIndex)) > 0 {
+				s.spans[nodeIndex] = tagSpan{start: treeIndex(len(s.packed)), cap: treeIndex(len(tags))}
+				s.packed = append(s.packed, tags...)
+			}
+		}
+	default:
+		s.slices = slices
+	}
+	return nil
+}
+
+// copies of tags and their expiration times, carved out of a few large blocks rather than allocated one by one
+type tagCopier struct {
+	tags        sliceArena[complex64]
+	expirations sliceArena[int64]
+}
+
+// returns empty storage laid out like this, sharing its interned tag sets, for copyNode to copy nodes' tags into
+func (s *tagStorage) emptyCopy() tagStorage {
+	return tagStorage{layout: s.layout, intern: s.intern, arena: s.arena, interner: s.interner.clone()}
+}
+
+// copy the tags at node fromIndex in src, and their expiration times, to node toIndex, which has none
+// - src can be laid out differently, as long as it has no more than one tag at the node when this is tagInline
+// - interned tags are shared, and copies of the rest are carved out of copier's blocks - or with a nil copier, src's
+// slices are taken over rather than copied, so src mustn't be changed afterwards
+// - shared interned tags must be interned here too, or never be changed in place - see share
+// - the caller makes sure tagPacked storage has room for them - see hasRoom
+func (s *tagStorage) copyNode(src *tagStorage, fromIndex uint, toIndex uint, tagCount int, copier *tagCopier) {
+	if tagCount == 0 {
+		return
+	}
+	tags := src.get(fromIndex, tagCount)
+	switch s.layout {
+	case tagInline:
+		s.inline = growSlots(s.inline, toIndex)
+		s.inline[toIndex] = tags[0]
+	case tagPacked:
+		s.spans = growSlots(s.spans, toIndex)
+		s.spans[toIndex] = tagSpan{start: treeIndex(len(s.packed)), cap: treeIndex(len(tags))}
+		s.packed = append(s.packed, tags...)
+	default:
+		if copier != nil && (src.interner == nil || !src.interner.holds(tags)) {
+			// interned tags are never changed in place, so they can be shared
+			tags = copier.tags.copy(tags)
+		}
+		s.slices = growSlots(s.slices, toIndex)
+		s.slices[toIndex] = tags
+	}
+	if expirations := src.nodeExpirations(fromIndex, tagCount); expirations != nil {
+		if copier != nil {
+			expirations = copier.expirations.copy(expirations)
+		}
+		s.expirations = growSlots(s.expirations, toIndex)
+		s.expirations[toIndex] = expirations
+		for _, expiresAt := range expirations {
+			if expiresAt != 0 {
+				s.expiring++
+			}
+		}
+	}
+}
+
+// returns a copy of the storage, holding tags for nodeCount nodes, that shares nothing with it that either changes in
+// place - the tags themselves are copied by assignment, and tagPacked storage leaves out the room they don't use
+func (s *tagStorage) clone(counts tagCounter, nodeCount int) tagStorage {
+	ret := s.emptyCopy()
+	ret.reserve(nodeCount)
+	if s.layout == tagPacked {
+		ret.packed = make([]complex64, 0, len(s.packed))
+	}
+	var copier tagCopier
+	for nodeIndex := 0; nodeIndex < nodeCount; nodeIndex++ {
+		ret.copyNode(s, uint(nodeIndex), uint(nodeIndex), counts.nodeTagCount(uint(nodeIndex)), &copier)
+	}
+	return ret
+}
+
+// make room for the tags of capacity nodes, without growing, in the layouts that keep a slot for each node
+func (s *tagStorage) reserve(capacity int) {
+	switch s.layout {
+	case tagInline:
+		s.inline = reserveSlots(s.inline, capacity)
+	case tagPacked:
+		s.spans = reserveSlots(s.spans, capacity)
+	default:
+		s.slices = reserveSlots(s.slices, capacity)
+	}
+}
+
+// remove every tag, keeping the room for them
+func (s *tagStorage) reset() {
+	clear(s.slices)
+	s.slices = s.slices[:0]
+	clear(s.inline)
+	s.inline = s.inline[:0]
+	clear(s.packed)
+	s.packed = s.packed[:0]
+	clear(s.spans)
+	s.spans = s.spans[:0]
+	s.interner = nil
+	clear(s.expirations)
+	s.expirations = s.expirations[:0]
+	s.expiring = 0
+}
+
+// roughly how many bytes the tags and their expiration times take, counting shared tags once
+func (s *tagStorage) bytes() int {
+	var zero complex64
+	ret := (cap(s.slices) + cap(s.expirations)) * int(unsafe.Sizeof([]complex64(nil)))
+	ret += (cap(s.inline) + cap(s.packed)) * int(unsafe.Sizeof(zero))
+	ret += cap(s.spans) * int(unsafe.Sizeof(tagSpan{}))
+	for _, tags := range s.slices {
+		if s.interner == nil || !s.interner.holds(tags) {
+			ret += cap(tags) * int(unsafe.Sizeof(zero))
+		}
+	}
+	if s.interner != nil {
+		ret += s.interner.bytes()
+	}
+	for _, expirations := range s.expirations {
+		ret += cap(expirations) * int(unsafe.Sizeof(int64(0)))
+	}
+	return ret
+}
+
+// whether count more tags fit, which they always do unless they're packed, where the array holds as many as a
+// treeIndex can address
+func (s *tagStorage) hasRoom(count int) bool {
+	return s.layout != tagPacked || uint64(len(s.packed))+uint64(count) <= _maxTreeIndex
+}
+
+// add a tag after the tagCount tags at the input node, for tagPacked storage
+// - a node that's used up its room keeps it if it's at the end of the array, and otherwise moves to the end with twice
+// as much
+// - the room nodes have moved out of is taken back, if there's not enough at the end without it, and if there still
+// isn't, returns ErrTreeFull, leaving the node as it was
+func (s *tagStorage) appendPackedTag(counts tagCounter, nodeIndex uint, tagCount int, tag complex64) error {
+	s.spans = growSlots(s.spans, nodeIndex)
+	if tagCount == int(s.spans[nodeIndex].cap) && !s.hasRoom(tagCount+1) {
+		s.repack(counts)
+	}
+	span := &s.spans[nodeIndex]
+	switch {
+	case tagCount < int(span.cap):
+	case span.cap > 0 && uint(span.start)+uint(span.cap) == uint(len(s.packed)):
+		if _, err := s.packedRoom(1, 1); err != nil {
+			return err
+		}
+		span.cap++
+	default:
+		moved, err := s.packedRoom(tagCount+1, max(2*tagCount, 1))
+		if err != nil {
+			return err
+		}
+		copy(s.packed[moved.start:], s.packed[span.start:uint(span.start)+uint(tagCount)])
+		clear(s.packed[span.start : span.start+span.cap])
+		*span = moved
+	}
+	s.packed[uint(span.start)+uint(tagCount)] = tag
+	return nil
+}
+
+// make room for count tags at the end of the packed tags, returning where it is, with room for capacity of them
+// - returns ErrTreeFull if the array would hold more than a treeIndex can address
+func (s *tagStorage) packedRoom(count int, capacity int) (tagSpan, error) {
+	if !s.hasRoom(capacity) {
+		capacity = count
+		if !s.hasRoom(count) {
+			return tagSpan{}, fmt.Errorf("%w: no room for %d more tags in a tree made WithPackedTags", ErrTreeFull, count)
+		}
+	}
+	start := len(s.packed)
+	s.packed = append(s.packed, make([]complex64, capacity)...)
+	return tagSpan{start: treeIndex(start), cap: treeIndex(capacity)}, nil
+}
+
+// copy the packed tags into a new array, leaving out the room they don't use
+func (s *tagStorage) repack(counts tagCounter) {
+	packed := make([]complex64, 0, len(s.packed))
+	for nodeIndex := range s.spans {
+		tags := s.get(uint(nodeIndex), counts.nodeTagCount(uint(nodeIndex)))
+		if len(tags) == 0 {
+			s.spans[nodeIndex] = tagSpan{}
+			continue
+		}
+		s.spans[nodeIndex] = tagSpan{start: treeIndex(len(packed)), cap: treeIndex(len(tags))}
+		packed = append(packed, tags...)
+	}
+	s.packed = packed
+}
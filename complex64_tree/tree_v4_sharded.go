@@ -0,0 +1,196 @@
+package complex64_tree
+
+import (
+	"iter"
+
+	"github.com/kentik/patricia"
+)
+
+// the most shards a ShardedTreeV4 can have, as bits of the address
+const _maxShardBitsV4 = 8
+
+// ShardedTreeV4 is a tree that's safe for concurrent use, split into shards by the top bits of the address, each with
+// its own lock, so writers to different parts of the address space don't wait on each other
+// - prefixes shorter than the shard bits cover more than one shard, so they're kept together in one more tree, with
+// its own lock - these are usually few, and rarely change
+// - lookups go to the shard for the address, and the tree of short prefixes, and give the same results as a TreeV4 would
+// - walk functions are called with a shard's read lock held, so they must not change this tree
+type ShardedTreeV4 struct {
+	bits   uint
+	short  *SafeTreeV4 // prefixes shorter than bits
+	shards []*SafeTreeV4
+}
+
+// NewShardedTreeV4 returns a new, empty tree, split into 1<<shardBits shards
+// - shardBits is capped at 8, for 256 shards
+// - the options apply to each shard
+func NewShardedTreeV4(shardBits uint, options ...TreeOption) *ShardedTreeV4 {
+	if shardBits > _maxShardBitsV4 {
+		shardBits = _maxShardBitsV4
+	}
+	ret := &ShardedTreeV4{
+		bits:   shardBits,
+		short:  NewSafeTreeV4(options...),
+		shards: make([]*SafeTreeV4, 1<<shardBits),
+	}
+	for i := range ret.shards {
+		ret.shards[i] = NewSafeTreeV4(options...)
+	}
+	return ret
+}
+
+// the tree that holds the prefix
+func (s *ShardedTreeV4) shard(address patricia.IPv4Address) *SafeTreeV4 {
+	if address.Length < s.bits {
+		return s.short
+	}
+	return s.shards[shardIndexV4(address, s.bits)]
+}
+
+// ShardCount returns how many shards the tree is split into
+func (s *ShardedTreeV4) ShardCount() int {
+	return len(s.shards)
+}
+
+// Clear removes everything from the tree - see TreeV4.Clear
+// - each shard is cleared in turn, so concurrent readers can see some shards cleared and others not
+func (s *ShardedTreeV4) Clear() error {
+	if err := s.short.Clear(); err != nil {
+		return err
+	}
+	for _, shard := range s.shards {
+		if err := shard.Clear(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountTags returns the number of tags in the tree - see TreeV4.CountTags
+func (s *ShardedTreeV4) CountTags() int {
+	return s.TagCount()
+}
+
+// Size returns the number of nodes in use, across all the shards, each of which has a root - see TreeV4.Size
+func (s *ShardedTreeV4) Size() int {
+	ret := s.short.Size()
+	for _, shard := range s.shards {
+		ret += shard.Size()
+	}
+	return ret
+}
+
+// PrefixCount returns the number of prefixes with tags - see TreeV4.PrefixCount
+func (s *ShardedTreeV4) PrefixCount() int {
+	ret := s.short.PrefixCount()
+	for _, shard := range s.shards {
+		ret += shard.PrefixCount()
+	}
+	return ret
+}
+
+// TagCount returns the number of tags in the tree - see TreeV4.TagCount
+func (s *ShardedTreeV4) TagCount() int {
+	ret := s.short.TagCount()
+	for _, shard := range s.shards {
+		ret += shard.TagCount()
+	}
+	return ret
+}
+
+// Set sets the single value for a node - see TreeV4.Set
+func (s *ShardedTreeV4) Set(address patricia.IPv4Address, tag complex64) (bool, int, error) {
+	return s.shard(address).Set(address, tag)
+}
+
+// Add adds a tag to the tree - see TreeV4.Add
+func (s *ShardedTreeV4) Add(address patricia.IPv4Address, tag complex64, matchFunc MatchesFunc) (bool, int, error) {
+	return s.shard(address).Add(address, tag, matchFunc)
+}
+
+// Delete removes tags from the tree - see TreeV4.Delete
+func (s *ShardedTreeV4) Delete(address patricia.IPv4Address, matchFunc MatchesFunc, matchVal complex64) (int, error) {
+	return s.shard(address).Delete(address, matchFunc, matchVal)
+}
+
+// Sweep removes expired tags - see TreeV4.Sweep
+func (s *ShardedTreeV4) Sweep() int {
+	ret := s.short.Sweep()
+	for _, shard := range s.shards {
+		ret += shard.Sweep()
+	}
+	return ret
+}
+
+// FindTags finds all matching tags for the address - see TreeV4.FindTags
+func (s *ShardedTreeV4) FindTags(address patricia.IPv4Address) ([]complex64, error) {
+	ret := s.FindTagsAppend(make([]complex64, 0), address)
+	return ret, nil
+}
+
+// FindTagsAppend finds all matching tags for the address and appends them to ret - see TreeV4.FindTagsAppend
+func (s *ShardedTreeV4) FindTagsAppend(ret []complex64, address patricia.IPv4Address) []complex64 {
+	// the short prefixes are the shallower matches, so their tags come first
+	ret = s.short.FindTagsAppend(ret, address)
+	if address.Length >= s.bits {
+		ret = s.shards[shardIndexV4(address, s.bits)].FindTagsAppend(ret, address)
+	}
+	return ret
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree - see TreeV4.FindDeepestTag
+func (s *ShardedTreeV4) FindDeepestTag(address patricia.IPv4Address) (bool, complex64, error) {
+	if address.Length >= s.bits {
+		found, tag, err := s.shards[shardIndexV4(address, s.bits)].FindDeepestTag(address)
+		if found || err != nil {
+			return found, tag, err
+		}
+	}
+	return s.short.FindDeepestTag(address)
+}
+
+// FindDeepestTags finds all tags at the deepest level in the tree - see TreeV4.FindDeepestTags
+func (s *ShardedTreeV4) FindDeepestTags(address patricia.IPv4Address) (bool, []complex64, error) {
+	if address.Length >= s.bits {
+		found, tags, err := s.shards[shardIndexV4(address, s.bits)].FindDeepestTags(address)
+		if found || err != nil {
+			return found, tags, err
+		}
+	}
+	return s.short.FindDeepestTags(address)
+}
+
+// Walk calls walkFunc for every prefix in the tree that has tags, in the same order as TreeV4.Walk
+// - each shard is walked in turn, so this isn't a consistent view of the whole tree if it's changing
+func (s *ShardedTreeV4) Walk(walkFunc func(prefix patricia.IPv4Address, tags []complex64) bool) {
+	// each short prefix comes right before the shard it starts in, so gather them up first
+	var short []EntryV4
+	s.short.Walk(func(prefix patricia.IPv4Address, tags []complex64) bool {
+		short = append(short, EntryV4{Prefix: prefix, Tags: tags})
+		return true
+	})
+
+	for shardIndex, shard := range s.shards {
+		for len(short) > 0 && shardIndexV4(short[0].Prefix, s.bits) == shardIndex {
+			if !walkFunc(short[0].Prefix, short[0].Tags) {
+				return
+			}
+			short = short[1:]
+		}
+		keepWalking := true
+		shard.Walk(func(prefix patricia.IPv4Address, tags []complex64) bool {
+			keepWalking = walkFunc(prefix, tags)
+			return keepWalking
+		})
+		if !keepWalking {
+			return
+		}
+	}
+}
+
+// All returns an iterator over every prefix in the tree that has tags - see Walk
+func (s *ShardedTreeV4) All() iter.Seq2[patricia.IPv4Address, []complex64] {
+	return func(yield func(patricia.IPv4Address, []complex64) bool) {
+		s.Walk(yield)
+	}
+}
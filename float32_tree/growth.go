@@ -0,0 +1,32 @@
+package float32_tree
+
+// node array growth, shared by the IPv4/IPv6 trees
+
+// the default factor the node array's capacity is multiplied by when it's full
+const _defaultGrowthFactor = 2.0
+
+// WithGrowthPolicy sets how the node array grows when adds run out of room: its capacity is multiplied by factor, but
+// grows by no more than maxStep nodes at a time
+// - a factor of 1 or less uses the default, doubling the capacity
+// - a maxStep of 0 or less doesn't cap the growth - capping it saves memory in very large trees, at the cost of copying
+// the array more often
+// - Reserve sizes the array up front, for trees whose size is known
+func WithGrowthPolicy(factor float64, maxStep int) TreeOption {
+	return func(c *treeConfig) {
+		c.growthFactor = factor
+		c.maxGrowthStep = maxStep
+	}
+}
+
+// the capacity to grow a node array with the input capacity to, so it holds at least need nodes
+func (c *treeConfig) grownCapacity(capacity int, need int) int {
+	factor := c.growthFactor
+	if factor <= 1 {
+		factor = _defaultGrowthFactor
+	}
+	ret := int(float64(capacity+1) * factor)
+	if c.maxGrowthStep > 0 && ret > capacity+c.maxGrowthStep {
+		ret = capacity + c.maxGrowthStep
+	}
+	return max(ret, need)
+}
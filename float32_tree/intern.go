@@ -0,0 +1,130 @@
+package float32_tree
+
+import "unsafe"
+
+// tag set interning, shared by the IPv4/IPv6 trees - see WithInternedTags
+
+// tagInterner holds the distinct tag sets of a tree made WithInternedTags, which nodes with the same tags share
+// - sets are looked up by their first tag and length, then compared tag by tag, with ==
+// - the sets are never changed in place, so nodes - and clones - can share them, and each is counted by how many nodes
+// refer to it, and forgotten once none do
+type tagInterner struct {
+	sets map[internKey][]*internedTags
+}
+
+// the sets that might be equal to a set of tags
+type internKey struct {
+	first float32
+	count int
+}
+
+// a set of tags that nodes share, and how many of them do
+type internedTags struct {
+	tags []float32 // capacity is its length, so appending to it moves it somewhere new
+	refs int
+}
+
+func newTagInterner() *tagInterner {
+	return &tagInterner{sets: make(map[internKey][]*internedTags)}
+}
+
+// returns the set equal to tags, adding a copy of tags if there isn't one, and counts a reference to it
+// - a set starting with a tag that isn't equal to itself, like a NaN, can't be looked up, so is returned as it is
+func (in *tagInterner) intern(tags []float32) []float32 {
+	if len(tags) == 0 || tags[0] != tags[0] {
+		return tags
+	}
+	key := internKey{first: tags[0], count: len(tags)}
+	for _, set := range in.sets[key] {
+		if equalTagSets(set.tags, tags) {
+			set.refs++
+			return set.tags
+		}
+	}
+	set := &internedTags{tags: append(make([]float32, 0, len(tags)), tags...), refs: 1}
+	in.sets[key] = append(in.sets[key], set)
+	return set.tags
+}
+
+// drops a reference to tags, if it's one of the sets - not just equal to one - forgetting the set once nothing refers
+// to it, and returns whether it was
+func (in *tagInterner) release(tags []float32) bool {
+	key, i := in.find(tags)
+	if i < 0 {
+		return false
+	}
+	sets := in.sets[key]
+	if sets[i].refs--; sets[i].refs > 0 {
+		return true
+	}
+	sets[i] = sets[len(sets)-1]
+	sets[len(sets)-1] = nil
+	if sets = sets[:len(sets)-1]; len(sets) == 0 {
+		delete(in.sets, key)
+	} else {
+		in.sets[key] = sets
+	}
+	return true
+}
+
+// whether tags is one of the sets, not just equal to one
+func (in *tagInterner) holds(tags []float32) bool {
+	_, i := in.find(tags)
+	return i >= 0
+}
+
+// returns where tags is among the sets, or an index of -1 if it isn't one of them
+func (in *tagInterner) find(tags []float32) (internKey, int) {
+	if len(tags) == 0 || tags[0] != tags[0] {
+		return internKey{}, -1
+	}
+	key := internKey{first: tags[0], count: len(tags)}
+	for i, set := range in.sets[key] {
+		if &set.tags[0] == &tags[0] {
+			return key, i
+		}
+	}
+	return key, -1
+}
+
+// returns a copy of the interner, sharing its sets, which are never changed in place - nil for nil
+func (in *tagInterner) clone() *tagInterner {
+	if in == nil {
+		return nil
+	}
+	ret := &tagInterner{sets: make(map[internKey][]*internedTags, len(in.sets))}
+	for key, sets := range in.sets {
+		copies := make([]*internedTags, len(sets))
+		for i, set := range sets {
+			copies[i] = &internedTags{tags: set.tags, refs: set.refs}
+		}
+		ret.sets[key] = copies
+	}
+	return ret
+}
+
+// roughly how many bytes the sets, and the table of them, take
+func (in *tagInterner) bytes() int {
+	var zero float32
+	ret := 0
+	for _, sets := range in.sets {
+		ret += int(unsafe.Sizeof(internKey{})) + int(unsafe.Sizeof(sets)) + cap(sets)*int(unsafe.Sizeof(&internedTags{}))
+		for _, set := range sets {
+			ret += int(unsafe.Sizeof(*set)) + cap(set.tags)*int(unsafe.Sizeof(zero))
+		}
+	}
+	return ret
+}
+
+// whether two sets of tags are the same, tag by tag, in order
+func equalTagSets(a []float32, b []float32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package float32_tree
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONFloats(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(patricia.NewIPv4Address(0, 0), 0.1, nil)
+	tree.Add(patricia.NewIPv4Address(10<<24, 8), float32(math.NaN()), nil)
+	tree.Add(patricia.NewIPv4Address(10<<24, 8), float32(math.Inf(1)), nil)
+	tree.Add(patricia.NewIPv4Address(10<<24|1<<16, 16), float32(math.Inf(-1)), nil)
+
+	// numbers JSON has no numbers for are strings
+	data, err := json.Marshal(tree)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"cidr":"0.0.0.0/0","tags":[0.1]},{"cidr":"10.0.0.0/8","tags":["NaN","+Inf"]},`+
+		`{"cidr":"10.1.0.0/16","tags":["-Inf"]}]`, string(data))
+
+	decoded := NewTreeV4()
+	assert.NoError(t, json.Unmarshal(data, decoded))
+	tags, err := decoded.FindTags(patricia.NewIPv4Address(10<<24|1<<16|1, 32))
+	assert.NoError(t, err)
+	if assert.Equal(t, 4, len(tags)) {
+		assert.Equal(t, float32(0.1), tags[0])
+		assert.True(t, math.IsNaN(float64(tags[1])))
+		assert.True(t, math.IsInf(float64(tags[2]), 1))
+		assert.True(t, math.IsInf(float64(tags[3]), -1))
+	}
+
+	// strings that aren't numbers aren't floats
+	assert.Error(t, json.Unmarshal([]byte(`[{"cidr":"10.0.0.0/8","tags":["nope"]}]`), decoded))
+	assert.Error(t, json.Unmarshal([]byte(`[{"cidr":"10.0.0.0/8","tags":[true]}]`), decoded))
+	assert.Equal(t, 4, decoded.CountTags())
+}
@@ -0,0 +1,44 @@
+package float32_tree
+
+// MemoryStats breaks down the memory a tree's storage takes, in bytes, for sizing instances - see TreeV4.MemoryStats
+// - capacity that's allocated but not in use counts towards the bytes, as it takes memory all the same
+// - tag values are counted by their size in the tree's storage, not what they point to, such as strings' contents
+type MemoryStats struct {
+	// Nodes is the node array's length, including free nodes, NodeCapacity its capacity, and NodeBytes the bytes its
+	// capacity takes
+	Nodes        int
+	NodeCapacity int
+	NodeBytes    int
+
+	// FreeNodes is how many nodes have been deleted and are waiting for reuse, and FreeListBytes the bytes the list of them takes
+	FreeNodes     int
+	FreeListBytes int
+
+	// Tags is how many tags the tree holds, and TagBytes the bytes the tags, their expiration times, and the slices
+	// holding them take
+	Tags     int
+	TagBytes int
+
+	// Prefixes is how many prefixes have tags
+	Prefixes int
+
+	// TotalBytes is the bytes the tree's storage takes in all
+	TotalBytes int
+}
+
+// BytesPerPrefix is the average bytes each prefix with tags takes, counting its share of the nodes, free nodes, and
+// spare capacity - multiply by an expected prefix count to estimate the memory a tree of that size needs
+func (s MemoryStats) BytesPerPrefix() float64 {
+	if s.Prefixes == 0 {
+		return 0
+	}
+	return float64(s.TotalBytes) / float64(s.Prefixes)
+}
+
+// BytesPerTag is the average bytes each tag takes, counted the same way as BytesPerPrefix
+func (s MemoryStats) BytesPerTag() float64 {
+	if s.Tags == 0 {
+		return 0
+	}
+	return float64(s.TotalBytes) / float64(s.Tags)
+}
@@ -0,0 +1,51 @@
+package float32_tree
+
+import (
+	"fmt"
+	"strings"
+)
+
+// routing table text export shared by the IPv4/IPv6 trees
+
+// RouteStyle is the text format that WriteRoutes writes routes in
+type RouteStyle int
+
+const (
+	// RouteStyleIP writes routes like `ip route show`: "10.0.0.0/8 via 192.0.2.1 # comment"
+	RouteStyleIP RouteStyle = iota
+
+	// RouteStyleBIRD writes routes like BIRD's static protocol: "route 10.0.0.0/8 via 192.0.2.1; # comment"
+	RouteStyleBIRD
+)
+
+// RouteFormatFunc returns how a tag is written as a route: what follows the prefix, such as "via 192.0.2.1 dev eth0",
+// and a comment to go after it
+// - either can be empty, leaving it out
+type RouteFormatFunc func(tag float32) (route string, comment string)
+
+// the default RouteFormatFunc: just the tag, as a comment
+func formatRouteTag(tag float32) (string, string) {
+	return "", fmt.Sprint(tag)
+}
+
+// return a route's line, without its newline
+func (s RouteStyle) line(prefix string, route string, comment string) string {
+	var b strings.Builder
+	if s == RouteStyleBIRD {
+		b.WriteString("route ")
+	}
+	b.WriteString(prefix)
+	if route != "" {
+		b.WriteByte(' ')
+		b.WriteString(route)
+	}
+	if s == RouteStyleBIRD {
+		b.WriteByte(';')
+	}
+	if comment != "" {
+		// a line break in the comment would start a new line that's not a route
+		b.WriteString(" # ")
+		b.WriteString(strings.Join(strings.Fields(comment), " "))
+	}
+	return b.String()
+}
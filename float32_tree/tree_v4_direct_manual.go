@@ -0,0 +1,102 @@
+package float32_tree
+
+import "github.com/kentik/patricia"
+
+// this is IPv4-only: a table over the first 24 bits of IPv6 addresses wouldn't cover enough of them to help
+
+// the bits of the address a DirectTreeV4's table is indexed by
+const _directBitsV4 = 24
+
+// set in a DirectTreeV4's table entry when prefixes longer than /24 start in its /24, so lookups there need the trie
+const _directFallbackV4 = uint32(1 << 31)
+
+// DirectTreeV4 is an OptimizedTreeV4 with a table indexed by the first 24 bits of the address in front of it, DIR-24-8
+// style, so most lookups of full addresses are a single read of the table - see TreeV4.OptimizeDirect
+// - the table holds the deepest prefix, up to /24, for each /24, and lookups in a /24 with longer prefixes in it, or of
+// addresses shorter than /24, go to the trie instead
+// - the table has 16M entries, taking 64MB, whatever the size of the tree
+// - safe for concurrent use
+type DirectTreeV4 struct {
+	*OptimizedTreeV4
+	table []uint32
+}
+
+// OptimizeDirect returns a read-only copy of the tree like Optimize, along with a table indexed by the first 24 bits of
+// the address, for line-rate lookups in large routing tables - see DirectTreeV4
+func (t *TreeV4) OptimizeDirect() *DirectTreeV4 {
+	optimized, entries := t.optimize()
+	ret := &DirectTreeV4{OptimizedTreeV4: optimized, table: make([]uint32, 1<<_directBitsV4)}
+
+	// the prefixes up to /24 cover runs of the table, the deepest taking precedence - being in order, each one comes
+	// after those holding it, so the table is filled in one pass, keeping track of the prefixes it's inside of
+	type span struct {
+		index uint32
+		end   uint32
+	}
+	var inside []span
+	next := uint32(0)
+	fillTo := func(end uint32) {
+		index := optimized.root
+		if len(inside) > 0 {
+			index = inside[len(inside)-1].index
+		}
+		for ; next < end; next++ {
+			ret.table[next] = index
+		}
+	}
+	for _, entry := range entries {
+		if entry.address.Length > _directBitsV4 {
+			continue
+		}
+		start := entry.address.Address >> (32 - _directBitsV4)
+		for len(inside) > 0 && inside[len(inside)-1].end <= start {
+			fillTo(inside[len(inside)-1].end)
+			inside = inside[:len(inside)-1]
+		}
+		fillTo(start)
+		inside = append(inside, span{index: entry.index, end: start + 1<<(_directBitsV4-entry.address.Length)})
+	}
+	for len(inside) > 0 {
+		fillTo(inside[len(inside)-1].end)
+		inside = inside[:len(inside)-1]
+	}
+	fillTo(1 << _directBitsV4)
+
+	for _, entry := range entries {
+		if entry.address.Length > _directBitsV4 {
+			ret.table[entry.address.Address>>(32-_directBitsV4)] |= _directFallbackV4
+		}
+	}
+	return ret
+}
+
+// the index of the deepest prefix holding the address, or 0 if there isn't one
+func (d *DirectTreeV4) find(address patricia.IPv4Address) uint32 {
+	if address.Length >= _directBitsV4 {
+		if entry := d.table[address.Address>>(32-_directBitsV4)]; entry&_directFallbackV4 == 0 {
+			return entry
+		}
+	}
+	return d.OptimizedTreeV4.find(address)
+}
+
+// FindTags finds all matching tags for the address, like TreeV4.FindTags
+func (d *DirectTreeV4) FindTags(address patricia.IPv4Address) []float32 {
+	return d.appendTags(make([]float32, 0), d.find(address))
+}
+
+// FindTagsAppend finds all matching tags for the address and appends them to ret, like TreeV4.FindTagsAppend
+func (d *DirectTreeV4) FindTagsAppend(ret []float32, address patricia.IPv4Address) []float32 {
+	return d.appendTags(ret, d.find(address))
+}
+
+// FindDeepestTag finds a tag at the deepest level in the tree, like TreeV4.FindDeepestTag
+func (d *DirectTreeV4) FindDeepestTag(address patricia.IPv4Address) (bool, float32) {
+	return d.deepestTag(d.find(address))
+}
+
+// FindDeepestTags finds all tags at the deepest level in the tree, like TreeV4.FindDeepestTags
+// - the returned slice belongs to the tree, and must not be changed
+func (d *DirectTreeV4) FindDeepestTags(address patricia.IPv4Address) (bool, []float32) {
+	return d.deepestTags(d.find(address))
+}
@@ -1,6 +1,7 @@
 package float32_tree
 
 import (
+	"encoding/binary"
 	"fmt"
 
 	"github.com/kentik/patricia"
@@ -8,22 +9,89 @@ import (
 
 // this is IPv4 tree code that's not very copy/paste friendly for when we transfer IPv4 code to IPv6
 
+// the CBOR tag for an IPv4 prefix, from RFC 9164
+const _cborPrefixTagV4 = 52
+
 // create a new node in the tree, return its index
-func (t *TreeV4) newNode(address patricia.IPv4Address, prefixLength uint) uint {
+// - returns ErrTreeFull, if there's no index left for it
+func (t *TreeV4) newNode(address patricia.IPv4Address, prefixLength uint) (uint, error) {
 	availCount := len(t.availableIndexes)
 	if availCount > 0 {
-		index := t.availableIndexes[availCount-1]
+		index := uint(t.availableIndexes[availCount-1])
 		t.availableIndexes = t.availableIndexes[:availCount-1]
-		t.nodes[index] = treeNodeV4{prefix: address.Address, prefixLength: prefixLength}
-		return index
+		t.nodes[index] = treeNodeV4{prefix: packPrefixV4(address.Address, prefixLength)}
+		return index, nil
+	}
+
+	if uint64(len(t.nodes)) > _maxTreeIndex {
+		return 0, fmt.Errorf("%w: it can't hold more than %d nodes - see treeIndex", ErrTreeFull, len(t.nodes))
+	}
+	if len(t.nodes) == cap(t.nodes) {
+		t.growNodes()
+	}
+	t.nodes = append(t.nodes, treeNodeV4{prefix: packPrefixV4(address.Address, prefixLength)})
+	return uint(len(t.nodes) - 1), nil
+}
+
+// make sure the input address is one the tree can hold
+func (t *TreeV4) validateAddress(address patricia.IPv4Address) error {
+	if address.Length > 32 {
+		return fmt.Errorf("invalid prefix length %d for address %s: must be <= 32", address.Length, address)
+	}
+	return nil
+}
+
+// parse an IPv4 prefix in CIDR notation
+func (t *TreeV4) parseAddress(cidr string) (patricia.IPv4Address, error) {
+	v4, _, err := patricia.ParseIPFromString(cidr)
+	if err != nil {
+		return patricia.IPv4Address{}, err
+	}
+	if v4 == nil {
+		return patricia.IPv4Address{}, fmt.Errorf("%q isn't an IPv4 prefix", cidr)
 	}
+	return *v4, nil
+}
 
-	t.nodes = append(t.nodes, treeNodeV4{prefix: address.Address, prefixLength: prefixLength})
-	return uint(len(t.nodes) - 1)
+// the address's bytes, in network byte order
+func (t *TreeV4) addressBytes(address patricia.IPv4Address) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, address.Address)
+	return data
+}
+
+// build an address from its bytes, in network byte order, and prefix length
+func (t *TreeV4) addressFromBytes(data []byte, length uint) (patricia.IPv4Address, error) {
+	if len(data) == 0 {
+		// an all-zero address can be left out entirely
+		data = make([]byte, 4)
+	}
+	if len(data) != 4 {
+		return patricia.IPv4Address{}, fmt.Errorf("%d byte address isn't IPv4", len(data))
+	}
+	if length > 32 {
+		return patricia.IPv4Address{}, fmt.Errorf("prefix length %d is out of range", length)
+	}
+	return patricia.NewIPv4AddressFromBytes(data, length), nil
 }
 
 func (t *TreeV4) print() {
 	for i := range t.nodes {
-		fmt.Printf("%d: \tleft: %d, right: %d, prefix: %032b (%d), tags: (%d): %v\n", i, int(t.nodes[i].Left), int(t.nodes[i].Right), int(t.nodes[i].prefix), int(t.nodes[i].prefixLength), t.nodes[i].TagCount, t.tagsForNode(uint(i)))
+		fmt.Printf("%d: \tleft: %d, right: %d, prefix: %032b (%d), tags: (%d): %v\n", i, int(t.nodes[i].Left), int(t.nodes[i].Right), int(t.nodes[i].prefixBits()), int(t.nodes[i].length()), t.nodes[i].TagCount, t.tagsForNode(uint(i)))
 	}
 }
+
+// which of 1<<bits shards the address belongs in, going by its top bits
+func shardIndexV4(address patricia.IPv4Address, bits uint) int {
+	return int(address.Address >> (32 - bits))
+}
+
+// a hash of the address, with its length, whose top bits are spread evenly - see LookupCacheV4
+func hashAddressV4(address patricia.IPv4Address) uint64 {
+	return (uint64(address.Address)<<8 | uint64(address.Length)) * 0x9e3779b97f4a7c15
+}
+
+// the address, cut down to the first length bits, with the rest cleared
+func maskAddressV4(address patricia.IPv4Address, length uint) patricia.IPv4Address {
+	return patricia.IPv4Address{Address: address.Address &^ uint32(uint64(0xffffffff)>>length), Length: length}
+}
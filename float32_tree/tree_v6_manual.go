@@ -1,6 +1,7 @@
 package float32_tree
 
 import (
+	"encoding/binary"
 	"fmt"
 
 	"github.com/kentik/patricia"
@@ -8,18 +9,71 @@ import (
 
 // this is IPv6 tree code that's not very copy/paste friendly for when we transfer IPv4 code to IPv6
 
+// the CBOR tag for an IPv6 prefix, from RFC 9164
+const _cborPrefixTagV6 = 54
+
 // create a new node in the tree, return its index
-func (t *TreeV6) newNode(address patricia.IPv6Address, prefixLength uint) uint {
+// - returns ErrTreeFull, if there's no index left for it
+func (t *TreeV6) newNode(address patricia.IPv6Address, prefixLength uint) (uint, error) {
 	availCount := len(t.availableIndexes)
 	if availCount > 0 {
-		index := t.availableIndexes[availCount-1]
+		index := uint(t.availableIndexes[availCount-1])
 		t.availableIndexes = t.availableIndexes[:availCount-1]
 		t.nodes[index] = treeNodeV6{prefixLeft: address.Left, prefixRight: address.Right, prefixLength: prefixLength}
-		return index
+		return index, nil
 	}
 
+	if uint64(len(t.nodes)) > _maxTreeIndex {
+		return 0, fmt.Errorf("%w: it can't hold more than %d nodes - see treeIndex", ErrTreeFull, len(t.nodes))
+	}
+	if len(t.nodes) == cap(t.nodes) {
+		t.growNodes()
+	}
 	t.nodes = append(t.nodes, treeNodeV6{prefixLeft: address.Left, prefixRight: address.Right, prefixLength: prefixLength})
-	return uint(len(t.nodes) - 1)
+	return uint(len(t.nodes) - 1), nil
+}
+
+// make sure the input address is one the tree can hold
+func (t *TreeV6) validateAddress(address patricia.IPv6Address) error {
+	if address.Length > 128 {
+		return fmt.Errorf("invalid prefix length %d for address %s: must be <= 128", address.Length, address)
+	}
+	return nil
+}
+
+// parse an IPv6 prefix in CIDR notation
+func (t *TreeV6) parseAddress(cidr string) (patricia.IPv6Address, error) {
+	_, v6, err := patricia.ParseIPFromString(cidr)
+	if err != nil {
+		return patricia.IPv6Address{}, err
+	}
+	if v6 == nil {
+		return patricia.IPv6Address{}, fmt.Errorf("%q isn't an IPv6 prefix", cidr)
+	}
+	return *v6, nil
+}
+
+// the address's bytes, in network byte order
+func (t *TreeV6) addressBytes(address patricia.IPv6Address) []byte {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data, address.Left)
+	binary.BigEndian.PutUint64(data[8:], address.Right)
+	return data
+}
+
+// build an address from its bytes, in network byte order, and prefix length
+func (t *TreeV6) addressFromBytes(data []byte, length uint) (patricia.IPv6Address, error) {
+	if len(data) == 0 {
+		// an all-zero address can be left out entirely
+		data = make([]byte, 16)
+	}
+	if len(data) != 16 {
+		return patricia.IPv6Address{}, fmt.Errorf("%d byte address isn't IPv6", len(data))
+	}
+	if length > 128 {
+		return patricia.IPv6Address{}, fmt.Errorf("prefix length %d is out of range", length)
+	}
+	return patricia.NewIPv6Address(data, length), nil
 }
 
 func (t *TreeV6) print() {
@@ -27,3 +81,23 @@ func (t *TreeV6) print() {
 		fmt.Printf("%d: \tleft: %d, right: %d, prefix: %032b %032b (%d), tags: (%d): %v\n", i, int(t.nodes[i].Left), int(t.nodes[i].Right), int(t.nodes[i].prefixLeft), int(t.nodes[i].prefixRight), int(t.nodes[i].prefixLength), t.nodes[i].TagCount, t.tagsForNode(uint(i)))
 	}
 }
+
+// which of 1<<bits shards the address belongs in, going by its top bits
+func shardIndexV6(address patricia.IPv6Address, bits uint) int {
+	return int(address.Left >> (64 - bits))
+}
+
+// a hash of the address, with its length, whose top bits are spread evenly - see LookupCacheV6
+func hashAddressV6(address patricia.IPv6Address) uint64 {
+	hash := address.Left * 0x9e3779b97f4a7c15
+	hash = (hash ^ address.Right) * 0x9e3779b97f4a7c15
+	return (hash ^ uint64(address.Length)) * 0x9e3779b97f4a7c15
+}
+
+// the address, cut down to the first length bits, with the rest cleared
+func maskAddressV6(address patricia.IPv6Address, length uint) patricia.IPv6Address {
+	if length <= 64 {
+		return patricia.IPv6Address{Left: address.Left &^ (^uint64(0) >> length), Length: length}
+	}
+	return patricia.IPv6Address{Left: address.Left, Right: address.Right &^ (^uint64(0) >> (length - 64)), Length: length}
+}
@@ -1,6 +1,6 @@
 module github.com/kentik/patricia
 
-go 1.13
+go 1.23
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -0,0 +1,6 @@
+//go:build patricia_raceguard
+
+package int16_tree
+
+// built with the patricia_raceguard tag: lookups check that the tree didn't change while they ran
+const _raceGuard = true
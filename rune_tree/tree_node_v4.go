@@ -1,6 +1,8 @@
 package rune_tree
 
 import (
+	"encoding/binary"
+	"math"
 	"math/bits"
 
 	"github.com/kentik/patricia"
@@ -8,42 +10,135 @@ import (
 
 const _leftmost32Bit = uint32(1 << 31)
 
+// the longest prefix a node can have
+const _maxPrefixLengthV4 = 32
+
 type treeNodeV4 struct {
-	Left         uint // left node index: 0 for not set
-	Right        uint // right node index: 0 for not set
-	prefix       uint32
-	prefixLength uint
-	TagCount     int
+	Left  treeIndex // left node index: 0 for not set
+	Right treeIndex // right node index: 0 for not set
+	// the prefix's bits in the top 32 bits, and its length in the low ones - one word for both, rather than one each,
+	// takes the node from 32 bytes to 24 on 64-bit platforms, so more nodes fit in each cache line
+	prefix   uint64
+	TagCount int
+}
+
+// pack prefix bits and a length into a node's prefix word
+func packPrefixV4(prefix uint32, length uint) uint64 {
+	return uint64(prefix)<<32 | uint64(length)
 }
 
 // See how many bits match the input address
+// - branchless, as this is the innermost step of every lookup: min compiles to conditional moves
 func (n *treeNodeV4) MatchCount(address patricia.IPv4Address) uint {
-	var length uint
-	if address.Length > n.prefixLength {
-		length = n.prefixLength
-	} else {
-		length = address.Length
-	}
+	return min(uint(bits.LeadingZeros32(n.prefixBits()^address.Address)), n.length(), address.Length)
+}
 
-	matches := uint(bits.LeadingZeros32(n.prefix ^ address.Address))
-	if matches > length {
-		return length
-	}
-	return matches
+// a node's prefix bits, without its length, for layouts that keep the two apart
+type prefixBitsV4 = uint32
+
+// returns the node's prefix bits
+func (n *treeNodeV4) prefixBits() prefixBitsV4 {
+	return uint32(n.prefix >> 32)
+}
+
+// returns the length of the node's prefix
+func (n *treeNodeV4) length() uint {
+	return uint(uint32(n.prefix))
+}
+
+// set the length of the node's prefix, keeping its bits
+func (n *treeNodeV4) setLength(length uint) {
+	n.prefix = packPrefixV4(n.prefixBits(), length)
+}
+
+// see how many bits of the input prefix, prefixLength long, match the input address, like MatchCount
+func matchPrefixBitsV4(prefix prefixBitsV4, prefixLength uint, address patricia.IPv4Address) uint {
+	return min(uint(bits.LeadingZeros32(prefix^address.Address)), prefixLength, address.Length)
 }
 
 // ShiftPrefix shifts the prefix by the input shiftCount
 func (n *treeNodeV4) ShiftPrefix(shiftCount uint) {
-	n.prefix <<= shiftCount
-	n.prefixLength -= shiftCount
+	n.prefix = packPrefixV4(n.prefixBits()<<shiftCount, n.length()-shiftCount)
 }
 
 // IsLeftBitSet returns whether the leftmost bit is set
 func (n *treeNodeV4) IsLeftBitSet() bool {
-	return n.prefix >= _leftmost32Bit
+	return n.prefixBits() >= _leftmost32Bit
 }
 
 // MergeFromNodes updates the prefix and prefix length from the two input nodes
 func (n *treeNodeV4) MergeFromNodes(left *treeNodeV4, right *treeNodeV4) {
-	n.prefix, n.prefixLength = patricia.MergePrefixes32(left.prefix, left.prefixLength, right.prefix, right.prefixLength)
+	n.prefix = packPrefixV4(patricia.MergePrefixes32(left.prefixBits(), left.length(), right.prefixBits(), right.length()))
+}
+
+// treeNodeV4FromAddress returns an unlinked node holding the input address as its prefix
+func treeNodeV4FromAddress(address patricia.IPv4Address) treeNodeV4 {
+	return treeNodeV4{prefix: packPrefixV4(address.Address, address.Length)}
+}
+
+// Address returns the node's prefix as an address
+// - only the full prefix for nodes built up with MergeFromNodes from the root - otherwise, it's what's left below the parent
+func (n *treeNodeV4) Address() patricia.IPv4Address {
+	return patricia.IPv4Address{Address: n.prefixBits(), Length: n.length()}
+}
+
+// whether this node's prefix contains the other's - for nodes holding full prefixes
+func (n *treeNodeV4) containsPrefix(other *treeNodeV4) bool {
+	return n.length() <= other.length() && uint(bits.LeadingZeros32(n.prefixBits()^other.prefixBits())) >= n.length()
+}
+
+// compare this node's prefix to the other's, by address, then length - for nodes holding full prefixes
+// - returns -1, 0, or 1 when this node's prefix is less than, equal to, or greater than the other's
+// - the prefix words compare the same way, as the bits are above the length
+func (n *treeNodeV4) comparePrefix(other *treeNodeV4) int {
+	switch {
+	case n.prefix < other.prefix:
+		return -1
+	case n.prefix > other.prefix:
+		return 1
+	}
+	return 0
+}
+
+// write the node to the encoder
+func (n *treeNodeV4) encode(e *encoder) {
+	e.uvarint(uint64(n.Left))
+	e.uvarint(uint64(n.Right))
+	e.uint32(n.prefixBits())
+	e.byte(byte(n.length()))
+	e.uvarint(uint64(n.TagCount))
+}
+
+// read the node from the decoder, making sure its child indexes are less than nodeCount
+func (n *treeNodeV4) decode(d *decoder, nodeCount int) {
+	n.Left = treeIndex(d.count(uint64(nodeCount-1), "node index"))
+	n.Right = treeIndex(d.count(uint64(nodeCount-1), "node index"))
+	n.prefix = packPrefixV4(d.uint32(), uint(d.byte()))
+	if n.length() > _maxPrefixLengthV4 {
+		d.fail("prefix length %d is out of range", n.length())
+	}
+	n.TagCount = d.count(math.MaxUint32, "tag count")
+}
+
+// size of a node's record in a TreeV4View
+const _viewNodeSizeV4 = 24
+
+// append the node's record in a TreeV4View, with the offset of its tags in the view's tag data
+func (n *treeNodeV4) appendViewRecord(buf []byte, tagOffset uint32) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(n.Left))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(n.Right))
+	buf = binary.LittleEndian.AppendUint32(buf, n.prefixBits())
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(n.length()))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(n.TagCount))
+	return binary.LittleEndian.AppendUint32(buf, tagOffset)
+}
+
+// read the node from its record in a TreeV4View, returning the offset of its tags in the view's tag data
+func (n *treeNodeV4) readViewRecord(data []byte) uint32 {
+	_ = data[_viewNodeSizeV4-1]
+	n.Left = treeIndex(binary.LittleEndian.Uint32(data))
+	n.Right = treeIndex(binary.LittleEndian.Uint32(data[4:]))
+	n.prefix = packPrefixV4(binary.LittleEndian.Uint32(data[8:]), uint(binary.LittleEndian.Uint32(data[12:])))
+	n.TagCount = int(binary.LittleEndian.Uint32(data[16:]))
+	return binary.LittleEndian.Uint32(data[20:])
 }
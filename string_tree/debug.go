@@ -0,0 +1,7 @@
+//go:build patricia_debug
+
+package string_tree
+
+// built with the patricia_debug tag: changes check the tree's invariants as they go, returning ErrCorruptTree when
+// they don't hold
+const _debugChecks = true
@@ -1,7 +1,9 @@
 package template
 
 import (
+	"math/rand"
 	"testing"
+	"unsafe"
 
 	"github.com/kentik/patricia"
 	"github.com/stretchr/testify/assert"
@@ -9,8 +11,7 @@ import (
 
 func TestV4MatchCount(t *testing.T) {
 	node := &treeNodeV4{
-		prefix:       uint32(0xFFFFFFFF),
-		prefixLength: 32,
+		prefix: packPrefixV4(0xFFFFFFFF, 32),
 	}
 
 	// test moving the non-matching bit forward, making sure we never return more than the length of the prefix
@@ -24,7 +25,7 @@ func TestV4MatchCount(t *testing.T) {
 	}
 
 	// test moving the non-matching bit forward, with max of node address's 16 length
-	node.prefixLength = 16
+	node.setLength(16)
 	for i := 1; i < 32; i++ {
 		expected := uint(i - 1)
 		if expected > 16 {
@@ -39,7 +40,7 @@ func TestV4MatchCount(t *testing.T) {
 	}
 
 	// test moving the non-matching bit forward, with max of comparison address's 16 length
-	node.prefixLength = 32
+	node.setLength(32)
 	for i := 1; i < 32; i++ {
 		expected := uint(i - 1)
 		if expected > 16 {
@@ -53,3 +54,71 @@ func TestV4MatchCount(t *testing.T) {
 		assert.Equal(t, expected, node.MatchCount(address))
 	}
 }
+
+// the prefix and its length share a word, and have to come back out of it as they went in, through every change
+func TestV4PrefixWord(t *testing.T) {
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		assert.Equal(t, uintptr(24), unsafe.Sizeof(treeNodeV4{}))
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		address := patricia.NewIPv4Address(random.Uint32(), uint(random.Intn(33)))
+		node := treeNodeV4FromAddress(address)
+		assert.Equal(t, address.Address, node.prefixBits())
+		assert.Equal(t, address.Length, node.length())
+		assert.Equal(t, address, node.Address())
+		assert.Equal(t, address.IsLeftBitSet(), node.IsLeftBitSet())
+
+		shift := uint(random.Intn(int(address.Length) + 1))
+		shifted := node
+		shifted.ShiftPrefix(shift)
+		expected := address
+		expected.ShiftLeft(shift)
+		assert.Equal(t, expected.Address, shifted.prefixBits())
+		assert.Equal(t, expected.Length, shifted.length())
+
+		// merging the shifted part back onto what was shifted off gives the prefix back
+		var parent, merged treeNodeV4
+		parent = node
+		parent.setLength(shift)
+		merged.MergeFromNodes(&parent, &shifted)
+		assert.Equal(t, address.Length, merged.length())
+		assert.Equal(t, node.MatchCount(address), merged.MatchCount(address))
+
+		// prefix words sort by address, then length
+		other := treeNodeV4FromAddress(patricia.NewIPv4Address(random.Uint32(), uint(random.Intn(33))))
+		expectedOrder := 0
+		switch {
+		case node.prefixBits() != other.prefixBits():
+			expectedOrder = -1
+			if node.prefixBits() > other.prefixBits() {
+				expectedOrder = 1
+			}
+		case node.length() != other.length():
+			expectedOrder = -1
+			if node.length() > other.length() {
+				expectedOrder = 1
+			}
+		}
+		assert.Equal(t, expectedOrder, node.comparePrefix(&other))
+	}
+}
+
+func BenchmarkV4MatchCount(b *testing.B) {
+	// lengths and differences all over the place, so branches on them can't be predicted
+	random := rand.New(rand.NewSource(1))
+	nodes := make([]treeNodeV4, 1024)
+	addresses := make([]patricia.IPv4Address, len(nodes))
+	for i := range nodes {
+		nodes[i] = treeNodeV4{prefix: packPrefixV4(random.Uint32(), uint(random.Intn(33)))}
+		addresses[i] = patricia.NewIPv4Address(nodes[i].prefixBits()^uint32(1)<<random.Intn(32), uint(random.Intn(33)))
+	}
+
+	b.ResetTimer()
+	matches := uint(0)
+	for n := 0; n < b.N; n++ {
+		matches += nodes[n%len(nodes)].MatchCount(addresses[n%len(addresses)])
+	}
+	_ = matches
+}
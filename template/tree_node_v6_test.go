@@ -1,6 +1,7 @@
 package template
 
 import (
+	"math/rand"
 	"testing"
 
 	"github.com/kentik/patricia"
@@ -56,3 +57,24 @@ func TestV6MatchCount(t *testing.T) {
 		assert.Equal(t, uint(expected), node.MatchCount(address))
 	}
 }
+
+func BenchmarkV6MatchCount(b *testing.B) {
+	// lengths and differences all over the place, so branches on them can't be predicted
+	random := rand.New(rand.NewSource(1))
+	nodes := make([]treeNodeV6, 1024)
+	addresses := make([]patricia.IPv6Address, len(nodes))
+	for i := range nodes {
+		nodes[i] = treeNodeV6{prefixLeft: random.Uint64(), prefixRight: random.Uint64(), prefixLength: uint(random.Intn(129))}
+		addresses[i] = patricia.IPv6Address{Left: nodes[i].prefixLeft, Right: nodes[i].prefixRight ^ uint64(1)<<random.Intn(64), Length: uint(random.Intn(129))}
+		if i%2 == 0 {
+			addresses[i].Left ^= uint64(1) << random.Intn(64)
+		}
+	}
+
+	b.ResetTimer()
+	matches := uint(0)
+	for n := 0; n < b.N; n++ {
+		matches += nodes[n%len(nodes)].MatchCount(addresses[n%len(addresses)])
+	}
+	_ = matches
+}
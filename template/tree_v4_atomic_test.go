@@ -0,0 +1,54 @@
+package template
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAtomicTreeV4(t *testing.T) {
+	tree := NewAtomicTreeV4()
+	assert.Equal(t, uint64(0), tree.Generation())
+	found, _, err := tree.FindDeepestTag(patricia.NewIPv4Address(0, 32))
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// nothing is visible until it's published
+	tree.Writer().Add(patricia.NewIPv4Address(0, 0), -1, nil)
+	tags, err := tree.FindTags(patricia.NewIPv4Address(0, 32))
+	assert.NoError(t, err)
+	assert.Empty(t, tags)
+	assert.Equal(t, uint64(1), tree.Publish())
+	tags, err = tree.FindTags(patricia.NewIPv4Address(0, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{-1}, tags)
+
+	// readers see every published generation whole: generation n has the tags 0 to n-2, each at its own /16
+	var wg sync.WaitGroup
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tree.Generation() < 101 {
+				published, generation := tree.Load()
+				assert.Equal(t, int(generation), published.CountTags())
+				found, tag, err := published.FindDeepestTag(patricia.NewIPv4Address(uint32(generation)<<16, 32))
+				assert.NoError(t, err)
+				assert.True(t, found)
+				assert.Equal(t, -1, tag)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		tree.Writer().Add(patricia.NewIPv4Address(uint32(i)<<16, 16), i, nil)
+		tree.Publish()
+	}
+	wg.Wait()
+
+	published, generation := tree.Load()
+	assert.Equal(t, uint64(101), generation)
+	assert.Equal(t, 101, published.CountTags())
+	assert.Equal(t, []GeneratedType{-1, 99}, tree.FindTagsAppend(nil, patricia.NewIPv4Address(99<<16, 32)))
+}
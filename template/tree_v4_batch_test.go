@@ -0,0 +1,90 @@
+package template
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchCommit(t *testing.T) {
+	matchFunc := func(tagData GeneratedType, val GeneratedType) bool {
+		return tagData.(string) == val.(string)
+	}
+
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "old", nil)
+
+	batch := tree.NewBatch()
+	batch.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "a", nil)
+	batch.Set(ipv4FromBytes([]byte{10, 1, 2, 0}, 24), "b")
+	batch.Delete(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), matchFunc, "old")
+	assert.Equal(t, 3, batch.Len())
+
+	// nothing is applied until commit
+	tags, _ := tree.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.True(t, tagArraysEqual(tags, []string{"old"}))
+
+	assert.NoError(t, batch.Commit())
+	assert.Equal(t, 0, batch.Len())
+	tags, _ = tree.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.True(t, tagArraysEqual(tags, []string{"a", "b"}))
+}
+
+func TestBatchFailureLeavesTreeUntouched(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "old", nil)
+	nodeCount := len(tree.nodes)
+
+	// invalid address
+	batch := tree.NewBatch()
+	batch.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "a", nil)
+	batch.Add(patricia.IPv4Address{Address: 1, Length: 33}, "b", nil)
+	assert.Error(t, batch.Commit())
+	assert.Equal(t, 0, batch.Len())
+	assert.Equal(t, nodeCount, len(tree.nodes))
+	assert.Equal(t, 1, tree.CountTags())
+
+	// delete without a match function
+	batch.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "a", nil)
+	batch.Delete(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), nil, "old")
+	assert.Error(t, batch.Commit())
+	assert.Equal(t, 1, tree.CountTags())
+
+	// rollback discards queued operations
+	batch.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "a", nil)
+	batch.Rollback()
+	assert.NoError(t, batch.Commit())
+	assert.Equal(t, 1, tree.CountTags())
+}
+
+func TestBatchEvictions(t *testing.T) {
+	tree := NewTreeV4(WithPrefixLimit(2, PrefixLimitEvictLRU))
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "10/8", nil)
+	tree.Add(ipv4FromBytes([]byte{11, 0, 0, 0}, 8), "11/8", nil)
+
+	// a replica without the limit only loses what the log says to
+	replica := NewTreeV4()
+	replica.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "10/8", nil)
+	replica.Add(ipv4FromBytes([]byte{11, 0, 0, 0}, 8), "11/8", nil)
+
+	var log bytes.Buffer
+	assert.NoError(t, tree.SetChangeLog(&log))
+	var deleted []string
+	tree.OnDelete(func(prefix patricia.IPv4Address, tag GeneratedType, _ ChangeOp) {
+		deleted = append(deleted, prefix.String()+" "+tag.(string))
+	})
+
+	// making room for the new prefixes evicts the ones the ops don't name, which are logged and hooked like the rest
+	batch := tree.NewBatch()
+	batch.Add(ipv4FromBytes([]byte{12, 0, 0, 0}, 8), "12/8", nil)
+	batch.Add(ipv4FromBytes([]byte{13, 0, 0, 0}, 8), "13/8", nil)
+	assert.NoError(t, batch.Commit())
+	assert.Equal(t, 2, tree.PrefixCount())
+	assert.Equal(t, []string{"10.0.0.0/8 10/8", "11.0.0.0/8 11/8"}, deleted)
+
+	_, err := replica.Replay(bytes.NewReader(log.Bytes()))
+	assert.NoError(t, err)
+	assertSameTreesV4(t, tree, replica)
+}
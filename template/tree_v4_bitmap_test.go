@@ -0,0 +1,36 @@
+package template
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/kentik/patricia"
+)
+
+func TestBitmapTreeV4(t *testing.T) {
+	testReadOnlyTreeV4(t, func(tree *TreeV4) readOnlyTreeV4 { return tree.OptimizeBitmap() })
+}
+
+func TestBitmapTreeV6(t *testing.T) {
+	testReadOnlyTreeV6(t, func(tree *TreeV6) readOnlyTreeV6 { return tree.OptimizeBitmap() })
+}
+
+func BenchmarkFindTagsBitmap(b *testing.B) {
+	tree := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 200000; i++ {
+		tree.Add(patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25))), i, nil)
+	}
+	bitmap := tree.OptimizeBitmap()
+	addresses := make([]patricia.IPv4Address, 1024)
+	for i := range addresses {
+		addresses[i] = patricia.NewIPv4Address(random.Uint32(), 32)
+	}
+
+	ret := make([]GeneratedType, 0, 32)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ret = bitmap.FindTagsAppend(ret[:0], addresses[n%len(addresses)])
+	}
+}
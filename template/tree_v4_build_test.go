@@ -0,0 +1,151 @@
+package template
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildConcurrentV4(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	var entries []EntryV4
+	for i := 0; i < 5000; i++ {
+		address := patricia.NewIPv4Address(random.Uint32(), uint(random.Intn(33)))
+		if i%10 == 0 && i > 0 {
+			// more tags for a prefix that's already there
+			address = entries[random.Intn(len(entries))].Prefix
+		}
+		entries = append(entries, EntryV4{Prefix: address, Tags: []GeneratedType{i, -i}})
+	}
+
+	expected := NewTreeV4()
+	assert.NoError(t, expected.addEntries(entries))
+	for _, workers := range []int{0, 1, 3, 64} {
+		tree, err := BuildConcurrentV4(entries, workers)
+		assert.NoError(t, err)
+		assert.NoError(t, tree.checkStructure())
+		assert.Equal(t, expected.countNodes(1), tree.countNodes(1))
+		assertSameTreesV4(t, expected, tree)
+
+		// the tree carries on working as usual
+		tree.Add(patricia.NewIPv4Address(0, 0), "default", nil)
+		tags, err := tree.FindTags(entries[1].Prefix)
+		assert.NoError(t, err)
+		assert.Contains(t, tags, "default")
+		assert.NoError(t, tree.checkStructure())
+	}
+
+	tree, err := BuildConcurrentV4(nil, 4, WithSingleTag())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, tree.CountTags())
+	tree, err = BuildConcurrentV4(entries, 4, WithSingleTag())
+	assert.NoError(t, err)
+	expected = NewTreeV4(WithSingleTag())
+	assert.NoError(t, expected.addEntries(entries))
+	assertSameTreesV4(t, expected, tree)
+
+	_, err = BuildConcurrentV4([]EntryV4{{Prefix: patricia.IPv4Address{Length: 33}, Tags: []GeneratedType{1}}}, 4)
+	assert.Error(t, err)
+}
+
+func BenchmarkBuildConcurrentV4(b *testing.B) {
+	random := rand.New(rand.NewSource(1))
+	entries := make([]EntryV4, 100000)
+	for i := range entries {
+		entries[i] = EntryV4{Prefix: patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25))), Tags: []GeneratedType{i}}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		BuildConcurrentV4(entries, 0)
+	}
+}
+
+func TestBuildFromSortedV4(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	expected := NewTreeV4()
+	expected.Add(patricia.NewIPv4Address(0, 0), "default", nil)
+	for i := 0; i < 5000; i++ {
+		address := patricia.NewIPv4Address(random.Uint32(), uint(1+random.Intn(32)))
+		if i%2 == 0 {
+			// lots in one place, so prefixes hold each other
+			address.Address = 10<<24 | address.Address>>8
+		}
+		expected.Add(address, i, nil)
+		expected.Add(address, -i, nil)
+	}
+	var entries []EntryV4
+	for prefix, tags := range expected.All() {
+		entries = append(entries, EntryV4{Prefix: prefix, Tags: tags})
+	}
+
+	tree, err := BuildFromSortedV4(entries)
+	assert.NoError(t, err)
+	assert.NoError(t, tree.checkStructure())
+	assert.Equal(t, expected.countNodes(1), tree.countNodes(1))
+	assertSameTreesV4(t, expected, tree)
+
+	// the tree carries on working as usual
+	tree.Add(patricia.NewIPv4Address(10<<24, 8), "10/8", nil)
+	tags, err := tree.FindTags(patricia.NewIPv4Address(10<<24|1, 32))
+	assert.NoError(t, err)
+	assert.Contains(t, tags, "10/8")
+	assert.NoError(t, tree.checkStructure())
+
+	// options apply as they would to adds
+	tree, err = BuildFromSortedV4(entries, WithSingleTag())
+	assert.NoError(t, err)
+	expected = NewTreeV4(WithSingleTag())
+	assert.NoError(t, expected.addEntries(entries))
+	assertSameTreesV4(t, expected, tree)
+	_, err = BuildFromSortedV4(entries, WithTagLimit(1, TagLimitReject))
+	assert.True(t, errors.Is(err, ErrTagLimitReached))
+
+	// bits past the prefix length are ignored, and entries without tags skipped
+	tree, err = BuildFromSortedV4([]EntryV4{
+		{Prefix: patricia.NewIPv4Address(10<<24|1, 8), Tags: []GeneratedType{"10/8"}},
+		{Prefix: patricia.NewIPv4Address(10<<24|1<<16, 16)},
+		{Prefix: patricia.NewIPv4Address(10<<24|2<<16, 16), Tags: []GeneratedType{"10.2/16"}},
+	})
+	assert.NoError(t, err)
+	tags, _ = tree.FindTags(patricia.NewIPv4Address(10<<24|2<<16|1, 32))
+	assert.Equal(t, []GeneratedType{"10/8", "10.2/16"}, tags)
+	assert.Equal(t, 2, tree.countNodes(1)-1)
+
+	tree, err = BuildFromSortedV4(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, tree.CountTags())
+
+	// out of order, or repeated
+	_, err = BuildFromSortedV4([]EntryV4{entries[1], entries[0]})
+	assert.Error(t, err)
+	_, err = BuildFromSortedV4([]EntryV4{entries[1], entries[1]})
+	assert.Error(t, err)
+	_, err = BuildFromSortedV4([]EntryV4{{Prefix: patricia.IPv4Address{Length: 33}, Tags: []GeneratedType{1}}})
+	assert.Error(t, err)
+}
+
+func BenchmarkBuildFromSortedV4(b *testing.B) {
+	random := rand.New(rand.NewSource(1))
+	tree := NewTreeV4()
+	for i := 0; i < 100000; i++ {
+		tree.Add(patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25))), i, nil)
+	}
+	var entries []EntryV4
+	for prefix, tags := range tree.All() {
+		entries = append(entries, EntryV4{Prefix: prefix, Tags: tags})
+	}
+
+	b.Run("adds", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			NewTreeV4().addEntries(entries)
+		}
+	})
+	b.Run("sorted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			BuildFromSortedV4(entries)
+		}
+	})
+}
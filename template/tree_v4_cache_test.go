@@ -0,0 +1,106 @@
+package template
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupCache(t *testing.T) {
+	tree := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		tree.Add(patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25))), i, nil)
+	}
+	addresses := make([]patricia.IPv4Address, 100)
+	for i := range addresses {
+		addresses[i] = patricia.NewIPv4Address(random.Uint32(), 32)
+	}
+	cache := tree.NewLookupCache(1000)
+	assert.Equal(t, 1024, len(cache.slots))
+	assertCacheMatchesV4 := func() {
+		for _, address := range addresses {
+			found, tag, err := cache.FindDeepestTag(address)
+			assert.NoError(t, err)
+			expectedFound, expectedTag, _ := tree.FindDeepestTag(address)
+			assert.Equal(t, expectedFound, found)
+			assert.Equal(t, expectedTag, tag)
+		}
+	}
+
+	// the second time round, most are hits - some share a slot
+	assertCacheMatchesV4()
+	hits, misses := cache.Stats()
+	assert.Equal(t, uint64(0), hits)
+	assert.Equal(t, uint64(100), misses)
+	assertCacheMatchesV4()
+	hits, misses = cache.Stats()
+	assert.True(t, hits > 80)
+	assert.Equal(t, uint64(200), hits+misses)
+
+	// changes empty it
+	matchAll := func(GeneratedType, GeneratedType) bool { return true }
+	for _, address := range addresses[:10] {
+		tree.Set(address, "exact")
+	}
+	assertCacheMatchesV4()
+	tree.Delete(addresses[0], matchAll, nil)
+	assertCacheMatchesV4()
+	tree.Compact()
+	assertCacheMatchesV4()
+	tree.Clear()
+	assertCacheMatchesV4()
+
+	// while tags expire, lookups go to the tree
+	tree.AddWithExpiry(addresses[1], "soon", time.Now().Add(50*time.Millisecond), nil)
+	hits, _ = cache.Stats()
+	assertCacheMatchesV4()
+	assertCacheMatchesV4()
+	after, _ := cache.Stats()
+	assert.Equal(t, hits, after)
+	time.Sleep(60 * time.Millisecond)
+	assertCacheMatchesV4()
+
+	// a cache of one slot still works
+	cache = tree.NewLookupCache(0)
+	assert.Equal(t, 1, len(cache.slots))
+	assertCacheMatchesV4()
+}
+
+func TestLookupCacheV6(t *testing.T) {
+	tree := NewTreeV6()
+	address := patricia.NewIPv6Address([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 128)
+	prefix := patricia.NewIPv6Address([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 32)
+	tree.Add(prefix, "documentation", nil)
+	cache := tree.NewLookupCache(16)
+	for i := 0; i < 2; i++ {
+		found, tag, err := cache.FindDeepestTag(address)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, "documentation", tag)
+	}
+	hits, misses := cache.Stats()
+	assert.Equal(t, uint64(1), hits)
+	assert.Equal(t, uint64(1), misses)
+}
+
+// looking up a few hot addresses in a tree too big to stay in cache, where the cache in front of it saves walking down
+func BenchmarkFindDeepestTagLookupCache(b *testing.B) {
+	tree, addresses := hugeTreeV4()
+	hot := addresses[:16]
+	b.Run("tree", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			tree.FindDeepestTag(hot[n%len(hot)])
+		}
+	})
+	b.Run("cache", func(b *testing.B) {
+		cache := tree.NewLookupCache(64)
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			cache.FindDeepestTag(hot[n%len(hot)])
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package template
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalCBOR(t *testing.T) {
+	// 192.0.2.0/24 is the example in RFC 9164
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{192, 0, 2, 0}, 24), "a", nil)
+	data, err := tree.MarshalCBOR()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x81, 0x82, 0xd8, 0x34, 0x82, 0x18, 0x18, 0x43, 0xc0, 0x00, 0x02, 0x81, 0x61, 'a'}, data)
+
+	// a round trip
+	tree = buildTreeV4(t, _iterTestEntries)
+	data, err = tree.MarshalCBOR()
+	assert.NoError(t, err)
+	decoded := NewTreeV4()
+	assert.NoError(t, decoded.UnmarshalCBOR(data))
+	found := make(map[string][]string)
+	for prefix, tags := range decoded.All() {
+		for _, tag := range tags {
+			found[prefix.String()] = append(found[prefix.String()], tag.(string))
+		}
+	}
+	assert.Equal(t, _iterTestEntries, found)
+
+	// the tag types are CBOR's, which the generated packages convert to their own
+	tree = NewTreeV4()
+	for _, tag := range []GeneratedType{true, 42, int8(-1), uint16(7), float32(0.5), -1.5, complex(1, 2)} {
+		tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), tag, nil)
+	}
+	data, err = tree.MarshalCBOR()
+	assert.NoError(t, err)
+	assert.NoError(t, decoded.UnmarshalCBOR(data))
+	tags, err := decoded.FindTags(ipv4FromBytes([]byte{10, 0, 0, 0}, 8))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{true, uint64(42), int64(-1), uint64(7), float32(0.5), -1.5, complex(1, 2)}, tags)
+
+	// unsupported tags
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), struct{}{}, nil)
+	_, err = tree.MarshalCBOR()
+	assert.True(t, errors.Is(err, ErrUnsupportedTag))
+}
+
+func TestUnmarshalCBOR(t *testing.T) {
+	// indefinite-length arrays, a half-precision float, and a bare address
+	tree := NewTreeV4()
+	assert.NoError(t, tree.UnmarshalCBOR([]byte{0x9f,
+		0x82, 0xd8, 0x34, 0x82, 0x00, 0x40, 0x9f, 0xf9, 0x3c, 0x00, 0xff,
+		0x82, 0xd8, 0x34, 0x44, 10, 0, 0, 1, 0x81, 0xf9, 0xc0, 0x00,
+		0xff}))
+	tags, err := tree.FindTags(ipv4FromBytes([]byte{10, 0, 0, 1}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{float32(1), float32(-2)}, tags)
+
+	assert.Equal(t, float32(65504), float16ToFloat32(0x7bff))
+	assert.Equal(t, float32(5.960464477539063e-8), float16ToFloat32(0x0001))
+
+	// bad input leaves the tree alone
+	for _, data := range [][]byte{
+		{},
+		{0x81},
+		{0x81, 0x82, 0xd8, 0x36, 0x82, 0x00, 0x40, 0x80},                                                       // an IPv6 prefix
+		{0x81, 0x82, 0xd8, 0x34, 0x82, 0x18, 0x21, 0x40, 0x80},                                                 // /33
+		{0x81, 0x82, 0xd8, 0x34, 0x45, 1, 2, 3, 4, 5, 0x80},                                                    // 5 address bytes
+		{0x81, 0x82, 0xd8, 0x34, 0x82, 0x00, 0x40, 0x81, 0x40},                                                 // a byte string tag
+		{0x81, 0x82, 0xd8, 0x34, 0x82, 0x00, 0x40, 0x81, 0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // too negative
+		{0x80, 0x00}, // trailing data
+	} {
+		err := tree.UnmarshalCBOR(data)
+		assert.True(t, errors.Is(err, ErrInvalidData), "% x: %v", data, err)
+	}
+	assert.Equal(t, 2, tree.CountTags())
+}
+
+func TestCBORV6(t *testing.T) {
+	tree := NewTreeV6()
+	for i, cidr := range []string{"::/0", "2001:db8::/32", "fe80::1/128"} {
+		_, address, _ := patricia.ParseIPFromString(cidr)
+		tree.Add(*address, uint64(i), nil)
+	}
+	data, err := tree.MarshalCBOR()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x83, 0x82, 0xd8, 0x36, 0x82, 0x00, 0x40, 0x81, 0x00}, data[:9])
+
+	decoded := NewTreeV6()
+	assert.NoError(t, decoded.UnmarshalCBOR(data))
+	assert.Equal(t, tree.nodes, decoded.nodes)
+	assert.Equal(t, tree.tags.slices, decoded.tags.slices)
+	assert.True(t, errors.Is(NewTreeV4().UnmarshalCBOR(data), ErrInvalidData))
+}
@@ -0,0 +1,140 @@
+package template
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeLog(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	saved, err := tree.MarshalBinary()
+	assert.NoError(t, err)
+
+	var log bytes.Buffer
+	assert.NoError(t, tree.SetChangeLog(&log))
+	matchString := func(payload GeneratedType, val GeneratedType) bool {
+		_, ok := payload.(string)
+		return ok
+	}
+
+	// a bit of everything
+	tree.Add(ipv4FromBytes([]byte{10, 2, 0, 0}, 16), "x", nil)
+	tree.AddWithExpiry(ipv4FromBytes([]byte{10, 2, 0, 0}, 16), "gone", time.Now().Add(-time.Second), nil)
+	tree.AddWithExpiry(ipv4FromBytes([]byte{10, 3, 0, 0}, 16), "later", time.Now().Add(time.Hour), nil)
+	tree.Set(ipv4FromBytes([]byte{10, 1, 2, 3}, 32), "set")
+	tree.Delete(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), matchString, nil)
+	tree.UpdateTags(ipv4FromBytes([]byte{192, 168, 0, 0}, 16), func(payload GeneratedType) (GeneratedType, bool) {
+		return "updated", true
+	})
+	tree.Prune(ipv4FromBytes([]byte{10, 1, 0, 0}, 16))
+	graft := NewTreeV4()
+	graft.Add(ipv4FromBytes([]byte{1, 0, 0, 0}, 8), "grafted", nil)
+	tree.Graft(ipv4FromBytes([]byte{172, 0, 0, 0}, 8), graft, nil)
+	batch := tree.NewBatch()
+	batch.Add(ipv4FromBytes([]byte{8, 8, 8, 8}, 32), "batched", nil)
+	batch.Delete(ipv4FromBytes([]byte{192, 168, 0, 0}, 16), matchString, nil)
+	assert.NoError(t, batch.Commit())
+	batch.Add(ipv4FromBytes([]byte{9, 9, 9, 9}, 32), "failed", nil)
+	batch.Delete(ipv4FromBytes([]byte{9, 9, 9, 9}, 32), nil, nil)
+	assert.Error(t, batch.Commit())
+	assert.Equal(t, 1, tree.Sweep())
+	snapshot := tree.Snapshot()
+	tree.Add(ipv4FromBytes([]byte{10, 4, 0, 0}, 16), "after the snapshot", nil)
+	snapshot.Add(ipv4FromBytes([]byte{10, 5, 0, 0}, 16), "snapshots don't log", nil)
+	assert.NoError(t, tree.ChangeLogErr())
+
+	// replaying the log onto the saved copy gets the same tree
+	replayed := NewTreeV4()
+	assert.NoError(t, replayed.UnmarshalBinary(saved))
+	count, err := replayed.Replay(bytes.NewReader(log.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 12, count)
+	assertSameTreesV4(t, tree, replayed)
+	assert.Equal(t, tree.firstExpirationV4(ipv4FromBytes([]byte{10, 3, 0, 0}, 16)), replayed.firstExpirationV4(ipv4FromBytes([]byte{10, 3, 0, 0}, 16)))
+
+	// replacing the contents is logged in full, as is clearing
+	log.Reset()
+	assert.NoError(t, tree.UnmarshalBinary(saved))
+	assertSameTreesV4(t, buildEncodingTreeV4(), tree)
+	count, err = replayed.Replay(bytes.NewReader(log.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, count)
+	assertSameTreesV4(t, tree, replayed)
+	tree.Clear()
+	_, err = replayed.Replay(bytes.NewReader(log.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, replayed.CountTags())
+}
+
+func TestChangeLogErrors(t *testing.T) {
+	tree := NewTreeV4()
+	var log bytes.Buffer
+	tree.SetChangeLog(&log)
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "a", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "b", nil)
+	data := log.Bytes()
+
+	// a record cut short stops the replay, after the ones before it
+	firstRecord := int(data[0]) + 5
+	for i := 1; i < len(data); i++ {
+		replayed := NewTreeV4()
+		count, err := replayed.Replay(bytes.NewReader(data[:i]))
+		if i == firstRecord {
+			assert.NoError(t, err)
+		} else {
+			assert.True(t, errors.Is(err, ErrInvalidData), "%d bytes: %v", i, err)
+		}
+		assert.Equal(t, count, replayed.CountTags())
+	}
+	bad := append([]byte{}, data...)
+	bad[len(bad)-5] ^= 1
+	count, err := NewTreeV4().Replay(bytes.NewReader(bad))
+	assert.True(t, errors.Is(err, ErrInvalidData), "%v", err)
+	assert.Equal(t, 1, count)
+
+	// write errors stop the log
+	tree.SetChangeLog(failingWriter{})
+	tree.Add(ipv4FromBytes([]byte{10, 2, 0, 0}, 16), "c", nil)
+	assert.True(t, errors.Is(tree.ChangeLogErr(), io.ErrClosedPipe))
+	assert.True(t, errors.Is(tree.SetChangeLog(nil), io.ErrClosedPipe))
+	assert.NoError(t, tree.ChangeLogErr())
+	assert.Equal(t, 3, tree.CountTags())
+}
+
+// check that two trees have the same prefixes and tags, however they're laid out
+func assertSameTreesV4(t *testing.T, expected *TreeV4, actual *TreeV4) {
+	entries := func(tree *TreeV4) map[string][]GeneratedType {
+		ret := make(map[string][]GeneratedType)
+		for prefix, tags := range tree.All() {
+			ret[prefix.String()] = tags
+		}
+		return ret
+	}
+	assert.Equal(t, entries(expected), entries(actual))
+	assert.Equal(t, expected.CountTags(), actual.CountTags())
+}
+
+// each node's tags, and their expiration times, the same however they're stored, for comparing trees' storage
+func (t *TreeV4) storedTagsV4() ([][]GeneratedType, [][]int64) {
+	tags := make([][]GeneratedType, len(t.nodes))
+	expirations := make([][]int64, len(t.nodes))
+	for nodeIndex := range t.nodes {
+		tags[nodeIndex] = t.nodeTags(uint(nodeIndex))
+		for i := range tags[nodeIndex] {
+			expirations[nodeIndex] = append(expirations[nodeIndex], t.tagExpiration(uint(nodeIndex), i))
+		}
+	}
+	return tags, expirations
+}
+
+// the expiration time of the first tag at the address
+func (t *TreeV4) firstExpirationV4(address patricia.IPv4Address) int64 {
+	nodeIndex, _, _ := t.findNode(address)
+	return t.tagExpiration(nodeIndex, 0)
+}
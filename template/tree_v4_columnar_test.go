@@ -0,0 +1,51 @@
+package template
+
+import (
+	"math/rand"
+	"testing"
+	"unsafe"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColumnarTreeV4(t *testing.T) {
+	testReadOnlyTreeV4(t, func(tree *TreeV4) readOnlyTreeV4 { return tree.Columnar() })
+
+	// one entry for each of the tree's nodes, in less memory
+	tree := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		tree.Add(patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25))), "tag", nil)
+	}
+	columnar := tree.Columnar()
+	nodeCount := len(tree.nodes) - 1 - len(tree.availableIndexes)
+	assert.Equal(t, nodeCount, len(columnar.prefixBits))
+	assert.Equal(t, nodeCount, len(columnar.children))
+	nodeBytes := len(columnar.prefixBits)*4 + len(columnar.prefixLengths) + len(columnar.children)*8 + len(columnar.tagIndexes)*4
+	assert.True(t, nodeBytes < nodeCount*int(unsafe.Sizeof(treeNodeV4{})))
+}
+
+func TestColumnarTreeV6(t *testing.T) {
+	testReadOnlyTreeV6(t, func(tree *TreeV6) readOnlyTreeV6 { return tree.Columnar() })
+}
+
+func BenchmarkFindTagsColumnar(b *testing.B) {
+	tree := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 200000; i++ {
+		tree.Add(patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25))), i, nil)
+	}
+	columnar := tree.Columnar()
+	addresses := make([]patricia.IPv4Address, 1024)
+	for i := range addresses {
+		addresses[i] = patricia.NewIPv4Address(random.Uint32(), 32)
+	}
+
+	ret := make([]GeneratedType, 0, 32)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ret = columnar.FindTagsAppend(ret[:0], addresses[n%len(addresses)])
+	}
+}
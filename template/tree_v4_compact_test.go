@@ -0,0 +1,87 @@
+package template
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompact(t *testing.T) {
+	tree := NewTreeV4()
+	for i := 0; i < 1000; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<12, 20), i, nil)
+	}
+	tree.AddWithExpiry(patricia.NewIPv4Address(0, 8), "expires", time.Now().Add(time.Hour), nil)
+	matchAll := func(GeneratedType, GeneratedType) bool { return true }
+	for i := 0; i < 1000; i += 3 {
+		tree.Delete(patricia.NewIPv4Address(uint32(i)<<12, 20), matchAll, nil)
+	}
+	expected := tree.Clone()
+	nodeCount := tree.countNodes(1)
+	assert.NotEmpty(t, tree.availableIndexes)
+
+	// a step at a time, with the tree in use in between
+	compaction := tree.NewCompaction()
+	steps := 0
+	for !compaction.Step(100) {
+		steps++
+		found, _, err := tree.FindDeepestTag(patricia.NewIPv4Address(1<<12, 32))
+		assert.NoError(t, err)
+		assert.True(t, found)
+	}
+	assert.Equal(t, nodeCount/100, steps)
+	assert.True(t, compaction.Step(100))
+	assert.NoError(t, tree.checkStructure())
+	assert.Empty(t, tree.availableIndexes)
+	assert.Equal(t, nodeCount+1, len(tree.nodes))
+	assertSameTreesV4(t, expected, tree)
+	assert.Equal(t, 1, tree.tags.expiring)
+
+	// changing the tree between steps starts the compaction over, and snapshots keep the storage they had
+	tree.Delete(patricia.NewIPv4Address(1<<12, 20), matchAll, nil)
+	snapshot := tree.Snapshot()
+	compaction = tree.NewCompaction()
+	compaction.Step(100)
+	tree.Add(patricia.NewIPv4Address(1<<12, 20), "changed", nil)
+	expected = tree.Clone()
+	for !compaction.Step(100) {
+	}
+	assert.NoError(t, tree.checkStructure())
+	assertSameTreesV4(t, expected, tree)
+	assert.Equal(t, expected.CountTags()-1, snapshot.CountTags())
+	assert.NoError(t, snapshot.checkStructure())
+
+	// and in one go
+	tree.Delete(patricia.NewIPv4Address(1<<12, 20), matchAll, nil)
+	tree.Compact()
+	assert.Empty(t, tree.availableIndexes)
+	assert.NoError(t, tree.checkStructure())
+}
+
+func TestShrinkToFit(t *testing.T) {
+	tree := NewTreeV4()
+	for i := 0; i < 10000; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<12, 20), i, nil)
+	}
+	matchAll := func(GeneratedType, GeneratedType) bool { return true }
+	for i := 0; i < 10000; i++ {
+		if i%100 != 0 {
+			tree.Delete(patricia.NewIPv4Address(uint32(i)<<12, 20), matchAll, nil)
+		}
+	}
+	expected := tree.Clone()
+	before := tree.MemoryStats().TotalBytes
+
+	reclaimed := tree.ShrinkToFit()
+	assert.True(t, reclaimed > before/2)
+	assert.Equal(t, before-reclaimed, tree.MemoryStats().TotalBytes)
+	assert.Equal(t, len(tree.nodes), cap(tree.nodes))
+	assert.Empty(t, tree.availableIndexes)
+	assert.NoError(t, tree.checkStructure())
+	assertSameTreesV4(t, expected, tree)
+
+	// nothing more to release
+	assert.Equal(t, 0, tree.ShrinkToFit())
+}
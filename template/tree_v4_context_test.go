@@ -0,0 +1,108 @@
+package template
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+// cancels its context once written to
+type cancelingWriter struct {
+	bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (w *cancelingWriter) Write(data []byte) (int, error) {
+	w.cancel()
+	return w.Buffer.Write(data)
+}
+
+func TestContextOperations(t *testing.T) {
+	var entries []EntryV4
+	for i := 0; i < 10*_contextCheckInterval; i++ {
+		entries = append(entries, EntryV4{Prefix: patricia.NewIPv4Address(uint32(i)<<8, 24), Tags: []GeneratedType{i}})
+	}
+
+	// left alone, they do the same as the plain ones
+	tree := NewTreeV4()
+	addCount, err := tree.AddEntriesContext(context.Background(), entries, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, len(entries), addCount)
+	assert.Equal(t, len(entries), tree.CountTags())
+
+	walked := 0
+	assert.NoError(t, tree.WalkContext(context.Background(), func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		assert.Equal(t, entries[walked].Prefix, prefix)
+		walked++
+		return true
+	}))
+	assert.Equal(t, len(entries), walked)
+
+	var saved, expected bytes.Buffer
+	assert.NoError(t, tree.SaveContext(context.Background(), &saved))
+	assert.NoError(t, tree.Save(&expected))
+	assert.Equal(t, expected.Bytes(), saved.Bytes())
+
+	grafted := NewTreeV4()
+	addCount, err = grafted.GraftContext(context.Background(), patricia.NewIPv4Address(0, 0), tree, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, len(entries), addCount)
+	assertSameTreesV4(t, tree, grafted)
+
+	// nothing's done once the context already is
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	empty := NewTreeV4()
+	addCount, err = empty.AddEntriesContext(done, entries, nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, addCount)
+	addCount, err = empty.GraftContext(done, patricia.NewIPv4Address(0, 0), tree, nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, addCount)
+	assert.Equal(t, 0, empty.CountTags())
+	assert.Equal(t, context.Canceled, tree.WalkContext(done, func(patricia.IPv4Address, []GeneratedType) bool {
+		assert.Fail(t, "walked with a done context")
+		return true
+	}))
+	saved.Reset()
+	assert.Equal(t, context.Canceled, tree.SaveContext(done, &saved))
+	assert.Equal(t, 0, saved.Len())
+
+	// and things stop part way through once it's done
+	ctx, cancel := context.WithCancel(context.Background())
+	walked = 0
+	assert.Equal(t, context.Canceled, tree.WalkContext(ctx, func(patricia.IPv4Address, []GeneratedType) bool {
+		cancel()
+		walked++
+		return true
+	}))
+	assert.True(t, walked < len(entries))
+
+	ctx, cancel = context.WithCancel(context.Background())
+	w := &cancelingWriter{cancel: cancel}
+	assert.Equal(t, context.Canceled, tree.SaveContext(ctx, w))
+	assert.True(t, w.Len() < expected.Len())
+	assert.Error(t, NewTreeV4().Load(&w.Buffer))
+
+	for _, graft := range []bool{false, true} {
+		ctx, cancel = context.WithCancel(context.Background())
+		partial := NewTreeV4()
+		partial.OnAdd(func(patricia.IPv4Address, GeneratedType, ChangeOp) { cancel() })
+		if graft {
+			addCount, err = partial.GraftContext(ctx, patricia.NewIPv4Address(0, 0), tree, nil)
+		} else {
+			addCount, err = partial.AddEntriesContext(ctx, entries, nil)
+		}
+		assert.Equal(t, context.Canceled, err)
+		assert.True(t, addCount < len(entries))
+		assert.Equal(t, addCount, partial.CountTags())
+	}
+
+	// invalid entries say which they are
+	_, err = NewTreeV4().AddEntriesContext(context.Background(), []EntryV4{entries[0], {Prefix: patricia.IPv4Address{Length: 33}}}, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "entry 1")
+}
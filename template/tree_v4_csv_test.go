@@ -0,0 +1,125 @@
+package template
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadCSV(t *testing.T) {
+	tree := NewTreeV4()
+	added, err := tree.LoadCSV(strings.NewReader("10.0.0.0/8,a\n10.1.0.0/16,b\n\n 192.168.1.1 ,\"c, d\"\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, added)
+	tags, err := tree.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{"a", "b"}, tags)
+	tags, err = tree.FindTags(ipv4FromBytes([]byte{192, 168, 1, 1}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{"c, d"}, tags)
+
+	// other columns, a header, and a parser
+	tree = NewTreeV4()
+	parseInt := func(value string) (GeneratedType, error) {
+		return strconv.Atoi(value)
+	}
+	added, err = tree.LoadCSV(strings.NewReader("asn\tname\tprefix\n64512\tx\t10.0.0.0/8\n64513\ty\t10.1.0.0/16\n"),
+		WithCSVComma('\t'), WithCSVHeader(), WithCSVColumns(2, 0), WithCSVParser(parseInt))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, added)
+	tags, err = tree.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{64512, 64513}, tags)
+}
+
+func TestLoadCSVErrors(t *testing.T) {
+	parseInt := func(value string) (GeneratedType, error) {
+		return strconv.Atoi(value)
+	}
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{"10.0.0.0/8,1\n10.0.0.0/33,2\n", "line 2: "},
+		{"10.0.0.0/8,1\n\n2001:db8::/32,2\n", "line 3: \"2001:db8::/32\" isn't an IPv4 prefix"},
+		{"10.0.0.0/8,1\n10.0.0.0/8\n", "line 2: 1 columns, expected at least 2"},
+		{"10.0.0.0/8,1\n10.0.0.0/8,x\n", "line 2: invalid value \"x\": "},
+		{"10.0.0.0/8,1\n10.0.0.0/8,\"1\n", "line 2: "},
+	} {
+		tree := NewTreeV4()
+		added, err := tree.LoadCSV(strings.NewReader(test.input), WithCSVParser(parseInt))
+		assert.Error(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), test.expected), "%q: %v", test.input, err)
+		assert.Equal(t, 1, added)
+		assert.Equal(t, 1, tree.CountTags())
+	}
+
+	// Add's errors come through
+	tree := NewTreeV4(WithTagLimit(1, TagLimitReject))
+	_, err := tree.LoadCSV(strings.NewReader("10.0.0.0/8,1\n10.0.0.0/8,2\n"))
+	assert.True(t, errors.Is(err, ErrTagLimitReached))
+}
+
+func TestParseTag(t *testing.T) {
+	// GeneratedType is an interface here, so values are kept as strings - the generated packages parse them as their types
+	tag, err := parseTag("1")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", tag)
+}
+
+const _geoIPBlocksV4 = `network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,postal_code,latitude,longitude,accuracy_radius
+1.0.0.0/24,2077456,2077456,,0,0,,-33.4940,143.2104,1000
+1.0.1.0/24,,1814991,,0,0,,,,
+2.56.8.0/22,,,,1,0,,,,
+81.2.69.142/31,2643743,2635167,,0,0,"EC1A, 1",51.5142,-0.0931,5
+`
+
+func TestLoadGeoIPBlocks(t *testing.T) {
+	tree := NewTreeV4()
+	added, err := tree.LoadGeoIPBlocks(strings.NewReader(_geoIPBlocksV4), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, added)
+	for address, expected := range map[string][]GeneratedType{
+		"1.0.0.1":     {"2077456"},
+		"1.0.1.1":     {"1814991"},
+		"2.56.8.1":    {},
+		"81.2.69.143": {"2643743"},
+	} {
+		v4, _, _ := patricia.ParseIPFromString(address)
+		tags, err := tree.FindTags(*v4)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, tags, address)
+	}
+
+	// ASN blocks, with a tagFunc
+	tree = NewTreeV4()
+	asn := func(row GeoIPRow) (GeneratedType, bool, error) {
+		return row.Field("autonomous_system_organization"), true, nil
+	}
+	added, err = tree.LoadGeoIPBlocks(strings.NewReader("network,autonomous_system_number,autonomous_system_organization\n"+
+		"1.0.0.0/24,13335,CLOUDFLARENET\n1.0.4.0/22,38803,\"Wireless Broadband, AU\"\n"), asn)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, added)
+	tags, err := tree.FindTags(ipv4FromBytes([]byte{1, 0, 5, 0}, 24))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{"Wireless Broadband, AU"}, tags)
+
+	// IPv6
+	treeV6 := NewTreeV6()
+	added, err = treeV6.LoadGeoIPBlocks(strings.NewReader("network,geoname_id\n2001:200::/32,1861060\n"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, added)
+
+	// errors
+	_, err = NewTreeV4().LoadGeoIPBlocks(strings.NewReader(""), nil)
+	assert.EqualError(t, err, "line 1: no header")
+	_, err = NewTreeV4().LoadGeoIPBlocks(strings.NewReader("prefix,geoname_id\n"), nil)
+	assert.EqualError(t, err, "line 1: no network column")
+	added, err = NewTreeV4().LoadGeoIPBlocks(strings.NewReader("network,geoname_id\n1.0.0.0/24,1\n2001:200::/32,2\n"), nil)
+	assert.EqualError(t, err, "line 3: \"2001:200::/32\" isn't an IPv4 prefix")
+	assert.Equal(t, 1, added)
+}
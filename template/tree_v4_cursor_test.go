@@ -0,0 +1,99 @@
+package template
+
+import (
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursor(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	var walked []string
+	tree.Walk(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		walked = append(walked, prefix.String())
+		return true
+	})
+
+	// page through, resuming from a token each time, as if across requests
+	var paged []string
+	token := ""
+	for {
+		cursor, err := tree.CursorFrom(token)
+		assert.NoError(t, err)
+		entries, next := cursor.Next(3)
+		for _, entry := range entries {
+			paged = append(paged, entry.Prefix.String())
+		}
+		if len(entries) < 3 {
+			break
+		}
+		token = next
+	}
+	assert.Equal(t, walked, paged)
+
+	// the same cursor can keep going
+	cursor := tree.Cursor()
+	assert.Equal(t, "", cursor.Token())
+	entries, token := cursor.Next(2)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, walked[1], token)
+	entries, _ = cursor.Next(100)
+	assert.Equal(t, len(walked)-2, len(entries))
+	entries, _ = cursor.Next(100)
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestCursorAcrossChanges(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	cursor := tree.Cursor()
+	entries, token := cursor.Next(3)
+	assert.Equal(t, "10.0.0.0/8", entries[1].Prefix.String())
+	assert.Equal(t, "10.1.0.0/16", token)
+
+	// remove the prefix the token points at, and add some before and after it
+	address, _, _ := patricia.ParseIPFromString("10.1.0.0/16")
+	tree.Delete(*address, func(payload GeneratedType, val GeneratedType) bool { return true }, nil)
+	for _, cidr := range []string{"10.0.0.0/16", "10.1.0.0/17", "10.2.0.0/16"} {
+		address, _, _ = patricia.ParseIPFromString(cidr)
+		tree.Add(*address, "new", nil)
+	}
+
+	cursor, err := tree.CursorFrom(token)
+	assert.NoError(t, err)
+	entries, _ = cursor.Next(3)
+	assert.Equal(t, "10.1.0.0/17", entries[0].Prefix.String())
+	assert.Equal(t, "10.1.2.0/24", entries[1].Prefix.String())
+	assert.Equal(t, "10.2.0.0/16", entries[2].Prefix.String())
+}
+
+func TestCursorBadToken(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	_, err := tree.CursorFrom("garbage")
+	assert.Error(t, err)
+	_, err = tree.CursorFrom("2001:db8::/32")
+	assert.Error(t, err)
+}
+
+func TestCursorV6(t *testing.T) {
+	tree := NewTreeV6()
+	for _, cidr := range []string{"2001:db8::/32", "2001:db8:1::/48", "2001:db8:8000::/33", "fe80::/10"} {
+		_, address, _ := patricia.ParseIPFromString(cidr)
+		tree.Add(*address, cidr, nil)
+	}
+
+	cursor := tree.Cursor()
+	entries, token := cursor.Next(2)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "2001:db8:1::/48", token)
+
+	cursor, err := tree.CursorFrom(token)
+	assert.NoError(t, err)
+	entries, _ = cursor.Next(10)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "2001:db8:8000::/33", entries[0].Prefix.String())
+	assert.Equal(t, "fe80::/10", entries[1].Prefix.String())
+}
@@ -0,0 +1,21 @@
+//go:build patricia_debug
+
+package template
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugChecks(t *testing.T) {
+	// a node with no prefix is caught by the check for it, rather than by matching nothing
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "10/8", nil)
+	tree.nodes[2].setLength(0)
+	_, _, err := tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "a", nil)
+	assert.True(t, errors.Is(err, ErrCorruptTree))
+	assert.True(t, strings.Contains(err.Error(), "has no prefix"), "%v", err)
+}
@@ -0,0 +1,83 @@
+package template
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectTreeV4(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	tree := NewTreeV4()
+	tree.Add(patricia.IPv4Address{}, "default", nil)
+	var addresses []patricia.IPv4Address
+	for i := 0; i < 2000; i++ {
+		// mostly /8 to /24, as in a routing table, with some longer ones
+		address := patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(17)))
+		if i%10 == 0 {
+			address.Length = uint(25 + random.Intn(8))
+		}
+		if i%3 == 0 && len(addresses) > 0 {
+			// inside another, so some prefixes hold others
+			address.Address = addresses[random.Intn(len(addresses))].Address | address.Address>>16
+		}
+		address.Address &^= uint32(uint64(0xffffffff) >> address.Length)
+		addresses = append(addresses, address)
+		tree.Add(address, i, nil)
+	}
+
+	direct := tree.OptimizeDirect()
+	assert.Equal(t, tree.CountTags(), direct.CountTags())
+	for _, address := range addresses {
+		for _, length := range []uint{32, 24, 28, uint(random.Intn(33))} {
+			lookup := address
+			lookup.Address |= random.Uint32() & uint32(uint64(0xffffffff)>>address.Length)
+			lookup.Length = length
+
+			expected, _ := tree.FindTags(lookup)
+			assert.Equal(t, expected, direct.FindTags(lookup))
+			assert.Equal(t, expected, direct.FindTagsAppend(nil, lookup))
+
+			expectedFound, expectedTag, _ := tree.FindDeepestTag(lookup)
+			found, tag := direct.FindDeepestTag(lookup)
+			assert.Equal(t, expectedFound, found)
+			assert.Equal(t, expectedTag, tag)
+
+			_, expected, _ = tree.FindDeepestTags(lookup)
+			_, tags := direct.FindDeepestTags(lookup)
+			assert.Equal(t, expected, tags)
+		}
+	}
+
+	// and without a default, where most addresses aren't in any prefix
+	tree.Delete(patricia.IPv4Address{}, func(GeneratedType, GeneratedType) bool { return true }, nil)
+	direct = tree.OptimizeDirect()
+	for i := 0; i < 1000; i++ {
+		lookup := patricia.NewIPv4Address(random.Uint32(), 32)
+		expectedFound, expectedTag, _ := tree.FindDeepestTag(lookup)
+		found, tag := direct.FindDeepestTag(lookup)
+		assert.Equal(t, expectedFound, found)
+		assert.Equal(t, expectedTag, tag)
+	}
+}
+
+func BenchmarkFindDeepestTagDirect(b *testing.B) {
+	tree := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 200000; i++ {
+		tree.Add(patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25))), i, nil)
+	}
+	direct := tree.OptimizeDirect()
+	addresses := make([]patricia.IPv4Address, 1024)
+	for i := range addresses {
+		addresses[i] = patricia.NewIPv4Address(random.Uint32(), 32)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		direct.FindDeepestTag(addresses[n%len(addresses)])
+	}
+}
@@ -0,0 +1,34 @@
+package template
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteDot(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "a", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "b", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 128, 0, 0}, 9), "c", nil)
+	tree.Add(ipv4FromBytes([]byte{192, 0, 0, 0}, 2), "d", nil)
+
+	var buf bytes.Buffer
+	assert.NoError(t, tree.WriteDot(&buf))
+	assert.Equal(t, `digraph TreeV4 {
+	node [shape=box, fontname=monospace];
+	n1 [label="#1\n0.0.0.0/0\nbits: -\ntags: 0"];
+	n1 -> n2 [label="0"];
+	n1 -> n4 [label="1"];
+	n2 [label="#2\n10.0.0.0/8\nbits: 00001010\ntags: 2"];
+	n2 -> n3 [label="1"];
+	n3 [label="#3\n10.128.0.0/9\nbits: 1\ntags: 1"];
+	n4 [label="#4\n192.0.0.0/2\nbits: 11\ntags: 1"];
+}
+`, buf.String())
+
+	assert.True(t, errors.Is(tree.WriteDot(failingWriter{}), io.ErrClosedPipe))
+}
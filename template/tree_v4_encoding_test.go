@@ -0,0 +1,678 @@
+package template
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+	"testing/iotest"
+	"time"
+	"unsafe"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+// builds a tree with a bit of everything: tags of several types, an expiring tag, and deleted nodes on the free list
+func buildEncodingTreeV4() *TreeV4 {
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{0, 0, 0, 0}, 0), "root", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "a", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), 42, nil)
+	tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), -1.5, nil)
+	tree.Add(ipv4FromBytes([]byte{10, 1, 2, 0}, 24), true, nil)
+	tree.Add(ipv4FromBytes([]byte{10, 1, 2, 3}, 32), uint16(7), nil)
+	tree.Add(ipv4FromBytes([]byte{192, 168, 0, 0}, 16), complex(1, 2), nil)
+	tree.AddWithExpiry(ipv4FromBytes([]byte{192, 168, 1, 0}, 24), "expiring", time.Now().Add(time.Hour), nil)
+	tree.Add(ipv4FromBytes([]byte{172, 16, 0, 0}, 12), "deleted", nil)
+	tree.Delete(ipv4FromBytes([]byte{172, 16, 0, 0}, 12), func(payload GeneratedType, val GeneratedType) bool { return true }, nil)
+	return tree
+}
+
+func TestMarshalBinary(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	assert.NotEqual(t, 0, len(tree.availableIndexes))
+
+	data, err := tree.MarshalBinary()
+	assert.NoError(t, err)
+
+	decoded := NewTreeV4()
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assertSameTreesV4(t, tree, decoded)
+	assert.Equal(t, tree.tags.expiring, decoded.tags.expiring)
+
+	// the nodes are renumbered, leaving out the free ones, and otherwise as they were
+	assert.Equal(t, len(tree.nodes)-len(tree.availableIndexes), len(decoded.nodes))
+	assert.Equal(t, 0, len(decoded.availableIndexes))
+	assert.NoError(t, decoded.checkStructure())
+	assert.Equal(t, decoded.nodes[2], tree.nodes[2])
+	redone, err := decoded.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, data, redone)
+
+	// and it still works like the original
+	for _, address := range []patricia.IPv4Address{
+		ipv4FromBytes([]byte{10, 1, 2, 3}, 32),
+		ipv4FromBytes([]byte{192, 168, 1, 1}, 32),
+		ipv4FromBytes([]byte{172, 16, 0, 1}, 32),
+	} {
+		expected, _ := tree.FindTags(address)
+		found, err := decoded.FindTags(address)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, found)
+	}
+	decoded.Add(ipv4FromBytes([]byte{172, 16, 0, 0}, 12), "new", nil)
+	assert.Equal(t, tree.CountTags()+1, decoded.CountTags())
+}
+
+func TestMarshalBinaryCompacts(t *testing.T) {
+	tree := NewTreeV4()
+	matchAll := func(GeneratedType, GeneratedType) bool { return true }
+	for i := 0; i < 1000; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<16, 16), i, nil)
+	}
+	for i := 10; i < 1000; i++ {
+		tree.Delete(patricia.NewIPv4Address(uint32(i)<<16, 16), matchAll, nil)
+	}
+	data, err := tree.MarshalBinary()
+	assert.NoError(t, err)
+
+	// a tree that's had most of its prefixes removed loads as small as one that never had them
+	decoded := NewTreeV4()
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	fresh := NewTreeV4()
+	for i := 0; i < 10; i++ {
+		fresh.Add(patricia.NewIPv4Address(uint32(i)<<16, 16), i, nil)
+	}
+	assert.True(t, len(tree.nodes) > 1000)
+	assert.Equal(t, len(fresh.nodes), len(decoded.nodes))
+	assertSameTreesV4(t, fresh, decoded)
+}
+
+func TestMarshalBinaryV6(t *testing.T) {
+	tree := NewTreeV6()
+	for i, cidr := range []string{"::/0", "2001:db8::/32", "2001:db8:1::/48", "fe80::1/128"} {
+		_, address, _ := patricia.ParseIPFromString(cidr)
+		tree.Add(*address, i, nil)
+	}
+
+	data, err := tree.MarshalBinary()
+	assert.NoError(t, err)
+	decoded := NewTreeV6()
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, tree.nodes, decoded.nodes)
+	assert.Equal(t, tree.tags.slices, decoded.tags.slices)
+
+	// the families aren't interchangeable
+	assert.True(t, errors.Is(NewTreeV4().UnmarshalBinary(data), ErrInvalidData))
+}
+
+func TestUnmarshalBinaryInvalid(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	data, err := tree.MarshalBinary()
+	assert.NoError(t, err)
+
+	// every truncation fails cleanly, leaving the tree alone
+	decoded := NewTreeV4()
+	decoded.Add(ipv4FromBytes([]byte{1, 2, 3, 4}, 32), "untouched", nil)
+	for i := 0; i < len(data); i++ {
+		err := decoded.UnmarshalBinary(data[:i])
+		assert.True(t, errors.Is(err, ErrInvalidData), "%d bytes: %v", i, err)
+	}
+	assert.True(t, errors.Is(decoded.UnmarshalBinary(append(data, 0)), ErrInvalidData))
+	assert.Equal(t, 1, decoded.CountTags())
+
+	// unknown version
+	bad := append([]byte{}, data...)
+	bad[len(_encodingMagicV4)] = 99
+	assert.True(t, errors.Is(decoded.UnmarshalBinary(bad), ErrInvalidData))
+}
+
+func TestUnmarshalBinaryVersion1(t *testing.T) {
+	// written by the first version of the encoding, before it had sections
+	data := []byte("PTV4\x01\x05\x00\x00\x00\x00\x00\x00\x00\x00\x02\x04\x00\x00\x00\x00\x00\x00\x03\x00\n\x00\x00\x00\b\x01" +
+		"\x00\x00\x01\x00\x00\x00\b\x01\x00\x00\xc0\xa8\x00\x00\x10\x01\x00\x02\x01a\x03\x04\x01\x01\x00")
+
+	tree := NewTreeV4()
+	assert.NoError(t, tree.UnmarshalBinary(data))
+	assert.NoError(t, tree.Load(bytes.NewReader(data)))
+	tags, err := tree.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{"a", 2}, tags)
+	tags, err = tree.FindTags(ipv4FromBytes([]byte{192, 168, 2, 3}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{true}, tags)
+}
+
+func TestUnmarshalBinarySections(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	data, err := tree.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, byte(_encodingVersionV4), data[len(_encodingMagicV4)])
+	assert.Equal(t, byte(encodingSectionEnd), data[len(data)-1])
+
+	// version 2 is the same, without the checksum
+	checksum := len(data) - 7
+	assert.Equal(t, []byte{encodingSectionChecksum, 4}, data[checksum:checksum+2])
+	version2 := append(append([]byte{}, data[:checksum]...), encodingSectionEnd)
+	version2[len(_encodingMagicV4)] = _encodingVersion2V4
+	expected := NewTreeV4()
+	assert.NoError(t, expected.UnmarshalBinary(data))
+	decoded := NewTreeV4()
+	assert.NoError(t, decoded.UnmarshalBinary(version2))
+	assert.Equal(t, expected.nodes, decoded.nodes)
+
+	// sections from a later version are skipped
+	later := append(append([]byte{}, version2[:len(version2)-1]...), 99, 3, 1, 2, 3, encodingSectionEnd)
+	decoded = NewTreeV4()
+	assert.NoError(t, decoded.UnmarshalBinary(later))
+	assert.NoError(t, decoded.Load(bytes.NewReader(later)))
+	assert.Equal(t, expected.nodes, decoded.nodes)
+	assert.Equal(t, expected.tags.slices, decoded.tags.slices)
+
+	// but sections have to be as long as they say
+	header := len(_encodingMagicV4) + 1
+	assert.Equal(t, byte(encodingSectionNodes), version2[header])
+	bad := append([]byte{}, version2...)
+	bad[header+1]--
+	assert.True(t, errors.Is(decoded.UnmarshalBinary(bad), ErrInvalidData))
+
+	// and in order
+	bad = append(append([]byte{}, version2[:len(version2)-1]...), encodingSectionNodes, 0, encodingSectionEnd)
+	err = decoded.UnmarshalBinary(bad)
+	assert.True(t, errors.Is(err, ErrInvalidData), "%v", err)
+
+	// and the tags are required
+	bad = append(append([]byte{}, version2[:header]...), encodingSectionEnd)
+	err = decoded.UnmarshalBinary(bad)
+	assert.True(t, errors.Is(err, ErrInvalidData), "%v", err)
+
+	// as is the checksum, from version 3
+	bad = append([]byte{}, version2...)
+	bad[len(_encodingMagicV4)] = _encodingVersionV4
+	err = decoded.UnmarshalBinary(bad)
+	assert.True(t, errors.Is(err, ErrInvalidData), "%v", err)
+}
+
+func TestUnmarshalBinaryCorrupt(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	data, err := tree.MarshalBinary()
+	assert.NoError(t, err)
+
+	// the checksum catches any change
+	decoded := NewTreeV4()
+	for i := range data {
+		for _, flip := range []byte{0x01, 0x80} {
+			bad := append([]byte{}, data...)
+			bad[i] ^= flip
+			err := decoded.UnmarshalBinary(bad)
+			assert.True(t, errors.Is(err, ErrInvalidData), "byte %d ^ %02x: %v", i, flip, err)
+			err = decoded.Load(bytes.NewReader(bad))
+			assert.True(t, errors.Is(err, ErrInvalidData), "byte %d ^ %02x: %v", i, flip, err)
+		}
+	}
+
+	// and a tree that was broken before it was encoded doesn't get past the structure check
+	for _, corrupt := range []func(tree *TreeV4){
+		func(tree *TreeV4) { tree.nodes[2].Left = 1 },
+		func(tree *TreeV4) { tree.nodes[2].Left = tree.nodes[1].Right },
+		func(tree *TreeV4) { tree.nodes[2].setLength(0) },
+		func(tree *TreeV4) { tree.nodes[3].setLength(30) },
+		func(tree *TreeV4) { tree.nodes[1].setLength(1) },
+		func(tree *TreeV4) { tree.availableIndexes = append(tree.availableIndexes, 2) },
+		func(tree *TreeV4) { tree.availableIndexes = append(tree.availableIndexes, tree.availableIndexes[0]) },
+	} {
+		broken := buildEncodingTreeV4()
+		corrupt(broken)
+		assert.True(t, errors.Is(broken.checkStructure(), ErrCorruptTree))
+		data, err := broken.MarshalBinary()
+		assert.NoError(t, err)
+		err = decoded.UnmarshalBinary(data)
+		assert.True(t, errors.Is(err, ErrInvalidData), "%v", err)
+		assert.True(t, errors.Is(err, ErrCorruptTree), "%v", err)
+	}
+	assert.NoError(t, buildEncodingTreeV4().checkStructure())
+	assert.Equal(t, 0, decoded.CountTags())
+}
+
+// values that fit in 64 bits, but not in an int on 32-bit platforms, fail there rather than wrapping around
+func TestUnmarshalBinaryIntSize(t *testing.T) {
+	fits := strconv.IntSize == 64
+
+	d := decoder{data: binary.AppendUvarint(nil, math.MaxUint32)}
+	count := d.count(math.MaxUint32, "tag count")
+	assert.Equal(t, fits, d.err == nil, "%v", d.err)
+	assert.True(t, count >= 0)
+
+	d = decoder{data: binary.AppendVarint([]byte{tagKindInt}, -1<<40)}
+	value := d.tagValue()
+	assert.Equal(t, fits, d.err == nil, "%v", d.err)
+	if fits {
+		assert.Equal(t, int64(-1<<40), int64(value.(int)))
+	}
+	d = decoder{data: binary.AppendUvarint([]byte{tagKindUint}, 1<<40)}
+	value = d.tagValue()
+	assert.Equal(t, fits, d.err == nil, "%v", d.err)
+	if fits {
+		assert.Equal(t, uint64(1<<40), uint64(value.(uint)))
+	}
+
+	// and a native encoding's node count is checked before it's multiplied out
+	data, err := buildEncodingTreeV4().MarshalNative()
+	assert.NoError(t, err)
+	checksumStart := len(data) - _nativeChecksumLength
+	for _, nodeCount := range []uint32{math.MaxUint32, math.MaxUint32 / uint32(unsafe.Sizeof(treeNodeV4{}))} {
+		binary.NativeEndian.PutUint32(data[16:], nodeCount)
+		binary.BigEndian.PutUint32(data[checksumStart:], crc32Checksum(data[:checksumStart]))
+		assert.True(t, errors.Is(NewTreeV4().UnmarshalBinaryNoCopy(data), ErrInvalidData))
+	}
+}
+
+func TestMarshalBinaryUnsupportedTag(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), struct{}{}, nil)
+	_, err := tree.MarshalBinary()
+	assert.True(t, errors.Is(err, ErrUnsupportedTag))
+}
+
+func TestGob(t *testing.T) {
+	type wrapper struct {
+		Name string
+		Tree *TreeV4
+	}
+	tree := buildEncodingTreeV4()
+
+	var buf bytes.Buffer
+	assert.NoError(t, gob.NewEncoder(&buf).Encode(wrapper{Name: "tree", Tree: tree}))
+
+	var decoded wrapper
+	assert.NoError(t, gob.NewDecoder(&buf).Decode(&decoded))
+	assert.Equal(t, "tree", decoded.Name)
+	assertSameTreesV4(t, tree, decoded.Tree)
+
+	tags, err := decoded.Tree.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, 6, len(tags))
+	decoded.Tree.Add(ipv4FromBytes([]byte{10, 1, 2, 3}, 32), "new", nil)
+	assert.Equal(t, tree.CountTags()+1, decoded.Tree.CountTags())
+}
+
+func TestJSON(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	data, err := json.Marshal(tree)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"cidr":"0.0.0.0/0","tags":["root"]},{"cidr":"10.0.0.0/8","tags":["a","b"]},`+
+		`{"cidr":"10.1.0.0/16","tags":["c"]},{"cidr":"10.1.2.0/24","tags":["d"]},{"cidr":"10.128.0.0/9","tags":["e"]},`+
+		`{"cidr":"192.168.0.0/16","tags":["f"]},{"cidr":"192.168.1.1/32","tags":["g"]}]`, string(data))
+
+	decoded := NewTreeV4()
+	assert.NoError(t, json.Unmarshal(data, decoded))
+	found := make(map[string][]string)
+	for prefix, tags := range decoded.All() {
+		for _, tag := range tags {
+			found[prefix.String()] = append(found[prefix.String()], tag.(string))
+		}
+	}
+	assert.Equal(t, _iterTestEntries, found)
+
+	// empty trees are empty lists
+	data, err = json.Marshal(NewTreeV4())
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", string(data))
+
+	// complex numbers are pairs, and floats JSON has no numbers for are strings - see the complex and float packages
+	// for them being decoded
+	numbers := NewTreeV4()
+	numbers.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), complex(1, 2), nil)
+	numbers.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), math.NaN(), nil)
+	numbers.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), float32(math.Inf(-1)), nil)
+	data, err = json.Marshal(numbers)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"cidr":"10.0.0.0/8","tags":[[1,2],"NaN","-Inf"]}]`, string(data))
+
+	// bad input leaves the tree alone
+	assert.Error(t, json.Unmarshal([]byte(`[{"cidr":"10.0.0.0/33","tags":[1]}]`), decoded))
+	assert.Error(t, json.Unmarshal([]byte(`[{"cidr":"2001:db8::/32","tags":[1]}]`), decoded))
+	assert.Error(t, json.Unmarshal([]byte(`{}`), decoded))
+	assert.Equal(t, 8, decoded.CountTags())
+}
+
+func TestJSONV6(t *testing.T) {
+	tree := NewTreeV6()
+	assert.NoError(t, json.Unmarshal([]byte(`[{"cidr":"2001:db8::/32","tags":["a"]},{"cidr":"::/0","tags":["b"]}]`), tree))
+	data, err := json.Marshal(tree)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"cidr":"::/0","tags":["b"]},{"cidr":"2001:db8::/32","tags":["a"]}]`, string(data))
+}
+
+// records the size of each write
+type chunkRecorder struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (c *chunkRecorder) Write(data []byte) (int, error) {
+	c.writes = append(c.writes, len(data))
+	return c.Buffer.Write(data)
+}
+
+func TestSaveLoad(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	for i := 0; i < 20000; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<12, 20), "tag", nil)
+	}
+
+	// written in chunks, to the same encoding as MarshalBinary
+	var saved chunkRecorder
+	assert.NoError(t, tree.Save(&saved))
+	assert.True(t, len(saved.writes) > 1)
+	for _, size := range saved.writes {
+		assert.True(t, size < 2*_encodingChunkSize, "%d byte write", size)
+	}
+	data, err := tree.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, data, saved.Bytes())
+
+	// read back a byte at a time
+	expected := NewTreeV4()
+	assert.NoError(t, expected.UnmarshalBinary(data))
+	loaded := NewTreeV4()
+	assert.NoError(t, loaded.Load(iotest.OneByteReader(bytes.NewReader(data))))
+	assert.Equal(t, expected.nodes, loaded.nodes)
+	assert.Equal(t, expected.availableIndexes, loaded.availableIndexes)
+	expectedTags, expectedExpirations := expected.storedTagsV4()
+	loadedTags, loadedExpirations := loaded.storedTagsV4()
+	assert.Equal(t, expectedTags, loadedTags)
+	assert.Equal(t, expectedExpirations, loadedExpirations)
+	assertSameTreesV4(t, tree, loaded)
+}
+
+func TestLoadErrors(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	data, err := tree.MarshalBinary()
+	assert.NoError(t, err)
+
+	loaded := NewTreeV4()
+	loaded.Add(ipv4FromBytes([]byte{1, 2, 3, 4}, 32), "untouched", nil)
+	for i := 0; i < len(data); i++ {
+		err := loaded.Load(bytes.NewReader(data[:i]))
+		assert.True(t, errors.Is(err, ErrInvalidData), "%d bytes: %v", i, err)
+	}
+
+	// read errors come back as they are
+	err = loaded.Load(io.MultiReader(bytes.NewReader(data[:10]), iotest.ErrReader(io.ErrClosedPipe)))
+	assert.True(t, errors.Is(err, io.ErrClosedPipe), "%v", err)
+	assert.Equal(t, 1, loaded.CountTags())
+
+	// and so do write errors
+	assert.True(t, errors.Is(tree.Save(failingWriter{}), io.ErrClosedPipe))
+}
+
+func TestSaveCompressed(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	for i := 0; i < 20000; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<12, 20), "tag", nil)
+	}
+	var uncompressed bytes.Buffer
+	assert.NoError(t, tree.Save(&uncompressed))
+
+	gzipWriter := func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	}
+	gzipReader := func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	}
+	var compressed bytes.Buffer
+	assert.NoError(t, tree.SaveCompressed(&compressed, gzipWriter))
+	assert.True(t, compressed.Len() < uncompressed.Len()/4, "%d bytes compressed from %d", compressed.Len(), uncompressed.Len())
+
+	expected := NewTreeV4()
+	assert.NoError(t, expected.UnmarshalBinary(uncompressed.Bytes()))
+	loaded := NewTreeV4()
+	assert.NoError(t, loaded.LoadCompressed(bytes.NewReader(compressed.Bytes()), gzipReader))
+	assert.Equal(t, expected.nodes, loaded.nodes)
+	assert.Equal(t, expected.tags.slices, loaded.tags.slices)
+
+	// cutting it short anywhere fails
+	untouched := NewTreeV4()
+	untouched.Add(ipv4FromBytes([]byte{1, 2, 3, 4}, 32), "untouched", nil)
+	data := compressed.Bytes()
+	for i := 0; i < len(data); i += 1 + i/10 {
+		err := untouched.LoadCompressed(bytes.NewReader(data[:i]), gzipReader)
+		assert.True(t, errors.Is(err, ErrInvalidData), "%d bytes: %v", i, err)
+	}
+	assert.Equal(t, 1, untouched.CountTags())
+
+	// framing alone, without compression
+	var framed bytes.Buffer
+	assert.NoError(t, tree.SaveCompressed(&framed, nil))
+	assert.NoError(t, loaded.LoadCompressed(&framed, nil))
+	assert.Equal(t, expected.tags.slices, loaded.tags.slices)
+	assert.NoError(t, tree.SaveCompressed(&framed, nil))
+	err := loaded.LoadCompressed(bytes.NewReader(framed.Bytes()[:framed.Len()-1]), nil)
+	assert.True(t, errors.Is(err, ErrInvalidData), "%v", err)
+
+	// compressor errors come back as they are
+	assert.True(t, errors.Is(tree.SaveCompressed(failingWriter{}, gzipWriter), io.ErrClosedPipe))
+	failing := func(r io.Reader) (io.Reader, error) {
+		return nil, io.ErrClosedPipe
+	}
+	assert.True(t, errors.Is(loaded.LoadCompressed(bytes.NewReader(data), failing), io.ErrClosedPipe))
+}
+
+func TestSaveSubtree(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{0, 0, 0, 0}, 0), "default", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "a", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "b", nil)
+	tree.AddWithExpiry(ipv4FromBytes([]byte{10, 1, 2, 0}, 24), "c", time.Now().Add(time.Hour), nil)
+	tree.Add(ipv4FromBytes([]byte{11, 0, 0, 0}, 8), "d", nil)
+
+	var buf bytes.Buffer
+	assert.NoError(t, tree.SaveSubtree(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), &buf))
+	data := buf.Bytes()
+
+	// on its own, it's relative to the subtree's address
+	relative := NewTreeV4()
+	assert.NoError(t, relative.Load(bytes.NewReader(data)))
+	entries := make(map[string][]GeneratedType)
+	for prefix, tags := range relative.All() {
+		entries[prefix.String()] = tags
+	}
+	assert.Equal(t, map[string][]GeneratedType{"0.0.0.0/0": {"a"}, "1.0.0.0/8": {"b"}, "1.2.0.0/16": {"c"}}, entries)
+
+	// grafted back in where it came from
+	loaded := NewTreeV4()
+	added, err := loaded.LoadSubtree(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), bytes.NewReader(data), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, added)
+	tree.Delete(ipv4FromBytes([]byte{0, 0, 0, 0}, 0), func(GeneratedType, GeneratedType) bool { return true }, nil)
+	tree.Delete(ipv4FromBytes([]byte{11, 0, 0, 0}, 8), func(GeneratedType, GeneratedType) bool { return true }, nil)
+	assertSameTreesV4(t, tree, loaded)
+	assert.Equal(t, 1, loaded.tags.expiring)
+
+	// or somewhere else
+	loaded = NewTreeV4()
+	added, err = loaded.LoadSubtree(ipv4FromBytes([]byte{192, 168, 0, 0}, 16), bytes.NewReader(data), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, added)
+	tags, err := loaded.FindTags(ipv4FromBytes([]byte{192, 168, 1, 2}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{"a", "b", "c"}, tags)
+
+	// an empty subtree, and a broken one
+	var empty bytes.Buffer
+	assert.NoError(t, tree.SaveSubtree(ipv4FromBytes([]byte{172, 16, 0, 0}, 12), &empty))
+	added, err = loaded.LoadSubtree(ipv4FromBytes([]byte{172, 16, 0, 0}, 12), &empty, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, added)
+	added, err = loaded.LoadSubtree(ipv4FromBytes([]byte{172, 16, 0, 0}, 12), bytes.NewReader(data[:len(data)-1]), nil)
+	assert.True(t, errors.Is(err, ErrInvalidData))
+	assert.Equal(t, 3, loaded.CountTags())
+}
+
+func TestMarshalCanonical(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour)
+	prefixes := make([]patricia.IPv4Address, 1000)
+	for i := range prefixes {
+		prefixes[i] = patricia.NewIPv4Address(rand.Uint32(), uint(rand.Intn(33)))
+	}
+
+	// the same tags, added in a different order, with other tags added and removed along the way
+	first := NewTreeV4()
+	for i, prefix := range prefixes {
+		first.Add(prefix, i, nil)
+		first.Add(prefix, "x", nil)
+	}
+	first.AddWithExpiry(prefixes[0], "expiring", expiresAt, nil)
+	first.AddWithExpiry(prefixes[1], "expired", time.Now().Add(-time.Second), nil)
+	second := NewTreeV4()
+	second.AddWithExpiry(prefixes[0], "expiring", expiresAt, nil)
+	var removed []patricia.IPv4Address
+	for i := len(prefixes) - 1; i >= 0; i-- {
+		second.Add(prefixes[i], "x", nil)
+		removed = append(removed, patricia.NewIPv4Address(rand.Uint32(), 32))
+		second.Add(removed[len(removed)-1], "removed", nil)
+		second.Add(prefixes[i], i, nil)
+	}
+	for _, prefix := range removed {
+		second.Delete(prefix, func(payload GeneratedType, val GeneratedType) bool { return payload == val }, "removed")
+	}
+	assert.NotEqual(t, first.nodes, second.nodes)
+
+	firstData, err := first.MarshalCanonical()
+	assert.NoError(t, err)
+	secondData, err := second.MarshalCanonical()
+	assert.NoError(t, err)
+	assert.Equal(t, firstData, secondData)
+	var buf bytes.Buffer
+	assert.NoError(t, second.SaveCanonical(&buf))
+	assert.Equal(t, firstData, buf.Bytes())
+
+	// it decodes like any other encoding
+	decoded := NewTreeV4()
+	assert.NoError(t, decoded.UnmarshalBinary(firstData))
+	assert.Equal(t, second.CountTags(), decoded.CountTags())
+	assert.Equal(t, 0, len(decoded.availableIndexes))
+	assert.Equal(t, 1, decoded.tags.expiring)
+
+	// and the ordinary encoding doesn't change from one call to the next
+	firstData, _ = first.MarshalBinary()
+	for i := 0; i < 10; i++ {
+		data, _ := first.MarshalBinary()
+		assert.Equal(t, firstData, data)
+	}
+
+	unsupported := NewTreeV4()
+	unsupported.Add(prefixes[0], []int{1}, nil)
+	_, err = unsupported.MarshalCanonical()
+	assert.True(t, errors.Is(err, ErrUnsupportedTag))
+}
+
+func TestLoadConverted(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), uint32(8), nil)
+	tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), uint32(16), nil)
+	tree.Add(ipv4FromBytes([]byte{10, 1, 2, 0}, 24), uint32(70000), nil)
+	var buf bytes.Buffer
+	assert.NoError(t, tree.Save(&buf))
+	data := buf.Bytes()
+
+	type converted struct {
+		length uint16
+		large  bool
+	}
+	convert := func(value interface{}) (GeneratedType, error) {
+		v, ok := value.(uint32)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %T", value)
+		}
+		return converted{length: uint16(v), large: v > math.MaxUint16}, nil
+	}
+	loaded := NewTreeV4()
+	assert.NoError(t, loaded.LoadConverted(bytes.NewReader(data), convert))
+	assert.Equal(t, tree.nodes, loaded.nodes)
+	tags, err := loaded.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{converted{8, false}, converted{16, false}, converted{4464, true}}, tags)
+
+	// conversion errors come back, leaving the tree as it was
+	tree.Add(ipv4FromBytes([]byte{192, 168, 0, 0}, 16), "not a number", nil)
+	buf.Reset()
+	assert.NoError(t, tree.Save(&buf))
+	err = loaded.LoadConverted(&buf, convert)
+	assert.EqualError(t, err, "converting tag not a number: unexpected string")
+	assert.Equal(t, 3, loaded.CountTags())
+
+	// without a conversion, tags are converted as they would be for JSON
+	assert.NoError(t, loaded.LoadConverted(bytes.NewReader(data), nil))
+	assert.Equal(t, tree.CountTags()-1, loaded.CountTags())
+}
+
+func TestLoadFrom(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	for i := 0; i < 20000; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<12, 20), "tag", nil)
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, tree.Save(&buf))
+	data := buf.Bytes()
+
+	// progress is reported as it goes, and when it's done
+	var reports []LoadProgress
+	loaded := NewTreeV4()
+	err := loaded.LoadFrom(context.Background(), bytes.NewReader(data), WithLoadProgress(0, func(progress LoadProgress) {
+		reports = append(reports, progress)
+	}))
+	assert.NoError(t, err)
+	assertSameTreesV4(t, tree, loaded)
+	assert.True(t, len(reports) > 2, "%d reports", len(reports))
+	assert.Equal(t, LoadProgress{Tags: tree.CountTags(), BytesRead: int64(len(data))}, reports[len(reports)-1])
+	for i := 1; i < len(reports); i++ {
+		assert.True(t, reports[i].BytesRead >= reports[i-1].BytesRead && reports[i].Tags >= reports[i-1].Tags)
+	}
+
+	// and it stops when the context is done, leaving the tree as it was
+	ctx, cancel := context.WithCancel(context.Background())
+	untouched := NewTreeV4()
+	untouched.Add(ipv4FromBytes([]byte{1, 2, 3, 4}, 32), "untouched", nil)
+	err = untouched.LoadFrom(ctx, bytes.NewReader(data), WithLoadProgress(0, func(progress LoadProgress) {
+		if progress.BytesRead > 0 {
+			cancel()
+		}
+	}))
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	assert.Equal(t, 1, untouched.CountTags())
+	assert.True(t, errors.Is(untouched.LoadFrom(ctx, bytes.NewReader(data)), context.Canceled))
+
+	// compressed, without reporting progress
+	gzipWriter := func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	}
+	gzipReader := func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	}
+	var compressed bytes.Buffer
+	assert.NoError(t, tree.SaveCompressed(&compressed, gzipWriter))
+	loaded = NewTreeV4()
+	assert.NoError(t, loaded.LoadFrom(context.Background(), &compressed, WithLoadDecompressor(gzipReader)))
+	assertSameTreesV4(t, tree, loaded)
+	assert.Error(t, loaded.LoadFrom(context.Background(), bytes.NewReader(data), WithLoadDecompressor(gzipReader)))
+	assert.Equal(t, tree.CountTags(), loaded.CountTags())
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(data []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
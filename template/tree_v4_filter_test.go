@@ -0,0 +1,133 @@
+package template
+
+import (
+	"math/bits"
+	"math/rand"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+// how many of the filter's bits are set
+func (f *PresenceFilterV4) setCount() int {
+	ret := 0
+	for _, word := range f.bitmap {
+		ret += bits.OnesCount64(word)
+	}
+	return ret
+}
+
+func TestPresenceFilter(t *testing.T) {
+	tree := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		// a few networks' worth, with a prefix shorter than the filter's bits here and there
+		address := patricia.NewIPv4Address(10<<24|random.Uint32()>>12, uint(24+random.Intn(9)))
+		if i%100 == 0 {
+			address = patricia.NewIPv4Address(random.Uint32(), uint(12+random.Intn(4)))
+		}
+		tree.Add(address, i, nil)
+	}
+	filter := tree.NewPresenceFilter(16)
+
+	lookups := make([]patricia.IPv4Address, 0, 30000)
+	for i := 0; i < 10000; i++ {
+		lookups = append(lookups, patricia.NewIPv4Address(random.Uint32(), 32),
+			patricia.NewIPv4Address(10<<24|random.Uint32()>>12, 32), patricia.NewIPv4Address(random.Uint32(), uint(random.Intn(33))))
+	}
+	assertFiltered := func() {
+		for _, address := range lookups {
+			expectedFound, expectedTag, _ := tree.FindDeepestTag(address)
+			found, tag, err := filter.FindDeepestTag(address)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedFound, found, address.String())
+			assert.Equal(t, expectedTag, tag, address.String())
+		}
+	}
+	assertFiltered()
+	skipped, passed := filter.Stats()
+	assert.Equal(t, uint64(len(lookups)), skipped+passed)
+	assert.True(t, skipped > uint64(len(lookups))/3, "%d of %d lookups skipped", skipped, len(lookups))
+
+	// a change leaves it out of date, so lookups go to the tree until it's rebuilt
+	tree.Add(patricia.NewIPv4Address(192<<24|168<<16, 16), "new", nil)
+	filter.skipped, filter.passed = 0, 0
+	for i := 0; i < tree.PrefixCount(); i++ {
+		filter.FindDeepestTag(lookups[i])
+	}
+	skipped, passed = filter.Stats()
+	assert.Equal(t, uint64(0), skipped)
+	assertFiltered()
+	found, tag, _ := filter.FindDeepestTag(patricia.NewIPv4Address(192<<24|168<<16|1, 32))
+	assert.True(t, found)
+	assert.Equal(t, "new", tag)
+
+	// a prefix shorter than the bits sets all of the bits it covers, and one holding every address sets every bit
+	tree.Add(patricia.NewIPv4Address(0, 1), "half", nil)
+	filter.stale = tree.PrefixCount()
+	assertFiltered()
+	for _, word := range filter.bitmap[:len(filter.bitmap)/2] {
+		assert.Equal(t, ^uint64(0), word)
+	}
+	assert.True(t, filter.setCount() < len(filter.bitmap)*64)
+	tree.Add(patricia.IPv4Address{}, "default", nil)
+	filter.stale = tree.PrefixCount()
+	assertFiltered()
+	assert.Equal(t, len(filter.bitmap)*64, filter.setCount())
+
+	// as few bits as there are, or more than there can be
+	for _, bits := range []uint{0, 3, 32} {
+		filter = tree.NewPresenceFilter(bits)
+		assertFiltered()
+	}
+	assert.Equal(t, uint(_maxPresenceFilterBits), filter.bits)
+}
+
+func TestPresenceFilterV6(t *testing.T) {
+	tree := NewTreeV6()
+	prefix := patricia.NewIPv6Address([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 32)
+	tree.Add(prefix, "documentation", nil)
+	filter := tree.NewPresenceFilter(16)
+	for _, address := range []patricia.IPv6Address{
+		patricia.NewIPv6Address([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 128),
+		patricia.NewIPv6Address([]byte{0x20, 0x01, 0x0d, 0xb9, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 128),
+		patricia.NewIPv6Address([]byte{0x20, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 128),
+	} {
+		expectedFound, expectedTag, _ := tree.FindDeepestTag(address)
+		found, tag, err := filter.FindDeepestTag(address)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedFound, found)
+		assert.Equal(t, expectedTag, tag)
+	}
+	skipped, passed := filter.Stats()
+	assert.Equal(t, uint64(1), skipped)
+	assert.Equal(t, uint64(2), passed)
+}
+
+// lookups in a tree of prefixes from a few networks, which most addresses miss, in the tree itself, and through a
+// presence filter - about 3x faster, where this was written
+func BenchmarkFindDeepestTagPresenceFilter(b *testing.B) {
+	tree := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 200000; i++ {
+		tree.Add(patricia.NewIPv4Address(10<<24|random.Uint32()>>8, uint(24+random.Intn(9))), i, nil)
+		tree.Add(patricia.NewIPv4Address(172<<24|16<<16|random.Uint32()>>12, uint(24+random.Intn(9))), i, nil)
+	}
+	addresses := make([]patricia.IPv4Address, 1<<16)
+	for i := range addresses {
+		addresses[i] = patricia.NewIPv4Address(random.Uint32(), 32)
+	}
+	filter := tree.NewPresenceFilter(16)
+
+	b.Run("tree", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			tree.FindDeepestTag(addresses[n%len(addresses)])
+		}
+	})
+	b.Run("filter", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			filter.FindDeepestTag(addresses[n%len(addresses)])
+		}
+	})
+}
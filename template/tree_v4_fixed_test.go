@@ -0,0 +1,110 @@
+package template
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFixedLengthTreeV4(t *testing.T) {
+	optimize := func(tree *TreeV4) readOnlyTreeV4 {
+		ret, err := tree.OptimizeFixedLength()
+		assert.NoError(t, err)
+		return ret
+	}
+	random := rand.New(rand.NewSource(1))
+
+	// empty, then with tags at the root only
+	tree := NewTreeV4()
+	assertReadOnlyV4(t, tree, optimize, []patricia.IPv4Address{patricia.NewIPv4Address(random.Uint32(), 32), {}})
+	tree.Add(patricia.IPv4Address{}, "default", nil)
+	assertReadOnlyV4(t, tree, optimize, []patricia.IPv4Address{patricia.NewIPv4Address(random.Uint32(), 32), {}})
+
+	// /24s, few enough for a hash table, and /12s, in an array
+	for _, length := range []uint{24, 12} {
+		tree := NewTreeV4()
+		var lookups []patricia.IPv4Address
+		for i := 0; i < 2000; i++ {
+			address := patricia.NewIPv4Address(random.Uint32(), 32)
+			prefix := address
+			prefix.Length = length
+			tree.Add(prefix, i, nil)
+			if i%10 == 0 {
+				tree.Add(prefix, "again", nil)
+			}
+			short := address
+			short.Length = uint(random.Intn(33))
+			lookups = append(lookups, address, short, patricia.NewIPv4Address(random.Uint32(), 32))
+		}
+		fixed, err := tree.OptimizeFixedLength()
+		assert.NoError(t, err)
+		assert.Equal(t, length == 12, fixed.direct != nil)
+		assertReadOnlyV4(t, tree, optimize, lookups)
+	}
+
+	// a prefix of another length, as the root is to the rest
+	tree.Add(patricia.NewIPv4Address(10<<24, 8), "ten", nil)
+	_, err := tree.OptimizeFixedLength()
+	assert.True(t, errors.Is(err, ErrMixedPrefixLengths))
+}
+
+func TestFixedLengthTreeV6(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	tree := NewTreeV6()
+	var addresses []patricia.IPv6Address
+	for i := 0; i < 2000; i++ {
+		address := patricia.IPv6Address{Left: random.Uint64(), Right: random.Uint64(), Length: 128}
+		prefix := address
+		prefix.Length = 64
+		tree.Add(prefix, i, nil)
+		addresses = append(addresses, address, patricia.IPv6Address{Left: random.Uint64(), Length: 128})
+	}
+
+	fixed, err := tree.OptimizeFixedLength()
+	assert.NoError(t, err)
+	assert.Equal(t, tree.CountTags(), fixed.CountTags())
+	for _, address := range addresses {
+		expected, _ := tree.FindTags(address)
+		assert.Equal(t, expected, fixed.FindTags(address))
+		_, expectedTags, _ := tree.FindDeepestTags(address)
+		_, tags := fixed.FindDeepestTags(address)
+		assert.Equal(t, expectedTags, tags)
+	}
+}
+
+// lookups in a million /24s, in the tree, an optimized copy, and a fixed-length copy - about 15x and 2x faster than the
+// other two, where this was written
+func BenchmarkFindDeepestTagFixedLength(b *testing.B) {
+	for _, name := range []string{"tree", "optimized", "fixed"} {
+		b.Run(name, func(b *testing.B) {
+			tree := NewTreeV4()
+			random := rand.New(rand.NewSource(1))
+			for i := 0; i < 1<<20; i++ {
+				tree.Set(patricia.NewIPv4Address(random.Uint32(), 24), i)
+			}
+			addresses := make([]patricia.IPv4Address, 1<<16)
+			for i := range addresses {
+				addresses[i] = patricia.NewIPv4Address(random.Uint32(), 32)
+			}
+			findDeepestTag := func(address patricia.IPv4Address) {
+				tree.FindDeepestTag(address)
+			}
+			switch name {
+			case "optimized":
+				optimized := tree.Optimize()
+				findDeepestTag = func(address patricia.IPv4Address) { optimized.FindDeepestTag(address) }
+			case "fixed":
+				fixed, _ := tree.OptimizeFixedLength()
+				findDeepestTag = func(address patricia.IPv4Address) { fixed.FindDeepestTag(address) }
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				findDeepestTag(addresses[n%len(addresses)])
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package template
+
+import (
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+// a frozen TreeV4, with the lookups of a read-only copy
+type frozenTreeV4 struct {
+	*TreeV4
+}
+
+// TreeV4.CountTags counts expired tags too, which read-only copies leave out
+func (f frozenTreeV4) CountTags() int {
+	ret := 0
+	for _, tags := range f.All() {
+		ret += len(tags)
+	}
+	return ret
+}
+
+func (f frozenTreeV4) FindTags(address patricia.IPv4Address) []GeneratedType {
+	ret, _ := f.TreeV4.FindTags(address)
+	return ret
+}
+
+func (f frozenTreeV4) FindDeepestTag(address patricia.IPv4Address) (bool, GeneratedType) {
+	found, ret, _ := f.TreeV4.FindDeepestTag(address)
+	return found, ret
+}
+
+func (f frozenTreeV4) FindDeepestTags(address patricia.IPv4Address) (bool, []GeneratedType) {
+	found, ret, _ := f.TreeV4.FindDeepestTags(address)
+	return found, ret
+}
+
+func TestFrozenTreeV4(t *testing.T) {
+	testReadOnlyTreeV4(t, func(tree *TreeV4) readOnlyTreeV4 {
+		ret := tree.Clone()
+		ret.FreezeInPlace()
+		return frozenTreeV4{ret}
+	})
+}
+
+func TestFreezeInPlace(t *testing.T) {
+	tree := NewTreeV4(WithResultPool())
+	tree.Add(patricia.IPv4Address{}, "default", nil)
+	tree.Add(patricia.NewIPv4Address(10<<24, 8), "10/8", nil)
+	tree.Add(patricia.NewIPv4Address(10<<24|1<<16, 16), "10.1/16", nil)
+	tree.Add(patricia.NewIPv4Address(10<<24|1<<16, 16), "10.1/16 again", nil)
+	address := patricia.NewIPv4Address(10<<24|1<<16|1, 32)
+	matchAll := func(GeneratedType, GeneratedType) bool { return true }
+
+	assert.False(t, tree.IsFrozen())
+	tree.FreezeInPlace()
+	assert.True(t, tree.IsFrozen())
+
+	// lookups come from the frozen copy, and find the same tags
+	tags, err := tree.FindTags(address)
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{"default", "10/8", "10.1/16", "10.1/16 again"}, tags)
+	ReleaseTags(tags)
+	tags, err = tree.FindTagsWithFilter(address, func(tag GeneratedType) bool { return tag != "10/8" })
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{"default", "10.1/16", "10.1/16 again"}, tags)
+	found, tags, err := tree.FindDeepestTags(address)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []GeneratedType{"10.1/16", "10.1/16 again"}, tags)
+	tags[0] = "changed"
+	_, tags, _ = tree.FindDeepestTags(address)
+	assert.Equal(t, []GeneratedType{"10.1/16", "10.1/16 again"}, tags)
+	assert.Equal(t, 4, tree.CountTags())
+
+	buf := make([]GeneratedType, 0, 8)
+	allocs := testing.AllocsPerRun(10, func() {
+		tree.FindDeepestTag(address)
+		tree.FindTagsAppend(buf[:0], address)
+	})
+	assert.Equal(t, float64(0), allocs)
+
+	// changes are refused, leaving the tree as it was
+	_, _, err = tree.Add(address, "new", nil)
+	assert.Equal(t, ErrFrozen, err)
+	_, _, err = tree.Set(address, "new")
+	assert.Equal(t, ErrFrozen, err)
+	_, err = tree.Delete(address, matchAll, nil)
+	assert.Equal(t, ErrFrozen, err)
+	_, _, err = tree.UpdateTags(address, func(tag GeneratedType) (GeneratedType, bool) { return tag, false })
+	assert.Equal(t, ErrFrozen, err)
+	_, _, err = tree.Prune(patricia.NewIPv4Address(10<<24, 8))
+	assert.Equal(t, ErrFrozen, err)
+	_, err = tree.Graft(patricia.IPv4Address{}, NewTreeV4(), nil)
+	assert.Equal(t, ErrFrozen, err)
+	batch := tree.NewBatch()
+	batch.Add(address, "new", nil)
+	assert.Equal(t, ErrFrozen, batch.Commit())
+	assert.Equal(t, 4, tree.CountTags())
+
+	// snapshots stay frozen, clones don't
+	assert.True(t, tree.Snapshot().IsFrozen())
+	clone := tree.Clone()
+	assert.False(t, clone.IsFrozen())
+	_, _, err = clone.Add(address, "new", nil)
+	assert.NoError(t, err)
+
+	// thawed, the tree can be changed again, and lookups see the changes
+	tree.Thaw()
+	assert.False(t, tree.IsFrozen())
+	_, _, err = tree.Add(address, "new", nil)
+	assert.NoError(t, err)
+	found, tag, err := tree.FindDeepestTag(address)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "new", tag)
+
+	// clearing a frozen tree fails, like any other change, and leaves it as it was
+	tree.FreezeInPlace()
+	assert.Equal(t, ErrFrozen, tree.Clear())
+	assert.True(t, tree.IsFrozen())
+	found, _, err = tree.FindDeepestTag(address)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	tree.Thaw()
+	assert.NoError(t, tree.Clear())
+	assert.Equal(t, 0, tree.CountTags())
+}
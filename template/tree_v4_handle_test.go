@@ -0,0 +1,73 @@
+package template
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTreeHandleV4(t *testing.T) {
+	handle := NewTreeHandleV4()
+	assert.Equal(t, 0, handle.Load().CountTags())
+
+	// changes to the standby tree aren't seen until it's swapped in
+	handle.Standby().Add(patricia.NewIPv4Address(0, 0), "root", nil)
+	assert.Equal(t, 0, handle.Load().CountTags())
+	active := handle.Swap()
+	assert.True(t, active == handle.Load())
+	assert.Equal(t, 1, handle.Load().CountTags())
+
+	// the new standby starts out the same, and changing it doesn't change the active tree
+	assert.Equal(t, 1, handle.Standby().CountTags())
+	handle.Standby().Add(patricia.NewIPv4Address(10<<24, 8), "10/8", nil)
+	assert.Equal(t, 1, active.CountTags())
+
+	// failed updates are thrown away
+	err := handle.Update(func(standby *TreeV4) error {
+		standby.Add(patricia.NewIPv4Address(11<<24, 8), "11/8", nil)
+		return errors.New("failed")
+	})
+	assert.EqualError(t, err, "failed")
+	assert.Equal(t, 1, handle.Standby().CountTags())
+	assert.Equal(t, 1, handle.Load().CountTags())
+
+	// a rebuilt tree can be stored as it is
+	rebuilt := NewTreeV4()
+	rebuilt.Add(patricia.NewIPv4Address(0, 0), "rebuilt", nil)
+	handle.Store(rebuilt)
+	assert.True(t, rebuilt == handle.Load())
+
+	// writers and readers at the same time - run with -race to make this mean something
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				assert.NoError(t, handle.Update(func(standby *TreeV4) error {
+					_, _, err := standby.Add(patricia.NewIPv4Address(uint32(w)<<24|uint32(i)<<8, 24), i, nil)
+					return err
+				}))
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				tree := handle.Load()
+				count := tree.CountTags()
+				tags, err := tree.FindTags(patricia.NewIPv4Address(0, 32))
+				assert.NoError(t, err)
+				assert.Equal(t, "rebuilt", tags[0])
+				assert.Equal(t, count, tree.CountTags())
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1+4*50, handle.Load().CountTags())
+}
@@ -0,0 +1,97 @@
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeHooks(t *testing.T) {
+	tree := NewTreeV4(WithTagLimit(2, TagLimitEvictOldest))
+	var events []string
+	record := func(prefix patricia.IPv4Address, tag GeneratedType, op ChangeOp) {
+		events = append(events, fmt.Sprintf("%s %s %v", op, prefix, tag))
+	}
+	tree.OnAdd(record)
+	tree.OnDelete(record)
+	expectEvents := func(expected ...string) {
+		t.Helper()
+		assert.Equal(t, expected, events)
+		events = nil
+	}
+	matchAll := func(GeneratedType, GeneratedType) bool { return true }
+	matchEqual := func(payload GeneratedType, val GeneratedType) bool { return payload == val }
+	address := patricia.NewIPv4Address(10<<24|1, 8) // the host bits are cleared for the hooks
+
+	tree.Add(address, "a", nil)
+	tree.Add(address, "a", matchEqual)
+	tree.Add(address, "b", nil)
+	expectEvents("add 10.0.0.0/8 a", "add 10.0.0.0/8 b")
+
+	// evicted to make room, and replaced
+	tree.Add(address, "c", nil)
+	tree.Set(address, "d")
+	tree.Set(address, "d")
+	expectEvents("delete 10.0.0.0/8 a", "add 10.0.0.0/8 c", "delete 10.0.0.0/8 b", "add 10.0.0.0/8 d")
+
+	tree.UpdateTags(address, func(tag GeneratedType) (GeneratedType, bool) { return tag, tag != "c" })
+	tree.Delete(address, matchAll, nil)
+	tree.Delete(address, matchAll, nil)
+	expectEvents("delete 10.0.0.0/8 c", "delete 10.0.0.0/8 d")
+
+	tree.Add(patricia.NewIPv4Address(10<<24, 8), "10/8", nil)
+	tree.Add(patricia.NewIPv4Address(10<<24, 16), "10/16", nil)
+	tree.AddWithExpiry(patricia.NewIPv4Address(10<<24, 24), "expired", time.Now().Add(-time.Second), nil)
+	events = nil
+	tree.Sweep()
+	expectEvents("delete 10.0.0.0/24 expired")
+	tree.Prune(patricia.NewIPv4Address(10<<24, 8))
+	expectEvents("delete 10.0.0.0/16 10/16")
+
+	// batches are worked out as a whole
+	batch := tree.NewBatch()
+	batch.Add(patricia.NewIPv4Address(10<<24, 8), "batch", nil)
+	batch.Delete(patricia.NewIPv4Address(10<<24, 8), matchEqual, "10/8")
+	batch.Add(patricia.NewIPv4Address(11<<24, 8), "11/8", nil)
+	assert.NoError(t, batch.Commit())
+	expectEvents("delete 10.0.0.0/8 10/8", "add 10.0.0.0/8 batch", "add 11.0.0.0/8 11/8")
+
+	// replaying a change log only reports what changed
+	var log bytes.Buffer
+	copied := tree.Clone()
+	copied.SetChangeLog(&log)
+	copied.Add(patricia.NewIPv4Address(10<<24, 8), "replayed", nil)
+	_, err := tree.Replay(&log)
+	assert.NoError(t, err)
+	expectEvents("add 10.0.0.0/8 replayed")
+
+	// decoding replaces everything
+	data, err := copied.MarshalBinary()
+	assert.NoError(t, err)
+	copied.Delete(patricia.NewIPv4Address(11<<24, 8), matchAll, nil)
+	data2, err := copied.MarshalBinary()
+	assert.NoError(t, err)
+	assert.NoError(t, tree.UnmarshalBinary(data2))
+	expectEvents("delete 10.0.0.0/8 batch", "delete 10.0.0.0/8 replayed", "delete 11.0.0.0/8 11/8",
+		"add 10.0.0.0/8 batch", "add 10.0.0.0/8 replayed")
+	assert.NoError(t, tree.UnmarshalBinary(data))
+	events = nil
+
+	// snapshots don't have the hooks, and changing the tree after one still calls them
+	snapshot := tree.Snapshot()
+	snapshot.Add(patricia.NewIPv4Address(0, 0), "snapshot", nil)
+	expectEvents()
+	tree.Add(patricia.NewIPv4Address(0, 0), "root", nil)
+	expectEvents("add 0.0.0.0/0 root")
+
+	tree.Clear()
+	expectEvents("delete 0.0.0.0/0 root", "delete 10.0.0.0/8 batch", "delete 10.0.0.0/8 replayed", "delete 11.0.0.0/8 11/8")
+
+	tree.ClearHooks()
+	tree.Add(address, "a", nil)
+	expectEvents()
+}
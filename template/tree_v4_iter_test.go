@@ -0,0 +1,646 @@
+package template
+
+import (
+	"context"
+	"math/rand"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+// builds a tree from "cidr" -> tags, for iteration tests
+func buildTreeV4(t *testing.T, entries map[string][]string) *TreeV4 {
+	tree := NewTreeV4()
+	for cidr, tags := range entries {
+		v4, _, err := patricia.ParseIPFromString(cidr)
+		assert.NoError(t, err)
+		for _, tag := range tags {
+			tree.Add(*v4, tag, nil)
+		}
+	}
+	return tree
+}
+
+var _iterTestEntries = map[string][]string{
+	"0.0.0.0/0":      {"root"},
+	"10.0.0.0/8":     {"a", "b"},
+	"10.1.0.0/16":    {"c"},
+	"10.1.2.0/24":    {"d"},
+	"10.128.0.0/9":   {"e"},
+	"192.168.0.0/16": {"f"},
+	"192.168.1.1/32": {"g"},
+}
+
+func TestWalk(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	found := make(map[string][]string)
+	tree.Walk(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		for _, tag := range tags {
+			found[prefix.String()] = append(found[prefix.String()], tag.(string))
+		}
+		return true
+	})
+	assert.Equal(t, _iterTestEntries, found)
+
+	// early termination
+	count := 0
+	tree.Walk(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		count++
+		return count < 3
+	})
+	assert.Equal(t, 3, count)
+
+	// empty tree
+	NewTreeV4().Walk(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		assert.Fail(t, "empty tree shouldn't have anything to walk")
+		return true
+	})
+}
+
+func TestWalkV6(t *testing.T) {
+	tree := NewTreeV6()
+	tree.Add(ipv6FromString("2001:db8::/32", 32), "a", nil)
+	tree.Add(ipv6FromString("2001:db8:0:1::/64", 64), "b", nil)
+	tree.Add(ipv6FromString("2001:db8:0:1::1/128", 128), "c", nil)
+
+	found := make(map[string]string)
+	tree.Walk(func(prefix patricia.IPv6Address, tags []GeneratedType) bool {
+		found[prefix.String()] = tags[0].(string)
+		return true
+	})
+	assert.Equal(t, map[string]string{
+		"2001:db8::/32":       "a",
+		"2001:db8:0:1::/64":   "b",
+		"2001:db8:0:1::1/128": "c",
+	}, found)
+}
+
+func TestIterators(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	found := make(map[string][]string)
+	for prefix, tags := range tree.All() {
+		for _, tag := range tags {
+			found[prefix.String()] = append(found[prefix.String()], tag.(string))
+		}
+	}
+	assert.Equal(t, _iterTestEntries, found)
+
+	prefixes := make(map[string]bool)
+	for prefix := range tree.Prefixes() {
+		prefixes[prefix.String()] = true
+	}
+	assert.Equal(t, len(_iterTestEntries), len(prefixes))
+	for cidr := range _iterTestEntries {
+		assert.True(t, prefixes[cidr], cidr)
+	}
+
+	tagCount := 0
+	for tag := range tree.Tags() {
+		assert.NotNil(t, tag)
+		tagCount++
+	}
+	assert.Equal(t, tree.CountTags(), tagCount)
+
+	// breaking out early
+	count := 0
+	for range tree.Tags() {
+		count++
+		if count == 2 {
+			break
+		}
+	}
+	assert.Equal(t, 2, count)
+}
+
+func TestWalkIsSorted(t *testing.T) {
+	tree := NewTreeV4()
+	for i := 0; i < 5000; i++ {
+		address := rand.Uint32()
+		tree.Add(patricia.NewIPv4Address(address, uint(rand.Intn(33))), i, nil)
+		tree.Add(patricia.NewIPv4Address(address, uint(rand.Intn(33))), i, nil)
+	}
+
+	var previous *patricia.IPv4Address
+	count := 0
+	for prefix := range tree.Prefixes() {
+		if previous != nil {
+			// addresses in the tree are masked to their length
+			if previous.Address == prefix.Address {
+				assert.True(t, previous.Length < prefix.Length, "%s should come after %s", previous, prefix)
+			} else {
+				assert.True(t, previous.Address < prefix.Address, "%s should come after %s", previous, prefix)
+			}
+		}
+		p := prefix
+		previous = &p
+		count++
+	}
+	assert.True(t, count > 5000)
+}
+
+func TestWalkIsSortedV6(t *testing.T) {
+	tree := NewTreeV6()
+	for i := 0; i < 5000; i++ {
+		left := rand.Uint64()
+		right := rand.Uint64()
+		tree.Add(patricia.IPv6Address{Left: left, Right: right, Length: uint(rand.Intn(129))}, i, nil)
+		tree.Add(patricia.IPv6Address{Left: left, Right: right, Length: uint(rand.Intn(129))}, i, nil)
+	}
+
+	var previous *patricia.IPv6Address
+	for prefix := range tree.Prefixes() {
+		if previous != nil {
+			if previous.Left == prefix.Left && previous.Right == prefix.Right {
+				assert.True(t, previous.Length < prefix.Length, "%s should come after %s", previous, prefix)
+			} else {
+				assert.True(t, previous.Left < prefix.Left || (previous.Left == prefix.Left && previous.Right < prefix.Right), "%s should come after %s", previous, prefix)
+			}
+		}
+		p := prefix
+		previous = &p
+	}
+}
+
+// a tree deeper than walks keep room for on their stack, with a right child waiting at every level
+func TestWalkDeepTreeV6(t *testing.T) {
+	tree := NewTreeV6()
+	var expected []patricia.IPv6Address
+	for length := uint(1); length <= 128; length++ {
+		bit := patricia.IPv6Address{Length: length}
+		if length <= 64 {
+			bit.Left = 1 << (64 - length)
+		} else {
+			bit.Right = 1 << (128 - length)
+		}
+		tree.Add(patricia.IPv6Address{Length: length}, "zeros", nil)
+		tree.Add(bit, "bit", nil)
+		expected = append(expected, patricia.IPv6Address{Length: length})
+	}
+	// the prefixes with a bit set come after all the longer ones without, the longest first
+	for length := uint(128); length >= 1; length-- {
+		bit := patricia.IPv6Address{Length: length}
+		if length <= 64 {
+			bit.Left = 1 << (64 - length)
+		} else {
+			bit.Right = 1 << (128 - length)
+		}
+		expected = append(expected, bit)
+	}
+
+	assert.Equal(t, expected, slices.Collect(tree.Prefixes()))
+	depths := make(map[patricia.IPv6Address]int)
+	for entry := range tree.Entries() {
+		depths[entry.Prefix] = entry.Depth
+	}
+	assert.Equal(t, len(expected), len(depths))
+	assert.Equal(t, 128, depths[patricia.IPv6Address{Length: 128}])
+	assert.Equal(t, 1, depths[expected[len(expected)-1]])
+	assert.Equal(t, len(expected)+1, tree.countNodes(1))
+
+	// the other walks keep their stacks the same way
+	overlaps := 0
+	tree.WalkOverlaps(func(covering patricia.IPv6Address, covered patricia.IPv6Address) bool {
+		assert.True(t, covering.Length < covered.Length)
+		overlaps++
+		return true
+	})
+	assert.Equal(t, 127*128, overlaps)
+	longest := 0
+	tree.WalkLength(128, func(patricia.IPv6Address, []GeneratedType) bool {
+		longest++
+		return true
+	})
+	assert.Equal(t, 2, longest)
+	_, token := tree.Cursor().Next(len(expected) / 2)
+	cursor, err := tree.CursorFrom(token)
+	assert.NoError(t, err)
+	rest, _ := cursor.Next(len(expected))
+	assert.Equal(t, len(expected)/2, len(rest))
+	assert.Equal(t, expected[len(expected)/2], rest[0].Prefix)
+
+	// as do those that take nodes out
+	mapped := tree.MapTags(func(tag GeneratedType) (GeneratedType, bool) {
+		return tag, tag == "bit"
+	})
+	assert.Equal(t, 128, mapped.PrefixCount())
+	// the zeros split between the longer zeros and a bit, besides the longest two, which are left with one child, or none
+	assert.Equal(t, 1+128+126, mapped.countNodes(1))
+	prefixCount, tagCount, err := tree.Prune(patricia.IPv6Address{Length: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 254, prefixCount)
+	assert.Equal(t, 254, tagCount)
+	assert.Equal(t, 2, tree.PrefixCount())
+	assert.Equal(t, 3, tree.countNodes(1))
+}
+
+func TestStream(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	found := make(map[string][]string)
+	for entry := range tree.Stream(context.Background()) {
+		for _, tag := range entry.Tags {
+			found[entry.Prefix.String()] = append(found[entry.Prefix.String()], tag.(string))
+		}
+	}
+	assert.Equal(t, _iterTestEntries, found)
+
+	// cancelling stops the stream, and closes the channel
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := tree.Stream(ctx)
+	entry := <-stream
+	assert.Equal(t, "0.0.0.0/0", entry.Prefix.String())
+	cancel()
+	count := 0
+	for range stream {
+		count++
+	}
+	assert.True(t, count <= 1) // the send that may have been in progress
+}
+
+func TestLeaves(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	var leaves []string
+	for prefix, tags := range tree.Leaves() {
+		assert.Equal(t, _iterTestEntries[prefix.String()][0], tags[0])
+		leaves = append(leaves, prefix.String())
+	}
+	assert.Equal(t, []string{"10.1.2.0/24", "10.128.0.0/9", "192.168.1.1/32"}, leaves)
+
+	// a lone root is a leaf
+	tree = buildTreeV4(t, map[string][]string{"0.0.0.0/0": {"root"}})
+	leaves = nil
+	tree.WalkLeaves(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		leaves = append(leaves, prefix.String())
+		return true
+	})
+	assert.Equal(t, []string{"0.0.0.0/0"}, leaves)
+}
+
+func TestWalkSubtree(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	subtree := func(cidr string) []string {
+		v4, _, err := patricia.ParseIPFromString(cidr)
+		assert.NoError(t, err)
+		var found []string
+		for prefix := range tree.Subtree(*v4) {
+			found = append(found, prefix.String())
+		}
+		return found
+	}
+
+	assert.Equal(t, []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.128.0.0/9"}, subtree("10.0.0.0/8"))
+	assert.Equal(t, []string{"10.1.0.0/16", "10.1.2.0/24"}, subtree("10.0.0.0/15"))
+	assert.Equal(t, []string{"10.1.2.0/24"}, subtree("10.1.2.0/23"))
+	assert.Equal(t, []string{"192.168.0.0/16", "192.168.1.1/32"}, subtree("192.0.0.0/2"))
+	assert.Equal(t, []string{"192.168.1.1/32"}, subtree("192.168.1.1/32"))
+	assert.Nil(t, subtree("10.2.0.0/16"))
+	assert.Nil(t, subtree("172.16.0.0/12"))
+	assert.Equal(t, len(_iterTestEntries), len(subtree("0.0.0.0/0")))
+}
+
+func TestIterationOrderIgnoresHistory(t *testing.T) {
+	matchFunc := func(payload GeneratedType, val GeneratedType) bool {
+		return payload == val
+	}
+
+	addresses := make([]patricia.IPv4Address, 2000)
+	for i := range addresses {
+		addresses[i] = patricia.NewIPv4Address(rand.Uint32(), uint(rand.Intn(33)))
+	}
+	sequence := func(tree *TreeV4) []string {
+		var ret []string
+		for prefix := range tree.Prefixes() {
+			ret = append(ret, prefix.String())
+		}
+		return ret
+	}
+
+	// in order
+	tree := NewTreeV4()
+	for _, address := range addresses {
+		tree.Add(address, "tag", nil)
+	}
+	expected := sequence(tree)
+
+	// shuffled, with extra prefixes that are deleted again, so node indexes get reused in a different layout
+	for round := 0; round < 5; round++ {
+		other := NewTreeV4()
+		for _, i := range rand.Perm(len(addresses)) {
+			other.Add(patricia.NewIPv4Address(rand.Uint32(), uint(rand.Intn(33))), "extra", nil)
+			other.Add(addresses[i], "tag", nil)
+		}
+		for _, address := range addresses {
+			// clear out everything, then add back what we're keeping
+			other.Delete(address, matchFunc, "tag")
+		}
+		for _, prefix := range sequence(other) {
+			v4, _, _ := patricia.ParseIPFromString(prefix)
+			other.Delete(*v4, matchFunc, "extra")
+		}
+		assert.Equal(t, 0, other.CountTags())
+		for _, i := range rand.Perm(len(addresses)) {
+			other.Add(addresses[i], "tag", nil)
+		}
+		assert.NotEqual(t, tree.nodes, other.nodes)
+		assert.Equal(t, expected, sequence(other))
+	}
+}
+
+func TestWalkBreadthFirst(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	var found []string
+	tree.WalkBreadthFirst(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		found = append(found, prefix.String())
+		return true
+	})
+	assert.Equal(t, []string{
+		"0.0.0.0/0",
+		"10.0.0.0/8",
+		"10.128.0.0/9",
+		"10.1.0.0/16",
+		"192.168.0.0/16",
+		"10.1.2.0/24",
+		"192.168.1.1/32",
+	}, found)
+
+	// early termination
+	count := 0
+	for range tree.BreadthFirst() {
+		count++
+		if count == 2 {
+			break
+		}
+	}
+	assert.Equal(t, 2, count)
+}
+
+func TestVisit(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	visit := func(verdicts map[string]WalkVerdict) []string {
+		var found []string
+		tree.Visit(func(prefix patricia.IPv4Address, tags []GeneratedType) WalkVerdict {
+			found = append(found, prefix.String())
+			return verdicts[prefix.String()]
+		})
+		return found
+	}
+
+	assert.Equal(t, len(_iterTestEntries), len(visit(nil)))
+	assert.Equal(t, []string{"0.0.0.0/0", "10.0.0.0/8", "192.168.0.0/16", "192.168.1.1/32"},
+		visit(map[string]WalkVerdict{"10.0.0.0/8": WalkSkipSubtree}))
+	assert.Equal(t, []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.128.0.0/9", "192.168.0.0/16"},
+		visit(map[string]WalkVerdict{"192.168.0.0/16": WalkSkipSubtree}))
+	assert.Equal(t, []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16"},
+		visit(map[string]WalkVerdict{"10.1.0.0/16": WalkStop}))
+	assert.Equal(t, []string{"0.0.0.0/0"},
+		visit(map[string]WalkVerdict{"0.0.0.0/0": WalkSkipSubtree}))
+}
+
+func TestWalkPrefixes(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	var found []string
+	tree.WalkPrefixes(func(prefix patricia.IPv4Address) bool {
+		found = append(found, prefix.String())
+		return true
+	})
+	var walked []string
+	tree.Walk(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		walked = append(walked, prefix.String())
+		return true
+	})
+	assert.Equal(t, walked, found)
+
+	// no tag slices are built, so allocations don't grow with the number of prefixes
+	for i := 0; i < 1000; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<8, 24), i, nil)
+	}
+	count := 0
+	allocs := testing.AllocsPerRun(10, func() {
+		count = 0
+		tree.WalkPrefixes(func(prefix patricia.IPv4Address) bool {
+			count++
+			return true
+		})
+	})
+	assert.Equal(t, len(_iterTestEntries)+1000, count)
+	assert.True(t, allocs < 10, "%f allocations", allocs)
+}
+
+func TestWalkEntries(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	type shape struct {
+		depth, childCount, tagCount int
+	}
+	found := make(map[string]shape)
+	for entry := range tree.Entries() {
+		assert.Equal(t, len(entry.Tags), entry.TagCount)
+		found[entry.Prefix.String()] = shape{entry.Depth, entry.ChildCount, entry.TagCount}
+	}
+	assert.Equal(t, map[string]shape{
+		"0.0.0.0/0":      {0, 2, 1},
+		"10.0.0.0/8":     {1, 2, 2},
+		"10.1.0.0/16":    {2, 1, 1},
+		"10.1.2.0/24":    {3, 0, 1},
+		"10.128.0.0/9":   {2, 0, 1},
+		"192.168.0.0/16": {1, 1, 1},
+		"192.168.1.1/32": {2, 0, 1},
+	}, found)
+
+	// untagged nodes still count towards depth
+	tree = NewTreeV4()
+	for _, cidr := range []string{"10.1.0.0/16", "10.2.0.0/16"} {
+		address, _, _ := patricia.ParseIPFromString(cidr)
+		tree.Add(*address, cidr, nil)
+	}
+	count := 0
+	for entry := range tree.Entries() {
+		count++
+		assert.Equal(t, 2, entry.Depth)
+		assert.Equal(t, 0, entry.ChildCount)
+	}
+	assert.Equal(t, 2, count)
+}
+
+func TestWalkParallel(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+	for i := 0; i < 1000; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<12, 20), i, nil)
+	}
+
+	var walked []string
+	tree.Walk(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		walked = append(walked, prefix.String())
+		return true
+	})
+
+	for _, workers := range []int{0, 1, 3, 16} {
+		var lock sync.Mutex
+		found := make(map[string]int)
+		tree.WalkParallel(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			found[prefix.String()]++
+			return true
+		}, workers)
+		assert.Equal(t, len(walked), len(found))
+		for _, prefix := range walked {
+			assert.Equal(t, 1, found[prefix], prefix)
+		}
+	}
+
+	// stopping
+	var count atomic.Int32
+	tree.WalkParallel(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		return count.Add(1) < 10
+	}, 4)
+	assert.True(t, count.Load() < int32(len(walked)))
+
+	// small and empty trees
+	found := 0
+	buildTreeV4(t, map[string][]string{"10.0.0.0/8": {"a"}}).WalkParallel(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		found++
+		return true
+	}, 4)
+	assert.Equal(t, 1, found)
+	NewTreeV4().WalkParallel(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		assert.Fail(t, "empty tree shouldn't have anything to walk")
+		return true
+	}, 4)
+}
+
+func TestAllNetip(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	found := make(map[string][]string)
+	for prefix, tags := range tree.AllNetip() {
+		assert.True(t, prefix.Addr().Is4())
+		assert.Equal(t, prefix.Masked(), prefix)
+		for _, tag := range tags {
+			found[prefix.String()] = append(found[prefix.String()], tag.(string))
+		}
+	}
+	assert.Equal(t, _iterTestEntries, found)
+
+	treeV6 := NewTreeV6()
+	_, address, _ := patricia.ParseIPFromString("2001:db8::/32")
+	treeV6.Add(*address, "a", nil)
+	for prefix := range treeV6.AllNetip() {
+		assert.Equal(t, netip.MustParsePrefix("2001:db8::/32"), prefix)
+	}
+}
+
+func TestWalkLength(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	walkLength := func(length uint) []string {
+		var found []string
+		tree.WalkLength(length, func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+			found = append(found, prefix.String())
+			return true
+		})
+		return found
+	}
+	assert.Equal(t, []string{"0.0.0.0/0"}, walkLength(0))
+	assert.Equal(t, []string{"10.0.0.0/8"}, walkLength(8))
+	assert.Equal(t, []string{"10.128.0.0/9"}, walkLength(9))
+	assert.Equal(t, []string{"10.1.0.0/16", "192.168.0.0/16"}, walkLength(16))
+	assert.Equal(t, []string{"192.168.1.1/32"}, walkLength(32))
+	assert.Nil(t, walkLength(12))
+	assert.Nil(t, walkLength(33))
+
+	// early termination
+	count := 0
+	tree.WalkLength(16, func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+		count++
+		return false
+	})
+	assert.Equal(t, 1, count)
+}
+
+func TestReduce(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	tagCount := ReduceV4(tree, 0, func(acc int, prefix patricia.IPv4Address, tags []GeneratedType) int {
+		return acc + len(tags)
+	})
+	assert.Equal(t, tree.CountTags(), tagCount)
+
+	longest := ReduceV4(tree, patricia.IPv4Address{}, func(acc patricia.IPv4Address, prefix patricia.IPv4Address, tags []GeneratedType) patricia.IPv4Address {
+		if prefix.Length > acc.Length {
+			return prefix
+		}
+		return acc
+	})
+	assert.Equal(t, "192.168.1.1/32", longest.String())
+
+	joined := ReduceV6(NewTreeV6(), "empty", func(acc string, prefix patricia.IPv6Address, tags []GeneratedType) string {
+		return acc + prefix.String()
+	})
+	assert.Equal(t, "empty", joined)
+}
+
+func TestWalkOverlaps(t *testing.T) {
+	tree := buildTreeV4(t, _iterTestEntries)
+
+	var found []string
+	for covering, covered := range tree.Overlaps() {
+		found = append(found, covering.String()+" "+covered.String())
+	}
+	assert.Equal(t, []string{
+		"0.0.0.0/0 10.0.0.0/8",
+		"0.0.0.0/0 10.1.0.0/16",
+		"10.0.0.0/8 10.1.0.0/16",
+		"0.0.0.0/0 10.1.2.0/24",
+		"10.0.0.0/8 10.1.2.0/24",
+		"10.1.0.0/16 10.1.2.0/24",
+		"0.0.0.0/0 10.128.0.0/9",
+		"10.0.0.0/8 10.128.0.0/9",
+		"0.0.0.0/0 192.168.0.0/16",
+		"0.0.0.0/0 192.168.1.1/32",
+		"192.168.0.0/16 192.168.1.1/32",
+	}, found)
+
+	// prefixes that are only split points aren't counted
+	tree = buildTreeV4(t, map[string][]string{"10.1.0.0/16": {"a"}, "10.2.0.0/16": {"b"}})
+	tree.WalkOverlaps(func(covering patricia.IPv4Address, covered patricia.IPv4Address) bool {
+		assert.Fail(t, "nothing overlaps", "%s %s", covering, covered)
+		return true
+	})
+}
+
+// walking a tree too big for cache, node by node, without copying tags, so it's the walk itself that's timed
+func BenchmarkWalkPrefixesHugeTree(b *testing.B) {
+	tree, _ := hugeTreeV4()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		count := 0
+		tree.WalkPrefixes(func(patricia.IPv4Address) bool {
+			count++
+			return true
+		})
+	}
+}
+
+func BenchmarkWalkEntriesHugeTree(b *testing.B) {
+	tree, _ := hugeTreeV4()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for range tree.Entries() {
+		}
+	}
+}
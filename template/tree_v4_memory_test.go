@@ -0,0 +1,50 @@
+package template
+
+import (
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStats(t *testing.T) {
+	tree := NewTreeV4()
+	stats := tree.MemoryStats()
+	assert.Equal(t, 2, stats.Nodes)
+	assert.Equal(t, 0, stats.Prefixes)
+	assert.Equal(t, 0.0, stats.BytesPerPrefix())
+	assert.Equal(t, 0.0, stats.BytesPerTag())
+
+	for i := 0; i < 1000; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<8, 24), i, nil)
+	}
+	tree.Add(patricia.NewIPv4Address(0, 24), "another", nil)
+	tree.AddWithExpiry(patricia.NewIPv4Address(0, 8), "expires", time.Now().Add(time.Hour), nil)
+	matchAll := func(GeneratedType, GeneratedType) bool { return true }
+	for i := 1; i < 1000; i += 2 {
+		tree.Delete(patricia.NewIPv4Address(uint32(i)<<8, 24), matchAll, nil)
+	}
+
+	stats = tree.MemoryStats()
+	assert.Equal(t, len(tree.nodes), stats.Nodes)
+	assert.Equal(t, cap(tree.nodes), stats.NodeCapacity)
+	assert.Equal(t, cap(tree.nodes)*int(unsafe.Sizeof(treeNodeV4{})), stats.NodeBytes)
+	assert.Equal(t, len(tree.availableIndexes), stats.FreeNodes)
+	assert.True(t, stats.FreeNodes > 0)
+	assert.Equal(t, tree.CountTags(), stats.Tags)
+	assert.Equal(t, 501, stats.Prefixes)
+	assert.True(t, stats.TagBytes >= stats.Tags*int(unsafe.Sizeof(GeneratedType(nil))))
+	assert.Equal(t, stats.NodeBytes+stats.FreeListBytes+stats.TagBytes, stats.TotalBytes)
+	assert.Equal(t, float64(stats.TotalBytes)/501, stats.BytesPerPrefix())
+	assert.Equal(t, float64(stats.TotalBytes)/502, stats.BytesPerTag())
+
+	// compacting it leaves less, with the same tags
+	tree.Compact()
+	compacted := tree.MemoryStats()
+	assert.Equal(t, 0, compacted.FreeNodes)
+	assert.Equal(t, stats.Tags, compacted.Tags)
+	assert.Equal(t, stats.Prefixes, compacted.Prefixes)
+	assert.True(t, compacted.TotalBytes < stats.TotalBytes)
+}
@@ -0,0 +1,60 @@
+package template
+
+import (
+	"errors"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmarshalBinaryNoCopy(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	data, err := tree.MarshalNative()
+	assert.NoError(t, err)
+	original := append([]byte(nil), data...)
+
+	loaded := NewTreeV4()
+	assert.NoError(t, loaded.UnmarshalBinaryNoCopy(data))
+	assert.Equal(t, tree.nodes, loaded.nodes)
+	assert.Equal(t, tree.availableIndexes, loaded.availableIndexes)
+	expectedTags, expectedExpirations := tree.storedTagsV4()
+	loadedTags, loadedExpirations := loaded.storedTagsV4()
+	assert.Equal(t, expectedTags, loadedTags)
+	assert.Equal(t, expectedExpirations, loadedExpirations)
+
+	// the nodes are the ones in data, until the tree's changed
+	assert.Equal(t, unsafe.Pointer(&data[_nativeHeaderSize]), unsafe.Pointer(&loaded.nodes[0]))
+	loaded.Add(ipv4FromBytes([]byte{10, 1, 2, 3}, 32), "added", nil)
+	assert.NotEqual(t, unsafe.Pointer(&data[_nativeHeaderSize]), unsafe.Pointer(&loaded.nodes[0]))
+	assert.Equal(t, original, data)
+	assert.Equal(t, tree.CountTags()+1, loaded.CountTags())
+
+	// nodes that aren't aligned are copied
+	unaligned := make([]byte, len(data)+1)[1:]
+	copy(unaligned, data)
+	assert.NoError(t, loaded.UnmarshalBinaryNoCopy(unaligned))
+	assert.Equal(t, tree.nodes, loaded.nodes)
+	assert.NotEqual(t, unsafe.Pointer(&unaligned[_nativeHeaderSize]), unsafe.Pointer(&loaded.nodes[0]))
+
+	// anything wrong with it fails, leaving the tree as it was
+	for i := 0; i < len(data); i++ {
+		assert.True(t, errors.Is(loaded.UnmarshalBinaryNoCopy(data[:i]), ErrInvalidData), "%d bytes", i)
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0x10
+		assert.True(t, errors.Is(loaded.UnmarshalBinaryNoCopy(corrupt), ErrInvalidData), "byte %d", i)
+	}
+	loadedTags, _ = loaded.storedTagsV4()
+	assert.Equal(t, expectedTags, loadedTags)
+	binary, _ := tree.MarshalBinary()
+	assert.True(t, errors.Is(loaded.UnmarshalBinaryNoCopy(binary), ErrInvalidData))
+	v6, _ := NewTreeV6().MarshalNative()
+	assert.True(t, errors.Is(loaded.UnmarshalBinaryNoCopy(v6), ErrInvalidData))
+
+	_, err = NewTreeV4().MarshalNative()
+	assert.NoError(t, err)
+	unsupported := NewTreeV4()
+	unsupported.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), []int{1}, nil)
+	_, err = unsupported.MarshalNative()
+	assert.True(t, errors.Is(err, ErrUnsupportedTag))
+}
@@ -0,0 +1,87 @@
+package template
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetip(t *testing.T) {
+	tree := NewTreeV4()
+	matchAll := func(GeneratedType, GeneratedType) bool { return true }
+	_, _, err := tree.AddNetip(netip.MustParsePrefix("10.0.0.0/8"), "ten", nil)
+	assert.NoError(t, err)
+	_, _, err = tree.AddNetip(netip.MustParsePrefix("10.1.0.0/16"), "ten-one", nil)
+	assert.NoError(t, err)
+	_, _, err = tree.SetNetip(netip.MustParsePrefix("192.168.0.0/16"), "private")
+	assert.NoError(t, err)
+	expected, _ := tree.FindTags(patricia.NewIPv4Address(0x0a010203, 32))
+
+	addr := netip.MustParseAddr("10.1.2.3")
+	tags, err := tree.FindTagsNetip(addr)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, tags)
+	tags, err = tree.FindTagsAppendNetip([]GeneratedType{"first"}, addr)
+	assert.NoError(t, err)
+	assert.Equal(t, append([]GeneratedType{"first"}, expected...), tags)
+	found, tag, err := tree.FindDeepestTagNetip(addr)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "ten-one", tag)
+	found, tags, err = tree.FindDeepestTagsNetip(addr)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []GeneratedType{"ten-one"}, tags)
+
+	deleted, err := tree.DeleteNetip(netip.MustParsePrefix("10.1.0.0/16"), matchAll, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	_, tag, _ = tree.FindDeepestTagNetip(addr)
+	assert.Equal(t, "ten", tag)
+
+	// lookups don't allocate any more than the tree's own do
+	allocs := testing.AllocsPerRun(100, func() {
+		tree.FindDeepestTagNetip(addr)
+		tree.FindTagsAppendNetip(tags[:0], addr)
+	})
+	assert.Equal(t, float64(0), allocs)
+
+	// addresses of the other family, and ones that aren't valid, are turned away
+	for _, addr := range []netip.Addr{{}, netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("::ffff:10.1.2.3")} {
+		_, _, err = tree.AddNetip(netip.PrefixFrom(addr, 0), "wrong", nil)
+		assert.Error(t, err)
+		_, _, err = tree.SetNetip(netip.PrefixFrom(addr, 0), "wrong")
+		assert.Error(t, err)
+		_, err = tree.DeleteNetip(netip.PrefixFrom(addr, 0), matchAll, nil)
+		assert.Error(t, err)
+		_, err = tree.FindTagsNetip(addr)
+		assert.Error(t, err)
+		_, err = tree.FindTagsAppendNetip(nil, addr)
+		assert.Error(t, err)
+		_, _, err = tree.FindDeepestTagNetip(addr)
+		assert.Error(t, err)
+		_, _, err = tree.FindDeepestTagsNetip(addr)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 2, tree.PrefixCount())
+}
+
+func TestNetipV6(t *testing.T) {
+	tree := NewTreeV6()
+	_, _, err := tree.AddNetip(netip.MustParsePrefix("2001:db8::/32"), "documentation", nil)
+	assert.NoError(t, err)
+	_, _, err = tree.AddNetip(netip.MustParsePrefix("::ffff:0:0/96"), "mapped", nil)
+	assert.NoError(t, err)
+
+	found, tag, err := tree.FindDeepestTagNetip(netip.MustParseAddr("2001:db8::1"))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "documentation", tag)
+	_, tag, err = tree.FindDeepestTagNetip(netip.MustParseAddr("::ffff:10.0.0.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "mapped", tag)
+	_, _, err = tree.FindDeepestTagNetip(netip.MustParseAddr("10.0.0.1"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,81 @@
+package template
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpLog(t *testing.T) {
+	leader := buildEncodingTreeV4()
+	var ops []Op
+	stream := NewOpStream(100, func(op Op) error {
+		ops = append(ops, op)
+		return nil
+	})
+	assert.NoError(t, leader.SetChangeLog(stream))
+
+	// a follower starts from a copy, and the sequence number it was taken at
+	leader.Add(ipv4FromBytes([]byte{10, 2, 0, 0}, 16), "x", nil)
+	saved, err := leader.MarshalBinary()
+	assert.NoError(t, err)
+	savedSeq := stream.Seq()
+	assert.Equal(t, uint64(101), savedSeq)
+	follower := NewTreeV4()
+	assert.NoError(t, follower.UnmarshalBinary(saved))
+
+	leader.Set(ipv4FromBytes([]byte{10, 1, 2, 3}, 32), "set")
+	leader.Prune(ipv4FromBytes([]byte{10, 1, 0, 0}, 16))
+	leader.Add(ipv4FromBytes([]byte{8, 8, 8, 8}, 32), "eight", nil)
+	assert.Equal(t, uint64(104), stream.Seq())
+
+	// everything's applied once, however many times it's sent
+	lastSeq, err := follower.ApplyOps(savedSeq, ops[:3])
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(103), lastSeq)
+	lastSeq, err = follower.ApplyOps(lastSeq, ops)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(104), lastSeq)
+	lastSeq, err = follower.ApplyOps(lastSeq, ops)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(104), lastSeq)
+	assertSameTreesV4(t, leader, follower)
+
+	// the ops are the change log
+	var log bytes.Buffer
+	for _, op := range ops {
+		log.Write(op.Data)
+	}
+	replayed := buildEncodingTreeV4()
+	count, err := replayed.Replay(&log)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+	assertSameTreesV4(t, leader, replayed)
+
+	// gaps and corrupt ops stop things, after what came before them
+	leader.Clear()
+	leader.Add(ipv4FromBytes([]byte{1, 0, 0, 0}, 8), "one", nil)
+	leader.Add(ipv4FromBytes([]byte{2, 0, 0, 0}, 8), "two", nil)
+	lastSeq, err = follower.ApplyOps(104, ops[5:])
+	assert.True(t, errors.Is(err, ErrMissingOps))
+	assert.Equal(t, uint64(104), lastSeq)
+	corrupt := Op{Seq: 107, Data: append([]byte(nil), ops[6].Data...)}
+	corrupt.Data[2] ^= 0xff
+	lastSeq, err = follower.ApplyOps(104, []Op{ops[4], ops[5], corrupt})
+	assert.True(t, errors.Is(err, ErrInvalidData))
+	assert.Equal(t, uint64(106), lastSeq)
+	assert.Equal(t, 1, follower.CountTags())
+	_, err = follower.ApplyOps(106, []Op{{Seq: 107}})
+	assert.True(t, errors.Is(err, ErrInvalidData))
+	_, err = follower.ApplyOps(106, []Op{{Seq: 107, Data: append(ops[6].Data, 0)}})
+	assert.True(t, errors.Is(err, ErrInvalidData))
+
+	// send failing stops the stream
+	failing := NewOpStream(0, func(op Op) error { return errors.New("no route to follower") })
+	leader.SetChangeLog(failing)
+	leader.Add(ipv4FromBytes([]byte{3, 0, 0, 0}, 8), "three", nil)
+	assert.Error(t, leader.ChangeLogErr())
+	assert.Equal(t, uint64(0), failing.Seq())
+}
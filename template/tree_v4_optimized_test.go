@@ -0,0 +1,152 @@
+package template
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+// the lookups every read-only copy of a TreeV4 has
+type readOnlyTreeV4 interface {
+	CountTags() int
+	FindTags(address patricia.IPv4Address) []GeneratedType
+	FindTagsAppend(ret []GeneratedType, address patricia.IPv4Address) []GeneratedType
+	FindDeepestTag(address patricia.IPv4Address) (bool, GeneratedType)
+	FindDeepestTags(address patricia.IPv4Address) (bool, []GeneratedType)
+}
+
+type readOnlyTreeV6 interface {
+	CountTags() int
+	FindTags(address patricia.IPv6Address) []GeneratedType
+	FindDeepestTags(address patricia.IPv6Address) (bool, []GeneratedType)
+}
+
+// check that a read-only copy of the tree finds the same tags as the tree, for the input addresses
+func assertReadOnlyV4(t *testing.T, tree *TreeV4, optimize func(*TreeV4) readOnlyTreeV4, addresses []patricia.IPv4Address) {
+	optimized := optimize(tree)
+	tagCount := 0
+	for _, tags := range tree.All() {
+		tagCount += len(tags)
+	}
+	assert.Equal(t, tagCount, optimized.CountTags())
+	for _, address := range addresses {
+		expected, _ := tree.FindTags(address)
+		assert.Equal(t, expected, optimized.FindTags(address), address.String())
+		assert.Equal(t, append([]GeneratedType{"first"}, expected...), optimized.FindTagsAppend([]GeneratedType{"first"}, address))
+
+		expectedFound, expectedTag, _ := tree.FindDeepestTag(address)
+		found, tag := optimized.FindDeepestTag(address)
+		assert.Equal(t, expectedFound, found)
+		assert.Equal(t, expectedTag, tag)
+
+		_, expected, _ = tree.FindDeepestTags(address)
+		_, tags := optimized.FindDeepestTags(address)
+		assert.Equal(t, expected, tags)
+	}
+}
+
+func TestOptimizedTreeV4(t *testing.T) {
+	testReadOnlyTreeV4(t, func(tree *TreeV4) readOnlyTreeV4 { return tree.Optimize() })
+}
+
+func TestOptimizedTreeV6(t *testing.T) {
+	testReadOnlyTreeV6(t, func(tree *TreeV6) readOnlyTreeV6 { return tree.Optimize() })
+}
+
+func testReadOnlyTreeV4(t *testing.T, optimize func(*TreeV4) readOnlyTreeV4) {
+	random := rand.New(rand.NewSource(1))
+	tree := NewTreeV4()
+	var addresses []patricia.IPv4Address
+	randomAddress := func(length uint) patricia.IPv4Address {
+		address := patricia.NewIPv4Address(random.Uint32(), length)
+		if random.Intn(2) == 0 {
+			// lots in one place, so some nodes branch on many bits
+			address.Address = 10<<24 | address.Address>>8
+		}
+		return address
+	}
+
+	// empty, then with tags at the root only
+	assertReadOnlyV4(t, tree, optimize, []patricia.IPv4Address{randomAddress(32), {}})
+	tree.Add(patricia.IPv4Address{}, "default", nil)
+	assertReadOnlyV4(t, tree, optimize, []patricia.IPv4Address{randomAddress(32), randomAddress(8), {}})
+
+	for i := 0; i < 2000; i++ {
+		address := randomAddress(uint(1 + random.Intn(32)))
+		address.Address &^= uint32(uint64(0xffffffff) >> address.Length)
+		addresses = append(addresses, address)
+		tree.Add(address, i, nil)
+		if i%10 == 0 {
+			tree.Add(address, "again", nil)
+		}
+	}
+	tree.AddWithExpiry(addresses[0], "expired", time.Now().Add(-time.Minute), nil)
+	tree.AddWithExpiry(addresses[1], "expiring", time.Now().Add(time.Hour), nil)
+
+	// the prefixes themselves, addresses within them, and random ones of every length
+	var lookups []patricia.IPv4Address
+	for _, address := range addresses {
+		lookups = append(lookups, address)
+		within := address
+		within.Address |= random.Uint32() & uint32(uint64(0xffffffff)>>address.Length)
+		within.Length = uint(random.Intn(33))
+		lookups = append(lookups, within, randomAddress(32), randomAddress(uint(random.Intn(33))))
+	}
+	assertReadOnlyV4(t, tree, optimize, lookups)
+
+	// it's a copy, so changing the tree leaves it as it was
+	optimized := optimize(tree)
+	expected := optimized.FindTags(addresses[2])
+	tree.Add(addresses[2], "changed", nil)
+	assert.Equal(t, expected, optimized.FindTags(addresses[2]))
+}
+
+func testReadOnlyTreeV6(t *testing.T, optimize func(*TreeV6) readOnlyTreeV6) {
+	random := rand.New(rand.NewSource(1))
+	tree := NewTreeV6()
+	tree.Add(patricia.IPv6Address{}, "default", nil)
+	var addresses []patricia.IPv6Address
+	for i := 0; i < 2000; i++ {
+		address := patricia.IPv6Address{Left: 0x2001_0db8_0000_0000 | random.Uint64()>>32, Right: random.Uint64(), Length: uint(1 + random.Intn(128))}
+		if i%2 == 0 {
+			address.Left = random.Uint64()
+		}
+		address.ShiftLeft(0)
+		tree.Add(address, i, nil)
+		addresses = append(addresses, address)
+	}
+
+	optimized := optimize(tree)
+	assert.Equal(t, tree.CountTags(), optimized.CountTags())
+	for _, address := range addresses {
+		address.Length = 128
+		expected, _ := tree.FindTags(address)
+		assert.Equal(t, expected, optimized.FindTags(address))
+		_, expectedTags, _ := tree.FindDeepestTags(address)
+		_, tags := optimized.FindDeepestTags(address)
+		assert.Equal(t, expectedTags, tags)
+	}
+}
+
+func BenchmarkFindTagsOptimized(b *testing.B) {
+	tree := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 200000; i++ {
+		tree.Add(patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25))), i, nil)
+	}
+	optimized := tree.Optimize()
+	addresses := make([]patricia.IPv4Address, 1024)
+	for i := range addresses {
+		addresses[i] = patricia.NewIPv4Address(random.Uint32(), 32)
+	}
+
+	ret := make([]GeneratedType, 0, 32)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ret = optimized.FindTagsAppend(ret[:0], addresses[n%len(addresses)])
+	}
+}
@@ -0,0 +1,128 @@
+package template
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+// every prefix and its tags, in walk order, as strings
+func persistentEntriesV4(tree *PersistentTreeV4) []string {
+	var ret []string
+	for prefix, tags := range tree.All() {
+		for _, tag := range tags {
+			ret = append(ret, prefix.String()+" "+tag.(string))
+		}
+	}
+	return ret
+}
+
+func treeEntriesV4(tree *TreeV4) []string {
+	var ret []string
+	for prefix, tags := range tree.All() {
+		for _, tag := range tags {
+			ret = append(ret, prefix.String()+" "+tag.(string))
+		}
+	}
+	return ret
+}
+
+func TestPersistentTreeV4(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	expected := NewTreeV4()
+	tree := NewPersistentTreeV4()
+	var addresses []patricia.IPv4Address
+	var versions []*PersistentTreeV4
+	var versionEntries [][]string
+	matchAll := func(GeneratedType, GeneratedType) bool { return true }
+	matchEqual := func(payload GeneratedType, val GeneratedType) bool { return payload == val }
+
+	for i := 0; i < 2000; i++ {
+		var err error
+		switch {
+		case i%5 == 4:
+			// delete a prefix that's there, or one that isn't
+			address := addresses[random.Intn(len(addresses))]
+			if i%3 == 0 {
+				address = patricia.NewIPv4Address(random.Uint32(), 32)
+			}
+			expectedCount, _ := expected.Delete(address, matchAll, nil)
+			var deleteCount int
+			tree, deleteCount, err = tree.Delete(address, matchAll, nil)
+			assert.Equal(t, expectedCount, deleteCount)
+		case i%7 == 6:
+			address := addresses[random.Intn(len(addresses))]
+			expected.Set(address, "set")
+			tree, err = tree.Set(address, "set")
+		default:
+			address := patricia.NewIPv4Address(random.Uint32(), uint(random.Intn(33)))
+			if i%3 == 0 && len(addresses) > 0 {
+				address = addresses[random.Intn(len(addresses))]
+			}
+			addresses = append(addresses, address)
+			tag := string(rune('a' + i%3))
+			expectedIncreased, _, _ := expected.Add(address, tag, matchEqual)
+			var increased bool
+			tree, increased, err = tree.Add(address, tag, matchEqual)
+			assert.Equal(t, expectedIncreased, increased)
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, expected.CountTags(), tree.CountTags())
+
+		if i%100 == 0 {
+			versions = append(versions, tree)
+			versionEntries = append(versionEntries, treeEntriesV4(expected))
+		}
+	}
+	assert.Equal(t, treeEntriesV4(expected), persistentEntriesV4(tree))
+
+	for i := 0; i < 1000; i++ {
+		address := patricia.NewIPv4Address(random.Uint32(), 32)
+		if i%2 == 0 {
+			address = addresses[random.Intn(len(addresses))]
+		}
+		expectedTags, _ := expected.FindTags(address)
+		assert.Equal(t, expectedTags, tree.FindTags(address))
+		expectedFound, expectedTag, _ := expected.FindDeepestTag(address)
+		found, tag := tree.FindDeepestTag(address)
+		assert.Equal(t, expectedFound, found)
+		assert.Equal(t, expectedTag, tag)
+		_, expectedTags, _ = expected.FindDeepestTags(address)
+		_, tags := tree.FindDeepestTags(address)
+		assert.Equal(t, expectedTags, tags)
+	}
+
+	// every old version is still as it was
+	for i, version := range versions {
+		assert.Equal(t, versionEntries[i], persistentEntriesV4(version))
+	}
+
+	// and converting back and forth doesn't lose anything
+	assertSameTreesV4(t, expected, tree.Tree())
+	assert.Equal(t, treeEntriesV4(expected), persistentEntriesV4(expected.Persistent()))
+	assert.Equal(t, expected.CountTags(), expected.Persistent().CountTags())
+
+	// deleting everything leaves just the root
+	for _, address := range addresses {
+		tree, _, _ = tree.Delete(address, matchAll, nil)
+	}
+	assert.Equal(t, 0, tree.CountTags())
+	assert.Nil(t, tree.root.left)
+	assert.Nil(t, tree.root.right)
+
+	// changes that don't change anything return the same tree
+	tree, _, _ = tree.Add(patricia.NewIPv4Address(0, 8), "a", nil)
+	same, increased, err := tree.Add(patricia.NewIPv4Address(0, 8), "a", matchEqual)
+	assert.NoError(t, err)
+	assert.False(t, increased)
+	assert.True(t, same == tree)
+	same, deleteCount, err := tree.Delete(patricia.NewIPv4Address(0, 8), matchEqual, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleteCount)
+	assert.True(t, same == tree)
+
+	_, _, err = tree.Add(patricia.IPv4Address{Length: 33}, "a", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,82 @@
+package template
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPrefixList(t *testing.T) {
+	list := `# bogons
+0.0.0.0/8
+10.0.0.0/8     private network   // RFC 1918
+100.64.0.0/10 ; SBL123456
+192.0.2.1
+
+  198.18.0.0/15	benchmarking # RFC 2544
+`
+	tree := NewTreeV4()
+	added, err := tree.LoadPrefixList(strings.NewReader(list), "bogon")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, added)
+	for _, test := range []struct {
+		address  []byte
+		expected []GeneratedType
+	}{
+		{[]byte{0, 1, 2, 3}, []GeneratedType{"bogon"}},
+		{[]byte{10, 1, 2, 3}, []GeneratedType{"private network"}},
+		{[]byte{100, 64, 1, 1}, []GeneratedType{"bogon"}},
+		{[]byte{192, 0, 2, 1}, []GeneratedType{"bogon"}},
+		{[]byte{192, 0, 2, 2}, []GeneratedType{}},
+		{[]byte{198, 19, 0, 1}, []GeneratedType{"benchmarking"}},
+	} {
+		tags, err := tree.FindTags(ipv4FromBytes(test.address, 32))
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, tags, "%v", test.address)
+	}
+
+	// a parser
+	tree = NewTreeV4()
+	parseInt := func(value string) (GeneratedType, error) {
+		return strconv.Atoi(value)
+	}
+	added, err = tree.LoadPrefixList(strings.NewReader("10.0.0.0/8 64512\n10.1.0.0/16\n"), 0, WithPrefixListParser(parseInt))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, added)
+	tags, err := tree.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{64512, 0}, tags)
+}
+
+func TestLoadPrefixListErrors(t *testing.T) {
+	parseInt := func(value string) (GeneratedType, error) {
+		return strconv.Atoi(value)
+	}
+	list := "10.0.0.0/8\n2001:db8::/32\nexample.com\n10.0.0.0/33\n10.1.0.0/16 x\n192.168.0.0/16\n"
+
+	// strict stops at the first bad line
+	tree := NewTreeV4()
+	added, err := tree.LoadPrefixList(strings.NewReader(list), 1, WithPrefixListParser(parseInt))
+	assert.Equal(t, 1, added)
+	assert.EqualError(t, err, "line 2: \"2001:db8::/32\" isn't an IPv4 prefix")
+	assert.Equal(t, 1, tree.CountTags())
+
+	// lenient skips them all
+	var skipped []string
+	tree = NewTreeV4()
+	added, err = tree.LoadPrefixList(strings.NewReader(list), 1, WithPrefixListParser(parseInt), WithPrefixListLenient(func(err error) {
+		skipped = append(skipped, err.Error())
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, added)
+	assert.Equal(t, 4, len(skipped))
+	for i, prefix := range []string{"line 2: ", "line 3: ", "line 4: ", "line 5: invalid value \"x\": "} {
+		assert.True(t, strings.HasPrefix(skipped[i], prefix), skipped[i])
+	}
+
+	// lines too long to read fail even when lenient
+	_, err = NewTreeV4().LoadPrefixList(strings.NewReader("10.0.0.0/8\n"+strings.Repeat(" ", 100000)), 1, WithPrefixListLenient(nil))
+	assert.EqualError(t, err, "line 2: bufio.Scanner: token too long")
+}
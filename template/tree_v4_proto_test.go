@@ -0,0 +1,89 @@
+package template
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToProto(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "a", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), -3, nil)
+
+	data, err := tree.ToProto()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		0x0a, 0x11, // Tree.entries
+		0x0a, 0x04, 10, 0, 0, 0, // Entry.address
+		0x10, 0x08, // Entry.length
+		0x1a, 0x03, 0x12, 0x01, 'a', // Entry.tags: Tag.string_value
+		0x1a, 0x02, 0x18, 0x05, // Entry.tags: Tag.int_value, zigzag encoded
+	}, data)
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	data, err := tree.ToProto()
+	assert.NoError(t, err)
+
+	decoded := NewTreeV4()
+	assert.NoError(t, decoded.FromProto(data))
+	expected := make(map[string][]GeneratedType)
+	for prefix, tags := range tree.All() {
+		expected[prefix.String()] = tags
+	}
+	found := make(map[string][]GeneratedType)
+	for prefix, tags := range decoded.All() {
+		found[prefix.String()] = tags
+	}
+
+	// integers come back as the widest type of their sign, everything else as it was
+	expected["10.0.0.0/8"][1] = int64(42)
+	expected["10.1.2.3/32"][0] = uint64(7)
+	assert.Equal(t, expected, found)
+
+	// V6 too
+	treeV6 := NewTreeV6()
+	for i, cidr := range []string{"::/0", "2001:db8::/32", "fe80::1/128"} {
+		_, address, _ := patricia.ParseIPFromString(cidr)
+		treeV6.Add(*address, float32(i), nil)
+	}
+	data, err = treeV6.ToProto()
+	assert.NoError(t, err)
+	decodedV6 := NewTreeV6()
+	assert.NoError(t, decodedV6.FromProto(data))
+	assert.Equal(t, treeV6.nodes, decodedV6.nodes)
+	assert.Equal(t, treeV6.tags.slices, decodedV6.tags.slices)
+	assert.Error(t, decoded.FromProto(data))
+}
+
+func TestFromProto(t *testing.T) {
+	// fields we don't know are skipped, and an empty address is all zeros
+	tree := NewTreeV4()
+	assert.NoError(t, tree.FromProto([]byte{
+		0x10, 0x01, // unknown Tree field
+		0x0a, 0x06, // Tree.entries
+		0x1a, 0x02, 0x08, 0x01, // Entry.tags: Tag.bool_value
+		0x28, 0x07, // unknown Entry field
+	}))
+	tags, err := tree.FindTags(ipv4FromBytes([]byte{1, 2, 3, 4}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{true}, tags)
+
+	// bad input leaves the tree alone
+	for _, data := range [][]byte{
+		{0x0a, 0x06, 0x1a, 0x02, 0x08},       // truncated
+		{0x0a, 0x04, 0x0a, 0x02, 10, 0},      // 2 byte address
+		{0x0a, 0x02, 0x10, 0x21},             // prefix length 33
+		{0x0a, 0x02, 0x1a, 0x00},             // tag without a value
+		{0x0a, 0x03, 0x1a, 0x01, 0x08},       // truncated tag
+		{0x0a, 0x04, 0x1a, 0x02, 0x0d, 0x00}, // bool_value with the wrong wire type
+	} {
+		err := tree.FromProto(data)
+		assert.True(t, errors.Is(err, ErrInvalidData), "%v: %v", data, err)
+	}
+	assert.Equal(t, 1, tree.CountTags())
+}
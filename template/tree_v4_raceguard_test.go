@@ -0,0 +1,58 @@
+//go:build patricia_raceguard
+
+package template
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRaceGuard(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(patricia.NewIPv4Address(0, 0), "root", nil)
+	tree.Add(patricia.NewIPv4Address(10<<24, 8), "10/8", nil)
+	address := patricia.NewIPv4Address(10<<24|1, 32)
+
+	tags, err := tree.FindTags(address)
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{"root", "10/8"}, tags)
+
+	// the filter changes the tree in the middle of the lookup, standing in for another goroutine
+	i := uint32(0)
+	changeTree := func(payload GeneratedType) bool {
+		for n := 0; n < 100; n++ {
+			i++
+			tree.Add(patricia.NewIPv4Address(i<<8, 24), "new", nil)
+		}
+		return true
+	}
+	_, err = tree.FindTagsWithFilter(address, changeTree)
+	assert.True(t, errors.Is(err, ErrConcurrentModification))
+
+	// lookups that don't overlap a change are fine
+	tags, err = tree.FindTagsWithFilter(address, func(GeneratedType) bool { return true })
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{"root", "10/8"}, tags)
+	found, tag, err := tree.FindDeepestTag(address)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "10/8", tag)
+	found, tags, err = tree.FindDeepestTags(address)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []GeneratedType{"10/8"}, tags)
+
+	// every kind of change counts, but taking a snapshot, or sweeping with nothing to expire, isn't a change
+	changeSeq := tree.changeSeq
+	tree.Delete(patricia.NewIPv4Address(1<<8, 24), func(GeneratedType, GeneratedType) bool { return true }, nil)
+	tree.Snapshot()
+	tree.Sweep()
+	tree.Clear()
+	batch := tree.NewBatch()
+	batch.Add(patricia.NewIPv4Address(0, 0), "batch", nil)
+	assert.NoError(t, batch.Commit())
+	assert.Equal(t, changeSeq+3, tree.changeSeq)
+}
@@ -0,0 +1,37 @@
+package template
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteRoutes(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "a", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "b", nil)
+	tree.Add(ipv4FromBytes([]byte{192, 168, 0, 0}, 16), "c\nd", nil)
+	tree.Add(ipv4FromBytes([]byte{0, 0, 0, 0}, 0), "default", nil)
+
+	var buf bytes.Buffer
+	assert.NoError(t, tree.WriteRoutes(&buf, RouteStyleIP, nil))
+	assert.Equal(t, "0.0.0.0/0 # default\n10.0.0.0/8 # a\n10.0.0.0/8 # b\n192.168.0.0/16 # c d\n", buf.String())
+
+	nextHops := map[GeneratedType]string{"a": "192.0.2.1", "b": "192.0.2.2"}
+	format := func(tag GeneratedType) (string, string) {
+		if nextHop, ok := nextHops[tag]; ok {
+			return "via " + nextHop, ""
+		}
+		return "unreachable", fmt.Sprintf("tag %v", tag)
+	}
+	buf.Reset()
+	assert.NoError(t, tree.WriteRoutes(&buf, RouteStyleBIRD, format))
+	assert.Equal(t, "route 0.0.0.0/0 unreachable; # tag default\nroute 10.0.0.0/8 via 192.0.2.1;\nroute 10.0.0.0/8 via 192.0.2.2;\nroute 192.168.0.0/16 unreachable; # tag c d\n", buf.String())
+
+	assert.Error(t, tree.WriteRoutes(&buf, RouteStyle(-1), nil))
+	assert.True(t, errors.Is(tree.WriteRoutes(failingWriter{}, RouteStyleIP, nil), io.ErrClosedPipe))
+}
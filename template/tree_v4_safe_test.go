@@ -0,0 +1,81 @@
+package template
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafeTreeV4(t *testing.T) {
+	tree := NewSafeTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "ten", nil)
+
+	// writers and readers at the same time - run with -race to make this mean something
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 256; i++ {
+				address := ipv4FromBytes([]byte{10, byte(w), byte(i), 0}, 24)
+				_, _, err := tree.Add(address, i, nil)
+				assert.NoError(t, err)
+				if i%2 == 1 {
+					_, err = tree.Delete(address, func(a, b GeneratedType) bool { return true }, nil)
+					assert.NoError(t, err)
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 256; i++ {
+				address := ipv4FromBytes([]byte{10, byte(r), byte(i), 1}, 32)
+				tags, err := tree.FindTags(address)
+				assert.NoError(t, err)
+				assert.Equal(t, "ten", tags[0])
+				found, _, err := tree.FindDeepestTag(address)
+				assert.NoError(t, err)
+				assert.True(t, found)
+				batchFound := make([]bool, 2)
+				assert.NoError(t, tree.FindDeepestTagBatch([]patricia.IPv4Address{address, address}, batchFound, make([]GeneratedType, 2)))
+				assert.Equal(t, []bool{true, true}, batchFound)
+				if i%64 == 0 {
+					for _, tags := range tree.All() {
+						assert.NotEmpty(t, tags)
+					}
+					// a snapshot doesn't need the lock, and doesn't change underneath us
+					snapshot := tree.Snapshot()
+					count := 0
+					for _, tags := range snapshot.All() {
+						count += len(tags)
+					}
+					assert.Equal(t, snapshot.CountTags(), count)
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1+4*128, tree.CountTags())
+	count := 0
+	for prefix, tags := range tree.Subtree(ipv4FromBytes([]byte{10, 1, 0, 0}, 16)) {
+		assert.Equal(t, 0, tags[0].(int)%2, prefix.String())
+		count++
+	}
+	assert.Equal(t, 128, count)
+
+	data, err := tree.MarshalBinary()
+	assert.NoError(t, err)
+	loaded := NewSafeTreeV4()
+	assert.NoError(t, loaded.UnmarshalBinary(data))
+	tree.Read(func(expected *TreeV4) {
+		loaded.Write(func(actual *TreeV4) {
+			assertSameTreesV4(t, expected, actual)
+		})
+	})
+}
@@ -0,0 +1,105 @@
+package template
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedTreeV4(t *testing.T) {
+	for _, bits := range []uint{0, 1, 4, 8, 20} {
+		tree := NewShardedTreeV4(bits)
+		expected := NewTreeV4()
+		if bits > _maxShardBitsV4 {
+			assert.Equal(t, 1<<_maxShardBitsV4, tree.ShardCount())
+		} else {
+			assert.Equal(t, 1<<bits, tree.ShardCount())
+		}
+
+		random := rand.New(rand.NewSource(int64(bits)))
+		var addresses []patricia.IPv4Address
+		for i := 0; i < 1000; i++ {
+			address := patricia.NewIPv4Address(random.Uint32(), uint(random.Intn(33)))
+			address.Address &^= uint32(uint64(0xffffffff) >> address.Length)
+			addresses = append(addresses, address)
+			tree.Add(address, i, nil)
+			expected.Add(address, i, nil)
+		}
+		matchAll := func(payload GeneratedType, val GeneratedType) bool { return true }
+		for i, address := range addresses[:100] {
+			if i%2 == 0 {
+				_, err := tree.Delete(address, matchAll, nil)
+				assert.NoError(t, err)
+				expected.Delete(address, matchAll, nil)
+			} else {
+				_, _, err := tree.Set(address, "set")
+				assert.NoError(t, err)
+				expected.Set(address, "set")
+			}
+		}
+		assert.Equal(t, expected.CountTags(), tree.CountTags())
+		assert.Equal(t, expected.PrefixCount(), tree.PrefixCount())
+
+		for i := 0; i < 1000; i++ {
+			address := patricia.NewIPv4Address(random.Uint32(), 32)
+			if i%10 == 0 {
+				address = addresses[i]
+			}
+			expectedTags, _ := expected.FindTags(address)
+			tags, err := tree.FindTags(address)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedTags, tags)
+
+			expectedFound, expectedTag, _ := expected.FindDeepestTag(address)
+			found, tag, err := tree.FindDeepestTag(address)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedFound, found)
+			assert.Equal(t, expectedTag, tag)
+
+			_, expectedTags, _ = expected.FindDeepestTags(address)
+			_, tags, err = tree.FindDeepestTags(address)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedTags, tags)
+		}
+
+		var expectedPrefixes, prefixes []patricia.IPv4Address
+		for prefix := range expected.All() {
+			expectedPrefixes = append(expectedPrefixes, prefix)
+		}
+		for prefix := range tree.All() {
+			prefixes = append(prefixes, prefix)
+		}
+		assert.Equal(t, expectedPrefixes, prefixes)
+		for range tree.All() {
+			break
+		}
+
+		tree.Clear()
+		assert.Equal(t, 0, tree.CountTags())
+	}
+}
+
+func TestShardedTreeV4Concurrent(t *testing.T) {
+	tree := NewShardedTreeV4(4)
+	tree.Add(patricia.NewIPv4Address(0, 0), "default", nil)
+
+	// one writer per shard, along with readers - run with -race to make this mean something
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				tree.Add(patricia.NewIPv4Address(uint32(w)<<28|uint32(i)<<8, 24), i, nil)
+				tags, err := tree.FindTags(patricia.NewIPv4Address(uint32(w)<<28|uint32(i)<<8|1, 32))
+				assert.NoError(t, err)
+				assert.Equal(t, []GeneratedType{"default", i}, tags)
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.Equal(t, 1+16*100, tree.CountTags())
+}
@@ -2,9 +2,17 @@ package template
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kentik/patricia"
 	"github.com/stretchr/testify/assert"
@@ -37,11 +45,127 @@ func BenchmarkFindTags(b *testing.B) {
 	}
 }
 
+func BenchmarkFindTagsPooled(b *testing.B) {
+	tree := NewTreeV4(WithResultPool())
+	tree.Add(patricia.IPv4Address{}, "tagZ", nil) // default
+	tree.Add(ipv4FromBytes([]byte{129, 0, 0, 1}, 7), "tagA", nil)
+	tree.Add(ipv4FromBytes([]byte{160, 0, 0, 0}, 2), "tagB", nil) // 160 -> 128
+	tree.Add(ipv4FromBytes([]byte{128, 3, 6, 240}, 32), "tagC", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		address := patricia.NewIPv4Address(uint32(2156823809), 32)
+		tags, _ := tree.FindTags(address)
+		ReleaseTags(tags)
+	}
+}
+
+// lookups in a tree too big for its tags to stay in cache, where the cost of getting at a node's tags shows
+func BenchmarkFindTagsLargeTree(b *testing.B) {
+	tree := NewTreeV4(WithResultPool())
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 200000; i++ {
+		tree.Add(patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25))), i, nil)
+	}
+	addresses := make([]patricia.IPv4Address, 1024)
+	for i := range addresses {
+		addresses[i] = patricia.NewIPv4Address(random.Uint32(), 32)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tags, _ := tree.FindTags(addresses[n%len(addresses)])
+		ReleaseTags(tags)
+	}
+}
+
+// single-tag lookups in a large tree, with the tags in slices of their own, and inline
+func BenchmarkFindDeepestTagInline(b *testing.B) {
+	for _, option := range []struct {
+		name   string
+		option TreeOption
+	}{{"single", WithSingleTag()}, {"inline", WithInlineTag()}} {
+		b.Run(option.name, func(b *testing.B) {
+			tree := NewTreeV4(option.option)
+			random := rand.New(rand.NewSource(1))
+			for i := 0; i < 200000; i++ {
+				tree.Set(patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25))), "tag")
+			}
+			addresses := make([]patricia.IPv4Address, 1024)
+			for i := range addresses {
+				addresses[i] = patricia.NewIPv4Address(random.Uint32(), 32)
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				tree.FindDeepestTag(addresses[n%len(addresses)])
+			}
+			b.ReportMetric(float64(tree.MemoryStats().TotalBytes), "tree-bytes")
+		})
+	}
+}
+
+// a tree of a million prefixes, whose nodes take up tens of megabytes - far more than fits in L2, or most L3 caches -
+// along with addresses to look up in it, spread over the whole tree
+func hugeTreeV4(options ...TreeOption) (*TreeV4, []patricia.IPv4Address) {
+	tree := NewTreeV4(options...)
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 1<<20; i++ {
+		tree.Set(patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25))), i)
+	}
+	addresses := make([]patricia.IPv4Address, 1<<16)
+	for i := range addresses {
+		addresses[i] = patricia.NewIPv4Address(random.Uint32(), 32)
+	}
+	return tree, addresses
+}
+
+// lookups that miss in cache at almost every node, where the time goes on waiting for memory
+// - finding the next node before checking the current one's tags, and touching it early, made no difference here: the
+// next node's index is only known once the current one's loaded, so there's nothing to fetch ahead of it, and the CPU
+// already overlaps checking the tags with that load
+func BenchmarkFindDeepestTagHugeTree(b *testing.B) {
+	tree, addresses := hugeTreeV4()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tree.FindDeepestTag(addresses[n%len(addresses)])
+	}
+}
+
+// the same lookups, a batch at a time, with several under way at once, so their waits for memory overlap
+// - reported per address, to compare with BenchmarkFindDeepestTagHugeTree - about 40% less, where this was written
+// - loading every lookup's next node before checking any of them made about 10% of that difference, and 16 lookups
+// under way, rather than 8, about 15% more, on a core that can wait on more reads than most
+func BenchmarkFindDeepestTagBatchHugeTree(b *testing.B) {
+	tree, addresses := hugeTreeV4()
+	found := make([]bool, 64)
+	tags := make([]GeneratedType, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n += len(found) {
+		start := n % len(addresses)
+		tree.FindDeepestTagBatch(addresses[start:start+len(found)], found, tags)
+	}
+}
+
+func BenchmarkFindTagsHugeTree(b *testing.B) {
+	tree, addresses := hugeTreeV4()
+	ret := make([]GeneratedType, 0, 32)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ret = tree.FindTagsAppend(ret[:0], addresses[n%len(addresses)])
+	}
+}
+
 func BenchmarkFindDeepestTag(b *testing.B) {
 	tree := NewTreeV4()
 	for i := 32; i > 0; i-- {
 		tree.Add(ipv4FromBytes([]byte{127, 0, 0, 1}, i), fmt.Sprintf("Tag-%d", i), nil)
 	}
+	b.ReportAllocs()
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		address := patricia.NewIPv4Address(uint32(2130706433), 32)
@@ -49,6 +173,25 @@ func BenchmarkFindDeepestTag(b *testing.B) {
 	}
 }
 
+// setting prefixes in a tree too big to stay in cache, where the cost of walking down to them shows
+func BenchmarkSetLargeTree(b *testing.B) {
+	tree := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 200000; i++ {
+		tree.Set(patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25))), "tag")
+	}
+	addresses := make([]patricia.IPv4Address, 1024)
+	for i := range addresses {
+		addresses[i] = patricia.NewIPv4Address(random.Uint32(), uint(8+random.Intn(25)))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tree.Set(addresses[n%len(addresses)], "tag")
+	}
+}
+
 func BenchmarkBuildTreeAndFindDeepestTag(b *testing.B) {
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
@@ -748,7 +891,7 @@ func TestDelete1(t *testing.T) {
 	assert.Equal(t, 3, tree.countNodes(1))
 	assert.Equal(t, 2, tree.countTags(1))
 	assert.Equal(t, 1, len(tree.availableIndexes))
-	assert.Equal(t, uint(2), tree.availableIndexes[0])
+	assert.Equal(t, treeIndex(2), tree.availableIndexes[0])
 
 	// 5. delete tag B
 	count, err = tree.Delete(ipv4FromBytes([]byte{128, 0, 0, 0}, 2), matchFunc, "tagB")
@@ -762,7 +905,7 @@ func TestDelete1(t *testing.T) {
 	assert.Equal(t, 2, tree.countNodes(1))
 	assert.Equal(t, 1, tree.countTags(1))
 	assert.Equal(t, 2, len(tree.availableIndexes))
-	assert.Equal(t, uint(3), tree.availableIndexes[1])
+	assert.Equal(t, treeIndex(3), tree.availableIndexes[1])
 
 	// add tagE & tagF to the same node
 	tree.Add(ipv4FromBytes([]byte{1, 3, 6, 240}, 32), "tagE", nil)
@@ -772,7 +915,7 @@ func TestDelete1(t *testing.T) {
 
 	// this should be recycling tagB
 	assert.Equal(t, 1, len(tree.availableIndexes))
-	assert.Equal(t, uint(2), tree.availableIndexes[0])
+	assert.Equal(t, treeIndex(2), tree.availableIndexes[0])
 	assert.Equal(t, "tagE", tree.tagsForNode(3)[0])
 
 	// 6. delete tag C
@@ -805,14 +948,16 @@ func TestTagsMap(t *testing.T) {
 	tree := NewTreeV4()
 
 	// insert tags
-	tree.addTag("tagA", 1, nil, false)
-	tree.addTag("tagB", 1, nil, false)
-	tree.addTag("tagC", 1, nil, false)
-	tree.addTag("tagD", 0, nil, false) // there's no node0, but it exists, so use it for this test
+	tree.addTag("tagA", 1, nil, false, 0)
+	tree.addTag("tagB", 1, nil, false, 0)
+	tree.addTag("tagC", 1, nil, false, 0)
+	tree.addTag("tagD", 0, nil, false, 0) // there's no node0, but it exists, so use it for this test
 
 	// verify
 	assert.Equal(t, 3, tree.nodes[1].TagCount)
-	assert.Equal(t, "tagA", tree.firstTagForNode(1))
+	firstTag, found := tree.firstTagForNode(1)
+	assert.True(t, found)
+	assert.Equal(t, "tagA", firstTag)
 	assert.Equal(t, 3, len(tree.tagsForNode(1)))
 	assert.Equal(t, "tagA", tree.tagsForNode(1)[0])
 	assert.Equal(t, "tagB", tree.tagsForNode(1)[1])
@@ -930,3 +1075,1605 @@ func payloadToByteArrays(tags []GeneratedType) [][]byte {
 	}
 	return ret
 }
+
+func TestUpdateTags(t *testing.T) {
+	address := ipv4FromBytes([]byte{1, 2, 3, 4}, 32)
+
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{1, 2, 3, 0}, 24), "parent", nil)
+	tree.Add(address, "a", nil)
+	tree.Add(address, "b", nil)
+	tree.Add(address, "c", nil)
+
+	// rewrite one tag, drop another
+	kept, dropped, err := tree.UpdateTags(address, func(tag GeneratedType) (GeneratedType, bool) {
+		switch tag.(string) {
+		case "a":
+			return "A", true
+		case "b":
+			return nil, false
+		}
+		return tag, true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, kept)
+	assert.Equal(t, 1, dropped)
+	found, tags, err := tree.FindDeepestTags(address)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, tagArraysEqual(tags, []string{"A", "c"}))
+
+	// no exact match - nothing updated
+	kept, dropped, err = tree.UpdateTags(ipv4FromBytes([]byte{1, 2, 3, 5}, 32), func(tag GeneratedType) (GeneratedType, bool) {
+		return nil, false
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, kept)
+	assert.Equal(t, 0, dropped)
+
+	// drop everything - the node goes away
+	kept, dropped, err = tree.UpdateTags(address, func(tag GeneratedType) (GeneratedType, bool) {
+		return nil, false
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, kept)
+	assert.Equal(t, 2, dropped)
+	assert.Equal(t, 2, tree.countNodes(1))
+	found, tag, err := tree.FindDeepestTag(address)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "parent", tag)
+}
+
+func TestClear(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{0, 0, 0, 0}, 0), "root", nil)
+	for i := 0; i < 100; i++ {
+		tree.Add(ipv4FromBytes([]byte{10, byte(i), 0, 0}, 16), "a", nil)
+	}
+	tree.Delete(ipv4FromBytes([]byte{10, 5, 0, 0}, 16), func(GeneratedType, GeneratedType) bool { return true }, nil)
+	nodesCap := cap(tree.nodes)
+
+	tree.Clear()
+	assert.Equal(t, 2, len(tree.nodes))
+	assert.Equal(t, nodesCap, cap(tree.nodes))
+	assert.Zero(t, len(tree.availableIndexes))
+	assert.Zero(t, len(tree.tags.slices))
+	assert.Equal(t, 0, tree.CountTags())
+	assert.Equal(t, 1, tree.countNodes(1))
+
+	found, _, err := tree.FindDeepestTag(ipv4FromBytes([]byte{10, 1, 0, 0}, 32))
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// it's usable again
+	tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "b", nil)
+	tags, err := tree.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.NoError(t, err)
+	assert.True(t, tagArraysEqual(tags, []string{"b"}))
+}
+
+func TestClone(t *testing.T) {
+	matchFunc := func(tagData GeneratedType, val GeneratedType) bool {
+		return tagData.(string) == val.(string)
+	}
+
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "a", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "b", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 2, 0, 0}, 16), "c", nil)
+	tree.Delete(ipv4FromBytes([]byte{10, 2, 0, 0}, 16), matchFunc, "c")
+
+	clone := tree.Clone()
+	assert.Equal(t, tree.nodes, clone.nodes)
+	assert.Equal(t, tree.availableIndexes, clone.availableIndexes)
+	treeTags, treeExpirations := tree.storedTagsV4()
+	cloneTags, cloneExpirations := clone.storedTagsV4()
+	assert.Equal(t, treeTags, cloneTags)
+	assert.Equal(t, treeExpirations, cloneExpirations)
+
+	// mutating the clone leaves the original alone
+	clone.Add(ipv4FromBytes([]byte{10, 1, 2, 0}, 24), "d", nil)
+	clone.Delete(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), matchFunc, "a")
+	tags, _ := tree.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.True(t, tagArraysEqual(tags, []string{"a", "b"}))
+	tags, _ = clone.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.True(t, tagArraysEqual(tags, []string{"b", "d"}))
+
+	// and vice versa
+	tree.Add(ipv4FromBytes([]byte{10, 1, 2, 3}, 32), "e", nil)
+	tags, _ = clone.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.True(t, tagArraysEqual(tags, []string{"b", "d"}))
+}
+
+func TestAddIfAbsent(t *testing.T) {
+	address := ipv4FromBytes([]byte{1, 2, 3, 4}, 32)
+
+	tree := NewTreeV4()
+	added, err := tree.AddIfAbsent(address, "a", nil)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	added, err = tree.AddIfAbsent(address, "a", nil)
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	added, err = tree.AddIfAbsent(address, "b", nil)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	// custom match func: case-insensitive
+	added, err = tree.AddIfAbsent(address, "B", func(payload GeneratedType, val GeneratedType) bool {
+		return strings.EqualFold(payload.(string), val.(string))
+	})
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	tags, err := tree.FindTags(address)
+	assert.NoError(t, err)
+	assert.True(t, tagArraysEqual(tags, []string{"a", "b"}))
+}
+
+func TestTagLimit(t *testing.T) {
+	address := ipv4FromBytes([]byte{0, 0, 0, 0}, 0)
+
+	// reject
+	tree := NewTreeV4(WithTagLimit(2, TagLimitReject))
+	for _, tag := range []string{"a", "b"} {
+		countIncreased, _, err := tree.Add(address, tag, nil)
+		assert.NoError(t, err)
+		assert.True(t, countIncreased)
+	}
+	countIncreased, count, err := tree.Add(address, "c", nil)
+	assert.Equal(t, ErrTagLimitReached, err)
+	assert.False(t, countIncreased)
+	assert.Equal(t, 2, count)
+
+	// Set still replaces the first tag
+	_, _, err = tree.Set(address, "A")
+	assert.NoError(t, err)
+	tags, _ := tree.FindTags(address)
+	assert.True(t, tagArraysEqual(tags, []string{"A", "b"}))
+
+	// evict oldest
+	tree = NewTreeV4(WithTagLimit(2, TagLimitEvictOldest))
+	for _, tag := range []string{"a", "b", "c"} {
+		_, count, err = tree.Add(address, tag, nil)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, count)
+	tags, _ = tree.FindTags(address)
+	assert.True(t, tagArraysEqual(tags, []string{"b", "c"}))
+
+	// evict by callback: evict the largest tag, unless the new one is larger still
+	tree = NewTreeV4(WithTagEvictFunc(2, func(tags []GeneratedType, newTag GeneratedType) int {
+		largest := 0
+		for i, tag := range tags {
+			if tag.(string) > tags[largest].(string) {
+				largest = i
+			}
+		}
+		if newTag.(string) > tags[largest].(string) {
+			return -1
+		}
+		return largest
+	}))
+	for _, tag := range []string{"b", "d", "c"} {
+		_, _, err = tree.Add(address, tag, nil)
+		assert.NoError(t, err)
+	}
+	_, _, err = tree.Add(address, "z", nil)
+	assert.Equal(t, ErrTagLimitReached, err)
+	tags, _ = tree.FindTags(address)
+	assert.True(t, tagArraysEqual(tags, []string{"b", "c"}))
+}
+
+func TestPrefixLimit(t *testing.T) {
+	addressOf := func(i int) patricia.IPv4Address {
+		return patricia.NewIPv4Address(uint32(i)<<8, 24)
+	}
+
+	// reject, though tags can still be added to the prefixes already there
+	tree := NewTreeV4(WithPrefixLimit(3, PrefixLimitReject))
+	for i := 0; i < 3; i++ {
+		_, _, err := tree.Add(addressOf(i), i, nil)
+		assert.NoError(t, err)
+	}
+	countIncreased, count, err := tree.Add(addressOf(3), 3, nil)
+	assert.Equal(t, ErrPrefixLimitReached, err)
+	assert.False(t, countIncreased)
+	assert.Equal(t, 0, count)
+	_, count, err = tree.Add(addressOf(0), "again", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 3, tree.PrefixCount())
+
+	// evict the least recently hit, while a few prefixes are looked up all along - only a sample is checked, but with
+	// fewer prefixes hot than it holds, they always stay
+	tree = NewTreeV4(WithPrefixLimit(200, PrefixLimitEvictLRU))
+	var evicted []patricia.IPv4Address
+	tree.OnDelete(func(prefix patricia.IPv4Address, _ GeneratedType, _ ChangeOp) {
+		evicted = append(evicted, prefix)
+	})
+	hot := []int{0, 1, 2, 3, 4}
+	for i := 0; i < 1000; i++ {
+		_, _, err := tree.Add(addressOf(i), i, nil)
+		assert.NoError(t, err)
+		for _, h := range hot {
+			tree.FindDeepestTag(addressOf(h))
+		}
+		if i == 500 {
+			// compacting keeps the hits
+			before := prefixHitsV4(tree)
+			tree.Compact()
+			assert.Equal(t, before, prefixHitsV4(tree))
+		}
+	}
+	assert.Equal(t, 200, tree.PrefixCount())
+	assert.Equal(t, 800, len(evicted))
+	for _, h := range hot {
+		found, tag, _ := tree.FindDeepestTag(addressOf(h))
+		assert.True(t, found)
+		assert.Equal(t, h, tag)
+	}
+	assertCountsV4(t, tree)
+
+	// evict by callback: evict the lowest tag, unless the new prefix is lower still
+	tree = NewTreeV4(WithPrefixEvictFunc(10, func(candidates []PrefixCandidate, newPrefix netip.Prefix) int {
+		lowest := 0
+		for i, candidate := range candidates {
+			assert.True(t, candidate.LastHit > 0)
+			if candidate.Tags[0].(int) < candidates[lowest].Tags[0].(int) {
+				lowest = i
+			}
+		}
+		if newPrefix.Addr().As4()[0] == 0xff {
+			return -1
+		}
+		return lowest
+	}))
+	for i := 0; i < 100; i++ {
+		_, _, err := tree.Add(addressOf(i), i, nil)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 10, tree.PrefixCount())
+	_, _, err = tree.Add(patricia.NewIPv4Address(0xff000000, 8), -1, nil)
+	assert.Equal(t, ErrPrefixLimitReached, err)
+	assert.Equal(t, 10, tree.PrefixCount())
+}
+
+// returns when each prefix with tags in the tree was last hit, by prefix
+func prefixHitsV4(tree *TreeV4) map[patricia.IPv4Address]uint64 {
+	ret := make(map[patricia.IPv4Address]uint64)
+	for entry := range tree.Entries() {
+		nodeIndex, _, _ := tree.findNode(entry.Prefix)
+		ret[entry.Prefix] = tree.hits[nodeIndex]
+	}
+	return ret
+}
+
+func TestTreeFull(t *testing.T) {
+	defer func(maxTreeIndex uint64) { _maxTreeIndex = maxTreeIndex }(_maxTreeIndex)
+	_maxTreeIndex = 5
+
+	// the root's node 1, so these take nodes 2-4
+	tree := NewTreeV4()
+	for _, length := range []int{8, 16, 24} {
+		_, _, err := tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, length), length, nil)
+		assert.NoError(t, err)
+	}
+
+	// splitting needs two more, and there's only room for one - the one taken goes back
+	countIncreased, count, err := tree.Add(ipv4FromBytes([]byte{11, 0, 0, 0}, 8), "full", nil)
+	assert.True(t, errors.Is(err, ErrTreeFull))
+	assert.False(t, countIncreased)
+	assert.Equal(t, 0, count)
+	assert.Equal(t, 3, tree.PrefixCount())
+	assert.Equal(t, 3, tree.countNodes(1)-1)
+	assert.Equal(t, []treeIndex{5}, tree.availableIndexes)
+
+	// which a prefix that needs just the one can still have
+	_, _, err = tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 25), 25, nil)
+	assert.NoError(t, err)
+	_, _, err = tree.Add(ipv4FromBytes([]byte{10, 0, 0, 128}, 25), "full", nil)
+	assert.True(t, errors.Is(err, ErrTreeFull))
+	assert.Equal(t, 4, tree.PrefixCount())
+	found, _ := tree.FindTags(ipv4FromBytes([]byte{10, 0, 0, 1}, 32))
+	assert.Equal(t, []GeneratedType{8, 16, 24, 25}, found)
+
+	// the sorted build fails the same way
+	_, err = BuildFromSortedV4([]EntryV4{
+		{Prefix: ipv4FromBytes([]byte{10, 0, 0, 0}, 8), Tags: []GeneratedType{8}},
+		{Prefix: ipv4FromBytes([]byte{10, 0, 0, 0}, 16), Tags: []GeneratedType{16}},
+		{Prefix: ipv4FromBytes([]byte{10, 0, 0, 0}, 24), Tags: []GeneratedType{24}},
+		{Prefix: ipv4FromBytes([]byte{10, 0, 0, 0}, 25), Tags: []GeneratedType{25}},
+		{Prefix: ipv4FromBytes([]byte{11, 0, 0, 0}, 8), Tags: []GeneratedType{11}},
+	})
+	assert.True(t, errors.Is(err, ErrTreeFull))
+
+	// a tree made WithPackedTags can't have more tags than that either, but takes back the room nodes have moved out of
+	// before it gives up
+	_maxTreeIndex = 8
+	tree = NewTreeV4(WithPackedTags())
+	a, b := ipv4FromBytes([]byte{10, 0, 0, 0}, 8), ipv4FromBytes([]byte{11, 0, 0, 0}, 8)
+	for _, add := range []struct {
+		address patricia.IPv4Address
+		tag     string
+	}{{a, "a1"}, {b, "b1"}, {a, "a2"}, {b, "b2"}, {a, "a3"}, {b, "b3"}, {b, "b4"}, {b, "b5"}} {
+		_, _, err := tree.Add(add.address, add.tag, nil)
+		assert.NoError(t, err)
+	}
+	countIncreased, count, err = tree.Add(b, "b6", nil)
+	assert.True(t, errors.Is(err, ErrTreeFull))
+	assert.False(t, countIncreased)
+	assert.Equal(t, 5, count)
+	_, _, err = tree.Add(ipv4FromBytes([]byte{12, 0, 0, 0}, 8), "c1", nil)
+	assert.True(t, errors.Is(err, ErrTreeFull))
+	assert.Equal(t, 3, tree.countNodes(1)-1)
+	assert.Equal(t, 2, tree.PrefixCount())
+	assert.Equal(t, 8, tree.CountTags())
+	found, _ = tree.FindTags(a)
+	assert.Equal(t, []GeneratedType{"a1", "a2", "a3"}, found)
+	found, _ = tree.FindTags(b)
+	assert.Equal(t, []GeneratedType{"b1", "b2", "b3", "b4", "b5"}, found)
+
+	_, err = tree.Delete(a, func(a GeneratedType, b GeneratedType) bool { return a == b }, "a3")
+	assert.NoError(t, err)
+	_, count, err = tree.Add(b, "b6", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, count)
+	found, _ = tree.FindTags(b)
+	assert.Equal(t, []GeneratedType{"b1", "b2", "b3", "b4", "b5", "b6"}, found)
+}
+
+func TestResultPool(t *testing.T) {
+	tree := NewTreeV4(WithResultPool())
+	expected := NewTreeV4()
+	for _, tree := range []*TreeV4{tree, expected} {
+		tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "10/8", nil)
+		tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "10.1/16", nil)
+		tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "10.1/16-again", nil)
+	}
+	notAgain := func(tag GeneratedType) bool { return !strings.HasSuffix(tag.(string), "-again") }
+
+	for i := 0; i < 10; i++ {
+		for _, address := range []patricia.IPv4Address{ipv4FromBytes([]byte{10, 1, 2, 3}, 32), ipv4FromBytes([]byte{11, 0, 0, 0}, 8)} {
+			expectedTags, _ := expected.FindTags(address)
+			tags, err := tree.FindTags(address)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedTags, tags)
+			assert.NotNil(t, tags)
+
+			expectedTags, _ = expected.FindTagsWithFilter(address, notAgain)
+			filtered, err := tree.FindTagsWithFilter(address, notAgain)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedTags, filtered)
+
+			// released tags are cleared, so the pool doesn't hold on to them
+			ReleaseTags(tags)
+			for _, tag := range tags {
+				assert.Nil(t, tag)
+			}
+			ReleaseTags(filtered)
+		}
+	}
+
+	// other slices can go in too, other than huge ones, and nil
+	ReleaseTags(make([]GeneratedType, 3))
+	ReleaseTags(make([]GeneratedType, _maxPooledResultCap+1))
+	ReleaseTags(nil)
+	tags, _ := tree.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.Equal(t, []GeneratedType{"10/8", "10.1/16", "10.1/16-again"}, tags)
+}
+
+func TestReserve(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	addresses := make([]patricia.IPv4Address, 1000)
+	for i := range addresses {
+		addresses[i] = patricia.NewIPv4Address(random.Uint32(), uint(1+random.Intn(32)))
+	}
+
+	// adding as many prefixes as were reserved never grows the storage
+	tree := NewTreeV4()
+	tree.Reserve(len(addresses))
+	nodes, tags := &tree.nodes[:1][0], cap(tree.tags.slices)
+	assert.True(t, tags >= 2*len(addresses))
+	for i, address := range addresses {
+		tree.Add(address, i, nil)
+	}
+	assert.True(t, nodes == &tree.nodes[0])
+	assert.Equal(t, tags, cap(tree.tags.slices))
+	assert.NoError(t, tree.checkStructure())
+
+	// nor does it shrink it, or change what's in it
+	expected := tree.Clone()
+	tree.Reserve(10)
+	assert.True(t, nodes == &tree.nodes[0])
+	assertSameTreesV4(t, expected, tree)
+
+	// and a snapshot keeps the storage it had
+	snapshot := tree.Snapshot()
+	tree.Reserve(2 * len(addresses))
+	assert.False(t, nodes == &tree.nodes[0])
+	assert.True(t, nodes == &snapshot.nodes[0])
+	assertSameTreesV4(t, expected, tree)
+}
+
+func TestGrowthPolicy(t *testing.T) {
+	var c treeConfig
+	assert.Equal(t, 2002, c.grownCapacity(1000, 1010))
+	assert.Equal(t, 5000, c.grownCapacity(1000, 5000))
+
+	c = newTreeConfig([]TreeOption{WithGrowthPolicy(1.5, 100)})
+	assert.Equal(t, 15, c.grownCapacity(9, 12))
+	assert.Equal(t, 1100, c.grownCapacity(1000, 1010))
+	assert.Equal(t, 1500, c.grownCapacity(1000, 1500))
+
+	// the policy doesn't change what ends up in the tree
+	tree := NewTreeV4(WithGrowthPolicy(1.1, 16))
+	expected := NewTreeV4()
+	for i := 0; i < 1000; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<8, 24), i, nil)
+		expected.Add(patricia.NewIPv4Address(uint32(i)<<8, 24), i, nil)
+		assert.True(t, cap(tree.nodes)-len(tree.nodes) <= 16)
+	}
+	assertSameTreesV4(t, expected, tree)
+
+	// growing one node at a time, adds that make two nodes grow the array part way through, moving every node
+	tree = NewTreeV4(WithGrowthPolicy(1.01, 1))
+	expected = NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		address := patricia.NewIPv4Address(random.Uint32(), uint(1+random.Intn(32)))
+		tree.Add(address, i, nil)
+		expected.Add(address, i, nil)
+		assert.Equal(t, len(tree.nodes), cap(tree.nodes))
+	}
+	assert.NoError(t, tree.checkStructure())
+	assertSameTreesV4(t, expected, tree)
+}
+
+func TestArena(t *testing.T) {
+	arena := NewArena()
+	build := func(options ...TreeOption) *TreeV4 {
+		tree := NewTreeV4(options...)
+		random := rand.New(rand.NewSource(1))
+		for i := 0; i < 1000; i++ {
+			address := patricia.NewIPv4Address(random.Uint32(), uint(1+random.Intn(32)))
+			// tags that don't allocate, so the counts below are just the tree's
+			tree.Add(address, "first", nil)
+			tree.Add(address, "second", nil)
+		}
+		return tree
+	}
+	expected := build()
+
+	// trees sharing the arena don't get in each other's way
+	trees := []*TreeV4{build(WithArena(arena)), build(WithArena(arena)), build(WithArena(arena))}
+	for _, tree := range trees {
+		assert.NoError(t, tree.checkStructure())
+		assertSameTreesV4(t, expected, tree)
+	}
+	clone := trees[0].Clone()
+	clone.Add(patricia.NewIPv4Address(0, 1), "clone", nil)
+	assertSameTreesV4(t, expected, trees[0])
+
+	// once reset, the arena's memory is reused, so building the trees again allocates much less
+	heapAllocs := testing.AllocsPerRun(5, func() { build() })
+	arenaAllocs := testing.AllocsPerRun(5, func() {
+		arena.Reset()
+		build(WithArena(arena))
+	})
+	assert.True(t, arenaAllocs < heapAllocs/2, "%f allocs with an arena, %f without", arenaAllocs, heapAllocs)
+	arena.Reset()
+	assertSameTreesV4(t, expected, build(WithArena(arena)))
+}
+
+func TestPrune(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "10/8", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "10.1/16", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 1, 2, 0}, 24), "10.1.2/24", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 2, 0, 0}, 16), "10.2/16", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 2, 0, 0}, 16), "10.2/16-again", nil)
+	tree.Add(ipv4FromBytes([]byte{11, 0, 0, 0}, 8), "11/8", nil)
+
+	// nothing below a leaf
+	prefixCount, tagCount, err := tree.Prune(ipv4FromBytes([]byte{10, 1, 2, 0}, 24))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, prefixCount)
+	assert.Equal(t, 0, tagCount)
+
+	prefixCount, tagCount, err = tree.Prune(ipv4FromBytes([]byte{10, 0, 0, 0}, 8))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, prefixCount)
+	assert.Equal(t, 4, tagCount)
+	assert.Equal(t, 2, tree.CountTags())
+	assert.Equal(t, tree.countTags(1), tree.CountTags())
+
+	tags, err := tree.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.NoError(t, err)
+	assert.True(t, tagArraysEqual(tags, []string{"10/8"}))
+	tags, err = tree.FindTags(ipv4FromBytes([]byte{11, 1, 2, 3}, 32))
+	assert.NoError(t, err)
+	assert.True(t, tagArraysEqual(tags, []string{"11/8"}))
+}
+
+func TestPruneWithoutExactNode(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "10.1/16", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 2, 0, 0}, 16), "10.2/16", nil)
+	tree.Add(ipv4FromBytes([]byte{11, 0, 0, 0}, 8), "11/8", nil)
+	assert.Equal(t, 6, tree.countNodes(1))
+
+	prefixCount, tagCount, err := tree.Prune(ipv4FromBytes([]byte{10, 0, 0, 0}, 8))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, prefixCount)
+	assert.Equal(t, 2, tagCount)
+
+	// the split node that was holding 10/8 and 11/8 together is gone too
+	assert.Equal(t, 2, tree.countNodes(1))
+	found, tag, err := tree.FindDeepestTag(ipv4FromBytes([]byte{11, 1, 2, 3}, 32))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "11/8", tag)
+	found, _, err = tree.FindDeepestTag(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// pruning the root leaves only the root
+	tree.Add(ipv4FromBytes([]byte{0, 0, 0, 0}, 0), "root", nil)
+	prefixCount, tagCount, err = tree.Prune(ipv4FromBytes([]byte{0, 0, 0, 0}, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, prefixCount)
+	assert.Equal(t, 1, tagCount)
+	assert.Equal(t, 1, tree.countNodes(1))
+	assert.Equal(t, 1, tree.CountTags())
+}
+
+func TestTagExpiry(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "10/8", nil)
+	tree.AddWithExpiry(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "expired", past, nil)
+	tree.AddWithExpiry(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "live", future, nil)
+	tree.AddWithExpiry(ipv4FromBytes([]byte{10, 1, 2, 0}, 24), "expired", past, nil)
+	tree.AddWithExpiry(ipv4FromBytes([]byte{10, 3, 0, 0}, 16), "expired", past, nil)
+	assert.Equal(t, 5, tree.CountTags())
+
+	// queries skip expired tags
+	address := ipv4FromBytes([]byte{10, 1, 2, 3}, 32)
+	tags, err := tree.FindTags(address)
+	assert.NoError(t, err)
+	assert.True(t, tagArraysEqual(tags, []string{"10/8", "live"}))
+
+	found, tag, err := tree.FindDeepestTag(address)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "live", tag)
+
+	found, tags, err = tree.FindDeepestTags(address)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.True(t, tagArraysEqual(tags, []string{"live"}))
+
+	found, tag, err = tree.FindDeepestTag(ipv4FromBytes([]byte{10, 3, 2, 1}, 32))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "10/8", tag)
+
+	// re-adding a matching tag refreshes its expiration time
+	tree.AddWithExpiry(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "expired", future, func(a GeneratedType, b GeneratedType) bool { return a == b })
+	tags, _ = tree.FindTags(address)
+	assert.True(t, tagArraysEqual(tags, []string{"10/8", "expired", "live"}))
+
+	// sweep reclaims expired tags and their nodes
+	nodeCount := tree.countNodes(1)
+	assert.Equal(t, 2, tree.Sweep())
+	assert.Equal(t, 3, tree.CountTags())
+	assert.Equal(t, tree.countTags(1), tree.CountTags())
+	assert.Equal(t, nodeCount-3, tree.countNodes(1)) // the two expired leaves, and the node splitting 10.1/16 from 10.3/16
+	assert.Equal(t, 0, tree.Sweep())
+
+	tags, _ = tree.FindTags(address)
+	assert.True(t, tagArraysEqual(tags, []string{"10/8", "expired", "live"}))
+
+	// the zero time means a new tag never expires, as if it was added with Add, which leaves a matching tag's time alone
+	tree.AddWithExpiry(ipv4FromBytes([]byte{10, 4, 0, 0}, 16), "never", time.Time{}, nil)
+	assert.Equal(t, 0, tree.Sweep())
+	found, tag, err = tree.FindDeepestTag(ipv4FromBytes([]byte{10, 4, 0, 1}, 32))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "never", tag)
+	nodeIndex, _, _ := tree.findNode(ipv4FromBytes([]byte{10, 4, 0, 0}, 16))
+	assert.Nil(t, tree.nodeExpirations(nodeIndex))
+
+	nodeIndex, _, _ = tree.findNode(ipv4FromBytes([]byte{10, 1, 0, 0}, 16))
+	expirations := append([]int64(nil), tree.nodeExpirations(nodeIndex)...)
+	tree.AddWithExpiry(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "live", time.Time{}, func(a GeneratedType, b GeneratedType) bool { return a == b })
+	assert.Equal(t, expirations, tree.nodeExpirations(nodeIndex))
+
+	// the Unix epoch isn't mistaken for never
+	tree.AddWithExpiry(ipv4FromBytes([]byte{10, 5, 0, 0}, 16), "epoch", time.Unix(0, 0), nil)
+	assert.Equal(t, 1, tree.Sweep())
+}
+
+func TestUpsert(t *testing.T) {
+	address := ipv4FromBytes([]byte{1, 2, 3, 4}, 32)
+
+	tree := NewTreeV4(WithSingleTag())
+	previous, existed, err := tree.Upsert(address, "a")
+	assert.NoError(t, err)
+	assert.False(t, existed)
+	assert.Nil(t, previous)
+
+	previous, existed, err = tree.Upsert(address, "b")
+	assert.NoError(t, err)
+	assert.True(t, existed)
+	assert.Equal(t, "a", previous)
+
+	// Add replaces too, in single-tag mode
+	countIncreased, count, err := tree.Add(address, "c", nil)
+	assert.NoError(t, err)
+	assert.False(t, countIncreased)
+	assert.Equal(t, 1, count)
+
+	previous, existed, err = tree.Upsert(address, "d")
+	assert.NoError(t, err)
+	assert.True(t, existed)
+	assert.Equal(t, "c", previous)
+
+	tags, err := tree.FindTags(address)
+	assert.NoError(t, err)
+	assert.True(t, tagArraysEqual(tags, []string{"d"}))
+
+	// a parent's tag isn't a previous value
+	previous, existed, err = tree.Upsert(ipv4FromBytes([]byte{1, 2, 3, 5}, 32), "e")
+	assert.NoError(t, err)
+	assert.False(t, existed)
+}
+
+// FindDeepestTag is the lookup on every packet's path, so it must never allocate, whatever the tree's options and tags
+// check the tree's counts against walking it
+func assertCountsV4(t *testing.T, tree *TreeV4) {
+	prefixCount := 0
+	tree.walkNodes(1, treeNodeV4{}, func(nodeIndex uint, _ treeNodeV4) bool {
+		if tree.nodes[nodeIndex].TagCount > 0 {
+			prefixCount++
+		}
+		return true
+	})
+	assert.Equal(t, tree.countNodes(1), tree.Size())
+	assert.Equal(t, prefixCount, tree.PrefixCount())
+	assert.Equal(t, tree.countTags(1), tree.TagCount())
+	assert.Equal(t, tree.countTags(1), tree.CountTags())
+}
+
+func TestSizeAndCounts(t *testing.T) {
+	tree := NewTreeV4()
+	assert.Equal(t, 1, tree.Size())
+	assert.Equal(t, 0, tree.PrefixCount())
+	assert.Equal(t, 0, tree.TagCount())
+
+	random := rand.New(rand.NewSource(1))
+	matchAll := func(GeneratedType, GeneratedType) bool { return true }
+	var addresses []patricia.IPv4Address
+	for i := 0; i < 5000; i++ {
+		address := patricia.NewIPv4Address(random.Uint32(), uint(random.Intn(33)))
+		if i%3 == 0 && i > 0 {
+			address = addresses[random.Intn(len(addresses))]
+		}
+		addresses = append(addresses, address)
+		switch random.Intn(10) {
+		case 0:
+			tree.Delete(address, matchAll, nil)
+		case 1:
+			tree.Set(address, i)
+		case 2:
+			tree.AddWithExpiry(address, i, time.Now().Add(-time.Hour), nil)
+		case 3:
+			tree.UpdateTags(address, func(tag GeneratedType) (GeneratedType, bool) { return tag, tag.(int)%2 == 0 })
+		case 4:
+			if random.Intn(20) == 0 {
+				tree.Prune(address)
+			}
+		default:
+			tree.Add(address, i, nil)
+		}
+		if i%500 == 0 {
+			assertCountsV4(t, tree)
+		}
+	}
+	assertCountsV4(t, tree)
+	assert.Equal(t, tree.MemoryStats().Prefixes, tree.PrefixCount())
+
+	tree.Sweep()
+	assertCountsV4(t, tree)
+	clone := tree.Clone()
+	clone.Add(addresses[0], "clone", nil)
+	assert.Equal(t, tree.TagCount()+1, clone.TagCount())
+	tree.Compact()
+	assertCountsV4(t, tree)
+
+	// loaded trees are counted too
+	data, err := tree.MarshalBinary()
+	assert.NoError(t, err)
+	decoded := NewTreeV4()
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assertCountsV4(t, decoded)
+	assert.Equal(t, tree.PrefixCount(), decoded.PrefixCount())
+	built, err := BuildConcurrentV4(slices.Collect(tree.Entries()), 4)
+	assert.NoError(t, err)
+	assertCountsV4(t, built)
+	assert.Equal(t, tree.TagCount(), built.TagCount())
+	inline := NewTreeV4(WithInlineTag())
+	for i, address := range addresses[:1000] {
+		inline.Add(address, i, nil)
+		if i%3 == 0 {
+			inline.Delete(addresses[i/2], matchAll, nil)
+		}
+	}
+	assertCountsV4(t, inline)
+
+	tree.Clear()
+	assertCountsV4(t, tree)
+	assert.Equal(t, 0, tree.TagCount())
+}
+
+func TestFindDeepestTagAllocs(t *testing.T) {
+	build := func(options ...TreeOption) *TreeV4 {
+		tree := NewTreeV4(options...)
+		for i := 32; i > 0; i-- {
+			tree.Add(ipv4FromBytes([]byte{127, 0, 0, 1}, i), "tag", nil)
+		}
+		return tree
+	}
+	address := ipv4FromBytes([]byte{127, 0, 0, 1}, 32)
+	missing := ipv4FromBytes([]byte{128, 0, 0, 1}, 32)
+	assertNoAllocs := func(name string, findDeepestTag func(address patricia.IPv4Address) bool) {
+		assert.True(t, findDeepestTag(address), name)
+		allocs := testing.AllocsPerRun(100, func() {
+			findDeepestTag(address)
+			findDeepestTag(missing)
+		})
+		assert.Equal(t, float64(0), allocs, name)
+	}
+	tree := func(tree *TreeV4) func(address patricia.IPv4Address) bool {
+		return func(address patricia.IPv4Address) bool {
+			found, _, _ := tree.FindDeepestTag(address)
+			return found
+		}
+	}
+
+	assertNoAllocs("tree", tree(build()))
+	assertNoAllocs("single tag", tree(build(WithSingleTag())))
+	assertNoAllocs("inline tag", tree(build(WithInlineTag())))
+	assertNoAllocs("result pool", tree(build(WithResultPool())))
+	expiring := build()
+	expiring.AddWithExpiry(address, "expiring", time.Now().Add(time.Hour), nil)
+	expiring.AddWithExpiry(ipv4FromBytes([]byte{127, 0, 0, 1}, 31), "expired", time.Now().Add(-time.Hour), nil)
+	assertNoAllocs("expiring tags", tree(expiring))
+	frozen := build()
+	frozen.FreezeInPlace()
+	assertNoAllocs("frozen", tree(frozen))
+
+	optimized := build().Optimize()
+	assertNoAllocs("optimized", func(address patricia.IPv4Address) bool {
+		found, _ := optimized.FindDeepestTag(address)
+		return found
+	})
+	columnar := build().Columnar()
+	assertNoAllocs("columnar", func(address patricia.IPv4Address) bool {
+		found, _ := columnar.FindDeepestTag(address)
+		return found
+	})
+	persistent := build().Persistent()
+	assertNoAllocs("persistent", func(address patricia.IPv4Address) bool {
+		found, _ := persistent.FindDeepestTag(address)
+		return found
+	})
+
+	safe := NewSafeTreeV4()
+	sharded := NewShardedTreeV4(4)
+	atomicTree := NewAtomicTreeV4()
+	for i := 32; i > 0; i-- {
+		prefix := ipv4FromBytes([]byte{127, 0, 0, 1}, i)
+		safe.Add(prefix, "tag", nil)
+		sharded.Add(prefix, "tag", nil)
+		atomicTree.Writer().Add(prefix, "tag", nil)
+	}
+	atomicTree.Publish()
+	assertNoAllocs("safe", func(address patricia.IPv4Address) bool {
+		found, _, _ := safe.FindDeepestTag(address)
+		return found
+	})
+	assertNoAllocs("sharded", func(address patricia.IPv4Address) bool {
+		found, _, _ := sharded.FindDeepestTag(address)
+		return found
+	})
+	assertNoAllocs("atomic", func(address patricia.IPv4Address) bool {
+		found, _, _ := atomicTree.FindDeepestTag(address)
+		return found
+	})
+}
+
+func TestFindTagsFunc(t *testing.T) {
+	tree := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	var addresses []patricia.IPv4Address
+	for i := 0; i < 2000; i++ {
+		address := patricia.NewIPv4Address(10<<24|random.Uint32()>>8, uint(random.Intn(33)))
+		addresses = append(addresses, address)
+		tree.Add(address, i, nil)
+		if i%5 == 0 {
+			tree.Add(address, "again", nil)
+		}
+	}
+	tree.AddWithExpiry(addresses[0], "expired", time.Now().Add(-time.Hour), nil)
+	tree.AddWithExpiry(addresses[1], "expiring", time.Now().Add(time.Hour), nil)
+	frozen := tree.Clone()
+	frozen.FreezeInPlace()
+	safe := NewSafeTreeV4()
+	safe.Write(func(safeTree *TreeV4) { safeTree.Graft(patricia.IPv4Address{}, tree, nil) })
+
+	for _, address := range addresses {
+		address.Length = 32
+		expected, _ := tree.FindTags(address)
+		for _, findTagsFunc := range []func(patricia.IPv4Address, func(GeneratedType) bool) error{tree.FindTagsFunc, frozen.FindTagsFunc, safe.FindTagsFunc} {
+			var tags []GeneratedType
+			assert.NoError(t, findTagsFunc(address, func(tag GeneratedType) bool {
+				tags = append(tags, tag)
+				return true
+			}))
+			assert.Equal(t, expected, append(make([]GeneratedType, 0), tags...))
+
+			// stopping early
+			if len(expected) > 1 {
+				tags = tags[:0]
+				findTagsFunc(address, func(tag GeneratedType) bool {
+					tags = append(tags, tag)
+					return len(tags) < 2
+				})
+				assert.Equal(t, expected[:2], tags)
+			}
+		}
+	}
+
+	count := 0
+	countTags := func(GeneratedType) bool {
+		count++
+		return true
+	}
+	address := patricia.NewIPv4Address(addresses[2].Address, 32)
+	allocs := testing.AllocsPerRun(100, func() {
+		tree.FindTagsFunc(address, countTags)
+		frozen.FindTagsFunc(address, countTags)
+	})
+	assert.Equal(t, float64(0), allocs)
+	assert.True(t, count > 0)
+}
+
+func TestFindDeepestTagBatch(t *testing.T) {
+	tree := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	var addresses []patricia.IPv4Address
+	for i := 0; i < 2000; i++ {
+		address := patricia.NewIPv4Address(10<<24|random.Uint32()>>8, uint(random.Intn(33)))
+		addresses = append(addresses, address)
+		tree.Add(address, i, nil)
+	}
+	tree.AddWithExpiry(addresses[0], "expired", time.Now().Add(-time.Hour), nil)
+	tree.AddWithExpiry(addresses[1], "expiring", time.Now().Add(time.Hour), nil)
+	frozen := tree.Clone()
+	frozen.FreezeInPlace()
+
+	// full addresses and prefixes, a few with nothing found, and batches that don't fill every lane
+	for i := 0; i < 1000; i++ {
+		addresses[i].Length = 32
+	}
+	addresses = append(addresses, patricia.NewIPv4Address(11<<24, 32), patricia.IPv4Address{})
+	for _, count := range []int{0, 1, 5, len(addresses)} {
+		batch := addresses[len(addresses)-count:]
+		for _, view := range []*TreeV4{tree, frozen} {
+			found := make([]bool, count)
+			tags := make([]GeneratedType, count+1)
+			assert.NoError(t, view.FindDeepestTagBatch(batch, found, tags))
+			for i, address := range batch {
+				expectedFound, expected, _ := tree.FindDeepestTag(address)
+				assert.Equal(t, expectedFound, found[i])
+				assert.Equal(t, expected, tags[i])
+			}
+		}
+	}
+	assert.Panics(t, func() { tree.FindDeepestTagBatch(addresses, nil, nil) })
+
+	// an empty tree finds nothing, and clears what was there
+	found := []bool{true}
+	tags := []GeneratedType{"stale"}
+	assert.NoError(t, NewTreeV4().FindDeepestTagBatch(addresses[:1], found, tags))
+	assert.False(t, found[0])
+	assert.Nil(t, tags[0])
+}
+
+func TestFindDeepestTagsView(t *testing.T) {
+	tree := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	var addresses []patricia.IPv4Address
+	for i := 0; i < 2000; i++ {
+		address := patricia.NewIPv4Address(10<<24|random.Uint32()>>8, uint(random.Intn(33)))
+		addresses = append(addresses, address)
+		tree.Add(address, i, nil)
+		if i%5 == 0 {
+			tree.Add(address, "again", nil)
+		}
+	}
+	tree.AddWithExpiry(addresses[0], "expired", time.Now().Add(-time.Hour), nil)
+	tree.AddWithExpiry(addresses[1], "expiring", time.Now().Add(time.Hour), nil)
+	frozen := tree.Clone()
+	frozen.FreezeInPlace()
+
+	for _, address := range append(addresses, patricia.NewIPv4Address(11<<24, 32)) {
+		address.Length = 32
+		expectedFound, expected, _ := tree.FindDeepestTags(address)
+		for _, view := range []*TreeV4{tree, frozen} {
+			found, tags, err := view.FindDeepestTagsView(address)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedFound, found)
+			if found {
+				assert.Equal(t, expected, tags)
+			} else {
+				assert.Nil(t, tags)
+			}
+		}
+	}
+
+	// the tags are the tree's own, but appending to them doesn't write into the tree
+	address := patricia.NewIPv4Address(addresses[5].Address, 32)
+	_, expected, _ := tree.FindDeepestTags(address)
+	_, tags, _ := tree.FindDeepestTagsView(address)
+	nodeIndex, _, _ := tree.findNode(addresses[5])
+	assert.Equal(t, &tree.nodeTags(nodeIndex)[0], &tags[0])
+	_ = append(tags, "appended")
+	_, tags, _ = tree.FindDeepestTagsView(address)
+	assert.Equal(t, expected, tags)
+	allocs := testing.AllocsPerRun(100, func() {
+		tree.FindDeepestTagsView(address)
+		frozen.FindDeepestTagsView(address)
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+// check that every node's tags are one of the interned sets, counted once for each node sharing it, and that no two
+// sets are the same
+func assertInternedV4(t *testing.T, tree *TreeV4) {
+	refs := make(map[*GeneratedType]int)
+	for nodeIndex := range tree.nodes {
+		if tree.nodes[nodeIndex].TagCount > 0 {
+			tags := tree.nodeTags(uint(nodeIndex))
+			assert.True(t, tree.tags.interner.holds(tags), "node %d's tags %v aren't interned", nodeIndex, tags)
+			refs[&tags[0]]++
+		}
+	}
+	setCount := 0
+	for _, sets := range tree.tags.interner.sets {
+		for i, set := range sets {
+			setCount++
+			assert.Equal(t, refs[&set.tags[0]], set.refs, "%v", set.tags)
+			for _, other := range sets[i+1:] {
+				assert.False(t, equalTagSets(set.tags, other.tags), "%v is interned twice", set.tags)
+			}
+		}
+	}
+	assert.Equal(t, len(refs), setCount)
+}
+
+func TestInternedTags(t *testing.T) {
+	tree := NewTreeV4(WithInternedTags())
+	expected := NewTreeV4()
+	equalTags := func(a GeneratedType, b GeneratedType) bool { return a == b }
+	random := rand.New(rand.NewSource(1))
+	var addresses []patricia.IPv4Address
+	for i := 0; i < 5000; i++ {
+		address := patricia.NewIPv4Address(random.Uint32(), uint(random.Intn(33)))
+		if i%3 == 0 && i > 0 {
+			address = addresses[random.Intn(len(addresses))]
+		}
+		addresses = append(addresses, address)
+
+		// few enough tags that lots of prefixes have the same ones
+		tag := fmt.Sprintf("AS%d", random.Intn(10))
+		switch random.Intn(7) {
+		case 0:
+			tree.Delete(address, equalTags, tag)
+			expected.Delete(address, equalTags, tag)
+		case 1:
+			tree.Set(address, tag)
+			expected.Set(address, tag)
+		case 2:
+			expiresAt := time.Now().Add(-time.Hour)
+			tree.AddWithExpiry(address, tag, expiresAt, nil)
+			expected.AddWithExpiry(address, tag, expiresAt, nil)
+		case 3:
+			rename := func(tag GeneratedType) (GeneratedType, bool) { return tag.(string) + "x", len(tag.(string)) < 4 }
+			tree.UpdateTags(address, rename)
+			expected.UpdateTags(address, rename)
+		default:
+			tree.Add(address, tag, nil)
+			expected.Add(address, tag, nil)
+		}
+	}
+	tree.Prune(addresses[0])
+	expected.Prune(addresses[0])
+	assert.NoError(t, tree.checkStructure())
+	assertSameTreesV4(t, expected, tree)
+	tags, expirations := tree.storedTagsV4()
+	expectedTags, expectedExpirations := expected.storedTagsV4()
+	assert.Equal(t, expectedTags, tags)
+	assert.Equal(t, expectedExpirations, expirations)
+	assertInternedV4(t, tree)
+
+	// the tags are kept once for each set of them
+	stats, expectedStats := tree.MemoryStats(), expected.MemoryStats()
+	assert.True(t, stats.TagBytes < expectedStats.TagBytes, "%d tag bytes, %d without interning", stats.TagBytes, expectedStats.TagBytes)
+
+	// a clone shares the sets, but changing it doesn't change them
+	clone := tree.Clone()
+	assertInternedV4(t, clone)
+	for _, address := range addresses[:100] {
+		clone.Set(address, "clone")
+	}
+	assertInternedV4(t, clone)
+	assertInternedV4(t, tree)
+	assertSameTreesV4(t, expected, tree)
+
+	// so does a snapshot, until one of them changes
+	snapshot := tree.Snapshot()
+	tree.Add(addresses[1], "after", nil)
+	expected.Add(addresses[1], "after", nil)
+	assertInternedV4(t, tree)
+	assertInternedV4(t, snapshot)
+	assertSameTreesV4(t, expected, tree)
+
+	// compacting, and loading an encoding, keep them interned
+	tree.Compact()
+	assertInternedV4(t, tree)
+	assertSameTreesV4(t, expected, tree)
+	data, err := expected.MarshalBinary()
+	assert.NoError(t, err)
+	decoded := NewTreeV4(WithInternedTags())
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assertInternedV4(t, decoded)
+	assertSameTreesV4(t, expected, decoded)
+	// leaving out the expired tags
+	entries := slices.Collect(expected.Entries())
+	built, err := BuildConcurrentV4(entries, 4, WithInternedTags())
+	assert.NoError(t, err)
+	assertInternedV4(t, built)
+	expectedBuilt, err := BuildConcurrentV4(entries, 4)
+	assert.NoError(t, err)
+	assertSameTreesV4(t, expectedBuilt, built)
+
+	// sets nothing refers to any more are forgotten
+	tree.Clear()
+	assert.Nil(t, tree.tags.interner)
+	tree.Add(addresses[1], "again", nil)
+	tree.Add(addresses[2], "again", nil)
+	assertInternedV4(t, tree)
+	tree.Delete(addresses[1], equalTags, "again")
+	tree.Delete(addresses[2], equalTags, "again")
+	assert.Empty(t, tree.tags.interner.sets)
+}
+
+func TestPackedTags(t *testing.T) {
+	tree := NewTreeV4(WithPackedTags())
+	expected := NewTreeV4()
+	random := rand.New(rand.NewSource(1))
+	var addresses []patricia.IPv4Address
+	matchAll := func(GeneratedType, GeneratedType) bool { return true }
+	for i := 0; i < 5000; i++ {
+		address := patricia.NewIPv4Address(random.Uint32(), uint(random.Intn(33)))
+		if i%3 == 0 && i > 0 {
+			address = addresses[random.Intn(len(addresses))]
+		}
+		addresses = append(addresses, address)
+
+		switch random.Intn(6) {
+		case 0:
+			tree.Delete(address, matchAll, nil)
+			expected.Delete(address, matchAll, nil)
+		case 1:
+			tree.Set(address, i)
+			expected.Set(address, i)
+		case 2:
+			expiresAt := time.Now().Add(-time.Hour)
+			tree.AddWithExpiry(address, i, expiresAt, nil)
+			expected.AddWithExpiry(address, i, expiresAt, nil)
+		case 3:
+			odd := func(tag GeneratedType) (GeneratedType, bool) { return tag, tag.(int)%2 == 1 }
+			tree.UpdateTags(address, odd)
+			expected.UpdateTags(address, odd)
+		default:
+			tree.Add(address, i, nil)
+			expected.Add(address, i, nil)
+		}
+	}
+	tree.Prune(addresses[0])
+	expected.Prune(addresses[0])
+	assert.NoError(t, tree.checkStructure())
+	assertSameTreesV4(t, expected, tree)
+	tags, expirations := tree.storedTagsV4()
+	expectedTags, expectedExpirations := expected.storedTagsV4()
+	assert.Equal(t, expectedTags, tags)
+	assert.Equal(t, expectedExpirations, expirations)
+
+	// the tags are all in one array, and nothing else holding them has pointers
+	assert.Nil(t, tree.tags.slices)
+	assert.False(t, hasPointers(reflect.TypeOf(treeNodeV4{})))
+	assert.False(t, hasPointers(reflect.TypeOf(tagSpan{})))
+
+	clone := tree.Clone()
+	clone.Add(addresses[1], "clone", nil)
+	assert.Equal(t, tree.CountTags()+1, clone.CountTags())
+	found, _ := tree.FindTags(addresses[1])
+	assert.NotContains(t, found, "clone")
+	assert.Equal(t, expected.Sweep(), tree.Sweep())
+	tree.Compact()
+	expected.Compact()
+	assert.NoError(t, tree.checkStructure())
+	assertSameTreesV4(t, expected, tree)
+	assert.Equal(t, tree.CountTags(), len(tree.tags.packed))
+
+	// loading encodings
+	data, err := expected.MarshalBinary()
+	assert.NoError(t, err)
+	decoded := NewTreeV4(WithPackedTags())
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assertSameTreesV4(t, expected, decoded)
+	assert.Nil(t, decoded.tags.slices)
+	decoded.Add(addresses[1], "added", nil)
+	found, _ = decoded.FindTags(addresses[1])
+	assert.Contains(t, found, "added")
+	data, err = expected.MarshalNative()
+	assert.NoError(t, err)
+	native := NewTreeV4(WithPackedTags())
+	assert.NoError(t, native.UnmarshalBinaryNoCopy(data))
+	assertSameTreesV4(t, expected, native)
+	assert.Nil(t, native.tags.slices)
+
+	// which trees made WithInlineTag need the same care with
+	single := NewTreeV4(WithSingleTag())
+	for i, address := range addresses[:100] {
+		single.Set(address, i)
+	}
+	data, err = single.MarshalNative()
+	assert.NoError(t, err)
+	native = NewTreeV4(WithInlineTag())
+	assert.NoError(t, native.UnmarshalBinaryNoCopy(data))
+	assertSameTreesV4(t, single, native)
+
+	tree.Clear()
+	assert.Equal(t, 0, tree.CountTags())
+	tree.Add(addresses[1], "again", nil)
+	found, _ = tree.FindTags(addresses[1])
+	assert.Equal(t, []GeneratedType{"again"}, found)
+}
+
+// whether values of the type hold any pointers for the GC to follow
+func hasPointers(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Array:
+		return typ.Len() > 0 && hasPointers(typ.Elem())
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if hasPointers(typ.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Pointer, reflect.Slice, reflect.String,
+		reflect.UnsafePointer:
+		return true
+	}
+	return false
+}
+
+func TestInlineTag(t *testing.T) {
+	tree := NewTreeV4(WithInlineTag())
+	expected := NewTreeV4(WithSingleTag())
+	random := rand.New(rand.NewSource(1))
+	var addresses []patricia.IPv4Address
+	matchAll := func(GeneratedType, GeneratedType) bool { return true }
+	for i := 0; i < 5000; i++ {
+		address := patricia.NewIPv4Address(random.Uint32(), uint(random.Intn(33)))
+		if i%3 == 0 && i > 0 {
+			address = addresses[random.Intn(len(addresses))]
+		}
+		addresses = append(addresses, address)
+
+		switch random.Intn(5) {
+		case 0:
+			tree.Delete(address, matchAll, nil)
+			expected.Delete(address, matchAll, nil)
+		case 1:
+			tree.Set(address, i)
+			expected.Set(address, i)
+		case 2:
+			expiresAt := time.Now().Add(-time.Hour)
+			tree.AddWithExpiry(address, i, expiresAt, nil)
+			expected.AddWithExpiry(address, i, expiresAt, nil)
+		default:
+			tree.Add(address, i, nil)
+			expected.Add(address, i, nil)
+		}
+	}
+	tree.Prune(addresses[0])
+	expected.Prune(addresses[0])
+	assert.NoError(t, tree.checkStructure())
+	assertSameTreesV4(t, expected, tree)
+	tags, expirations := tree.storedTagsV4()
+	expectedTags, expectedExpirations := expected.storedTagsV4()
+	assert.Equal(t, expectedTags, tags)
+	assert.Equal(t, expectedExpirations, expirations)
+	assert.Nil(t, tree.tags.slices)
+
+	// the tags are kept alongside the nodes, not in slices of their own
+	assert.True(t, tree.MemoryStats().TotalBytes < expected.MemoryStats().TotalBytes)
+	next := uint32(0)
+	allocs := testing.AllocsPerRun(100, func() {
+		next++
+		tree.Set(patricia.NewIPv4Address(next<<8, 24), "tag")
+	})
+	next = 0
+	expectedAllocs := testing.AllocsPerRun(100, func() {
+		next++
+		expected.Set(patricia.NewIPv4Address(next<<8, 24), "tag")
+	})
+	assert.True(t, allocs < expectedAllocs, "%f allocations, %f without inline tags", allocs, expectedAllocs)
+
+	clone := tree.Clone()
+	clone.Set(addresses[1], "clone")
+	found, tag, _ := clone.FindDeepestTag(addresses[1])
+	assert.True(t, found)
+	assert.Equal(t, "clone", tag)
+	_, tag, _ = tree.FindDeepestTag(addresses[1])
+	assert.NotEqual(t, "clone", tag)
+	assert.Equal(t, expected.Sweep(), tree.Sweep())
+	tree.Compact()
+	expected.Compact()
+	assert.NoError(t, tree.checkStructure())
+	assertSameTreesV4(t, expected, tree)
+
+	// loading an encoding
+	data, err := expected.MarshalBinary()
+	assert.NoError(t, err)
+	decoded := NewTreeV4(WithInlineTag())
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assertSameTreesV4(t, expected, decoded)
+	decoded.Set(addresses[1], "set")
+	found, tag, _ = decoded.FindDeepestTag(addresses[1])
+	assert.True(t, found)
+	assert.Equal(t, "set", tag)
+
+	// that has more than one tag for a prefix
+	multiple := NewTreeV4()
+	multiple.Add(addresses[1], 1, nil)
+	multiple.Add(addresses[1], 2, nil)
+	data, err = multiple.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Error(t, NewTreeV4(WithInlineTag()).UnmarshalBinary(data))
+
+	tree.Clear()
+	assert.Equal(t, 0, tree.CountTags())
+	tree.Add(addresses[1], "again", nil)
+	assert.Equal(t, 1, tree.CountTags())
+}
+
+func TestGraft(t *testing.T) {
+	src := NewTreeV4()
+	src.Add(ipv4FromBytes([]byte{0, 0, 0, 0}, 0), "src-root", nil)
+	src.Add(ipv4FromBytes([]byte{1, 0, 0, 0}, 8), "1/8", nil)
+	src.Add(ipv4FromBytes([]byte{1, 2, 0, 0}, 16), "1.2/16", nil)
+	src.Add(ipv4FromBytes([]byte{128, 0, 0, 0}, 1), "128/1", nil)
+
+	// absolute
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{1, 0, 0, 0}, 8), "1/8", nil)
+	addCount, err := tree.Graft(patricia.IPv4Address{}, src, func(a GeneratedType, b GeneratedType) bool { return a == b })
+	assert.NoError(t, err)
+	assert.Equal(t, 3, addCount)
+	tags, _ := tree.FindTags(ipv4FromBytes([]byte{1, 2, 3, 4}, 32))
+	assert.True(t, tagArraysEqual(tags, []string{"src-root", "1/8", "1.2/16"}))
+	tags, _ = tree.FindTags(ipv4FromBytes([]byte{200, 2, 3, 4}, 32))
+	assert.True(t, tagArraysEqual(tags, []string{"src-root", "128/1"}))
+
+	// relative to 10.0.0.0/8: 1.0.0.0/8 becomes 10.1.0.0/16, 128.0.0.0/1 becomes 10.128.0.0/9
+	tree = NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "10/8", nil)
+	addCount, err = tree.Graft(ipv4FromBytes([]byte{10, 255, 255, 255}, 8), src, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, addCount)
+	tags, _ = tree.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+	assert.True(t, tagArraysEqual(tags, []string{"10/8", "src-root", "1/8", "1.2/16"}))
+	tags, _ = tree.FindTags(ipv4FromBytes([]byte{10, 200, 2, 3}, 32))
+	assert.True(t, tagArraysEqual(tags, []string{"10/8", "src-root", "128/1"}))
+	tags, _ = tree.FindTags(ipv4FromBytes([]byte{1, 2, 3, 4}, 32))
+	assert.Equal(t, 0, len(tags))
+
+	// too long: src's /16 would be a /40 - and nothing's added, not even the prefixes that would fit
+	before := tree.Clone()
+	addCount, err = tree.Graft(ipv4FromBytes([]byte{10, 0, 0, 0}, 24), src, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 0, addCount)
+	assertSameTreesV4(t, before, tree)
+	assert.Equal(t, before.Size(), tree.Size())
+	assert.Equal(t, before.PrefixCount(), tree.PrefixCount())
+}
+
+func TestGraftSplicesNodes(t *testing.T) {
+	src := NewTreeV4()
+	src.Add(ipv4FromBytes([]byte{1, 0, 0, 0}, 8), "1/8", nil)
+	src.Add(ipv4FromBytes([]byte{1, 2, 0, 0}, 16), "1.2/16", nil)
+	src.AddWithExpiry(ipv4FromBytes([]byte{128, 0, 0, 0}, 1), "128/1", time.Now().Add(time.Hour), nil)
+	rooted := src.Clone()
+	rooted.Add(patricia.IPv4Address{}, "src-root", nil)
+	onlyChild := NewTreeV4()
+	onlyChild.Add(ipv4FromBytes([]byte{1, 2, 0, 0}, 16), "1.2/16", nil)
+
+	// a matchFunc that never matches adds the tags one at a time, as nil would, without linking src's nodes in
+	never := func(GeneratedType, GeneratedType) bool { return false }
+	for _, graft := range []struct {
+		name    string
+		tree    []patricia.IPv4Address
+		address patricia.IPv4Address
+		src     *TreeV4
+	}{
+		{"empty tree", nil, patricia.IPv4Address{}, rooted},
+		{"empty tree, only child", nil, patricia.IPv4Address{}, onlyChild},
+		{"below a prefix", []patricia.IPv4Address{ipv4FromBytes([]byte{10, 0, 0, 0}, 8)}, ipv4FromBytes([]byte{10, 1, 0, 0}, 16), rooted},
+		{"below a prefix, without a root tag", []patricia.IPv4Address{ipv4FromBytes([]byte{10, 0, 0, 0}, 8)}, ipv4FromBytes([]byte{10, 1, 0, 0}, 16), src},
+		{"only child", []patricia.IPv4Address{ipv4FromBytes([]byte{10, 0, 0, 0}, 8)}, ipv4FromBytes([]byte{10, 1, 0, 0}, 16), onlyChild},
+		{"split from a sibling", []patricia.IPv4Address{ipv4FromBytes([]byte{10, 0, 0, 0}, 8), ipv4FromBytes([]byte{10, 0, 0, 0}, 16)}, ipv4FromBytes([]byte{10, 1, 0, 0}, 16), rooted},
+		{"split from a sibling, only child", []patricia.IPv4Address{ipv4FromBytes([]byte{10, 0, 0, 0}, 16)}, ipv4FromBytes([]byte{10, 1, 0, 0}, 16), onlyChild},
+		{"prefix below", []patricia.IPv4Address{ipv4FromBytes([]byte{10, 1, 2, 0}, 24)}, ipv4FromBytes([]byte{10, 1, 0, 0}, 16), rooted},
+		{"prefix there", []patricia.IPv4Address{ipv4FromBytes([]byte{10, 1, 0, 0}, 16)}, ipv4FromBytes([]byte{10, 1, 0, 0}, 16), rooted},
+	} {
+		spliced, added := NewTreeV4(), NewTreeV4()
+		for _, prefix := range graft.tree {
+			spliced.Add(prefix, prefix.String(), nil)
+			added.Add(prefix, prefix.String(), nil)
+		}
+		addCount, err := spliced.Graft(graft.address, graft.src, nil)
+		assert.NoError(t, err, graft.name)
+		assert.Equal(t, graft.src.CountTags(), addCount, graft.name)
+		_, err = added.Graft(graft.address, graft.src, never)
+		assert.NoError(t, err, graft.name)
+		assertSameTreesV4(t, added, spliced)
+		assert.Equal(t, added.Size(), spliced.Size(), graft.name)
+		assert.Equal(t, added.PrefixCount(), spliced.PrefixCount(), graft.name)
+		assert.Equal(t, added.tags.expiring, spliced.tags.expiring, graft.name)
+
+		// the tree goes on working, and src isn't changed along with it
+		srcTags := graft.src.CountTags()
+		for _, prefix := range slices.Collect(spliced.Prefixes()) {
+			_, _, err = spliced.Add(prefix, "more", nil)
+			assert.NoError(t, err, graft.name)
+		}
+		assert.Equal(t, srcTags, graft.src.CountTags(), graft.name)
+		_, _, err = spliced.Add(ipv4FromBytes([]byte{10, 1, 2, 3}, 32), "10.1.2.3/32", nil)
+		assert.NoError(t, err, graft.name)
+		tags, _ := spliced.FindTags(ipv4FromBytes([]byte{10, 1, 2, 3}, 32))
+		assert.Contains(t, tags, "10.1.2.3/32", graft.name)
+	}
+}
+
+func TestGraftV6(t *testing.T) {
+	src := NewTreeV6()
+	src.Add(ipv6FromString("1:0:0:0:0:0:0:0/128", 16), "1::/16", nil)
+
+	tree := NewTreeV6()
+	addCount, err := tree.Graft(ipv6FromString("2001:db8:0:0:0:0:0:0/128", 32), src, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, addCount)
+	found, tag, err := tree.FindDeepestTag(ipv6FromString("2001:db8:1:0:0:0:0:1/128", 128))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "1::/16", tag)
+	found, _, err = tree.FindDeepestTag(ipv6FromString("2001:db8:2:0:0:0:0:1/128", 128))
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestCorruptTreeReturnsErrors(t *testing.T) {
+	tree := NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "10/8", nil)
+	tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "10.1/16", nil)
+
+	// point 10/8 at a node that doesn't exist
+	tree.nodes[2].Right = 1000
+	_, _, err := tree.Add(ipv4FromBytes([]byte{10, 200, 0, 0}, 16), "a", nil)
+	assert.True(t, errors.Is(err, ErrCorruptTree))
+	_, err = tree.Delete(ipv4FromBytes([]byte{10, 200, 0, 0}, 16), func(GeneratedType, GeneratedType) bool { return true }, nil)
+	assert.True(t, errors.Is(err, ErrCorruptTree))
+
+	// lookups stop at the bad link, rather than panicking
+	tags, err := tree.FindTags(ipv4FromBytes([]byte{10, 200, 0, 1}, 32))
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{"10/8"}, tags)
+	found, tag, err := tree.FindDeepestTag(ipv4FromBytes([]byte{10, 200, 0, 1}, 32))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "10/8", tag)
+
+	// a node with no prefix
+	tree = NewTreeV4()
+	tree.Add(ipv4FromBytes([]byte{10, 0, 0, 0}, 8), "10/8", nil)
+	tree.nodes[2].setLength(0)
+	_, _, err = tree.Add(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "a", nil)
+	assert.True(t, errors.Is(err, ErrCorruptTree))
+}
+
+func TestConcurrentReads(t *testing.T) {
+	tree := NewTreeV4(WithResultPool())
+	for i := 0; i < 1000; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<16, 16), i, nil)
+		tree.AddWithExpiry(patricia.NewIPv4Address(uint32(i)<<16, 24), "expiring", time.Now().Add(time.Hour), nil)
+	}
+	expectedTags, _ := tree.FindTags(patricia.NewIPv4Address(7<<16|1, 32))
+	expectedBytes, _ := tree.MarshalBinary()
+
+	// with no writer, any number of goroutines can read at once, even sharing the address they look up -
+	// run with -race to make this mean something
+	address := patricia.NewIPv4Address(7<<16|1, 32)
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				tags, err := tree.FindTags(address)
+				assert.NoError(t, err)
+				assert.Equal(t, expectedTags, tags)
+				ReleaseTags(tags)
+				tags, err = tree.FindTagsWithFilter(address, func(tag GeneratedType) bool { return tag != "expiring" })
+				assert.NoError(t, err)
+				assert.Equal(t, []GeneratedType{7}, tags)
+				found, tag, err := tree.FindDeepestTag(address)
+				assert.NoError(t, err)
+				assert.True(t, found)
+				assert.Equal(t, "expiring", tag)
+				_, tags, err = tree.FindDeepestTags(address)
+				assert.NoError(t, err)
+				assert.Equal(t, []GeneratedType{"expiring"}, tags)
+				assert.Equal(t, 2000, tree.CountTags())
+			}
+
+			walked := 0
+			for range tree.All() {
+				walked++
+			}
+			assert.Equal(t, 2000, walked)
+			for range tree.BreadthFirst() {
+			}
+			for range tree.Subtree(patricia.NewIPv4Address(7<<16, 16)) {
+			}
+			for range tree.Leaves() {
+			}
+			data, err := tree.MarshalBinary()
+			assert.NoError(t, err)
+			assert.Equal(t, expectedBytes, data)
+			_, err = tree.MarshalCanonical()
+			assert.NoError(t, err)
+			assert.Equal(t, tree.CountTags(), tree.Clone().CountTags())
+			assert.Equal(t, tree.CountTags(), tree.Persistent().CountTags())
+			entries, _ := tree.Cursor().Next(10)
+			assert.Len(t, entries, 10)
+			tree.WalkParallel(func(patricia.IPv4Address, []GeneratedType) bool { return true }, 2)
+			for range tree.Overlaps() {
+			}
+			for _, encode := range []func() ([]byte, error){tree.MarshalJSON, tree.MarshalCBOR, tree.ToProto, tree.MarshalNative, tree.Freeze} {
+				_, err = encode()
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, tree.WriteDot(io.Discard))
+			assert.NoError(t, tree.SaveSubtree(patricia.NewIPv4Address(7<<16, 16), io.Discard))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, patricia.NewIPv4Address(7<<16|1, 32), address)
+}
+
+func TestSnapshot(t *testing.T) {
+	tree := NewTreeV4()
+	for i := 0; i < 100; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<16, 16), i, nil)
+	}
+
+	snapshot := tree.Snapshot()
+	done := make(chan struct{})
+	go func() {
+		// keep reading the snapshot while the tree changes
+		defer close(done)
+		for round := 0; round < 20; round++ {
+			count := 0
+			snapshot.Walk(func(prefix patricia.IPv4Address, tags []GeneratedType) bool {
+				assert.Equal(t, int(prefix.Address>>16), tags[0])
+				count++
+				return true
+			})
+			assert.Equal(t, 100, count)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<16, 16), "changed", nil)
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<24, 24), i, nil)
+		tree.Delete(patricia.NewIPv4Address(uint32(i)<<16, 16), func(payload GeneratedType, val GeneratedType) bool { return payload == i }, i)
+	}
+	<-done
+
+	assert.Equal(t, 100, snapshot.CountTags())
+	assert.Equal(t, 200, tree.CountTags())
+
+	// readers sharing a snapshot can each take their own from it, without locking, while the tree changes
+	var wg sync.WaitGroup
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			own := snapshot.Snapshot()
+			for i := 0; i < 100; i++ {
+				tags, err := own.FindTags(patricia.NewIPv4Address(uint32(i)<<16|1, 32))
+				assert.NoError(t, err)
+				assert.Equal(t, []GeneratedType{i}, tags)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<16, 16), i, nil)
+		tree.Delete(patricia.NewIPv4Address(uint32(i)<<16, 16), func(payload GeneratedType, val GeneratedType) bool { return payload == val }, i)
+	}
+	wg.Wait()
+	assert.Equal(t, 100, snapshot.CountTags())
+
+	// changing the snapshot doesn't change the tree, and clearing the tree doesn't touch the snapshot
+	snapshot = tree.Snapshot()
+	snapshot.Add(patricia.NewIPv4Address(0, 32), "snapshot only", nil)
+	assert.Equal(t, 201, snapshot.CountTags())
+	assert.Equal(t, 200, tree.CountTags())
+	tree.Clear()
+	assert.Equal(t, 0, tree.CountTags())
+	assert.Equal(t, 201, snapshot.CountTags())
+}
+
+func TestMapTags(t *testing.T) {
+	tree := NewTreeV4()
+	for i := 0; i < 10; i++ {
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<24, 8), i, nil)
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<24, 8), i*10, nil)
+		tree.Add(patricia.NewIPv4Address(uint32(i)<<24|1, 32), i+100, nil)
+	}
+	nodeCount := tree.countNodes(1)
+
+	// double every tag, dropping the /32s
+	mapped := tree.MapTags(func(payload GeneratedType) (GeneratedType, bool) {
+		if payload.(int) >= 100 {
+			return nil, false
+		}
+		return payload.(int) * 2, true
+	})
+	assert.Equal(t, 20, mapped.CountTags())
+	assert.Equal(t, nodeCount-10, mapped.countNodes(1))
+	for i := 0; i < 10; i++ {
+		tags, err := mapped.FindTags(patricia.NewIPv4Address(uint32(i)<<24|1, 32))
+		assert.NoError(t, err)
+		assert.Equal(t, []GeneratedType{i * 2, i * 20}, tags)
+	}
+
+	// the original is untouched
+	assert.Equal(t, 30, tree.CountTags())
+	assert.Equal(t, nodeCount, tree.countNodes(1))
+	tags, _ := tree.FindTags(patricia.NewIPv4Address(1<<24|1, 32))
+	assert.Equal(t, []GeneratedType{1, 10, 101}, tags)
+}
@@ -0,0 +1,146 @@
+package template
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kentik/patricia"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestView(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	tree.AddWithExpiry(ipv4FromBytes([]byte{10, 1, 0, 0}, 16), "expired", time.Now().Add(-time.Second), nil)
+	for i := 0; i < 1000; i++ {
+		tree.Add(patricia.NewIPv4Address(rand.Uint32(), uint(rand.Intn(33))), i, nil)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, tree.WriteView(&buf))
+	view, err := NewTreeV4View(buf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, tree.CountTags()-1, view.CountTags())
+
+	// the view finds the same as the tree
+	for i := 0; i < 10000; i++ {
+		address := patricia.NewIPv4Address(rand.Uint32(), uint(rand.Intn(33)))
+		if i%2 == 0 {
+			address = patricia.NewIPv4Address(0x0a000000|rand.Uint32()&0x00ffffff, 32)
+		}
+
+		expected, _ := tree.FindTags(address)
+		found, err := view.FindTags(address)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, found)
+
+		expectedFound, expectedTag, _ := tree.FindDeepestTag(address)
+		deepestFound, deepestTag, err := view.FindDeepestTag(address)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedFound, deepestFound)
+		assert.Equal(t, expectedTag, deepestTag)
+
+		expectedFound, expected, _ = tree.FindDeepestTags(address)
+		deepestFound, found, err = view.FindDeepestTags(address)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedFound, deepestFound)
+		assert.Equal(t, expected, found)
+	}
+}
+
+func TestViewV6(t *testing.T) {
+	tree := NewTreeV6()
+	for i, cidr := range []string{"::/0", "2001:db8::/32", "2001:db8:1::/48", "fe80::1/128"} {
+		_, address, _ := patricia.ParseIPFromString(cidr)
+		tree.Add(*address, i, nil)
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, tree.WriteView(&buf))
+	view, err := NewTreeV6View(buf.Bytes())
+	assert.NoError(t, err)
+
+	_, address, _ := patricia.ParseIPFromString("2001:db8:1:2::/64")
+	tags, err := view.FindTags(*address)
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneratedType{0, 1, 2}, tags)
+
+	_, err = NewTreeV4View(buf.Bytes())
+	assert.True(t, errors.Is(err, ErrInvalidData))
+}
+
+func TestViewInvalid(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	var buf bytes.Buffer
+	assert.NoError(t, tree.WriteView(&buf))
+	data := buf.Bytes()
+
+	for i := 0; i < len(data); i++ {
+		_, err := NewTreeV4View(data[:i])
+		assert.True(t, errors.Is(err, ErrInvalidData), "%d bytes: %v", i, err)
+	}
+
+	// a child pointing back up at the root
+	bad := append([]byte{}, data...)
+	var root treeNodeV4
+	root.readViewRecord(bad[_viewHeaderSizeV4+_viewNodeSizeV4:])
+	leftRecord := bad[_viewHeaderSizeV4+int(root.Left)*_viewNodeSizeV4:]
+	leftRecord[0], leftRecord[1], leftRecord[2], leftRecord[3] = 1, 0, 0, 0
+	_, err := NewTreeV4View(bad)
+	assert.True(t, errors.Is(err, ErrInvalidData), "%v", err)
+
+	// corrupt tags are only noticed when they're looked up
+	bad = append([]byte{}, data...)
+	for i := _viewHeaderSizeV4 + len(tree.nodes)*_viewNodeSizeV4; i < len(bad); i++ {
+		bad[i] = 0xff
+	}
+	view, err := NewTreeV4View(bad)
+	assert.NoError(t, err)
+	_, err = view.FindTags(ipv4FromBytes([]byte{192, 168, 1, 1}, 32))
+	assert.True(t, errors.Is(err, ErrInvalidData), "%v", err)
+}
+
+func TestFreeze(t *testing.T) {
+	tree := buildEncodingTreeV4()
+	for i := 0; i < 1000; i++ {
+		tree.Add(patricia.NewIPv4Address(rand.Uint32(), uint(rand.Intn(33))), i, nil)
+	}
+	for i := 0; i < 100; i++ {
+		tree.Delete(patricia.NewIPv4Address(rand.Uint32(), uint(rand.Intn(33))), func(GeneratedType, GeneratedType) bool { return true }, nil)
+	}
+
+	data, err := tree.Freeze()
+	assert.NoError(t, err)
+	loaded := NewTreeV4()
+	loaded.Add(ipv4FromBytes([]byte{192, 168, 0, 0}, 16), "replaced", nil)
+	assert.NoError(t, loaded.LoadFrozen(data))
+
+	// the nodes are loaded as they were, and the ones not in use are free again
+	assert.Equal(t, tree.nodes, loaded.nodes)
+	sortedIndexes := func(indexes []treeIndex) []treeIndex {
+		ret := append([]treeIndex{}, indexes...)
+		sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+		return ret
+	}
+	assert.Equal(t, sortedIndexes(tree.availableIndexes), sortedIndexes(loaded.availableIndexes))
+	assertSameTreesV4(t, tree, loaded)
+	loaded.Add(ipv4FromBytes([]byte{192, 168, 0, 0}, 16), "added", nil)
+	assert.Equal(t, tree.CountTags()+1, loaded.CountTags())
+
+	// corrupt data leaves the tree as it was
+	before := loaded.Clone()
+	for i := 0; i < len(data); i += 7 {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0xff
+		if err := loaded.LoadFrozen(corrupt); err != nil {
+			assert.True(t, errors.Is(err, ErrInvalidData))
+			assert.Equal(t, before.nodes, loaded.nodes)
+		} else {
+			loaded = before.Clone()
+		}
+	}
+	assertSameTreesV4(t, before, loaded)
+	assert.True(t, errors.Is(loaded.LoadFrozen(data[:len(data)-1]), ErrInvalidData))
+}
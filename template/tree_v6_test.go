@@ -3,6 +3,7 @@ package template
 import (
 	"encoding/binary"
 	"fmt"
+	"math/rand"
 	"net"
 	"testing"
 
@@ -42,18 +43,60 @@ func BenchmarkFindTagsV6(b *testing.B) {
 	}
 }
 
+// lookups in a tree of prefixes of all sorts of lengths, like a routing table, where the bits each node matches vary
+func BenchmarkFindTagsV6LargeTree(b *testing.B) {
+	tree := NewTreeV6(WithResultPool())
+	random := rand.New(rand.NewSource(1))
+	prefixes := make([]patricia.IPv6Address, 200000)
+	for i := range prefixes {
+		prefixes[i] = patricia.IPv6Address{Left: 0x2000<<48 | random.Uint64()>>4, Right: random.Uint64(), Length: uint(16 + random.Intn(49))}
+		if i%4 == 0 {
+			// below one that's already there
+			prefixes[i] = prefixes[random.Intn(i+1)]
+			prefixes[i].Length = min(prefixes[i].Length+uint(1+random.Intn(64)), 128)
+		}
+		tree.Add(prefixes[i], i, nil)
+	}
+	addresses := make([]patricia.IPv6Address, 1024)
+	for i := range addresses {
+		addresses[i] = prefixes[random.Intn(len(prefixes))]
+		addresses[i].Right ^= random.Uint64() >> (addresses[i].Length % 64)
+		addresses[i].Length = 128
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tags, _ := tree.FindTags(addresses[n%len(addresses)])
+		ReleaseTags(tags)
+	}
+}
+
 func BenchmarkFindDeepestTagV6(b *testing.B) {
 	tree := NewTreeV6()
 	for i := 128; i > 0; i-- {
 		tree.Add(ipv6FromString("2001:db8:0:0:0:0:2:1/128", i), fmt.Sprintf("Tag-%d", i), nil)
 	}
 	address := ipv6FromString("2001:db8:0:0:0:0:2:1/128", 128)
+	b.ReportAllocs()
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		tree.FindDeepestTag(address)
 	}
 }
 
+func TestFindDeepestTagAllocsV6(t *testing.T) {
+	tree := NewTreeV6()
+	for i := 128; i > 0; i-- {
+		tree.Add(ipv6FromString("2001:db8:0:0:0:0:2:1/128", i), "tag", nil)
+	}
+	address := ipv6FromString("2001:db8:0:0:0:0:2:1/128", 128)
+	allocs := testing.AllocsPerRun(100, func() {
+		tree.FindDeepestTag(address)
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
 func TestSimpleTreeV6(t *testing.T) {
 	tree := NewTreeV6()
 
@@ -442,3 +485,33 @@ func TestDuplicateTagsWithMatchFuncV6(t *testing.T) {
 	assert.Equal(t, 2, count)
 	assert.NoError(t, err)
 }
+
+func TestUpdateTagsV6(t *testing.T) {
+	address := ipv6FromString("2001:db8:0:0:0:0:2:1/128", 128)
+
+	tree := NewTreeV6()
+	tree.Add(ipv6FromString("2001:db8:0:0:0:0:2:1/128", 64), "parent", nil)
+	tree.Add(address, "a", nil)
+
+	kept, dropped, err := tree.UpdateTags(address, func(tag GeneratedType) (GeneratedType, bool) {
+		return tag.(string) + "!", true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, kept)
+	assert.Equal(t, 0, dropped)
+	found, tag, err := tree.FindDeepestTag(address)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "a!", tag)
+
+	kept, dropped, err = tree.UpdateTags(address, func(tag GeneratedType) (GeneratedType, bool) {
+		return nil, false
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, kept)
+	assert.Equal(t, 1, dropped)
+	found, tag, err = tree.FindDeepestTag(address)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "parent", tag)
+}
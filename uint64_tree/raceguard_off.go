@@ -0,0 +1,6 @@
+//go:build !patricia_raceguard
+
+package uint64_tree
+
+// lookups don't check that the tree didn't change while they ran - build with the patricia_raceguard tag for that
+const _raceGuard = false